@@ -9,3 +9,116 @@ type EnhancedResponse struct {
 	AirQualityData []dpapi.AirQualityData `json:"airQualityData,omitempty"`
 	Alert          []dpapi.Alert          `json:"alert,omitempty"`
 }
+
+// FeatureCollection is a GeoJSON (RFC 7946) collection of stations
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+// Snapshot holds the stations along with the cursors of the changes as of the
+// snapshot, the changes after them are requested from there on
+type Snapshot struct {
+	Stations       FeatureCollection `json:"stations"`
+	ReadingsCursor int64             `json:"readingsCursor"`
+	AlertsCursor   int64             `json:"alertsCursor"`
+}
+
+type Feature struct {
+	Type       string            `json:"type"`
+	Geometry   Geometry          `json:"geometry"`
+	Properties StationProperties `json:"properties"`
+}
+
+// Geometry holds a GeoJSON point, coordinates are in [lng, lat] order
+type Geometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// StationProperties holds the latest reading and the active alert of a station
+type StationProperties struct {
+	Idx         int64        `json:"idx"`
+	CityName    string       `json:"cityName,omitempty"`
+	Timestamp   string       `json:"timestamp,omitempty"`
+	Aqi         *int64       `json:"aqi,omitempty"`
+	DewPoint    *float64     `json:"dewPoint,omitempty"`
+	Humidity    *float64     `json:"humidity,omitempty"`
+	Pressure    *float64     `json:"pressure,omitempty"`
+	Temperature *float64     `json:"temperature,omitempty"`
+	WindSpeed   *float64     `json:"windSpeed,omitempty"`
+	WindGust    *float64     `json:"windGust,omitempty"`
+	PM25        *float64     `json:"pm25,omitempty"`
+	PM10        *float64     `json:"pm10,omitempty"`
+	Units       dpapi.Units  `json:"units,omitempty"`
+	Alert       *dpapi.Alert `json:"alert,omitempty"`
+}
+
+type ExportFormat string
+
+const (
+	ExportCSV     ExportFormat = "csv"
+	ExportNDJSON  ExportFormat = "ndjson"
+	ExportParquet ExportFormat = "parquet"
+)
+
+type ExportTable string
+
+const (
+	ExportAirQuality ExportTable = "air_quality"
+	ExportCity       ExportTable = "city"
+	ExportAlert      ExportTable = "alert"
+)
+
+// BoundingBox selects the stations located within the given coordinates
+type BoundingBox struct {
+	MinLat float64 `json:"minLat"`
+	MinLng float64 `json:"minLng"`
+	MaxLat float64 `json:"maxLat"`
+	MaxLng float64 `json:"maxLng"`
+}
+
+// ExportRequest describes a bulk export of one table,
+// time range and region are optional
+type ExportRequest struct {
+	Table     ExportTable  `json:"table"`
+	Format    ExportFormat `json:"format"`
+	StartTime string       `json:"startTime,omitempty"`
+	EndTime   string       `json:"endTime,omitempty"`
+	Region    *BoundingBox `json:"region,omitempty"`
+}
+
+// Page is a paginated list returned by the REST API
+type Page[T any] struct {
+	Items  []T `json:"items"`
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// StationAlert is an alert along with the station it was issued for
+type StationAlert struct {
+	Idx int64 `json:"idx"`
+	dpapi.Alert
+}
+
+// StationReading is a reading along with the station it was taken at
+type StationReading struct {
+	Idx int64 `json:"idx"`
+	dpapi.AirQualityData
+}
+
+// Changes holds the rows inserted into the central storage after the cursors of a request.
+// The cursors are the row ids of the last returned reading and alert, and More is set
+// when a limit was hit and the request should be repeated with the new cursors.
+// Reset is set when the cursors are ahead of the storage, e.g. the database was replaced,
+// and the client should drop what it has and start over from zero cursors.
+type Changes struct {
+	ReadingsCursor int64            `json:"readingsCursor"`
+	AlertsCursor   int64            `json:"alertsCursor"`
+	Stations       []dpapi.City     `json:"stations"`
+	Readings       []StationReading `json:"readings"`
+	Alerts         []StationAlert   `json:"alerts"`
+	More           bool             `json:"more,omitempty"`
+	Reset          bool             `json:"reset,omitempty"`
+}
@@ -2,6 +2,11 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	units "github.com/etesami/air-quality-monitoring/pkg/units"
 )
 
 type Attributions struct {
@@ -17,17 +22,125 @@ type City struct {
 	Location string    `json:"location,omitempty"`
 }
 
+// IAQI holds the individual measurements of a station. WAQI reports the
+// pollutants as US EPA sub-indices, other sources may report concentrations.
 type IAQI struct {
+	CO   Measurement `json:"co,omitempty"`
+	Dew  Measurement `json:"dew,omitempty"`
 	H    Measurement `json:"h,omitempty"`
+	NO2  Measurement `json:"no2,omitempty"`
+	O3   Measurement `json:"o3,omitempty"`
 	P    Measurement `json:"p,omitempty"`
+	PM10 Measurement `json:"pm10,omitempty"`
 	PM25 Measurement `json:"pm25,omitempty"`
+	SO2  Measurement `json:"so2,omitempty"`
 	T    Measurement `json:"t,omitempty"`
 	W    Measurement `json:"w,omitempty"`
 	WG   Measurement `json:"wg,omitempty"`
 }
 
+// Measurement is a value tagged with its unit and kind, WAQI does not
+// report them and untagged values are in the unit of their field
 type Measurement struct {
-	V float64 `json:"v,omitempty"`
+	V    float64    `json:"v"`
+	Unit units.Unit `json:"unit,omitempty"`
+	Kind units.Kind `json:"kind,omitempty"`
+	// Reported tells a zero value from a measurement missing from the payload
+	Reported bool `json:"-"`
+}
+
+// UnmarshalJSON decodes a measurement, it is reported when it has a value
+func (m *Measurement) UnmarshalJSON(b []byte) error {
+	var aux struct {
+		V    *float64   `json:"v"`
+		Unit units.Unit `json:"unit"`
+		Kind units.Kind `json:"kind"`
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	*m = Measurement{Unit: aux.Unit, Kind: aux.Kind, Reported: aux.V != nil}
+	if aux.V != nil {
+		m.V = *aux.V
+	}
+	return nil
+}
+
+// MarshalJSON encodes a measurement that was not reported as an empty object
+func (m Measurement) MarshalJSON() ([]byte, error) {
+	if !m.Reported {
+		return []byte("{}"), nil
+	}
+	type measurement Measurement
+	return json.Marshal(measurement(m))
+}
+
+// IAQIField is a measurement of IAQI along with its key, the unit it has when
+// untagged and the kinds it may hold
+type IAQIField struct {
+	Key     string
+	Default units.Unit
+	Kinds   []units.Kind
+	*Measurement
+}
+
+// Fields returns the measurements of i
+func (i *IAQI) Fields() []IAQIField {
+	pollutant := []units.Kind{units.KindIndex, units.KindConcentration}
+	return []IAQIField{
+		{"co", units.Index, pollutant, &i.CO},
+		{"dew", units.Celsius, []units.Kind{units.KindTemperature}, &i.Dew},
+		{"h", units.Percent, []units.Kind{units.KindHumidity}, &i.H},
+		{"no2", units.Index, pollutant, &i.NO2},
+		{"o3", units.Index, pollutant, &i.O3},
+		{"p", units.Hectopascal, []units.Kind{units.KindPressure}, &i.P},
+		{"pm10", units.Index, pollutant, &i.PM10},
+		{"pm25", units.Index, pollutant, &i.PM25},
+		{"so2", units.Index, pollutant, &i.SO2},
+		{"t", units.Celsius, []units.Kind{units.KindTemperature}, &i.T},
+		{"w", units.MetersPerSecond, []units.Kind{units.KindSpeed}, &i.W},
+		{"wg", units.MetersPerSecond, []units.Kind{units.KindSpeed}, &i.WG},
+	}
+}
+
+// Missing reports whether the measurement was not reported
+func (f IAQIField) Missing() bool {
+	return !f.Reported
+}
+
+// Normalize tags the measurement with the unit of its field when it has none
+// and converts it to the canonical unit of its kind. A measurement of an unknown
+// unit or of a kind its field cannot hold is left as it is.
+func (f IAQIField) Normalize() error {
+	if f.Unit == "" {
+		f.Unit = f.Default
+	}
+	if !f.Unit.Valid() {
+		return fmt.Errorf("%s: unknown unit %q", f.Key, f.Unit)
+	}
+	if !slices.Contains(f.Kinds, f.Unit.Kind()) {
+		return fmt.Errorf("%s: %s is a %s, expected a %s", f.Key, f.Unit, f.Unit.Kind(), f.Kinds[0])
+	}
+	v, err := units.Convert(f.V, f.Unit, f.Unit.Canonical())
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.Key, err)
+	}
+	f.V, f.Unit, f.Kind = v, f.Unit.Canonical(), f.Unit.Kind()
+	return nil
+}
+
+// Normalize normalizes the reported measurements of i, see IAQIField.Normalize
+func (i *IAQI) Normalize() error {
+	var errs []error
+	for _, f := range i.Fields() {
+		if f.Missing() {
+			continue
+		}
+		if err := f.Normalize(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 type Time struct {
@@ -62,6 +175,7 @@ type Msg struct {
 	IAQI         IAQI           `json:"iaqi,omitempty"`
 	Time         Time           `json:"time,omitempty"`
 	Forecast     Forecast       `json:"forecast,omitempty"`
+	Lineage      Lineage        `json:"lineage,omitempty"`
 }
 
 type Observation struct {
@@ -92,6 +206,7 @@ func (obs *Observation) ToMap() (map[string]any, error) {
 		{"iaqi", obs.Msg.IAQI},
 		{"time", obs.Msg.Time},
 		{"status", obs.Status},
+		{"lineage", obs.Msg.Lineage},
 	}
 
 	for _, item := range marshaled {
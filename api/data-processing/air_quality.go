@@ -1,9 +1,15 @@
 package dataprocessing
 
+import (
+	api "github.com/etesami/air-quality-monitoring/api"
+	units "github.com/etesami/air-quality-monitoring/pkg/units"
+)
+
 type EnhancedDataResponse struct {
 	City           `json:"city,omitempty"`
 	AirQualityData `json:"airQualityData,omitempty"`
 	*Alert         `json:"alert,omitempty"`
+	Lineage        api.Lineage `json:"lineage,omitempty"`
 }
 
 type City struct {
@@ -42,15 +48,84 @@ type AlertRaw struct {
 	Severity    string `json:"severity,omitempty"`
 }
 
+// AirQualityData is a reading of a station, Units holds the unit of each measurement by its JSON name
 type AirQualityData struct {
-	Timestamp   string `json:"timestamp,omitempty"`
-	Aqi         int64  `json:"aqi,omitempty"`
-	DewPoint    int64  `json:"dewPoint,omitempty"`
-	Humidity    int64  `json:"humidity,omitempty"`
-	Pressure    int64  `json:"pressure,omitempty"`
-	Temperature int64  `json:"temperature,omitempty"`
-	WindSpeed   int64  `json:"windSpeed,omitempty"`
-	WindGust    int64  `json:"windGust,omitempty"`
-	PM25        int64  `json:"pm25,omitempty"`
-	PM10        int64  `json:"pm10,omitempty"`
+	Timestamp   string  `json:"timestamp,omitempty"`
+	Aqi         int64   `json:"aqi,omitempty"`
+	DewPoint    float64 `json:"dewPoint,omitempty"`
+	Humidity    float64 `json:"humidity,omitempty"`
+	Pressure    float64 `json:"pressure,omitempty"`
+	Temperature float64 `json:"temperature,omitempty"`
+	WindSpeed   float64 `json:"windSpeed,omitempty"`
+	WindGust    float64 `json:"windGust,omitempty"`
+	PM25        float64 `json:"pm25,omitempty"`
+	PM10        float64 `json:"pm10,omitempty"`
+	Units       Units   `json:"units,omitempty"`
+}
+
+// Units are the units of the measurements of a reading by their JSON name
+type Units map[string]units.Unit
+
+// DefaultUnits returns the units of the readings stored before they were tagged,
+// the units WAQI reports the measurements in
+func DefaultUnits() Units {
+	return Units{
+		"dewPoint":    units.Celsius,
+		"humidity":    units.Percent,
+		"pressure":    units.Hectopascal,
+		"temperature": units.Celsius,
+		"windSpeed":   units.MetersPerSecond,
+		"windGust":    units.MetersPerSecond,
+		"pm25":        units.Index,
+	}
+}
+
+// Reported reports whether the reading holds the measurement of the JSON name, the
+// measurements a station did not report have no unit. Readings without units predate
+// the tagging and hold the measurements of the default units.
+func (d AirQualityData) Reported(name string) bool {
+	u := d.Units
+	if len(u) == 0 {
+		u = DefaultUnits()
+	}
+	_, ok := u[name]
+	return ok
+}
+
+// NewAirQualityData returns the reading of msg. Its measurements are expected to be
+// normalized, untagged ones are in the unit of their field.
+func NewAirQualityData(msg api.Msg) AirQualityData {
+	d := AirQualityData{
+		Timestamp: msg.Time.ISO,
+		Aqi:       int64(msg.Aqi),
+		Units:     Units{},
+	}
+	fields := make(map[string]api.IAQIField)
+	for _, f := range msg.IAQI.Fields() {
+		fields[f.Key] = f
+	}
+	for _, m := range []struct {
+		key, name string
+		value     *float64
+	}{
+		{"dew", "dewPoint", &d.DewPoint},
+		{"h", "humidity", &d.Humidity},
+		{"p", "pressure", &d.Pressure},
+		{"t", "temperature", &d.Temperature},
+		{"w", "windSpeed", &d.WindSpeed},
+		{"wg", "windGust", &d.WindGust},
+		{"pm25", "pm25", &d.PM25},
+		{"pm10", "pm10", &d.PM10},
+	} {
+		f := fields[m.key]
+		if f.Missing() {
+			continue
+		}
+		*m.value = f.V
+		d.Units[m.name] = f.Unit
+		if f.Unit == "" {
+			d.Units[m.name] = f.Default
+		}
+	}
+	return d
 }
@@ -0,0 +1,90 @@
+package api
+
+import "time"
+
+// Stage is a stage of the pipeline a reading goes through
+type Stage string
+
+const (
+	StageObserved        Stage = "observed"
+	StageCollected       Stage = "collected"
+	StageIngested        Stage = "ingested"
+	StageStoredLocally   Stage = "stored_locally"
+	StageProcessed       Stage = "processed"
+	StageStoredCentrally Stage = "stored_centrally"
+)
+
+// Lineage is when a reading went through each stage of the pipeline, in Unix
+// milliseconds. The stages a reading has not reached yet are zero.
+type Lineage struct {
+	// Observed is the time of the reading at the station
+	Observed        int64 `json:"observed,omitempty"`
+	Collected       int64 `json:"collected,omitempty"`
+	Ingested        int64 `json:"ingested,omitempty"`
+	StoredLocally   int64 `json:"storedLocally,omitempty"`
+	Processed       int64 `json:"processed,omitempty"`
+	StoredCentrally int64 `json:"storedCentrally,omitempty"`
+}
+
+// stage returns the timestamp of stage
+func (l *Lineage) stage(stage Stage) *int64 {
+	switch stage {
+	case StageObserved:
+		return &l.Observed
+	case StageCollected:
+		return &l.Collected
+	case StageIngested:
+		return &l.Ingested
+	case StageStoredLocally:
+		return &l.StoredLocally
+	case StageProcessed:
+		return &l.Processed
+	case StageStoredCentrally:
+		return &l.StoredCentrally
+	}
+	return nil
+}
+
+// Stamp records that the reading reached stage at t
+func (l *Lineage) Stamp(stage Stage, t time.Time) {
+	if ts := l.stage(stage); ts != nil {
+		*ts = t.UnixMilli()
+	}
+}
+
+// At returns when the reading reached stage, false if it has not
+func (l Lineage) At(stage Stage) (time.Time, bool) {
+	ts := l.stage(stage)
+	if ts == nil || *ts == 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(*ts), true
+}
+
+// Freshness returns how old the reading was when it reached stage
+func (l Lineage) Freshness(stage Stage) (time.Duration, bool) {
+	return l.between(StageObserved, stage)
+}
+
+// Latency returns how long the reading took from the collector to stage
+func (l Lineage) Latency(stage Stage) (time.Duration, bool) {
+	return l.between(StageCollected, stage)
+}
+
+func (l Lineage) between(from, to Stage) (time.Duration, bool) {
+	start, ok := l.At(from)
+	if !ok {
+		return 0, false
+	}
+	end, ok := l.At(to)
+	if !ok {
+		return 0, false
+	}
+	return end.Sub(start), true
+}
+
+// ObservedAt returns the time of the reading at the station
+func (m Msg) ObservedAt() (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, m.Time.ISO)
+	return t, err == nil
+}
@@ -9,15 +9,26 @@ import (
 type DataType string
 
 const (
-	RequestPoints DataType = "points"
+	RequestPoints   DataType = "points"
+	RequestGeoJSON  DataType = "geojson"
+	RequestReadings DataType = "readings"
+	RequestAlerts   DataType = "alerts"
+	RequestChanges  DataType = "changes"
 )
 
 type DataRequest struct {
-	StartTime   string   `json:"startTime,omitempty"`
-	EndTime     string   `json:"endTime,omitempty"`
-	LAT         float64  `json:"lat,omitempty"`
-	LNG         float64  `json:"lng,omitempty"`
-	RequestType DataType `json:"requestType,omitempty"`
+	StartTime string  `json:"startTime,omitempty"`
+	EndTime   string  `json:"endTime,omitempty"`
+	LAT       float64 `json:"lat,omitempty"`
+	LNG       float64 `json:"lng,omitempty"`
+	Idx       int64   `json:"idx,omitempty"`
+	Active    bool    `json:"active,omitempty"`
+	Limit     int     `json:"limit,omitempty"`
+	Offset    int     `json:"offset,omitempty"`
+	// ReadingsSince and AlertsSince are the cursors of a changes request
+	ReadingsSince int64    `json:"readingsSince,omitempty"`
+	AlertsSince   int64    `json:"alertsSince,omitempty"`
+	RequestType   DataType `json:"requestType,omitempty"`
 }
 
 type DataResponse struct {
@@ -31,4 +42,5 @@ type DataResponse struct {
 	Timestamp    time.Time          `json:"timestamp,omitempty"`
 	Forecast     api.Forecast       `json:"forecast,omitempty"`
 	Status       string             `json:"status,omitempty"`
+	Lineage      api.Lineage        `json:"lineage,omitempty"`
 }
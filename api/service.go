@@ -1,9 +1,7 @@
 package api
 
 import (
-	"fmt"
 	"net"
-	"time"
 )
 
 type Service struct {
@@ -11,15 +9,7 @@ type Service struct {
 	Port    string
 }
 
-func (s *Service) ServiceReachable() error {
-	if s.Address == "" || s.Port == "" {
-		return fmt.Errorf("service address or port is not set")
-	}
-	address := fmt.Sprintf("%s:%s", s.Address, s.Port)
-	conn, err := net.DialTimeout("tcp", address, 3*time.Second)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-	return nil
+// HostPort returns the address of the service to dial or listen on
+func (s *Service) HostPort() string {
+	return net.JoinHostPort(s.Address, s.Port)
 }
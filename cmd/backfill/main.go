@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	backfill "github.com/etesami/air-quality-monitoring/pkg/backfill"
+	config "github.com/etesami/air-quality-monitoring/pkg/config"
+	grpcclient "github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
+	tlsconfig "github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+)
+
+// backfill imports historical WAQI/OpenAQ exports into the central storage service
+//
+//	backfill -input seattle.csv -format waqi-csv -station-idx 1234 -lat 47.6 -lng -122.3 \
+//	  -addr svc-central-storage:50051
+//
+// The OpenAQ locations are stored as the stations backfill.OpenAQIdxOffset + location_id, apart
+// from the WAQI stations. An OpenAQ export must list the records of a location together.
+func main() {
+	input := flag.String("input", "", "input file")
+	format := flag.String("format", "", "input format: json, waqi-csv or openaq-csv (default from the file extension)")
+	addr := flag.String("addr", "", "address (host:port) of the central storage service")
+	batchSize := flag.Int("batch", 50, "number of records sent per request")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of a single request, its retries included")
+	tlsCfg := tlsconfig.Flags(flag.CommandLine)
+	tokenFile := flag.String("token-file", "", "file of the API key or JWT to call the service with")
+	checkpoint := flag.String("checkpoint", "", "checkpoint file used to resume (default <input>.checkpoint)")
+	stationIdx := flag.Int("station-idx", 0, "station index (waqi-csv)")
+	stationName := flag.String("station-name", "", "station name (waqi-csv)")
+	lat := flag.Float64("lat", 0, "station latitude (waqi-csv)")
+	lng := flag.Float64("lng", 0, "station longitude (waqi-csv)")
+	flag.Parse()
+
+	if *input == "" || *addr == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		switch strings.ToLower(filepath.Ext(*input)) {
+		case ".csv":
+			*format = string(backfill.FormatWAQICSV)
+		default:
+			*format = string(backfill.FormatJSON)
+		}
+	}
+	if *checkpoint == "" {
+		*checkpoint = *input + ".checkpoint"
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		log.Fatalf("Error opening input: %v", err)
+	}
+	defer f.Close()
+
+	reader, err := backfill.NewReader(f, backfill.Format(*format), &backfill.Station{
+		Idx:  *stationIdx,
+		Name: *stationName,
+		Lat:  *lat,
+		Lng:  *lng,
+	})
+	if err != nil {
+		log.Fatalf("Error reading input: %v", err)
+	}
+
+	absInput, err := filepath.Abs(*input)
+	if err != nil {
+		log.Fatalf("Error resolving input path: %v", err)
+	}
+	cp, err := backfill.LoadCheckpoint(*checkpoint, absInput)
+	if err != nil {
+		log.Fatalf("Error loading checkpoint: %v", err)
+	}
+
+	// The client waits for the service and retries the batches it turns away
+	// while busy, as the services do between each other
+	clientCfg := grpcclient.Config{}
+	if err := config.Defaults(&clientCfg); err != nil {
+		log.Fatalf("Error setting up client: %v", err)
+	}
+	clientCfg.CallTimeout = config.Duration(*timeout)
+	clientCfg.TLS = *tlsCfg
+	clientCfg.TokenFile = *tokenFile
+	if err := clientCfg.Validate(); err != nil {
+		log.Fatalf("Invalid client options: %v", err)
+	}
+	client, err := grpcclient.New("central-storage", *addr, clientCfg, metric.New("backfill", metric.Buckets{}))
+	if err != nil {
+		log.Fatalf("did not connect to [%s]: %v", *addr, err)
+	}
+	defer client.Close()
+
+	// Interrupting the import keeps the checkpoint of the last acknowledged batch
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	im := &backfill.Importer{
+		Client:     client,
+		BatchSize:  *batchSize,
+		Timeout:    *timeout,
+		Checkpoint: cp,
+	}
+	st := time.Now()
+	stats, err := im.Run(ctx, reader)
+	log.Printf("Read [%d] records, skipped [%d], invalid [%d], sent [%d] in [%s]\n",
+		stats.Read, stats.Skipped, stats.Invalid, stats.Sent, time.Since(st).Round(time.Millisecond))
+	if err != nil {
+		log.Fatalf("Error importing data: %v", err)
+	}
+}
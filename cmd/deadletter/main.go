@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	auth "github.com/etesami/air-quality-monitoring/pkg/auth"
+	deadletter "github.com/etesami/air-quality-monitoring/pkg/deadletter"
+	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+	tlsconfig "github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+
+	"google.golang.org/grpc"
+)
+
+const usage = `deadletter inspects and reinjects the records rejected by a service
+
+	deadletter -addr svc-local-storage:50051 list -stage store -reason invalid_timestamp
+	deadletter -addr svc-local-storage:50051 inspect <id>
+	deadletter -addr svc-local-storage:50051 reinject <id>...
+	deadletter -addr svc-local-storage:50051 delete <id>...
+
+Flags:
+`
+
+func main() {
+	addr := flag.String("addr", "", "address (host:port) of the service")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of a single request")
+	tlsCfg := tlsconfig.Flags(flag.CommandLine)
+	tokenFile := flag.String("token-file", "", "file of the API key or JWT to call the service with")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *addr == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *tokenFile != "" && !tlsCfg.Enabled {
+		log.Fatalf("-token-file requires -tls, the token is not sent in plain text")
+	}
+
+	creds, err := tlsconfig.DialOption(*tlsCfg)
+	if err != nil {
+		log.Fatalf("Error setting up TLS: %v", err)
+	}
+	opts := []grpc.DialOption{creds}
+	if *tokenFile != "" {
+		token, err := auth.TokenFile(*tokenFile)
+		if err != nil {
+			log.Fatalf("Error reading token: %v", err)
+		}
+		opts = append(opts, token)
+	}
+	conn, err := grpc.NewClient(*addr, opts...)
+	if err != nil {
+		log.Fatalf("did not connect to [%s]: %v", *addr, err)
+	}
+	defer conn.Close()
+	client := pb.NewDeadLetterClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	switch cmd {
+	case "list":
+		err = list(ctx, client, args)
+	case "inspect":
+		err = inspect(ctx, client, args)
+	case "reinject":
+		err = forEach(args, func(id string) error {
+			_, err := client.ReinjectDeadLetter(ctx, request(id))
+			return err
+		})
+	case "delete":
+		err = forEach(args, func(id string) error {
+			_, err := client.DeleteDeadLetter(ctx, request(id))
+			return err
+		})
+	default:
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		log.Fatalf("Error running %s: %v", cmd, err)
+	}
+}
+
+func list(ctx context.Context, client pb.DeadLetterClient, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	stage := fs.String("stage", "", "only records rejected at the stage")
+	reason := fs.String("reason", "", "only records with a rejection of the reason")
+	since := fs.Duration("since", 0, "only records rejected in the last duration")
+	limit := fs.Int("limit", 50, "maximum number of records, 0 for all")
+	fs.Parse(args)
+
+	q := deadletter.Query{Stage: *stage, Reason: *reason, Limit: *limit}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		return fmt.Errorf("error marshalling query: %v", err)
+	}
+	res, err := client.ListDeadLetters(ctx, request(string(b)))
+	if err != nil {
+		return err
+	}
+	var records []deadletter.Record
+	if err := json.Unmarshal([]byte(res.Payload), &records); err != nil {
+		return fmt.Errorf("error unmarshalling response: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tSERVICE\tSTAGE\tSOURCE\tSIZE\tREASONS")
+	for _, rec := range records {
+		reasons := make([]string, 0, len(rec.Rejections))
+		for _, r := range rec.Rejections {
+			reasons = append(reasons, string(r.Reason))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", rec.ID, rec.Time.Format(time.RFC3339),
+			rec.Service, rec.Stage, rec.Source, rec.Size, strings.Join(reasons, ","))
+	}
+	return w.Flush()
+}
+
+func inspect(ctx context.Context, client pb.DeadLetterClient, args []string) error {
+	return forEach(args, func(id string) error {
+		res, err := client.GetDeadLetter(ctx, request(id))
+		if err != nil {
+			return err
+		}
+		rec := &deadletter.Record{}
+		if err := json.Unmarshal([]byte(res.Payload), rec); err != nil {
+			return fmt.Errorf("error unmarshalling response: %v", err)
+		}
+		// The payload is printed as is, the rest of the record indented
+		payload := rec.Payload
+		rec.Payload = ""
+		b, err := json.MarshalIndent(rec, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n%s\n", b, payload)
+		return nil
+	})
+}
+
+// forEach runs fn for every ID and stops at the first error
+func forEach(ids []string, fn func(id string) error) error {
+	if len(ids) == 0 {
+		return fmt.Errorf("no record ID given")
+	}
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return fmt.Errorf("%s: %v", id, err)
+		}
+		log.Printf("Done [%s]\n", id)
+	}
+	return nil
+}
+
+func request(payload string) *pb.Data {
+	return &pb.Data{
+		Payload:       payload,
+		SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
+	}
+}
@@ -0,0 +1,334 @@
+// Package auth authenticates the callers of a gRPC server and authorizes their calls
+// by role. A caller presents a static API key or a JWT as a bearer token, or the
+// certificate of a mutual TLS connection, and is granted the roles the clients file or
+// the JWT give it. The health service is open to anyone and the denied calls are
+// written to the audit log. Without authentication the methods requiring RoleAdmin
+// are only served to callers on the loopback interface. The HTTP routes serving data are authorized the same
+// way, from bearer tokens only.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+	"github.com/etesami/air-quality-monitoring/pkg/metric"
+	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+	"github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Role is a permission granted to a client
+type Role string
+
+const (
+	// RoleWriteIngest sends data to be stored
+	RoleWriteIngest Role = "write-ingest"
+	// RoleReadData reads and exports the stored data
+	RoleReadData Role = "read-data"
+	// RoleAdmin may call every method, such as the ones of the dead-letter service
+	RoleAdmin Role = "admin"
+)
+
+// methodRoles are the roles the methods require, the empty role only requires the
+// caller to be authenticated and the methods not listed require RoleAdmin
+var methodRoles = map[string]Role{
+	pb.AirQualityMonitoring_SendDataToServer_FullMethodName:      RoleWriteIngest,
+	pb.AirQualityMonitoring_ReceiveDataFromServer_FullMethodName: RoleReadData,
+	pb.AirQualityMonitoring_ExportData_FullMethodName:            RoleReadData,
+	pb.AirQualityMonitoring_CheckConnection_FullMethodName:       "",
+}
+
+// publicService is open to unauthenticated callers, the probes and the
+// services upstream check the health of the service through it
+const publicService = "/grpc.health.v1.Health/"
+
+// Config configures the authentication and authorization of the calls
+type Config struct {
+	Enabled        bool            `config:"enabled" env:"ENABLED" default:"false" usage:"authenticate and authorize the calls, anyone may call the service otherwise but the admin methods, served to local callers only"`
+	ClientsFile    string          `config:"clientsFile" env:"CLIENTS_FILE" usage:"JSON file of the clients, their API key hashes or certificate names, and their roles"`
+	JWKSFile       string          `config:"jwksFile" env:"JWKS_FILE" usage:"JWKS file the JWTs are verified against, no JWT is accepted when empty"`
+	Issuer         string          `config:"issuer" env:"ISSUER" usage:"issuer of the JWTs, any when empty"`
+	Audience       string          `config:"audience" env:"AUDIENCE" usage:"audience the JWTs must be meant for, any when empty"`
+	RolesClaim     string          `config:"rolesClaim" env:"ROLES_CLAIM" default:"roles" usage:"claim of the JWTs holding the roles"`
+	ReloadInterval config.Duration `config:"reloadInterval" env:"RELOAD_INTERVAL" default:"1m" usage:"interval between checks of the files for changes"`
+}
+
+func (c *Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.ClientsFile == "" && c.JWKSFile == "" {
+		return fmt.Errorf("clientsFile or jwksFile must be set")
+	}
+	if c.ReloadInterval <= 0 {
+		return fmt.Errorf("reloadInterval must be positive")
+	}
+	return nil
+}
+
+// Client is an entry of the clients file, it is matched by the SHA-256 of its
+// API key, in hex, or by a name of its certificate
+type Client struct {
+	Name      string `json:"name"`
+	KeySHA256 string `json:"keySha256,omitempty"`
+	Peer      string `json:"peer,omitempty"`
+	Roles     []Role `json:"roles"`
+}
+
+// clients are the clients of the clients file by key hash and by certificate name
+type clients struct {
+	byKey  map[string]Client
+	byPeer map[string]Client
+}
+
+// parseClients parses a clients file, a JSON list of clients
+func parseClients(b []byte) (clients, error) {
+	var list []Client
+	if err := json.Unmarshal(b, &list); err != nil {
+		return clients{}, fmt.Errorf("error parsing clients: %v", err)
+	}
+	c := clients{byKey: map[string]Client{}, byPeer: map[string]Client{}}
+	for _, client := range list {
+		if client.Name == "" {
+			return clients{}, fmt.Errorf("client without name")
+		}
+		for _, r := range client.Roles {
+			if r != RoleWriteIngest && r != RoleReadData && r != RoleAdmin {
+				return clients{}, fmt.Errorf("unknown role %q of client %s", r, client.Name)
+			}
+		}
+		switch {
+		case client.KeySHA256 != "":
+			key := strings.ToLower(client.KeySHA256)
+			if b, err := hex.DecodeString(key); err != nil || len(b) != sha256.Size {
+				return clients{}, fmt.Errorf("keySha256 of client %s is not a SHA-256 in hex", client.Name)
+			}
+			c.byKey[key] = client
+		case client.Peer != "":
+			c.byPeer[client.Peer] = client
+		default:
+			return clients{}, fmt.Errorf("client %s has neither keySha256 nor peer", client.Name)
+		}
+	}
+	return c, nil
+}
+
+// Principal is the authenticated caller of an RPC
+type Principal struct {
+	Name string
+	// Via is how the caller authenticated: api-key, jwt or certificate
+	Via   string
+	Roles []Role
+}
+
+// Has reports whether the principal was granted role, admins have every role
+func (p Principal) Has(role Role) bool {
+	return slices.Contains(p.Roles, role) || slices.Contains(p.Roles, RoleAdmin)
+}
+
+type principalKey struct{}
+
+func contextWithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the caller of the RPC of ctx, false when the calls are not authenticated
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Authorizer authenticates and authorizes the calls of a server
+type Authorizer struct {
+	cfg     Config
+	metric  *metric.Metrics
+	clients *watched[clients]
+	keys    *watched[jwks]
+}
+
+// New returns the authorizer of cfg, the denied calls are counted in m.
+// A disabled authorizer lets every call through but the admin ones of remote callers.
+func New(cfg Config, m *metric.Metrics) (*Authorizer, error) {
+	a := &Authorizer{cfg: cfg, metric: m}
+	if !cfg.Enabled {
+		return a, nil
+	}
+	var err error
+	if cfg.ClientsFile != "" {
+		if a.clients, err = watch(cfg.ClientsFile, cfg.ReloadInterval.Duration(), parseClients); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.JWKSFile != "" {
+		if a.keys, err = watch(cfg.JWKSFile, cfg.ReloadInterval.Duration(), parseJWKS); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Unary authorizes the unary calls of a server
+func (a *Authorizer) Unary() grpc.ServerOption {
+	return grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := a.authorize(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	})
+}
+
+// Stream authorizes the streaming calls of a server
+func (a *Authorizer) Stream() grpc.ServerOption {
+	return grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authorize(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	})
+}
+
+// serverStream is a stream with the principal in its context
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorize authenticates the caller of method and checks it has the role the
+// method requires, the principal is added to the returned context
+func (a *Authorizer) authorize(ctx context.Context, method string) (context.Context, error) {
+	if strings.HasPrefix(method, publicService) {
+		return ctx, nil
+	}
+	role, ok := methodRoles[method]
+	if !ok {
+		role = RoleAdmin
+	}
+	addr := ""
+	pr, ok := peer.FromContext(ctx)
+	if ok {
+		addr = pr.Addr.String()
+	}
+	if !a.cfg.Enabled {
+		if role == RoleAdmin && !(ok && local(pr.Addr)) {
+			a.deny(ctx, method, addr, Principal{}, codes.PermissionDenied, "admin method called by a remote caller without authentication")
+			return nil, status.Error(codes.PermissionDenied, "admin methods are only served to local callers without authentication")
+		}
+		return ctx, nil
+	}
+	p, err := a.authenticate(ctx)
+	if err != nil {
+		a.deny(ctx, method, addr, p, codes.Unauthenticated, err.Error())
+		return nil, status.Error(codes.Unauthenticated, "missing or invalid credentials")
+	}
+	if role != "" && !p.Has(role) {
+		a.deny(ctx, method, addr, p, codes.PermissionDenied, fmt.Sprintf("role %s required", role))
+		return nil, status.Errorf(codes.PermissionDenied, "role %s required", role)
+	}
+	return contextWithPrincipal(ctx, p), nil
+}
+
+// local reports whether addr is on the loopback interface or a unix socket
+func local(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	case *net.UnixAddr:
+		return true
+	}
+	return false
+}
+
+// authenticate returns the caller of the RPC of ctx from its bearer token or, without
+// one, from its certificate
+func (a *Authorizer) authenticate(ctx context.Context) (Principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	token, err := bearerToken(md.Get("authorization"))
+	if err != nil {
+		return Principal{}, err
+	}
+	if token != "" {
+		return a.authenticateToken(token)
+	}
+	if id, ok := tlsconfig.PeerIdentity(ctx); ok && a.clients != nil {
+		c := a.clients.get()
+		for _, name := range id.Names() {
+			if client, ok := c.byPeer[name]; ok {
+				return Principal{Name: client.Name, Via: "certificate", Roles: client.Roles}, nil
+			}
+		}
+		return Principal{Name: id.CommonName, Via: "certificate"}, fmt.Errorf("unknown certificate %s", strings.Join(id.Names(), ", "))
+	}
+	return Principal{}, fmt.Errorf("no credentials")
+}
+
+// authenticateToken returns the caller presenting token, an API key or a JWT
+func (a *Authorizer) authenticateToken(token string) (Principal, error) {
+	// JWTs have three segments separated by dots, the API keys none
+	if strings.Count(token, ".") == 2 {
+		return a.authenticateJWT(token)
+	}
+	return a.authenticateKey(token)
+}
+
+func (a *Authorizer) authenticateKey(key string) (Principal, error) {
+	if a.clients == nil {
+		return Principal{}, fmt.Errorf("API keys are not accepted")
+	}
+	sum := sha256.Sum256([]byte(key))
+	client, ok := a.clients.get().byKey[hex.EncodeToString(sum[:])]
+	if !ok {
+		return Principal{}, fmt.Errorf("unknown API key")
+	}
+	return Principal{Name: client.Name, Via: "api-key", Roles: client.Roles}, nil
+}
+
+func (a *Authorizer) authenticateJWT(token string) (Principal, error) {
+	if a.keys == nil {
+		return Principal{}, fmt.Errorf("JWTs are not accepted")
+	}
+	c, err := verifyJWT(token, a.keys.get(), a.cfg.Issuer, a.cfg.Audience, time.Now())
+	if err != nil {
+		return Principal{}, fmt.Errorf("invalid JWT: %v", err)
+	}
+	return Principal{Name: c.Subject, Via: "jwt", Roles: c.roles(a.cfg.RolesClaim)}, nil
+}
+
+// bearerToken returns the bearer token of the values of an authorization metadata
+// or header, empty without one
+func bearerToken(values []string) (string, error) {
+	if len(values) == 0 {
+		return "", nil
+	}
+	scheme, token, ok := strings.Cut(values[0], " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return "", fmt.Errorf("authorization is not a bearer token")
+	}
+	return token, nil
+}
+
+// deny writes a denied call from addr to the audit log and counts it
+func (a *Authorizer) deny(ctx context.Context, method, addr string, p Principal, code codes.Code, reason string) {
+	slog.WarnContext(ctx, "Denied call", "log", "audit", "method", method, "principal", p.Name,
+		"via", p.Via, "peer", addr, "code", code.String(), "reason", reason)
+	a.metric.AddDenied(method, code.String())
+}
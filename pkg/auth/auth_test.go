@@ -0,0 +1,395 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+	"github.com/etesami/air-quality-monitoring/pkg/metric"
+	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "disabled", cfg: Config{}},
+		{name: "clients file", cfg: Config{Enabled: true, ClientsFile: "clients.json", ReloadInterval: config.Duration(time.Minute)}},
+		{name: "JWKS file", cfg: Config{Enabled: true, JWKSFile: "jwks.json", ReloadInterval: config.Duration(time.Minute)}},
+		{name: "no file", cfg: Config{Enabled: true, ReloadInterval: config.Duration(time.Minute)}, wantErr: true},
+		{name: "no reload interval", cfg: Config{Enabled: true, ClientsFile: "clients.json"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseClients(t *testing.T) {
+	hash := keyHash("secret")
+	tests := []struct {
+		name     string
+		doc      string
+		wantKey  string
+		wantPeer string
+		wantErr  string
+	}{
+		{name: "key and peer", doc: fmt.Sprintf(`[
+			{"name": "svc-3", "keySha256": %q, "roles": ["write-ingest"]},
+			{"name": "dashboard", "peer": "dashboard.local", "roles": ["read-data"]}]`, strings.ToUpper(hash)),
+			wantKey: "svc-3", wantPeer: "dashboard"},
+		{name: "no roles", doc: `[{"name": "probe", "peer": "dashboard.local"}]`, wantPeer: "probe"},
+		{name: "not JSON", doc: `{"name": "svc-3"}`, wantErr: "error parsing clients"},
+		{name: "no name", doc: fmt.Sprintf(`[{"keySha256": %q}]`, hash), wantErr: "client without name"},
+		{name: "unknown role", doc: `[{"name": "svc-3", "peer": "svc-3", "roles": ["root"]}]`, wantErr: `unknown role "root" of client svc-3`},
+		{name: "short hash", doc: `[{"name": "svc-3", "keySha256": "abcd"}]`, wantErr: "is not a SHA-256 in hex"},
+		{name: "key instead of hash", doc: `[{"name": "svc-3", "keySha256": "secret"}]`, wantErr: "is not a SHA-256 in hex"},
+		{name: "neither key nor peer", doc: `[{"name": "svc-3", "roles": ["admin"]}]`, wantErr: "has neither keySha256 nor peer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseClients([]byte(tt.doc))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseClients() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseClients(): %v", err)
+			}
+			if c.byKey[hash].Name != tt.wantKey || c.byPeer["dashboard.local"].Name != tt.wantPeer {
+				t.Errorf("parseClients() = %+v", c)
+			}
+		})
+	}
+}
+
+func TestPrincipalHas(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles []Role
+		role  Role
+		want  bool
+	}{
+		{name: "granted", roles: []Role{RoleReadData}, role: RoleReadData, want: true},
+		{name: "other role", roles: []Role{RoleReadData}, role: RoleWriteIngest},
+		{name: "no roles", role: RoleReadData},
+		{name: "admin has every role", roles: []Role{RoleAdmin}, role: RoleWriteIngest, want: true},
+		{name: "admin", roles: []Role{RoleWriteIngest, RoleAdmin}, role: RoleAdmin, want: true},
+		{name: "admin not granted", roles: []Role{RoleWriteIngest, RoleReadData}, role: RoleAdmin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Principal{Roles: tt.roles}).Has(tt.role); got != tt.want {
+				t.Errorf("Has(%s) = %v, want %v", tt.role, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "bearer", values: []string{"Bearer abc"}, want: "abc"},
+		{name: "lower case scheme", values: []string{"bearer a.b.c"}, want: "a.b.c"},
+		{name: "first value", values: []string{"Bearer first", "Bearer second"}, want: "first"},
+		{name: "basic", values: []string{"Basic dXNlcjpwYXNz"}, wantErr: true},
+		{name: "no scheme", values: []string{"abc"}, wantErr: true},
+		{name: "no token", values: []string{"Bearer "}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bearerToken(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bearerToken(%q) error = %v, wantErr %v", tt.values, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("bearerToken(%q) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+// testAuthorizer returns an authorizer of the clients ingest, reader and admin,
+// whose API keys are their names, of the certificate svc-4.local, and of the JWTs
+// signed by the keys of k
+func testAuthorizer(t *testing.T, k testKeys) *Authorizer {
+	t.Helper()
+	dir := t.TempDir()
+	clientsFile := filepath.Join(dir, "clients.json")
+	clients := fmt.Sprintf(`[
+		{"name": "ingest", "keySha256": %q, "roles": ["write-ingest"]},
+		{"name": "reader", "keySha256": %q, "roles": ["read-data"]},
+		{"name": "admin", "keySha256": %q, "roles": ["admin"]},
+		{"name": "svc-4", "peer": "svc-4.local", "roles": ["write-ingest"]}]`,
+		keyHash("ingest"), keyHash("reader"), keyHash("admin"))
+	if err := os.WriteFile(clientsFile, []byte(clients), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(dir, "jwks.json")
+	if err := os.WriteFile(jwksFile, k.jwks(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(Config{
+		Enabled:        true,
+		ClientsFile:    clientsFile,
+		JWKSFile:       jwksFile,
+		Audience:       "storage",
+		RolesClaim:     "roles",
+		ReloadInterval: config.Duration(time.Minute),
+	}, metric.New("test", metric.Buckets{}))
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	return a
+}
+
+// peerContext returns the context of a call over mutual TLS from a client presenting
+// a certificate for name
+func peerContext(name string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.IPv4(10, 0, 0, 4), Port: 50000},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	})
+}
+
+func TestAuthorize(t *testing.T) {
+	k := newTestKeys(t)
+	a := testAuthorizer(t, k)
+	jwt := func(roles any, exp time.Duration) string {
+		return signJWT(t, "ES256", "ec256", k.ec256, map[string]any{
+			"sub": "svc-3", "aud": "storage", "exp": time.Now().Add(exp).Unix(), "roles": roles})
+	}
+	bearer := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	}
+	const (
+		send     = pb.AirQualityMonitoring_SendDataToServer_FullMethodName
+		export   = pb.AirQualityMonitoring_ExportData_FullMethodName
+		check    = pb.AirQualityMonitoring_CheckConnection_FullMethodName
+		unlisted = "/deadletter.DeadLetter/Replay"
+	)
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		method   string
+		wantCode codes.Code
+		wantName string
+	}{
+		{name: "health is public", ctx: context.Background(), method: "/grpc.health.v1.Health/Check"},
+		{name: "no credentials", ctx: context.Background(), method: check, wantCode: codes.Unauthenticated},
+		{name: "not a bearer token", ctx: metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Basic eDp5")),
+			method: check, wantCode: codes.Unauthenticated},
+		{name: "unknown API key", ctx: bearer("nobody"), method: check, wantCode: codes.Unauthenticated},
+		{name: "any client checks the connection", ctx: bearer("reader"), method: check, wantName: "reader"},
+		{name: "ingest sends data", ctx: bearer("ingest"), method: send, wantName: "ingest"},
+		{name: "ingest may not export", ctx: bearer("ingest"), method: export, wantCode: codes.PermissionDenied},
+		{name: "reader exports", ctx: bearer("reader"), method: export, wantName: "reader"},
+		{name: "reader may not send data", ctx: bearer("reader"), method: send, wantCode: codes.PermissionDenied},
+		{name: "unlisted methods require admin", ctx: bearer("reader"), method: unlisted, wantCode: codes.PermissionDenied},
+		{name: "admin calls unlisted methods", ctx: bearer("admin"), method: unlisted, wantName: "admin"},
+		{name: "admin sends data", ctx: bearer("admin"), method: send, wantName: "admin"},
+		{name: "JWT with the role", ctx: bearer(jwt([]string{"write-ingest"}, time.Hour)), method: send, wantName: "svc-3"},
+		{name: "JWT with roles as a string", ctx: bearer(jwt("read-data write-ingest", time.Hour)), method: export, wantName: "svc-3"},
+		{name: "JWT without the role", ctx: bearer(jwt([]string{"read-data"}, time.Hour)), method: send, wantCode: codes.PermissionDenied},
+		{name: "expired JWT", ctx: bearer(jwt([]string{"write-ingest"}, -time.Hour)), method: send, wantCode: codes.Unauthenticated},
+		{name: "known certificate", ctx: peerContext("svc-4.local"), method: send, wantName: "svc-4"},
+		{name: "unknown certificate", ctx: peerContext("intruder.local"), method: send, wantCode: codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := a.authorize(tt.ctx, tt.method)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("authorize() = %v, want code %s", err, tt.wantCode)
+			}
+			if tt.wantCode != codes.OK {
+				return
+			}
+			p, ok := FromContext(ctx)
+			if tt.wantName == "" {
+				if ok {
+					t.Errorf("authorize() added principal %+v to a public call", p)
+				}
+				return
+			}
+			if !ok || p.Name != tt.wantName {
+				t.Errorf("principal = %+v, want %s", p, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestAuthorizeDisabled(t *testing.T) {
+	a, err := New(Config{}, metric.New("test", metric.Buckets{}))
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	from := func(addr net.Addr) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+	}
+	remote := from(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 4), Port: 50000})
+	const unlisted = "/deadletter.DeadLetter/Replay"
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		method   string
+		wantCode codes.Code
+	}{
+		{name: "remote caller sends data", ctx: remote, method: pb.AirQualityMonitoring_SendDataToServer_FullMethodName},
+		{name: "remote caller checks the health", ctx: remote, method: "/grpc.health.v1.Health/Check"},
+		{name: "remote caller of an admin method", ctx: remote, method: unlisted, wantCode: codes.PermissionDenied},
+		{name: "caller without address", ctx: context.Background(), method: unlisted, wantCode: codes.PermissionDenied},
+		{name: "IPv4 loopback", ctx: from(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}), method: unlisted},
+		{name: "IPv6 loopback", ctx: from(&net.TCPAddr{IP: net.IPv6loopback, Port: 50000}), method: unlisted},
+		{name: "unix socket", ctx: from(&net.UnixAddr{Name: "/run/dl.sock", Net: "unix"}), method: unlisted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := a.authorize(tt.ctx, tt.method)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("authorize() = %v, want code %s", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if _, ok := FromContext(ctx); ok {
+				t.Error("authorize() added a principal without authentication")
+			}
+		})
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	k := newTestKeys(t)
+	a := testAuthorizer(t, k)
+	data := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := FromContext(r.Context())
+		fmt.Fprint(w, p.Name)
+	})
+
+	tests := []struct {
+		name          string
+		authorizer    *Authorizer
+		authorization string
+		wantCode      int
+		wantBody      string
+	}{
+		{name: "disabled", authorizer: &Authorizer{}, wantCode: http.StatusOK},
+		{name: "no credentials", authorizer: a, wantCode: http.StatusUnauthorized},
+		{name: "not a bearer token", authorizer: a, authorization: "Basic eDp5", wantCode: http.StatusUnauthorized},
+		{name: "unknown API key", authorizer: a, authorization: "Bearer nobody", wantCode: http.StatusUnauthorized},
+		{name: "without the role", authorizer: a, authorization: "Bearer ingest", wantCode: http.StatusForbidden},
+		{name: "with the role", authorizer: a, authorization: "Bearer reader", wantCode: http.StatusOK, wantBody: "reader"},
+		{name: "admin", authorizer: a, authorization: "Bearer admin", wantCode: http.StatusOK, wantBody: "admin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.Handle("GET /v1/readings", tt.authorizer.HTTP(RoleReadData, data))
+			r := httptest.NewRequest(http.MethodGet, "/v1/readings", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+			if tt.wantCode == http.StatusOK && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	if err := os.WriteFile(path, []byte(" first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := watch(path, 0, func(b []byte) (string, error) { return strings.TrimSpace(string(b)), nil })
+	if err != nil {
+		t.Fatalf("watch(): %v", err)
+	}
+	b := bearer{w}
+	if !b.RequireTransportSecurity() {
+		t.Error("RequireTransportSecurity() = false, the token would be sent in plain text")
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "initial token", want: "Bearer first"},
+		{name: "rotated token", content: "rotated token\n", want: "Bearer rotated token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			md, err := b.GetRequestMetadata(context.Background())
+			if err != nil {
+				t.Fatalf("GetRequestMetadata(): %v", err)
+			}
+			if md["authorization"] != tt.want {
+				t.Errorf("authorization = %q, want %q", md["authorization"], tt.want)
+			}
+		})
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TokenFile(empty); err == nil {
+		t.Error("TokenFile() of an empty file succeeded, want an error")
+	}
+	if _, err := TokenFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("TokenFile() of a missing file succeeded, want an error")
+	}
+}
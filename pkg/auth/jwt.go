@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// leeway is the clock skew tolerated on the expiry and not-before times of a JWT
+const leeway = time.Minute
+
+// jwks are the public keys of a JWKS file by key ID
+type jwks map[string]crypto.PublicKey
+
+// parseJWKS parses a JWKS document, only the RSA and EC keys are kept
+func parseJWKS(b []byte) (jwks, error) {
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS: %v", err)
+	}
+	keys := jwks{}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := decodeInt(k.N)
+			e, err2 := decodeInt(k.E)
+			if err1 != nil || err2 != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("unsupported curve %q of key %q", k.Crv, k.Kid)
+			}
+			x, err1 := decodeInt(k.X)
+			y, err2 := decodeInt(k.Y)
+			if err1 != nil || err2 != nil || !curve.IsOnCurve(x, y) {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing key found in JWKS")
+	}
+	return keys, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// claims are the claims of a JWT the authorization looks at
+type claims struct {
+	Issuer    string         `json:"iss"`
+	Subject   string         `json:"sub"`
+	Audience  audience       `json:"aud"`
+	ExpiresAt *int64         `json:"exp"`
+	NotBefore *int64         `json:"nbf"`
+	Extra     map[string]any `json:"-"`
+}
+
+// audience is the aud claim, a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return fmt.Errorf("aud is neither a string nor a list of strings")
+	}
+	*a = l
+	return nil
+}
+
+// roles returns the roles in the claim name, a list of strings or a
+// string of roles separated by spaces
+func (c claims) roles(name string) []Role {
+	var roles []Role
+	switch v := c.Extra[name].(type) {
+	case string:
+		for _, r := range strings.Fields(v) {
+			roles = append(roles, Role(r))
+		}
+	case []any:
+		for _, r := range v {
+			if s, ok := r.(string); ok {
+				roles = append(roles, Role(s))
+			}
+		}
+	}
+	return roles
+}
+
+// verifyJWT verifies the signature of token with keys and its times, issuer
+// and audience, it returns its claims
+func verifyJWT(token string, keys jwks, issuer, aud string, now time.Time) (claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims{}, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims{}, fmt.Errorf("malformed header: %v", err)
+	}
+	key, ok := keys[header.Kid]
+	if !ok {
+		return claims{}, fmt.Errorf("unknown key %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims{}, fmt.Errorf("malformed signature: %v", err)
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return claims{}, err
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return claims{}, fmt.Errorf("malformed claims: %v", err)
+	}
+	if err := decodeSegment(parts[1], &c.Extra); err != nil {
+		return claims{}, fmt.Errorf("malformed claims: %v", err)
+	}
+	if c.ExpiresAt == nil {
+		return claims{}, fmt.Errorf("token has no expiry")
+	}
+	if now.After(time.Unix(*c.ExpiresAt, 0).Add(leeway)) {
+		return claims{}, fmt.Errorf("token expired")
+	}
+	if c.NotBefore != nil && now.Add(leeway).Before(time.Unix(*c.NotBefore, 0)) {
+		return claims{}, fmt.Errorf("token not valid yet")
+	}
+	if issuer != "" && c.Issuer != issuer {
+		return claims{}, fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	if aud != "" && !slices.Contains(c.Audience, aud) {
+		return claims{}, fmt.Errorf("token is not meant for %q", aud)
+	}
+	return c, nil
+}
+
+func decodeSegment(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// curveBits are the sizes of the curves of the EC algorithms
+var curveBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+// verifySignature verifies the signature sig of signed with key, the
+// algorithm must match the type of the key
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %q does not match the RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, sig); err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if curveBits[alg] != k.Curve.Params().BitSize {
+			return fmt.Errorf("algorithm %q does not match the EC key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported key type")
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys are the signing keys of the tests, see jwks for their kids
+type testKeys struct {
+	rsa   *rsa.PrivateKey
+	ec256 *ecdsa.PrivateKey
+	ec384 *ecdsa.PrivateKey
+	other *rsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	var k testKeys
+	var err error
+	if k.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if k.other, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if k.ec256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if k.ec384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// jwks returns the JWKS document of the public keys, other is left out
+func (k testKeys) jwks() []byte {
+	b64 := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	ec := func(kid, crv string, key *ecdsa.PrivateKey) map[string]string {
+		return map[string]string{"kty": "EC", "kid": kid, "use": "sig", "crv": crv, "x": b64(key.X), "y": b64(key.Y)}
+	}
+	doc := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(k.rsa.N), "e": b64(big.NewInt(int64(k.rsa.E)))},
+		ec("ec256", "P-256", k.ec256),
+		ec("ec384", "P-384", k.ec384),
+	}}
+	b, _ := json.Marshal(doc)
+	return b
+}
+
+// signJWT returns a JWT of claims signed with key under alg: an RSA or EC private
+// key, an HMAC secret, or nil for no signature
+func signJWT(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	encode := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+
+	hash := crypto.SHA256
+	switch {
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	k := newTestKeys(t)
+	keys, err := parseJWKS(k.jwks())
+	if err != nil {
+		t.Fatalf("parseJWKS(): %v", err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	at := func(d time.Duration) int64 { return now.Add(d).Unix() }
+	valid := func() map[string]any {
+		return map[string]any{"iss": "issuer", "sub": "svc-3", "aud": "storage", "exp": at(time.Hour), "roles": []string{"write-ingest"}}
+	}
+	with := func(key string, v any) map[string]any {
+		c := valid()
+		if v == nil {
+			delete(c, key)
+		} else {
+			c[key] = v
+		}
+		return c
+	}
+	tampered := func() string {
+		parts := strings.Split(signJWT(t, "RS256", "rsa", k.rsa, valid()), ".")
+		b, _ := json.Marshal(with("roles", []string{"admin"}))
+		parts[1] = base64.RawURLEncoding.EncodeToString(b)
+		return strings.Join(parts, ".")
+	}
+	// The public key of an RSA JWK, used as the secret of an HMAC
+	rsaSecret := []byte(base64.RawURLEncoding.EncodeToString(k.rsa.N.Bytes()))
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "RS256", token: signJWT(t, "RS256", "rsa", k.rsa, valid())},
+		{name: "RS512", token: signJWT(t, "RS512", "rsa", k.rsa, valid())},
+		{name: "ES256", token: signJWT(t, "ES256", "ec256", k.ec256, valid())},
+		{name: "ES384", token: signJWT(t, "ES384", "ec384", k.ec384, valid())},
+		{name: "audience list", token: signJWT(t, "RS256", "rsa", k.rsa, with("aud", []string{"other", "storage"}))},
+		{name: "expired within leeway", token: signJWT(t, "RS256", "rsa", k.rsa, with("exp", at(-30*time.Second)))},
+		{name: "not before within leeway", token: signJWT(t, "RS256", "rsa", k.rsa, with("nbf", at(30*time.Second)))},
+		{name: "malformed", token: "header.claims", wantErr: "malformed token"},
+		{name: "malformed header", token: "!.e30.sig", wantErr: "malformed header"},
+		{name: "alg none", token: signJWT(t, "none", "rsa", nil, valid()), wantErr: `unsupported algorithm "none"`},
+		{name: "HS256 with the RSA key as secret", token: signJWT(t, "HS256", "rsa", rsaSecret, valid()), wantErr: `unsupported algorithm "HS256"`},
+		{name: "ES256 on an RSA key", token: signJWT(t, "ES256", "rsa", k.ec256, valid()), wantErr: "does not match the RSA key"},
+		{name: "RS256 on an EC key", token: signJWT(t, "RS256", "ec256", k.rsa, valid()), wantErr: "does not match the EC key"},
+		{name: "ES384 on a P-256 key", token: signJWT(t, "ES384", "ec256", k.ec384, valid()), wantErr: "does not match the EC key"},
+		{name: "unknown key", token: signJWT(t, "RS256", "gone", k.rsa, valid()), wantErr: `unknown key "gone"`},
+		{name: "signed by another key", token: signJWT(t, "RS256", "rsa", k.other, valid()), wantErr: "invalid signature"},
+		{name: "EC signed by another key", token: signJWT(t, "ES256", "ec256", k.ec384, valid()), wantErr: "invalid signature"},
+		{name: "tampered claims", token: tampered(), wantErr: "invalid signature"},
+		{name: "no expiry", token: signJWT(t, "RS256", "rsa", k.rsa, with("exp", nil)), wantErr: "token has no expiry"},
+		{name: "expired", token: signJWT(t, "RS256", "rsa", k.rsa, with("exp", at(-2*time.Minute))), wantErr: "token expired"},
+		{name: "not valid yet", token: signJWT(t, "RS256", "rsa", k.rsa, with("nbf", at(5*time.Minute))), wantErr: "token not valid yet"},
+		{name: "wrong issuer", token: signJWT(t, "RS256", "rsa", k.rsa, with("iss", "someone")), wantErr: `unexpected issuer "someone"`},
+		{name: "wrong audience", token: signJWT(t, "RS256", "rsa", k.rsa, with("aud", "ingest")), wantErr: `token is not meant for "storage"`},
+		{name: "no audience", token: signJWT(t, "RS256", "rsa", k.rsa, with("aud", nil)), wantErr: `token is not meant for "storage"`},
+		{name: "audience of the wrong type", token: signJWT(t, "RS256", "rsa", k.rsa, with("aud", 1)), wantErr: "malformed claims"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := verifyJWT(tt.token, keys, "issuer", "storage", now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verifyJWT() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyJWT(): %v", err)
+			}
+			if c.Subject != "svc-3" || !slices.Equal(c.roles("roles"), []Role{RoleWriteIngest}) {
+				t.Errorf("verifyJWT() = %+v", c)
+			}
+		})
+	}
+
+	t.Run("any issuer and audience", func(t *testing.T) {
+		token := signJWT(t, "RS256", "rsa", k.rsa, with("aud", nil))
+		if _, err := verifyJWT(token, keys, "", "", now); err != nil {
+			t.Errorf("verifyJWT(): %v", err)
+		}
+	})
+}
+
+func TestParseJWKS(t *testing.T) {
+	k := newTestKeys(t)
+	point := base64.RawURLEncoding.EncodeToString(big.NewInt(1).Bytes())
+	tests := []struct {
+		name     string
+		doc      string
+		wantKids []string
+		wantErr  string
+	}{
+		{name: "RSA and EC keys", doc: string(k.jwks()), wantKids: []string{"ec256", "ec384", "rsa"}},
+		{name: "encryption and symmetric keys skipped", doc: `{"keys": [
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQ", "e": "AQAB"},
+			{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+			{"kty": "RSA", "kid": "sig", "n": "AQ", "e": "AQAB"}]}`, wantKids: []string{"sig"}},
+		{name: "no signing key", doc: `{"keys": [{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"}]}`, wantErr: "no signing key found in JWKS"},
+		{name: "empty", doc: `{"keys": []}`, wantErr: "no signing key found in JWKS"},
+		{name: "not JSON", doc: `keys`, wantErr: "error parsing JWKS"},
+		{name: "invalid RSA key", doc: `{"keys": [{"kty": "RSA", "kid": "bad", "n": "!", "e": "AQAB"}]}`, wantErr: `invalid RSA key "bad"`},
+		{name: "unsupported curve", doc: `{"keys": [{"kty": "EC", "kid": "ed", "crv": "Ed25519", "x": "AQ"}]}`, wantErr: `unsupported curve "Ed25519"`},
+		{name: "point not on the curve", doc: fmt.Sprintf(`{"keys": [{"kty": "EC", "kid": "off", "crv": "P-256", "x": %q, "y": %q}]}`, point, point),
+			wantErr: `invalid EC key "off"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseJWKS([]byte(tt.doc))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseJWKS() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJWKS(): %v", err)
+			}
+			var kids []string
+			for kid := range keys {
+				kids = append(kids, kid)
+			}
+			slices.Sort(kids)
+			if !slices.Equal(kids, tt.wantKids) {
+				t.Errorf("parseJWKS() kids = %v, want %v", kids, tt.wantKids)
+			}
+		})
+	}
+}
+
+func TestClaimsRoles(t *testing.T) {
+	tests := []struct {
+		name  string
+		claim any
+		want  []Role
+	}{
+		{name: "list", claim: []any{"read-data", "admin"}, want: []Role{RoleReadData, RoleAdmin}},
+		{name: "space separated", claim: "write-ingest  read-data", want: []Role{RoleWriteIngest, RoleReadData}},
+		{name: "non-strings skipped", claim: []any{"admin", 1.0, nil}, want: []Role{RoleAdmin}},
+		{name: "missing"},
+		{name: "wrong type", claim: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := claims{Extra: map[string]any{}}
+			if tt.claim != nil {
+				c.Extra["roles"] = tt.claim
+			}
+			if got := c.roles("roles"); !slices.Equal(got, tt.want) {
+				t.Errorf("roles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// tokenReload is the interval between checks of a token file, tokens
+// such as JWTs are refreshed often
+const tokenReload = 10 * time.Second
+
+// TokenFile sends the API key or JWT in the file at path as a bearer token with
+// every call, the file is read again once it changes. The connection must use TLS.
+func TokenFile(path string) (grpc.DialOption, error) {
+	w, err := watch(path, tokenReload, func(b []byte) (string, error) {
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return "", fmt.Errorf("token file %s is empty", path)
+		}
+		return token, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithPerRPCCredentials(bearer{w}), nil
+}
+
+// bearer sends a bearer token with the calls
+type bearer struct {
+	token *watched[string]
+}
+
+func (b bearer) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + b.token.get()}, nil
+}
+
+// RequireTransportSecurity keeps the token off plain text connections, gRPC
+// refuses to create a client sending it without TLS
+func (b bearer) RequireTransportSecurity() bool {
+	return true
+}
+
+// watched is the content of a file, parsed, the file is parsed again once it
+// changed, checking at most every interval
+type watched[T any] struct {
+	path     string
+	interval time.Duration
+	parse    func([]byte) (T, error)
+
+	mu      sync.Mutex
+	checked time.Time
+	info    os.FileInfo
+	value   T
+}
+
+// watch reads and parses the file at path
+func watch[T any](path string, interval time.Duration, parse func([]byte) (T, error)) (*watched[T], error) {
+	w := &watched[T]{path: path, interval: interval, parse: parse}
+	if err := w.read(); err != nil {
+		return nil, err
+	}
+	w.checked = time.Now()
+	return w, nil
+}
+
+func (w *watched[T]) read() error {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", w.path, err)
+	}
+	b, err := os.ReadFile(w.path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", w.path, err)
+	}
+	v, err := w.parse(b)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", w.path, err)
+	}
+	w.info, w.value = info, v
+	return nil
+}
+
+// get returns the content of the file, the last one that could be parsed
+func (w *watched[T]) get() T {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if time.Since(w.checked) >= w.interval {
+		w.checked = time.Now()
+		info, err := os.Stat(w.path)
+		if err != nil || !info.ModTime().Equal(w.info.ModTime()) || info.Size() != w.info.Size() {
+			if err := w.read(); err != nil {
+				slog.Warn("Error reloading file, keeping the current content", "path", w.path, "error", err)
+			} else {
+				slog.Info("Reloaded file", "path", w.path)
+			}
+		}
+	}
+	return w.value
+}
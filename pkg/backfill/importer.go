@@ -0,0 +1,217 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"time"
+
+	api "github.com/etesami/air-quality-monitoring/api"
+	dpapi "github.com/etesami/air-quality-monitoring/api/data-processing"
+	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+)
+
+// Stats summarizes an import run
+type Stats struct {
+	Read    int
+	Skipped int
+	Invalid int
+	Sent    int
+}
+
+// Importer sends records straight to the central storage service, duplicates are
+// dropped there on the (station, timestamp) hash. The local storage service is no
+// target: it only forwards the records observed since its last batch, history
+// sent to it would never reach the central storage.
+type Importer struct {
+	Client     pb.AirQualityMonitoringClient
+	BatchSize  int
+	Timeout    time.Duration
+	Checkpoint *Checkpoint
+}
+
+// Run reads all records from r and sends them in batches to the central storage service.
+// Records already covered by the checkpoint are skipped and the checkpoint is
+// advanced after every acknowledged batch, so an interrupted run can be resumed.
+// The central storage service acknowledges a batch once it is stored.
+func (im *Importer) Run(ctx context.Context, r Reader) (Stats, error) {
+	stats := Stats{}
+	if im.BatchSize <= 0 {
+		im.BatchSize = 1
+	}
+	done := 0
+	if im.Checkpoint != nil {
+		done = im.Checkpoint.Records
+		if done > 0 {
+			slog.Info("Resuming after the checkpoint", "records", done)
+		}
+	}
+
+	st := time.Now()
+	batch := make([]api.Msg, 0, im.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := im.send(ctx, batch); err != nil {
+			return err
+		}
+		stats.Sent += len(batch)
+		batch = batch[:0]
+		if im.Checkpoint != nil {
+			if err := im.Checkpoint.Save(stats.Read); err != nil {
+				return fmt.Errorf("error saving checkpoint: %v", err)
+			}
+		}
+		slog.Info("Sent records", "sent", stats.Sent, "read", stats.Read, "invalid", stats.Invalid,
+			"records_per_s", math.Round(float64(stats.Sent)/time.Since(st).Seconds()*10)/10)
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		msg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("error reading record [%d]: %v", stats.Read+1, err)
+		}
+		stats.Read++
+		if stats.Read <= done {
+			stats.Skipped++
+			continue
+		}
+		if err := validateMsg(msg); err != nil {
+			slog.Warn("Skipping invalid record", "record", stats.Read, "error", err)
+			stats.Invalid++
+			continue
+		}
+		batch = append(batch, *msg)
+		if len(batch) >= im.BatchSize {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return stats, err
+	}
+	// Records at the end of the input may all be invalid, the checkpoint still covers them
+	if im.Checkpoint != nil && stats.Read > im.Checkpoint.Records {
+		if err := im.Checkpoint.Save(stats.Read); err != nil {
+			return stats, fmt.Errorf("error saving checkpoint: %v", err)
+		}
+	}
+	return stats, nil
+}
+
+// validateMsg makes sure a record carries what the downstream services rely on
+// and normalizes its measurements
+func validateMsg(msg *api.Msg) error {
+	if msg.Idx == 0 {
+		return fmt.Errorf("station index is missing")
+	}
+	if len(msg.City.Geo) != 2 {
+		return fmt.Errorf("station coordinates are missing")
+	}
+	if _, err := time.Parse(time.RFC3339, msg.Time.ISO); err != nil {
+		return fmt.Errorf("error parsing timestamp: %v", err)
+	}
+	// Measurements are stored in the canonical unit of their kind
+	if err := msg.IAQI.Normalize(); err != nil {
+		return fmt.Errorf("invalid units: %v", err)
+	}
+	return nil
+}
+
+func (im *Importer) send(ctx context.Context, batch []api.Msg) error {
+	data := make([]dpapi.EnhancedDataResponse, 0, len(batch))
+	for _, msg := range batch {
+		data = append(data, toEnhancedData(msg))
+	}
+	byteData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal data: %v", err)
+	}
+
+	timeout := im.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ack, err := im.Client.SendDataToServer(ctx, &pb.Data{
+		Payload:       string(byteData),
+		SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
+	})
+	if err != nil {
+		return fmt.Errorf("send data not successful: %v", err)
+	}
+	if ack.Status != "ok" {
+		return fmt.Errorf("ack status not expected: %s", ack.Status)
+	}
+	return nil
+}
+
+// toEnhancedData maps a message to the record format of the central storage
+func toEnhancedData(msg api.Msg) dpapi.EnhancedDataResponse {
+	return dpapi.EnhancedDataResponse{
+		City: dpapi.City{
+			Idx:      int64(msg.Idx),
+			CityName: msg.City.Name,
+			Lat:      msg.City.Geo[0],
+			Lng:      msg.City.Geo[1],
+		},
+		AirQualityData: dpapi.NewAirQualityData(msg),
+	}
+}
+
+// Checkpoint records how many input records have been imported
+type Checkpoint struct {
+	path    string
+	Input   string    `json:"input"`
+	Records int       `json:"records"`
+	Updated time.Time `json:"updated"`
+}
+
+// LoadCheckpoint reads the checkpoint at path, a missing file starts a new checkpoint
+func LoadCheckpoint(path, input string) (*Checkpoint, error) {
+	c := &Checkpoint{path: path, Input: input}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("error unmarshalling checkpoint: %v", err)
+	}
+	if c.Input != input {
+		return nil, fmt.Errorf("checkpoint [%s] belongs to input [%s]", path, c.Input)
+	}
+	return c, nil
+}
+
+// Save atomically replaces the checkpoint file
+func (c *Checkpoint) Save(records int) error {
+	c.Records = records
+	c.Updated = time.Now()
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,240 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/etesami/air-quality-monitoring/api"
+	dpapi "github.com/etesami/air-quality-monitoring/api/data-processing"
+	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+
+	"google.golang.org/grpc"
+)
+
+// storage is a central storage service recording the batches it is sent
+type storage struct {
+	pb.AirQualityMonitoringClient
+	batches [][]dpapi.EnhancedDataResponse
+	// failAt fails the call of the batch with this number, from 1
+	failAt int
+	status string
+}
+
+func (s *storage) SendDataToServer(ctx context.Context, in *pb.Data, opts ...grpc.CallOption) (*pb.Ack, error) {
+	if len(s.batches)+1 == s.failAt {
+		return nil, fmt.Errorf("unavailable")
+	}
+	var batch []dpapi.EnhancedDataResponse
+	if err := json.Unmarshal([]byte(in.Payload), &batch); err != nil {
+		return nil, err
+	}
+	s.batches = append(s.batches, batch)
+	status := s.status
+	if status == "" {
+		status = "ok"
+	}
+	return &pb.Ack{Status: status}, nil
+}
+
+// sizes returns the number of records of each batch
+func (s *storage) sizes() []int {
+	var sizes []int
+	for _, b := range s.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+// sliceReader returns its messages, then io.EOF
+type sliceReader []api.Msg
+
+func (r *sliceReader) Next() (*api.Msg, error) {
+	if len(*r) == 0 {
+		return nil, io.EOF
+	}
+	msg := (*r)[0]
+	*r = (*r)[1:]
+	return &msg, nil
+}
+
+// testMsg returns a valid message of station idx, observed hours after midnight
+func testMsg(idx, hours int) api.Msg {
+	t := time.Date(2024, 1, 1, hours, 0, 0, 0, time.UTC)
+	msg := api.Msg{
+		Idx:  idx,
+		Aqi:  42,
+		City: api.City{Name: "Seattle", Geo: []float64{47.6, -122.3}},
+		Time: api.Time{ISO: t.Format(time.RFC3339), V: t.Unix()},
+	}
+	setMeasurement(&msg.IAQI, "pm25", 42, "")
+	return msg
+}
+
+func TestImporterRun(t *testing.T) {
+	noGeo := testMsg(2, 0)
+	noGeo.City.Geo = nil
+	badTime := testMsg(3, 0)
+	badTime.Time.ISO = "yesterday"
+	badUnit := testMsg(4, 0)
+	badUnit.IAQI.T = api.Measurement{V: 1, Unit: "furlongs", Reported: true}
+
+	tests := []struct {
+		name      string
+		msgs      []api.Msg
+		batchSize int
+		resume    int
+		failAt    int
+		status    string
+		wantStats Stats
+		wantSizes []int
+		wantSaved int
+		wantErr   string
+	}{
+		{name: "batches", msgs: []api.Msg{testMsg(1, 0), testMsg(1, 1), testMsg(1, 2), testMsg(1, 3), testMsg(1, 4)}, batchSize: 2,
+			wantStats: Stats{Read: 5, Sent: 5}, wantSizes: []int{2, 2, 1}, wantSaved: 5},
+		{name: "no batch size", msgs: []api.Msg{testMsg(1, 0), testMsg(1, 1)},
+			wantStats: Stats{Read: 2, Sent: 2}, wantSizes: []int{1, 1}, wantSaved: 2},
+		{name: "invalid records skipped", msgs: []api.Msg{testMsg(0, 0), noGeo, badTime, badUnit, testMsg(1, 0)}, batchSize: 10,
+			wantStats: Stats{Read: 5, Invalid: 4, Sent: 1}, wantSizes: []int{1}, wantSaved: 5},
+		{name: "only invalid records at the end", msgs: []api.Msg{testMsg(1, 0), testMsg(0, 0)}, batchSize: 1,
+			wantStats: Stats{Read: 2, Invalid: 1, Sent: 1}, wantSizes: []int{1}, wantSaved: 2},
+		{name: "resumed", msgs: []api.Msg{testMsg(1, 0), testMsg(1, 1), testMsg(1, 2), testMsg(1, 3)}, batchSize: 2, resume: 3,
+			wantStats: Stats{Read: 4, Skipped: 3, Sent: 1}, wantSizes: []int{1}, wantSaved: 4},
+		{name: "failed batch keeps the checkpoint", msgs: []api.Msg{testMsg(1, 0), testMsg(1, 1), testMsg(1, 2), testMsg(1, 3)}, batchSize: 2, failAt: 2,
+			wantStats: Stats{Read: 4, Sent: 2}, wantSizes: []int{2}, wantSaved: 2, wantErr: "send data not successful"},
+		{name: "unexpected ack", msgs: []api.Msg{testMsg(1, 0)}, batchSize: 1, status: "busy",
+			wantStats: Stats{Read: 1}, wantSizes: []int{1}, wantErr: "ack status not expected: busy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cp, err := LoadCheckpoint(filepath.Join(dir, "checkpoint"), "input.json")
+			if err != nil {
+				t.Fatalf("LoadCheckpoint(): %v", err)
+			}
+			if tt.resume > 0 {
+				if err := cp.Save(tt.resume); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := &storage{failAt: tt.failAt, status: tt.status}
+			im := &Importer{Client: s, BatchSize: tt.batchSize, Checkpoint: cp}
+			r := sliceReader(tt.msgs)
+
+			stats, err := im.Run(context.Background(), &r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Run() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Run(): %v", err)
+			}
+			if stats != tt.wantStats {
+				t.Errorf("Run() = %+v, want %+v", stats, tt.wantStats)
+			}
+			if !slices.Equal(s.sizes(), tt.wantSizes) {
+				t.Errorf("batches = %v, want %v", s.sizes(), tt.wantSizes)
+			}
+			saved, err := LoadCheckpoint(filepath.Join(dir, "checkpoint"), "input.json")
+			if err != nil {
+				t.Fatalf("LoadCheckpoint(): %v", err)
+			}
+			if saved.Records != tt.wantSaved {
+				t.Errorf("checkpoint = %d records, want %d", saved.Records, tt.wantSaved)
+			}
+		})
+	}
+}
+
+func TestImporterPayload(t *testing.T) {
+	s := &storage{}
+	im := &Importer{Client: s, BatchSize: 10}
+	msg := testMsg(1234, 6)
+	msg.IAQI.T = api.Measurement{V: 50, Unit: "°F", Reported: true}
+	r := sliceReader{msg}
+	if _, err := im.Run(context.Background(), &r); err != nil {
+		t.Fatalf("Run(): %v", err)
+	}
+	if len(s.batches) != 1 || len(s.batches[0]) != 1 {
+		t.Fatalf("batches = %v", s.sizes())
+	}
+	got := s.batches[0][0]
+	if got.City != (dpapi.City{Idx: 1234, CityName: "Seattle", Lat: 47.6, Lng: -122.3}) {
+		t.Errorf("city = %+v", got.City)
+	}
+	if got.AirQualityData.Timestamp != msg.Time.ISO || got.AirQualityData.Aqi != 42 {
+		t.Errorf("air quality data = %+v", got.AirQualityData)
+	}
+	// Temperatures are stored in °C
+	if got.AirQualityData.Temperature != 10 {
+		t.Errorf("temperature = %v, want 10", got.AirQualityData.Temperature)
+	}
+}
+
+func TestImporterCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := sliceReader{testMsg(1, 0)}
+	_, err := (&Importer{Client: &storage{}}).Run(ctx, &r)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want context.Canceled", err)
+	}
+}
+
+func TestLoadCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint")
+	cp, err := LoadCheckpoint(path, "a.csv")
+	if err != nil || cp.Records != 0 {
+		t.Fatalf("LoadCheckpoint() of a missing file = %+v, %v", cp, err)
+	}
+	if err := cp.Save(7); err != nil {
+		t.Fatalf("Save(): %v", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary checkpoint left behind: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		content string
+		want    int
+		wantErr string
+	}{
+		{name: "same input", input: "a.csv", want: 7},
+		{name: "other input", input: "b.csv", wantErr: "belongs to input [a.csv]"},
+		{name: "corrupt", input: "a.csv", content: "{", wantErr: "error unmarshalling checkpoint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cp, err := LoadCheckpoint(path, tt.input)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadCheckpoint() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadCheckpoint(): %v", err)
+			}
+			if cp.Records != tt.want {
+				t.Errorf("Records = %d, want %d", cp.Records, tt.want)
+			}
+		})
+	}
+}
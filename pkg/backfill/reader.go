@@ -0,0 +1,419 @@
+package backfill
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/etesami/air-quality-monitoring/api"
+	units "github.com/etesami/air-quality-monitoring/pkg/units"
+)
+
+type Format string
+
+const (
+	// FormatJSON reads WAQI feed payloads: a JSON array, a single document or
+	// newline-delimited documents, each either a message, a feed response ({"data": ...})
+	// or an AirQualityData object ({"obs": [...]})
+	FormatJSON Format = "json"
+	// FormatWAQICSV reads the WAQI historical data platform CSV of a single station
+	// (date, pm25, pm10, o3, no2, so2, co, ...), values are sub-indices
+	FormatWAQICSV Format = "waqi-csv"
+	// FormatOpenAQCSV reads OpenAQ measurement exports in long format
+	// (location_id, location, datetime, lat, lon, parameter, units, value),
+	// the records of a location must follow each other
+	FormatOpenAQCSV Format = "openaq-csv"
+)
+
+// OpenAQIdxOffset is added to the OpenAQ location IDs to number their stations, the
+// WAQI station indices share the same column and must stay below it
+const OpenAQIdxOffset = 1_000_000_000
+
+// checkWAQIIdx rejects the WAQI station indices colliding with the OpenAQ locations
+func checkWAQIIdx(idx int) error {
+	if idx >= OpenAQIdxOffset {
+		return fmt.Errorf("station index [%d] is in the range of the OpenAQ locations", idx)
+	}
+	return nil
+}
+
+// Reader returns historical messages one at a time, io.EOF marks the end of the input
+type Reader interface {
+	Next() (*api.Msg, error)
+}
+
+// Station describes the station of an input that does not carry it itself
+type Station struct {
+	Idx  int
+	Name string
+	Lat  float64
+	Lng  float64
+}
+
+// NewReader returns a reader for the given format, station is only used by the WAQI CSV format
+func NewReader(r io.Reader, format Format, station *Station) (Reader, error) {
+	switch format {
+	case FormatJSON:
+		return newJSONReader(r), nil
+	case FormatWAQICSV:
+		if station == nil || station.Idx == 0 {
+			return nil, fmt.Errorf("station index is required for format [%s]", format)
+		}
+		if err := checkWAQIIdx(station.Idx); err != nil {
+			return nil, err
+		}
+		return newWAQICSVReader(r, *station)
+	case FormatOpenAQCSV:
+		return newOpenAQCSVReader(r)
+	}
+	return nil, fmt.Errorf("unsupported input format: [%s]", format)
+}
+
+type jsonReader struct {
+	br      *bufio.Reader
+	dec     *json.Decoder
+	pending []api.Msg
+}
+
+func newJSONReader(r io.Reader) *jsonReader {
+	return &jsonReader{br: bufio.NewReader(r)}
+}
+
+func (j *jsonReader) Next() (*api.Msg, error) {
+	for len(j.pending) == 0 {
+		if j.dec == nil {
+			if err := j.start(); err != nil {
+				return nil, err
+			}
+		}
+		if !j.dec.More() {
+			return nil, io.EOF
+		}
+		var raw json.RawMessage
+		if err := j.dec.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("error decoding JSON: %v", err)
+		}
+		msgs, err := decodeMessages(raw)
+		if err != nil {
+			return nil, err
+		}
+		j.pending = msgs
+	}
+	msg := j.pending[0]
+	j.pending = j.pending[1:]
+	if err := checkWAQIIdx(msg.Idx); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// start checks whether the documents are wrapped in a top-level array
+func (j *jsonReader) start() error {
+	for {
+		b, err := j.br.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			j.br.ReadByte()
+			continue
+		}
+		j.dec = json.NewDecoder(j.br)
+		if b[0] == '[' {
+			if _, err := j.dec.Token(); err != nil {
+				return fmt.Errorf("error decoding JSON: %v", err)
+			}
+		}
+		return nil
+	}
+}
+
+// decodeMessages unwraps a single JSON document into its messages
+func decodeMessages(raw json.RawMessage) ([]api.Msg, error) {
+	var envelope struct {
+		Data *api.Msg          `json:"data"`
+		Obs  []api.Observation `json:"obs"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil, fmt.Errorf("error unmarshalling JSON: %v", err)
+	}
+	if envelope.Data != nil {
+		return []api.Msg{*envelope.Data}, nil
+	}
+	if envelope.Obs != nil {
+		msgs := make([]api.Msg, 0, len(envelope.Obs))
+		for _, obs := range envelope.Obs {
+			msgs = append(msgs, obs.Msg)
+		}
+		return msgs, nil
+	}
+	var msg api.Msg
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, fmt.Errorf("error unmarshalling JSON: %v", err)
+	}
+	return []api.Msg{msg}, nil
+}
+
+type waqiCSVReader struct {
+	r       *csv.Reader
+	station Station
+	columns map[string]int
+}
+
+func newWAQICSVReader(r io.Reader, station Station) (*waqiCSVReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %v", err)
+	}
+	return &waqiCSVReader{r: cr, station: station, columns: columnIndex(header)}, nil
+}
+
+func (w *waqiCSVReader) Next() (*api.Msg, error) {
+	record, err := w.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	date := field(record, w.columns, "date")
+	t, err := parseTime(date)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing date '%s': %v", date, err)
+	}
+
+	msg := &api.Msg{
+		Idx: w.station.Idx,
+		City: api.City{
+			Name: w.station.Name,
+			Geo:  []float64{w.station.Lat, w.station.Lng},
+		},
+		Time: api.Time{ISO: t.Format(time.RFC3339), V: t.Unix()},
+	}
+	// The overall index is the highest of the pollutant sub-indices
+	aqi := 0.0
+	for _, pol := range []string{"pm25", "pm10", "o3", "no2", "so2", "co"} {
+		v, ok := floatField(record, w.columns, pol)
+		if !ok {
+			continue
+		}
+		setMeasurement(&msg.IAQI, pol, v, units.Index)
+		if v > aqi {
+			aqi = v
+			msg.DominentPol = pol
+		}
+	}
+	msg.Aqi = int(math.Round(aqi))
+	setWeather(msg, record, w.columns)
+	return msg, nil
+}
+
+type openAQCSVReader struct {
+	r       *csv.Reader
+	columns map[string]int
+	// next is the first record of the next location, read while grouping the current one
+	next []string
+	// done are the locations already grouped
+	done map[int]bool
+	msgs []api.Msg
+}
+
+// newOpenAQCSVReader reads the input one location at a time, only the records of
+// a single location are held at once
+func newOpenAQCSVReader(r io.Reader) (*openAQCSVReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %v", err)
+	}
+	return &openAQCSVReader{r: cr, columns: columnIndex(header), done: make(map[int]bool)}, nil
+}
+
+func (o *openAQCSVReader) Next() (*api.Msg, error) {
+	for len(o.msgs) == 0 {
+		if err := o.readLocation(); err != nil {
+			return nil, err
+		}
+	}
+	msg := o.msgs[0]
+	o.msgs = o.msgs[1:]
+	return &msg, nil
+}
+
+// readLocation groups the measurements of the next location taken at the same time
+// into a single message, the messages are sorted by time. It returns io.EOF once
+// every location was read.
+func (o *openAQCSVReader) readLocation() error {
+	location := 0
+	index := make(map[int64]int)
+	for {
+		record := o.next
+		o.next = nil
+		if record == nil {
+			var err error
+			record, err = o.r.Read()
+			if err == io.EOF && location != 0 {
+				break
+			}
+			if err == io.EOF {
+				return io.EOF
+			}
+			if err != nil {
+				return fmt.Errorf("error reading CSV: %v", err)
+			}
+		}
+		locationId, err := strconv.Atoi(field(record, o.columns, "location_id"))
+		if err != nil {
+			return fmt.Errorf("error parsing location_id: %v", err)
+		}
+		if locationId <= 0 || locationId >= OpenAQIdxOffset {
+			return fmt.Errorf("location_id [%d] is out of range", locationId)
+		}
+		if location == 0 {
+			if o.done[locationId] {
+				return fmt.Errorf("location [%d] appears again after other locations, sort the input by location_id", locationId)
+			}
+			location = locationId
+		} else if locationId != location {
+			o.next = record
+			break
+		}
+		date := field(record, o.columns, "datetime")
+		t, err := parseTime(date)
+		if err != nil {
+			return fmt.Errorf("error parsing datetime '%s': %v", date, err)
+		}
+		value, ok := floatField(record, o.columns, "value")
+		if !ok {
+			continue
+		}
+
+		i, ok := index[t.Unix()]
+		if !ok {
+			lat, _ := floatField(record, o.columns, "lat")
+			lng, _ := floatField(record, o.columns, "lon")
+			o.msgs = append(o.msgs, api.Msg{
+				Idx: OpenAQIdxOffset + locationId,
+				City: api.City{
+					Name: field(record, o.columns, "location"),
+					Geo:  []float64{lat, lng},
+				},
+				Time: api.Time{ISO: t.Format(time.RFC3339), V: t.Unix()},
+			})
+			i = len(o.msgs) - 1
+			index[t.Unix()] = i
+		}
+		parameter := field(record, o.columns, "parameter")
+		p, ok := openAQParameters[parameter]
+		if !ok {
+			continue
+		}
+		unit := p.unit
+		if u := field(record, o.columns, "units"); u != "" {
+			if unit, err = units.Parse(u); err != nil {
+				slog.Warn("Skipping measurement of unknown unit", "parameter", parameter, "location", locationId, "date", date, "error", err)
+				continue
+			}
+		}
+		setMeasurement(&o.msgs[i].IAQI, p.key, value, unit)
+	}
+	o.done[location] = true
+	sort.SliceStable(o.msgs, func(i, j int) bool { return o.msgs[i].Time.V < o.msgs[j].Time.V })
+	return nil
+}
+
+// openAQParameter is the IAQI key of an OpenAQ parameter and its unit when the export has none
+type openAQParameter struct {
+	key  string
+	unit units.Unit
+}
+
+var openAQParameters = map[string]openAQParameter{
+	"pm25":             {"pm25", units.MicrogramsPerCubicMeter},
+	"pm10":             {"pm10", units.MicrogramsPerCubicMeter},
+	"o3":               {"o3", units.PartsPerMillion},
+	"no2":              {"no2", units.PartsPerMillion},
+	"so2":              {"so2", units.PartsPerMillion},
+	"co":               {"co", units.PartsPerMillion},
+	"temperature":      {"t", units.Celsius},
+	"relativehumidity": {"h", units.Percent},
+	"pressure":         {"p", units.Hectopascal},
+	"wind_speed":       {"w", units.MetersPerSecond},
+}
+
+// setMeasurement sets the measurement of iaqi with the given key
+func setMeasurement(iaqi *api.IAQI, key string, v float64, u units.Unit) {
+	for _, f := range iaqi.Fields() {
+		if f.Key == key {
+			*f.Measurement = api.Measurement{V: v, Unit: u, Reported: true}
+			return
+		}
+	}
+}
+
+// setWeather copies the optional weather columns of a WAQI CSV record
+func setWeather(msg *api.Msg, record []string, columns map[string]int) {
+	if v, ok := floatField(record, columns, "temperature"); ok {
+		setMeasurement(&msg.IAQI, "t", v, "")
+	}
+	if v, ok := floatField(record, columns, "humidity"); ok {
+		setMeasurement(&msg.IAQI, "h", v, "")
+	}
+	if v, ok := floatField(record, columns, "pressure"); ok {
+		setMeasurement(&msg.IAQI, "p", v, "")
+	}
+	if v, ok := floatField(record, columns, "wind-speed"); ok {
+		setMeasurement(&msg.IAQI, "w", v, "")
+	}
+	if v, ok := floatField(record, columns, "wind-gust"); ok {
+		setMeasurement(&msg.IAQI, "wg", v, "")
+	}
+}
+
+func columnIndex(header []string) map[string]int {
+	columns := make(map[string]int)
+	for i, h := range header {
+		columns[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	return columns
+}
+
+func field(record []string, columns map[string]int, name string) string {
+	i, ok := columns[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+func floatField(record []string, columns map[string]int, name string) (float64, bool) {
+	v := field(record, columns, name)
+	if v == "" {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
+
+// parseTime accepts RFC3339 timestamps and plain dates, plain dates are taken as UTC
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02", "2006/1/2"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unsupported time format")
+}
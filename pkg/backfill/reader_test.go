@@ -0,0 +1,262 @@
+package backfill
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	api "github.com/etesami/air-quality-monitoring/api"
+	units "github.com/etesami/air-quality-monitoring/pkg/units"
+)
+
+// readAll reads the messages of r until io.EOF or the first error
+func readAll(r Reader) ([]api.Msg, error) {
+	var msgs []api.Msg
+	for {
+		msg, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return msgs, nil
+		}
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, *msg)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		station *Station
+		wantErr string
+	}{
+		{name: "json", format: FormatJSON},
+		{name: "waqi-csv", format: FormatWAQICSV, station: &Station{Idx: 1234}},
+		{name: "openaq-csv", format: FormatOpenAQCSV},
+		{name: "waqi-csv without station", format: FormatWAQICSV, wantErr: "station index is required"},
+		{name: "waqi-csv without station index", format: FormatWAQICSV, station: &Station{Name: "Seattle"}, wantErr: "station index is required"},
+		{name: "waqi-csv in the OpenAQ range", format: FormatWAQICSV, station: &Station{Idx: OpenAQIdxOffset + 1}, wantErr: "range of the OpenAQ locations"},
+		{name: "unknown format", format: "xml", wantErr: "unsupported input format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReader(strings.NewReader("date\n"), tt.format, tt.station)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("NewReader(): %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("NewReader() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantIdx  []int
+		wantPM25 []float64
+		wantErr  string
+	}{
+		{name: "array of messages", input: `[{"idx": 1, "iaqi": {"pm25": {"v": 12}}}, {"idx": 2, "iaqi": {"pm25": {"v": 0}}}]`,
+			wantIdx: []int{1, 2}, wantPM25: []float64{12, 0}},
+		{name: "feed responses", input: `{"status": "ok", "data": {"idx": 3, "iaqi": {"pm25": {"v": 40}}}}
+			{"status": "ok", "data": {"idx": 4}}`, wantIdx: []int{3, 4}, wantPM25: []float64{40, 0}},
+		{name: "observations", input: `{"status": "ok", "obs": [{"msg": {"idx": 5}}, {"msg": {"idx": 6}}]}`,
+			wantIdx: []int{5, 6}, wantPM25: []float64{0, 0}},
+		{name: "newline delimited", input: "\n  {\"idx\": 7}\n{\"idx\": 8}\n", wantIdx: []int{7, 8}, wantPM25: []float64{0, 0}},
+		{name: "empty array", input: `[]`},
+		{name: "empty input", input: ``},
+		{name: "malformed", input: `[{"idx": 1}, {"idx": }]`, wantIdx: []int{1}, wantErr: "error decoding JSON"},
+		{name: "wrong type", input: `{"idx": "one"}`, wantErr: "error unmarshalling JSON"},
+		{name: "index in the OpenAQ range", input: `{"idx": 1000000001}`, wantErr: "range of the OpenAQ locations"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := readAll(newJSONReader(strings.NewReader(tt.input)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Next() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Next(): %v", err)
+			}
+			if len(msgs) != len(tt.wantIdx) {
+				t.Fatalf("read %d messages, want %d", len(msgs), len(tt.wantIdx))
+			}
+			for i, msg := range msgs {
+				if msg.Idx != tt.wantIdx[i] {
+					t.Errorf("message %d has idx %d, want %d", i, msg.Idx, tt.wantIdx[i])
+				}
+				if i < len(tt.wantPM25) && msg.IAQI.PM25.V != tt.wantPM25[i] {
+					t.Errorf("message %d has pm25 %v, want %v", i, msg.IAQI.PM25.V, tt.wantPM25[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWAQICSVReader(t *testing.T) {
+	station := Station{Idx: 1234, Name: "Seattle", Lat: 47.6, Lng: -122.3}
+	input := `date, pm25, pm10, o3, temperature, humidity, wind-speed
+2024-01-02, 55, 20, 31, -3.5, 80, 2
+2024/1/1, , 12, , , ,
+2024-01-03T10:00:00Z, 0, , , , ,
+`
+	r, err := newWAQICSVReader(strings.NewReader(input), station)
+	if err != nil {
+		t.Fatalf("newWAQICSVReader(): %v", err)
+	}
+	msgs, err := readAll(r)
+	if err != nil {
+		t.Fatalf("Next(): %v", err)
+	}
+
+	tests := []struct {
+		iso      string
+		aqi      int
+		dominant string
+		pm25     api.Measurement
+		pm10     api.Measurement
+		t        api.Measurement
+	}{
+		{iso: "2024-01-02T00:00:00Z", aqi: 55, dominant: "pm25",
+			pm25: api.Measurement{V: 55, Unit: units.Index, Reported: true},
+			pm10: api.Measurement{V: 20, Unit: units.Index, Reported: true},
+			t:    api.Measurement{V: -3.5, Reported: true}},
+		{iso: "2024-01-01T00:00:00Z", aqi: 12, dominant: "pm10",
+			pm10: api.Measurement{V: 12, Unit: units.Index, Reported: true}},
+		{iso: "2024-01-03T10:00:00Z", aqi: 0,
+			pm25: api.Measurement{V: 0, Unit: units.Index, Reported: true}},
+	}
+	if len(msgs) != len(tests) {
+		t.Fatalf("read %d messages, want %d", len(msgs), len(tests))
+	}
+	for i, tt := range tests {
+		t.Run(tt.iso, func(t *testing.T) {
+			msg := msgs[i]
+			if msg.Idx != station.Idx || msg.City.Name != station.Name || len(msg.City.Geo) != 2 || msg.City.Geo[0] != station.Lat {
+				t.Errorf("station = %d %s %v", msg.Idx, msg.City.Name, msg.City.Geo)
+			}
+			if msg.Time.ISO != tt.iso {
+				t.Errorf("time = %s, want %s", msg.Time.ISO, tt.iso)
+			}
+			if msg.Aqi != tt.aqi || msg.DominentPol != tt.dominant {
+				t.Errorf("aqi = %d %q, want %d %q", msg.Aqi, msg.DominentPol, tt.aqi, tt.dominant)
+			}
+			if msg.IAQI.PM25 != tt.pm25 || msg.IAQI.PM10 != tt.pm10 || msg.IAQI.T != tt.t {
+				t.Errorf("iaqi = %+v", msg.IAQI)
+			}
+			if msg.IAQI.O3.Reported != (i == 0) || msg.IAQI.H.Reported != (i == 0) || msg.IAQI.W.Reported != (i == 0) {
+				t.Errorf("o3, h or w reported = %+v", msg.IAQI)
+			}
+		})
+	}
+
+	t.Run("invalid date", func(t *testing.T) {
+		r, err := newWAQICSVReader(strings.NewReader("date, pm25\nyesterday, 10\n"), station)
+		if err != nil {
+			t.Fatalf("newWAQICSVReader(): %v", err)
+		}
+		if _, err := r.Next(); err == nil || !strings.Contains(err.Error(), "error parsing date") {
+			t.Errorf("Next() error = %v, want a date error", err)
+		}
+	})
+}
+
+func TestOpenAQCSVReader(t *testing.T) {
+	const header = "location_id,location,datetime,lat,lon,parameter,units,value\n"
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		check   func(t *testing.T, msgs []api.Msg)
+		wantErr string
+	}{
+		{name: "grouped by location and time, sorted by time", input: header +
+			"7,Downtown,2024-01-01T01:00:00Z,47.6,-122.3,pm25,µg/m³,12\n" +
+			"7,Downtown,2024-01-01T00:00:00Z,47.6,-122.3,pm25,ug/m3,8\n" +
+			"7,Downtown,2024-01-01T01:00:00Z,47.6,-122.3,o3,ppm,0.03\n" +
+			"9,Harbor,2024-01-01T00:00:00Z,47.5,-122.4,temperature,c,4\n",
+			want: []string{"1000000007 2024-01-01T00:00:00Z", "1000000007 2024-01-01T01:00:00Z", "1000000009 2024-01-01T00:00:00Z"},
+			check: func(t *testing.T, msgs []api.Msg) {
+				if got := msgs[1].IAQI.PM25; got != (api.Measurement{V: 12, Unit: units.MicrogramsPerCubicMeter, Reported: true}) {
+					t.Errorf("pm25 = %+v", got)
+				}
+				if got := msgs[1].IAQI.O3; got != (api.Measurement{V: 0.03, Unit: units.PartsPerMillion, Reported: true}) {
+					t.Errorf("o3 = %+v", got)
+				}
+				if msgs[0].IAQI.O3.Reported {
+					t.Errorf("o3 of the first hour reported: %+v", msgs[0].IAQI.O3)
+				}
+				if got := msgs[2].IAQI.T; got != (api.Measurement{V: 4, Unit: units.Celsius, Reported: true}) {
+					t.Errorf("t = %+v", got)
+				}
+				if msgs[2].City.Name != "Harbor" || msgs[2].City.Geo[0] != 47.5 || msgs[2].City.Geo[1] != -122.4 {
+					t.Errorf("city = %+v", msgs[2].City)
+				}
+			}},
+		{name: "default unit", input: header + "7,Downtown,2024-01-01,47.6,-122.3,no2,,0.02\n",
+			want: []string{"1000000007 2024-01-01T00:00:00Z"},
+			check: func(t *testing.T, msgs []api.Msg) {
+				if got := msgs[0].IAQI.NO2; got != (api.Measurement{V: 0.02, Unit: units.PartsPerMillion, Reported: true}) {
+					t.Errorf("no2 = %+v", got)
+				}
+			}},
+		{name: "unknown unit and parameter skipped", input: header +
+			"7,Downtown,2024-01-01,47.6,-122.3,pm25,grains,3\n" +
+			"7,Downtown,2024-01-01,47.6,-122.3,bc,µg/m³,1\n",
+			want: []string{"1000000007 2024-01-01T00:00:00Z"},
+			check: func(t *testing.T, msgs []api.Msg) {
+				for _, f := range msgs[0].IAQI.Fields() {
+					if !f.Missing() {
+						t.Errorf("%s reported: %+v", f.Key, *f.Measurement)
+					}
+				}
+			}},
+		{name: "missing value skipped", input: header + "7,Downtown,2024-01-01,47.6,-122.3,pm25,µg/m³,\n"},
+		{name: "location again after another", input: header +
+			"7,Downtown,2024-01-01,47.6,-122.3,pm25,µg/m³,1\n" +
+			"9,Harbor,2024-01-01,47.5,-122.4,pm25,µg/m³,2\n" +
+			"7,Downtown,2024-01-02,47.6,-122.3,pm25,µg/m³,3\n",
+			want:    []string{"1000000007 2024-01-01T00:00:00Z", "1000000009 2024-01-01T00:00:00Z"},
+			wantErr: "appears again after other locations"},
+		{name: "location out of range", input: header + "0,Nowhere,2024-01-01,0,0,pm25,µg/m³,1\n", wantErr: "out of range"},
+		{name: "location too large", input: header + "1000000000,Nowhere,2024-01-01,0,0,pm25,µg/m³,1\n", wantErr: "out of range"},
+		{name: "invalid location", input: header + "x,Nowhere,2024-01-01,0,0,pm25,µg/m³,1\n", wantErr: "error parsing location_id"},
+		{name: "invalid datetime", input: header + "7,Downtown,noon,0,0,pm25,µg/m³,1\n", wantErr: "error parsing datetime"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newOpenAQCSVReader(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("newOpenAQCSVReader(): %v", err)
+			}
+			msgs, err := readAll(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Next() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Next(): %v", err)
+			}
+			var got []string
+			for _, msg := range msgs {
+				got = append(got, strconv.Itoa(msg.Idx)+" "+msg.Time.ISO)
+			}
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Fatalf("messages = %v, want %v", got, tt.want)
+			}
+			if tt.check != nil {
+				tt.check(t, msgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,524 @@
+// Package config loads the typed configuration of a service from its defaults, a YAML or TOML
+// file, environment variables and command line flags, in increasing order of precedence.
+//
+// The fields of a configuration struct are described with tags:
+//
+//	config:"key"       key of the field in the file and name of its flag, nested keys are joined with "."
+//	env:"NAME"         environment variable, joined with "_" to the env tag of the enclosing struct
+//	default:"value"    value used when no source sets the field
+//	usage:"text"       help text of the flag
+//	required:"true"    the field, or every field of a struct, may not be left empty
+//	secret:"true"      the value is redacted when the configuration is printed
+//	unit:"s"           unit of bare numbers in the environment variable of a Duration, kept for
+//	                   deployments predating explicit units
+//
+// Supported field types are strings, booleans, integers, floats, Duration, slices of them
+// (comma-separated in env and flags), pointers to them (nil when unset), nested structs and,
+// in files only, slices of structs. Structs implementing Validator are validated after loading.
+package config
+
+import (
+	"encoding"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Validator is implemented by configuration structs checking their own values
+type Validator interface {
+	Validate() error
+}
+
+var textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+// leaf is a field of the configuration set from a single value
+type leaf struct {
+	path     string
+	env      string
+	field    reflect.StructField
+	value    reflect.Value
+	required bool
+}
+
+// Load fills cfg, a pointer to a struct, from its defaults, the config file, the environment
+// and the arguments parsed with fs. The flags of all fields are registered on fs, so callers
+// may add their own flags before calling Load.
+//
+// The file is given by the --config flag or the CONFIG_FILE environment variable, its format
+// follows the extension (.yaml, .yml or .toml). With --print-config the resulting configuration
+// is written to stdout and the process exits.
+func Load(cfg any, fs *flag.FlagSet, args []string) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to a struct, got %T", cfg)
+	}
+	v = v.Elem()
+	leaves := collectLeaves(v, "", "", false)
+
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file (env CONFIG_FILE)")
+	printConfig := fs.Bool("print-config", false, "print the resulting configuration and exit")
+
+	// Flags are applied last, after the file and the environment
+	type flagValue struct {
+		leaf  leaf
+		value string
+	}
+	flagValues := make([]flagValue, 0)
+	for _, l := range leaves {
+		if !settableFromString(l.value.Type()) {
+			continue
+		}
+		fs.Func(l.path, flagUsage(l), func(s string) error {
+			flagValues = append(flagValues, flagValue{leaf: l, value: s})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	for _, l := range leaves {
+		if def, ok := l.field.Tag.Lookup("default"); ok {
+			if err := setString(l.value, def); err != nil {
+				return fmt.Errorf("invalid default of %s: %v", l.path, err)
+			}
+		}
+	}
+
+	if *configFile != "" {
+		if err := loadFile(v, *configFile); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range leaves {
+		if l.env == "" {
+			continue
+		}
+		s, ok := os.LookupEnv(l.env)
+		if !ok {
+			continue
+		}
+		if unit := l.field.Tag.Get("unit"); unit != "" && l.value.Type() == reflect.TypeFor[Duration]() {
+			if _, err := strconv.ParseFloat(s, 64); err == nil {
+				slog.Warn("Duration has no unit, assuming the default one", "env", l.env, "value", s, "unit", unit, "hint", s+unit)
+				s += unit
+			}
+		}
+		if err := setString(l.value, s); err != nil {
+			return fmt.Errorf("invalid value of env %s: %v", l.env, err)
+		}
+	}
+
+	for _, f := range flagValues {
+		if err := setString(f.leaf.value, f.value); err != nil {
+			return fmt.Errorf("invalid value of flag -%s: %v", f.leaf.path, err)
+		}
+	}
+
+	err := validate(v, leaves)
+	if *printConfig {
+		if err := Print(os.Stdout, cfg); err != nil {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	return err
+}
+
+// collectLeaves returns the fields of v set from single values, descending into nested structs
+func collectLeaves(v reflect.Value, path, env string, required bool) []leaf {
+	leaves := make([]leaf, 0)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key := sf.Tag.Get("config")
+		if !sf.IsExported() || key == "-" {
+			continue
+		}
+		if key == "" {
+			key = sf.Name
+		}
+		fieldPath := joinNonEmpty(".", path, key)
+		fieldEnv := ""
+		if e := sf.Tag.Get("env"); e != "" {
+			fieldEnv = joinNonEmpty("_", env, e)
+		} else if sf.Type.Kind() == reflect.Struct {
+			fieldEnv = env
+		}
+		fieldRequired := required || sf.Tag.Get("required") == "true"
+
+		fv := v.Field(i)
+		if sf.Type.Kind() == reflect.Struct && !reflect.PointerTo(sf.Type).Implements(textUnmarshalerType) {
+			leaves = append(leaves, collectLeaves(fv, fieldPath, fieldEnv, fieldRequired)...)
+			continue
+		}
+		leaves = append(leaves, leaf{path: fieldPath, env: fieldEnv, field: sf, value: fv, required: fieldRequired})
+	}
+	return leaves
+}
+
+func joinNonEmpty(sep string, parts ...string) string {
+	nonEmpty := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return strings.Join(nonEmpty, sep)
+}
+
+func flagUsage(l leaf) string {
+	usage := l.field.Tag.Get("usage")
+	details := make([]string, 0)
+	if l.env != "" {
+		details = append(details, "env "+l.env)
+	}
+	if def, ok := l.field.Tag.Lookup("default"); ok {
+		details = append(details, fmt.Sprintf("default %q", def))
+	}
+	if len(details) > 0 {
+		usage += " (" + strings.Join(details, ", ") + ")"
+	}
+	return strings.TrimSpace(usage)
+}
+
+// settableFromString reports whether values of t can be read from env vars and flags
+func settableFromString(t reflect.Type) bool {
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	case reflect.Pointer:
+		return settableFromString(t.Elem())
+	case reflect.Slice:
+		return t.Elem().Kind() != reflect.Struct && settableFromString(t.Elem())
+	}
+	return false
+}
+
+// setString parses s into v, slices are comma-separated
+func setString(v reflect.Value, s string) error {
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	s = strings.TrimSpace(s)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Pointer:
+		if s == "" {
+			v.SetZero()
+			return nil
+		}
+		p := reflect.New(v.Type().Elem())
+		if err := setString(p.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Slice:
+		slice := reflect.MakeSlice(v.Type(), 0, 0)
+		if s != "" {
+			for _, part := range strings.Split(s, ",") {
+				elem := reflect.New(v.Type().Elem()).Elem()
+				if err := setString(elem, part); err != nil {
+					return err
+				}
+				slice = reflect.Append(slice, elem)
+			}
+		}
+		v.Set(slice)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// loadFile decodes a YAML or TOML file over the values of v
+func loadFile(v reflect.Value, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+	raw := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return fmt.Errorf("unknown config file format %q, expected .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	if err := setMap(v, raw, ""); err != nil {
+		return fmt.Errorf("error in config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// setMap sets the fields of the struct v from the keys of m, unknown keys are an error
+func setMap(v reflect.Value, m map[string]any, path string) error {
+	t := v.Type()
+	for key, raw := range m {
+		found := false
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			name := sf.Tag.Get("config")
+			if name == "" {
+				name = sf.Name
+			}
+			if !sf.IsExported() || name != key {
+				continue
+			}
+			if err := setAny(v.Field(i), raw, joinNonEmpty(".", path, key)); err != nil {
+				return err
+			}
+			found = true
+			break
+		}
+		if !found {
+			return fmt.Errorf("unknown key %q", joinNonEmpty(".", path, key))
+		}
+	}
+	return nil
+}
+
+// setAny sets v from a value decoded from a file
+func setAny(v reflect.Value, raw any, path string) error {
+	isText := v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType)
+	switch {
+	case v.Kind() == reflect.Struct && !isText:
+		m, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected a table of keys, got %T", path, raw)
+		}
+		return setMap(v, m, path)
+
+	case v.Kind() == reflect.Slice:
+		items, ok := raw.([]any)
+		if !ok {
+			// a single string may still hold a comma-separated list
+			if s, isString := raw.(string); isString && settableFromString(v.Type()) {
+				if err := setString(v, s); err != nil {
+					return fmt.Errorf("%s: %v", path, err)
+				}
+				return nil
+			}
+			return fmt.Errorf("%s: expected a list, got %T", path, raw)
+		}
+		slice := reflect.MakeSlice(v.Type(), 0, len(items))
+		for i, item := range items {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if elem.Kind() == reflect.Struct {
+				if err := applyDefaults(elem); err != nil {
+					return fmt.Errorf("%s[%d]: %v", path, i, err)
+				}
+			}
+			if err := setAny(elem, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+			slice = reflect.Append(slice, elem)
+		}
+		v.Set(slice)
+		return nil
+
+	case v.Kind() == reflect.Pointer && raw != nil && !isText:
+		p := reflect.New(v.Type().Elem())
+		if err := setAny(p.Elem(), raw, path); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	}
+
+	var s string
+	switch r := raw.(type) {
+	case string:
+		s = r
+	case nil:
+		v.SetZero()
+		return nil
+	case time.Time:
+		s = r.Format(time.RFC3339)
+	case bool, int, int64, uint64, float64:
+		s = fmt.Sprint(r)
+	default:
+		return fmt.Errorf("%s: unexpected value of type %T", path, raw)
+	}
+	if err := setString(v, s); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Defaults sets the fields of cfg, a pointer to a struct, to their defaults, for
+// the command line tools filling a configuration from flags of their own
+func Defaults(cfg any) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to a struct, got %T", cfg)
+	}
+	return applyDefaults(v.Elem())
+}
+
+// applyDefaults sets the fields of the struct v which have a default
+func applyDefaults(v reflect.Value) error {
+	for _, l := range collectLeaves(v, "", "", false) {
+		if def, ok := l.field.Tag.Lookup("default"); ok {
+			if err := setString(l.value, def); err != nil {
+				return fmt.Errorf("invalid default of %s: %v", l.path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the required fields and runs the Validators, innermost first
+func validate(v reflect.Value, leaves []leaf) error {
+	for _, l := range leaves {
+		if l.required && l.value.IsZero() {
+			if l.env != "" {
+				return fmt.Errorf("%s is required (env %s)", l.path, l.env)
+			}
+			return fmt.Errorf("%s is required", l.path)
+		}
+	}
+	return runValidators(v, "")
+}
+
+func runValidators(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if !sf.IsExported() {
+				continue
+			}
+			key := sf.Tag.Get("config")
+			if key == "" {
+				key = sf.Name
+			}
+			if err := runValidators(v.Field(i), joinNonEmpty(".", path, key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < v.Len(); i++ {
+				if err := runValidators(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		return nil
+	}
+	if validator, ok := v.Addr().Interface().(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			if path == "" {
+				return err
+			}
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// Print writes cfg as YAML, redacting the secrets
+func Print(w io.Writer, cfg any) error {
+	node, err := toNode(reflect.Indirect(reflect.ValueOf(cfg)), false)
+	if err != nil {
+		return err
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// toNode converts v to a YAML node keeping the order of the struct fields
+func toNode(v reflect.Value, secret bool) (*yaml.Node, error) {
+	if secret && !v.IsZero() {
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: "<redacted>"}, nil
+	}
+	isText := v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType)
+	if v.Kind() == reflect.Struct && !isText {
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			key := sf.Tag.Get("config")
+			if !sf.IsExported() || key == "-" {
+				continue
+			}
+			if key == "" {
+				key = sf.Name
+			}
+			value, err := toNode(v.Field(i), sf.Tag.Get("secret") == "true")
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+		}
+		return node, nil
+	}
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct {
+		node := &yaml.Node{Kind: yaml.SequenceNode}
+		for i := 0; i < v.Len(); i++ {
+			item, err := toNode(v.Index(i), false)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, item)
+		}
+		return node, nil
+	}
+	node := &yaml.Node{}
+	if err := node.Encode(v.Interface()); err != nil {
+		return nil, err
+	}
+	if node.Kind == yaml.SequenceNode {
+		node.Style = yaml.FlowStyle
+	}
+	return node, nil
+}
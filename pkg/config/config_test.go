@@ -0,0 +1,194 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDurationUnmarshalText(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "90s", want: 90 * time.Second},
+		{in: "15m", want: 15 * time.Minute},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "250ms", want: 250 * time.Millisecond},
+		{in: "0", want: 0},
+		{in: "30", wantErr: true},
+		{in: "1.5", wantErr: true},
+		{in: "-5", wantErr: true},
+		{in: "soon", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var d Duration
+			err := d.UnmarshalText([]byte(tt.in))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("UnmarshalText(%q) = %s, want an error", tt.in, d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UnmarshalText(%q): %v", tt.in, err)
+			}
+			if d.Duration() != tt.want {
+				t.Errorf("UnmarshalText(%q) = %s, want %s", tt.in, d, tt.want)
+			}
+		})
+	}
+}
+
+type unitConfig struct {
+	Interval Duration `config:"interval" env:"INTERVAL" default:"1m" unit:"s"`
+	Timeout  Duration `config:"timeout" env:"TIMEOUT" default:"5s"`
+}
+
+func TestLoadUnitTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    unitConfig
+		wantErr bool
+	}{
+		{name: "defaults", want: unitConfig{Interval: Duration(time.Minute), Timeout: Duration(5 * time.Second)}},
+		{name: "bare number takes the unit of the tag", env: map[string]string{"INTERVAL": "30"},
+			want: unitConfig{Interval: Duration(30 * time.Second), Timeout: Duration(5 * time.Second)}},
+		{name: "explicit unit is kept", env: map[string]string{"INTERVAL": "2m"},
+			want: unitConfig{Interval: Duration(2 * time.Minute), Timeout: Duration(5 * time.Second)}},
+		{name: "fractional bare number", env: map[string]string{"INTERVAL": "0.5"},
+			want: unitConfig{Interval: Duration(500 * time.Millisecond), Timeout: Duration(5 * time.Second)}},
+		{name: "bare number without unit tag", env: map[string]string{"TIMEOUT": "10"}, wantErr: true},
+		{name: "invalid duration", env: map[string]string{"INTERVAL": "often"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			t.Setenv("INTERVAL", "")
+			os.Unsetenv("INTERVAL")
+			t.Setenv("TIMEOUT", "")
+			os.Unsetenv("TIMEOUT")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var cfg unitConfig
+			err := Load(&cfg, flag.NewFlagSet("test", flag.ContinueOnError), nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Load() = %+v, want an error", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load(): %v", err)
+			}
+			if cfg != tt.want {
+				t.Errorf("Load() = %+v, want %+v", cfg, tt.want)
+			}
+		})
+	}
+}
+
+type nestedConfig struct {
+	Port string `config:"port" env:"PORT" required:"true"`
+}
+
+func (c *nestedConfig) Validate() error {
+	if c.Port == "0" {
+		return fmt.Errorf("port may not be 0")
+	}
+	return nil
+}
+
+type precedenceConfig struct {
+	Name   string       `config:"name" env:"NAME" default:"default"`
+	Count  int          `config:"count" env:"COUNT" default:"1"`
+	Tags   []string     `config:"tags" env:"TAGS"`
+	Server nestedConfig `config:"server" env:"SERVER"`
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(yamlFile, []byte("name: file\ncount: 2\nserver:\n  port: \"8080\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tomlFile := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(tomlFile, []byte("name = \"toml\"\ntags = [\"a\", \"b\"]\n[server]\nport = \"9090\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	unknownKey := filepath.Join(dir, "unknown.yaml")
+	if err := os.WriteFile(unknownKey, []byte("server:\n  host: x\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		want    precedenceConfig
+		wantErr string
+	}{
+		{name: "required field missing", wantErr: "server.port is required (env SERVER_PORT)"},
+		{name: "defaults and env", env: map[string]string{"SERVER_PORT": "1"},
+			want: precedenceConfig{Name: "default", Count: 1, Server: nestedConfig{Port: "1"}}},
+		{name: "file over defaults", args: []string{"-config", yamlFile},
+			want: precedenceConfig{Name: "file", Count: 2, Server: nestedConfig{Port: "8080"}}},
+		{name: "toml file", args: []string{"-config", tomlFile},
+			want: precedenceConfig{Name: "toml", Count: 1, Tags: []string{"a", "b"}, Server: nestedConfig{Port: "9090"}}},
+		{name: "env over file", env: map[string]string{"COUNT": "3", "TAGS": "x,y"}, args: []string{"-config", yamlFile},
+			want: precedenceConfig{Name: "file", Count: 3, Tags: []string{"x", "y"}, Server: nestedConfig{Port: "8080"}}},
+		{name: "flags over env", env: map[string]string{"NAME": "env", "SERVER_PORT": "1"}, args: []string{"-name", "flag"},
+			want: precedenceConfig{Name: "flag", Count: 1, Server: nestedConfig{Port: "1"}}},
+		{name: "validator", env: map[string]string{"SERVER_PORT": "0"}, wantErr: "server: port may not be 0"},
+		{name: "invalid integer", env: map[string]string{"SERVER_PORT": "1", "COUNT": "many"}, wantErr: "invalid value of env COUNT"},
+		{name: "unknown key", args: []string{"-config", unknownKey}, wantErr: `unknown key "server.host"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			for _, k := range []string{"NAME", "COUNT", "TAGS", "SERVER_PORT"} {
+				t.Setenv(k, "")
+				os.Unsetenv(k)
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var cfg precedenceConfig
+			err := Load(&cfg, flag.NewFlagSet("test", flag.ContinueOnError), tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load(): %v", err)
+			}
+			if fmt.Sprint(cfg) != fmt.Sprint(tt.want) {
+				t.Errorf("Load() = %+v, want %+v", cfg, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	var cfg precedenceConfig
+	if err := Defaults(&cfg); err != nil {
+		t.Fatalf("Defaults(): %v", err)
+	}
+	if cfg.Name != "default" || cfg.Count != 1 || cfg.Server.Port != "" {
+		t.Errorf("Defaults() = %+v", cfg)
+	}
+	if err := Defaults(cfg); err == nil {
+		t.Error("Defaults() of a struct value succeeded, want an error")
+	}
+}
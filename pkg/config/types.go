@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Duration is a time.Duration read from strings with an explicit unit such as "90s" or "15m".
+// Bare numbers are rejected since the services used to disagree on their unit.
+type Duration time.Duration
+
+// Duration returns d as a time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	s := string(b)
+	if _, err := strconv.ParseFloat(s, 64); err == nil && s != "0" {
+		return fmt.Errorf("duration %q has no unit, use e.g. %q or %q", s, s+"s", s+"m")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Endpoint is the address of a gRPC service
+type Endpoint struct {
+	Address string `config:"address" env:"ADDR" usage:"host of the service"`
+	Port    string `config:"port" env:"PORT" usage:"port of the service"`
+}
+
+// HostPort returns the address to dial or listen on
+func (e Endpoint) HostPort() string {
+	return net.JoinHostPort(e.Address, e.Port)
+}
+
+func (e *Endpoint) Validate() error {
+	if e.Port == "" {
+		return nil
+	}
+	if p, err := strconv.Atoi(e.Port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %q", e.Port)
+	}
+	return nil
+}
+
+// Listener is the address a server listens on, all interfaces when the address is empty
+type Listener struct {
+	Address string `config:"address" env:"ADDR" usage:"interface to listen on"`
+	Port    string `config:"port" env:"PORT" required:"true" usage:"port to listen on"`
+}
+
+// HostPort returns the address to listen on
+func (l Listener) HostPort() string {
+	return net.JoinHostPort(l.Address, l.Port)
+}
+
+func (l *Listener) Validate() error {
+	if p, err := strconv.Atoi(l.Port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %q", l.Port)
+	}
+	return nil
+}
+
+// Metrics configures the Prometheus metrics server and the buckets of its histograms
+type Metrics struct {
+	Address         string    `config:"address" env:"METRIC_ADDR" usage:"address of the metrics server"`
+	Port            string    `config:"port" env:"METRIC_PORT" default:"8001" usage:"port of the metrics server"`
+	SentDataBuckets []float64 `config:"sentDataBuckets" env:"SENT_DATA_BUCKETS" usage:"buckets of the sent data histogram in bytes"`
+	ProcTimeBuckets []float64 `config:"procTimeBuckets" env:"PROC_TIME_BUCKETS" usage:"buckets of the processing time histogram"`
+	RttTimeBuckets  []float64 `config:"rttTimeBuckets" env:"RTT_TIME_BUCKETS" usage:"buckets of the round-trip time histogram"`
+	LatencyBuckets  []float64 `config:"latencyBuckets" env:"LATENCY_BUCKETS" usage:"buckets of the reading freshness and latency histograms in seconds"`
+}
+
+// HostPort returns the address the metrics server listens on
+func (m Metrics) HostPort() string {
+	return net.JoinHostPort(m.Address, m.Port)
+}
+
+func (m *Metrics) Validate() error {
+	if p, err := strconv.Atoi(m.Port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %q", m.Port)
+	}
+	for name, buckets := range map[string][]float64{
+		"sentDataBuckets": m.SentDataBuckets,
+		"procTimeBuckets": m.ProcTimeBuckets,
+		"rttTimeBuckets":  m.RttTimeBuckets,
+		"latencyBuckets":  m.LatencyBuckets,
+	} {
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				return fmt.Errorf("%s must be in increasing order", name)
+			}
+		}
+	}
+	return nil
+}
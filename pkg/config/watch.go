@@ -0,0 +1,61 @@
+package config
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Watch calls onChange whenever the file at path is modified or the process receives SIGHUP,
+// until ctx is done. The file is polled in the given interval, an empty path only listens for SIGHUP.
+func Watch(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var poll <-chan time.Time
+	var modTime time.Time
+	var size int64
+	if path != "" {
+		if info, err := os.Stat(path); err == nil {
+			modTime, size = info.ModTime(), info.Size()
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading config")
+			onChange()
+		case <-poll:
+			info, err := os.Stat(path)
+			if err != nil {
+				slog.Error("Error watching config file", "path", path, "error", err)
+				continue
+			}
+			if info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			slog.Info("Config file changed, reloading config", "path", path)
+			onChange()
+		}
+	}
+}
+
+// File returns the config file given to Load through fs, empty if none
+func File(fs *flag.FlagSet) string {
+	if f := fs.Lookup("config"); f != nil {
+		return f.Value.String()
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reinjector processes the payload of a record again as if it was just received.
+// Payloads rejected again are written as new records, an error means processing
+// could not be completed and the record is kept.
+type Reinjector func(ctx context.Context, rec *Record) error
+
+// Server serves the DeadLetter RPCs of a store
+type Server struct {
+	pb.UnimplementedDeadLetterServer
+	Store    *Store
+	Reinject Reinjector
+}
+
+// ListDeadLetters lists the records matching the JSON query in the payload
+func (s Server) ListDeadLetters(ctx context.Context, req *pb.Data) (*pb.DataResponse, error) {
+	q := Query{}
+	if strings.TrimSpace(req.Payload) != "" {
+		if err := json.Unmarshal([]byte(req.Payload), &q); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid query: %v", err)
+		}
+	}
+	records, err := s.Store.List(q)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	return response(records)
+}
+
+// GetDeadLetter returns the record with the ID in the payload
+func (s Server) GetDeadLetter(ctx context.Context, req *pb.Data) (*pb.DataResponse, error) {
+	rec, err := s.get(req.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return response(rec)
+}
+
+// ReinjectDeadLetter processes the record with the ID in the payload again
+// and deletes it unless processing fails
+func (s Server) ReinjectDeadLetter(ctx context.Context, req *pb.Data) (*pb.Ack, error) {
+	if s.Reinject == nil {
+		return nil, status.Errorf(codes.Unimplemented, "reinjection is not supported by this service")
+	}
+	rec, err := s.get(req.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Reinject(ctx, rec); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "reinjecting %s: %v", rec.ID, err)
+	}
+	if err := s.Store.Delete(rec.ID); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	slog.InfoContext(ctx, "Reinjected dead-letter record", "id", rec.ID)
+	return ack(req), nil
+}
+
+// DeleteDeadLetter removes the record with the ID in the payload
+func (s Server) DeleteDeadLetter(ctx context.Context, req *pb.Data) (*pb.Ack, error) {
+	if err := s.Store.Delete(strings.TrimSpace(req.Payload)); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, status.Errorf(codes.NotFound, "%v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	return ack(req), nil
+}
+
+func (s Server) get(id string) (*Record, error) {
+	rec, err := s.Store.Get(strings.TrimSpace(id))
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "%v: %s", err, id)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	return rec, nil
+}
+
+func response(v any) (*pb.DataResponse, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error marshalling response: %v", err)
+	}
+	return &pb.DataResponse{
+		Status:        "ok",
+		Payload:       string(b),
+		SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
+	}, nil
+}
+
+func ack(req *pb.Data) *pb.Ack {
+	now := fmt.Sprintf("%d", int(time.Now().UnixMilli()))
+	return &pb.Ack{
+		Status:                "ok",
+		OriginalSentTimestamp: req.SentTimestamp,
+		ReceivedTimestamp:     now,
+		AckSentTimestamp:      now,
+	}
+}
@@ -0,0 +1,203 @@
+// Package deadletter keeps the records a service rejected so they can be inspected
+// and processed again once the cause is fixed, instead of being lost in the logs.
+package deadletter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	validation "github.com/etesami/air-quality-monitoring/pkg/validation"
+)
+
+// ErrNotFound is returned for IDs without a record
+var ErrNotFound = errors.New("record not found")
+
+// Record is a rejected payload with the reasons it was rejected
+type Record struct {
+	ID string `json:"id"`
+	// Time is when the payload was rejected
+	Time time.Time `json:"time"`
+	// Service and Stage tell where in the pipeline the payload was rejected
+	Service string `json:"service"`
+	Stage   string `json:"stage"`
+	// Source is where the payload came from, e.g. a station or an upstream service
+	Source     string                 `json:"source,omitempty"`
+	Rejections []validation.Rejection `json:"rejections"`
+	// Payload is the rejected data as received, omitted from listings
+	Payload string `json:"payload,omitempty"`
+	Size    int    `json:"size"`
+}
+
+// Query selects records, zero fields match any record
+type Query struct {
+	Stage  string    `json:"stage,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+	Limit  int       `json:"limit,omitempty"`
+}
+
+// Store keeps records as JSON files in a directory, one file per record.
+// It is safe for concurrent use.
+type Store struct {
+	dir     string
+	service string
+	mu      sync.Mutex
+}
+
+// Open returns the store of service in dir, creating the directory if needed
+func Open(dir, service string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating dead-letter directory: %v", err)
+	}
+	return &Store{dir: dir, service: service}, nil
+}
+
+// Reject writes payload with its rejections and returns the ID of the record
+func (s *Store) Reject(stage, source, payload string, rejections []validation.Rejection) (string, error) {
+	rec := Record{
+		ID:         newID(),
+		Time:       time.Now().UTC(),
+		Service:    s.service,
+		Stage:      stage,
+		Source:     source,
+		Rejections: rejections,
+		Payload:    payload,
+		Size:       len(payload),
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling record: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.WriteFile(s.path(rec.ID), data, 0o644); err != nil {
+		return "", fmt.Errorf("error writing record: %v", err)
+	}
+	return rec.ID, nil
+}
+
+// List returns the records matching q without their payloads, newest first
+func (s *Store) List(q Query) ([]Record, error) {
+	s.mu.Lock()
+	entries, err := os.ReadDir(s.dir)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("error reading dead-letter directory: %v", err)
+	}
+
+	// IDs start with the time, so sorting the names sorts the records
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	records := make([]Record, 0)
+	for _, name := range names {
+		rec, err := s.Get(strings.TrimSuffix(name, ".json"))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !q.matches(rec) {
+			continue
+		}
+		rec.Payload = ""
+		records = append(records, *rec)
+		if q.Limit > 0 && len(records) >= q.Limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+// Get returns the record with the given ID
+func (s *Store) Get(id string) (*Record, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	s.mu.Lock()
+	data, err := os.ReadFile(s.path(id))
+	s.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading record: %v", err)
+	}
+	rec := &Record{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("error unmarshalling record %s: %v", id, err)
+	}
+	return rec, nil
+}
+
+// Delete removes the record with the given ID
+func (s *Store) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (q Query) matches(rec *Record) bool {
+	if q.Stage != "" && rec.Stage != q.Stage {
+		return false
+	}
+	if !q.Since.IsZero() && rec.Time.Before(q.Since) {
+		return false
+	}
+	if q.Reason == "" {
+		return true
+	}
+	for _, r := range rec.Rejections {
+		if string(r.Reason) == q.Reason {
+			return true
+		}
+	}
+	return false
+}
+
+// newID returns a unique ID ordered by time
+func newID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return time.Now().UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(suffix)
+}
+
+// validID keeps IDs from naming files outside the store
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\`) && !strings.Contains(id, "..")
+}
+
+// ReasonFailed is the reason of payloads that were valid but could not be processed,
+// e.g. because the database was not available
+const ReasonFailed validation.Reason = "processing_failed"
+
+// Failed returns the rejection of a payload that could not be processed because of err
+func Failed(err error) validation.Rejection {
+	return validation.Rejection{Reason: ReasonFailed, Detail: err.Error()}
+}
@@ -0,0 +1,226 @@
+// Package grpcclient connects a service to the next one in the pipeline. The
+// connection is kept up with keepalive pings and reconnected with backoff, the
+// calls wait for it to be ready, up to their deadline, instead of failing while
+// the next service starts, and the calls turned away as UNAVAILABLE or
+// RESOURCE_EXHAUSTED are retried with backoff. The services can thus start in
+// any order.
+package grpcclient
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/etesami/air-quality-monitoring/pkg/auth"
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+	"github.com/etesami/air-quality-monitoring/pkg/logging"
+	"github.com/etesami/air-quality-monitoring/pkg/metric"
+	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+	"github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+	"github.com/etesami/air-quality-monitoring/pkg/tracing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+)
+
+// MinKeepaliveTime is the shortest interval between keepalive pings the servers
+// accept, see ServerOption
+const MinKeepaliveTime = 10 * time.Second
+
+// maxAttempts is the most attempts of a call gRPC makes, larger values are capped
+const maxAttempts = 5
+
+// Config configures the connection to the next service
+type Config struct {
+	CallTimeout         config.Duration  `config:"callTimeout" env:"CALL_TIMEOUT" default:"30s" usage:"deadline of the calls that have none, the wait for the connection included"`
+	MaxAttempts         int              `config:"maxAttempts" env:"MAX_ATTEMPTS" default:"4" usage:"attempts of a call turned away as unavailable or overloaded, 1 to never retry"`
+	InitialBackoff      config.Duration  `config:"initialBackoff" env:"INITIAL_BACKOFF" default:"200ms" usage:"wait before the first retry of a call"`
+	MaxBackoff          config.Duration  `config:"maxBackoff" env:"MAX_BACKOFF" default:"5s" usage:"longest wait between the retries of a call"`
+	ReconnectBackoff    config.Duration  `config:"reconnectBackoff" env:"RECONNECT_BACKOFF" default:"1s" usage:"wait before reconnecting after the connection failed"`
+	MaxReconnectBackoff config.Duration  `config:"maxReconnectBackoff" env:"MAX_RECONNECT_BACKOFF" default:"30s" usage:"longest wait between reconnections"`
+	KeepaliveTime       config.Duration  `config:"keepaliveTime" env:"KEEPALIVE_TIME" default:"30s" usage:"interval between the pings checking an idle connection"`
+	KeepaliveTimeout    config.Duration  `config:"keepaliveTimeout" env:"KEEPALIVE_TIMEOUT" default:"10s" usage:"time a ping may take before the connection is considered broken"`
+	TLS                 tlsconfig.Config `config:"tls" env:"TLS"`
+	TokenFile           string           `config:"tokenFile" env:"TOKEN_FILE" usage:"file of the API key or JWT the calls are authenticated with, none when empty"`
+}
+
+func (c *Config) Validate() error {
+	if c.CallTimeout <= 0 {
+		return fmt.Errorf("callTimeout must be positive")
+	}
+	if c.MaxAttempts < 1 || c.MaxAttempts > maxAttempts {
+		return fmt.Errorf("maxAttempts must be between 1 and %d", maxAttempts)
+	}
+	if c.InitialBackoff <= 0 || c.MaxBackoff < c.InitialBackoff {
+		return fmt.Errorf("initialBackoff must be positive and maxBackoff at least initialBackoff")
+	}
+	if c.ReconnectBackoff <= 0 || c.MaxReconnectBackoff < c.ReconnectBackoff {
+		return fmt.Errorf("reconnectBackoff must be positive and maxReconnectBackoff at least reconnectBackoff")
+	}
+	if c.KeepaliveTime.Duration() < MinKeepaliveTime {
+		return fmt.Errorf("keepaliveTime must be at least %s", MinKeepaliveTime)
+	}
+	if c.KeepaliveTimeout <= 0 {
+		return fmt.Errorf("keepaliveTimeout must be positive")
+	}
+	if c.TokenFile != "" && !c.TLS.Enabled {
+		return fmt.Errorf("tokenFile requires tls to be enabled, the token is not sent in plain text")
+	}
+	return nil
+}
+
+// serviceConfig returns the service config of the connection, the calls
+// of every method are retried
+func (c Config) serviceConfig() string {
+	if c.MaxAttempts < 2 {
+		return `{}`
+	}
+	return fmt.Sprintf(`{"methodConfig": [{
+		"name": [{}],
+		"retryPolicy": {
+			"maxAttempts": %d,
+			"initialBackoff": "%.3fs",
+			"maxBackoff": "%.3fs",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE", "RESOURCE_EXHAUSTED"]
+		}
+	}]}`, c.MaxAttempts, c.InitialBackoff.Duration().Seconds(), c.MaxBackoff.Duration().Seconds())
+}
+
+// Client is a client of the next service, it is usable as soon as it is
+// created and safe for concurrent use
+type Client struct {
+	pb.AirQualityMonitoringClient
+	service string
+	conn    *grpc.ClientConn
+}
+
+// New returns a client of service at target, the state of its connection is
+// recorded in m. The connection is made in the background and kept up until
+// the client is closed.
+func New(service, target string, cfg Config, m *metric.Metrics) (*Client, error) {
+	creds, err := tlsconfig.DialOption(cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up TLS to %s: %v", service, err)
+	}
+	opts := []grpc.DialOption{
+		creds,
+		grpc.WithDefaultServiceConfig(cfg.serviceConfig()),
+		grpc.WithDefaultCallOptions(grpc.WaitForReady(true)),
+		grpc.WithChainUnaryInterceptor(withTimeout(cfg.CallTimeout.Duration())),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  cfg.ReconnectBackoff.Duration(),
+				Multiplier: backoff.DefaultConfig.Multiplier,
+				Jitter:     backoff.DefaultConfig.Jitter,
+				MaxDelay:   cfg.MaxReconnectBackoff.Duration(),
+			},
+			MinConnectTimeout: 20 * time.Second,
+		}),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                cfg.KeepaliveTime.Duration(),
+			Timeout:             cfg.KeepaliveTimeout.Duration(),
+			PermitWithoutStream: true,
+		}),
+		tracing.DialOption(),
+		logging.DialOption(),
+	}
+	if cfg.TokenFile != "" {
+		token, err := auth.TokenFile(cfg.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading token of %s: %v", service, err)
+		}
+		opts = append(opts, token)
+	}
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating client of %s: %v", service, err)
+	}
+	c := &Client{
+		AirQualityMonitoringClient: pb.NewAirQualityMonitoringClient(conn),
+		service:                    service,
+		conn:                       conn,
+	}
+	go c.watch(m)
+	return c, nil
+}
+
+// Conn returns the connection of the client, e.g. to check the health of the service
+func (c *Client) Conn() *grpc.ClientConn {
+	return c.conn
+}
+
+// Ready reports whether the connection is ready
+func (c *Client) Ready() bool {
+	return c.conn.GetState() == connectivity.Ready
+}
+
+// WaitForReady blocks until the connection is ready or ctx is done
+func (c *Client) WaitForReady(ctx context.Context) error {
+	for {
+		state := c.conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Shutdown:
+			return fmt.Errorf("client of %s is closed", c.service)
+		case connectivity.Idle:
+			c.conn.Connect()
+		}
+		if !c.conn.WaitForStateChange(ctx, state) {
+			return ctx.Err()
+		}
+	}
+}
+
+// Close closes the connection, the calls in flight are cancelled
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// watch records the state of the connection until it is closed. An idle
+// connection is reconnected right away, so that the next call does not wait for it.
+func (c *Client) watch(m *metric.Metrics) {
+	for {
+		state := c.conn.GetState()
+		m.SetConnState(c.service, strings.ToLower(state.String()), state == connectivity.Ready)
+		switch state {
+		case connectivity.Shutdown:
+			return
+		case connectivity.Idle:
+			c.conn.Connect()
+		case connectivity.Ready:
+			slog.Info("Connected to target service", "service", c.service, "target", c.conn.CanonicalTarget())
+		case connectivity.TransientFailure:
+			slog.Warn("Connection to target service failed", "service", c.service, "target", c.conn.CanonicalTarget())
+		}
+		c.conn.WaitForStateChange(context.Background(), state)
+	}
+}
+
+// withTimeout bounds the calls without a deadline by timeout, so that
+// they do not wait forever for the connection
+func withTimeout(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// ServerOption lets the clients ping the server as often as MinKeepaliveTime,
+// the servers otherwise close the connections of clients pinging more than
+// every five minutes
+func ServerOption() grpc.ServerOption {
+	return grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             MinKeepaliveTime,
+		PermitWithoutStream: true,
+	})
+}
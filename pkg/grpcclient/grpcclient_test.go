@@ -0,0 +1,145 @@
+package grpcclient
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+
+	"google.golang.org/grpc"
+)
+
+func defaultConfig(t *testing.T) Config {
+	t.Helper()
+	var cfg Config
+	if err := config.Defaults(&cfg); err != nil {
+		t.Fatalf("Defaults(): %v", err)
+	}
+	return cfg
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr bool
+	}{
+		{name: "defaults", change: func(c *Config) {}},
+		{name: "no retries", change: func(c *Config) { c.MaxAttempts = 1 }},
+		{name: "most attempts", change: func(c *Config) { c.MaxAttempts = maxAttempts }},
+		{name: "token over TLS", change: func(c *Config) { c.TokenFile = "token"; c.TLS.Enabled = true }},
+		{name: "no call timeout", change: func(c *Config) { c.CallTimeout = 0 }, wantErr: true},
+		{name: "no attempts", change: func(c *Config) { c.MaxAttempts = 0 }, wantErr: true},
+		{name: "too many attempts", change: func(c *Config) { c.MaxAttempts = maxAttempts + 1 }, wantErr: true},
+		{name: "no initial backoff", change: func(c *Config) { c.InitialBackoff = 0 }, wantErr: true},
+		{name: "max backoff below initial", change: func(c *Config) {
+			c.InitialBackoff = config.Duration(time.Second)
+			c.MaxBackoff = config.Duration(500 * time.Millisecond)
+		}, wantErr: true},
+		{name: "no reconnect backoff", change: func(c *Config) { c.ReconnectBackoff = 0 }, wantErr: true},
+		{name: "max reconnect backoff below reconnect", change: func(c *Config) {
+			c.MaxReconnectBackoff = config.Duration(c.ReconnectBackoff.Duration() / 2)
+		}, wantErr: true},
+		{name: "keepalive below the server minimum", change: func(c *Config) {
+			c.KeepaliveTime = config.Duration(MinKeepaliveTime - time.Second)
+		}, wantErr: true},
+		{name: "no keepalive timeout", change: func(c *Config) { c.KeepaliveTimeout = 0 }, wantErr: true},
+		{name: "token without TLS", change: func(c *Config) { c.TokenFile = "token" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig(t)
+			tt.change(&cfg)
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServiceConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		wantRetry   bool
+	}{
+		{name: "no retries", maxAttempts: 1},
+		{name: "retries", maxAttempts: 4, wantRetry: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig(t)
+			cfg.MaxAttempts = tt.maxAttempts
+			var sc struct {
+				MethodConfig []struct {
+					Name        []map[string]string `json:"name"`
+					RetryPolicy struct {
+						MaxAttempts          int      `json:"maxAttempts"`
+						InitialBackoff       string   `json:"initialBackoff"`
+						MaxBackoff           string   `json:"maxBackoff"`
+						BackoffMultiplier    float64  `json:"backoffMultiplier"`
+						RetryableStatusCodes []string `json:"retryableStatusCodes"`
+					} `json:"retryPolicy"`
+				} `json:"methodConfig"`
+			}
+			if err := json.Unmarshal([]byte(cfg.serviceConfig()), &sc); err != nil {
+				t.Fatalf("serviceConfig() is not JSON: %v", err)
+			}
+			if !tt.wantRetry {
+				if len(sc.MethodConfig) != 0 {
+					t.Errorf("serviceConfig() = %+v, want no retry policy", sc)
+				}
+				return
+			}
+			if len(sc.MethodConfig) != 1 {
+				t.Fatalf("serviceConfig() has %d method configs, want 1", len(sc.MethodConfig))
+			}
+			p := sc.MethodConfig[0].RetryPolicy
+			if p.MaxAttempts != tt.maxAttempts || p.InitialBackoff != "0.200s" || p.MaxBackoff != "5.000s" {
+				t.Errorf("retry policy = %+v", p)
+			}
+			if len(p.RetryableStatusCodes) != 2 || p.RetryableStatusCodes[0] != "UNAVAILABLE" || p.RetryableStatusCodes[1] != "RESOURCE_EXHAUSTED" {
+				t.Errorf("retryable codes = %v", p.RetryableStatusCodes)
+			}
+		})
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	const timeout = time.Minute
+	tests := []struct {
+		name         string
+		deadline     time.Duration
+		wantDeadline time.Duration
+	}{
+		{name: "no deadline", wantDeadline: timeout},
+		{name: "shorter deadline kept", deadline: time.Second, wantDeadline: time.Second},
+		{name: "longer deadline kept", deadline: time.Hour, wantDeadline: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			start := time.Now()
+			invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				deadline, ok := ctx.Deadline()
+				if !ok {
+					t.Fatal("call has no deadline")
+				}
+				if got := deadline.Sub(start); got < tt.wantDeadline-time.Second || got > tt.wantDeadline+time.Second {
+					t.Errorf("deadline in %s, want %s", got, tt.wantDeadline)
+				}
+				return nil
+			}
+			if err := withTimeout(timeout)(ctx, "/test", nil, nil, nil, invoker); err != nil {
+				t.Errorf("withTimeout() = %v", err)
+			}
+		})
+	}
+}
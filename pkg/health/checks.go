@@ -0,0 +1,99 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Writable checks that db is open and accepts writes without writing to it. It takes
+// the write lock of the database and releases it, and writes a temporary file next
+// to the database file to check that its file system accepts writes.
+func Writable(db *sql.DB) Check {
+	return func(ctx context.Context) error {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return fmt.Errorf("error connecting: %v", err)
+		}
+		defer conn.Close()
+		if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+			return fmt.Errorf("error taking the write lock: %v", err)
+		}
+		// The lock is released even once ctx is done
+		if _, err := conn.ExecContext(context.Background(), "ROLLBACK"); err != nil {
+			// The connection is dropped rather than put back in the pool in a transaction
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+			return fmt.Errorf("error releasing the write lock: %v", err)
+		}
+
+		// The first database listed is the main one, in-memory ones have no file
+		var seq int
+		var name, file string
+		if err := conn.QueryRowContext(ctx, "PRAGMA database_list").Scan(&seq, &name, &file); err != nil {
+			return fmt.Errorf("error listing databases: %v", err)
+		}
+		if file == "" {
+			return nil
+		}
+		return writeTemp(filepath.Dir(file))
+	}
+}
+
+// writeTemp writes and removes a temporary file in dir
+func writeTemp(dir string) error {
+	f, err := os.CreateTemp(dir, ".health-check-*")
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	return f.Close()
+}
+
+// Serving checks that service reports SERVING on conn. The downstream services are
+// checked with the empty name, their overall status, so that a service stays ready
+// while the ones further down the pipeline are not.
+func Serving(conn *grpc.ClientConn, service string) Check {
+	client := healthpb.NewHealthClient(conn)
+	return func(ctx context.Context) error {
+		res, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			return err
+		}
+		if res.Status != healthpb.HealthCheckResponse_SERVING {
+			return fmt.Errorf("status is %s", res.Status)
+		}
+		return nil
+	}
+}
+
+// Wait blocks until service reports SERVING on conn, checking every interval,
+// or until ctx is done
+func Wait(ctx context.Context, conn *grpc.ClientConn, service string, interval time.Duration) error {
+	check := Serving(conn, service)
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		err := check(checkCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		slog.Warn("Target service is not serving", "target", conn.CanonicalTarget(), "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
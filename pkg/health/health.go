@@ -0,0 +1,214 @@
+// Package health reports whether a service is alive and ready to do its work. The
+// dependencies of the service, its database, the downstream service or the upstream
+// API, are checked periodically and their state is served over the standard gRPC
+// health service, grpc.health.v1, and over HTTP on /healthz and /readyz.
+//
+// The overall status, the empty service name, tells the service is alive. The
+// services given to New are SERVING only while all the checks added with Add pass,
+// the ones added with Watch are only reported.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Config configures the checks of the dependencies
+type Config struct {
+	Interval config.Duration `config:"interval" env:"HEALTH_INTERVAL" default:"10s" usage:"interval between the checks of the dependencies"`
+	Timeout  config.Duration `config:"timeout" env:"HEALTH_TIMEOUT" default:"3s" usage:"time a check of a dependency may take"`
+}
+
+func (c *Config) Validate() error {
+	if c.Interval <= 0 || c.Timeout <= 0 {
+		return fmt.Errorf("interval and timeout must be positive")
+	}
+	return nil
+}
+
+// Check returns an error when a dependency is not usable
+type Check func(ctx context.Context) error
+
+// Checker checks the dependencies of a service and reports its health
+type Checker struct {
+	cfg      Config
+	services []string
+	server   *grpchealth.Server
+
+	mu       sync.Mutex
+	names    []string
+	checks   map[string]Check
+	watched  map[string]bool
+	results  map[string]error
+	checked  bool
+	stopping bool
+}
+
+// New returns a checker reporting the readiness of the given gRPC services, they
+// are not serving until the first checks pass
+func New(cfg Config, services ...string) *Checker {
+	c := &Checker{
+		cfg:      cfg,
+		services: services,
+		server:   grpchealth.NewServer(),
+		checks:   map[string]Check{},
+		watched:  map[string]bool{},
+		results:  map[string]error{},
+	}
+	for _, s := range services {
+		c.server.SetServingStatus(s, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	return c
+}
+
+// Add checks the dependency name, the service is not ready while it fails
+func (c *Checker) Add(name string, check Check) {
+	c.add(name, check, false)
+}
+
+// Watch checks the dependency name and reports its state, the service stays
+// ready while it fails, e.g. when it can keep the data until the dependency is back
+func (c *Checker) Watch(name string, check Check) {
+	c.add(name, check, true)
+}
+
+func (c *Checker) add(name string, check Check, watched bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+	c.watched[name] = watched
+}
+
+// Register serves the health of the service on s
+func (c *Checker) Register(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, c.server)
+}
+
+// RegisterHTTP serves the liveness of the service on /healthz and its readiness
+// on /readyz, along with the state of every dependency
+func (c *Checker) RegisterHTTP(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", c.serveReady)
+}
+
+// Run checks the dependencies every interval until ctx is done
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.Interval.Duration())
+	defer ticker.Stop()
+	for {
+		c.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown reports the service as not serving from now on, so that the clients
+// and the load balancers move away before it stops
+func (c *Checker) Shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopping = true
+	c.server.Shutdown()
+}
+
+// checkAll runs the checks and updates the status of the services
+func (c *Checker) checkAll(ctx context.Context) {
+	c.mu.Lock()
+	names := append([]string(nil), c.names...)
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mu.Unlock()
+
+	results := make(map[string]error, len(names))
+	for _, name := range names {
+		checkCtx, cancel := context.WithTimeout(ctx, c.cfg.Timeout.Duration())
+		results[name] = checks[name](checkCtx)
+		cancel()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range names {
+		prev, seen := c.results[name]
+		switch err := results[name]; {
+		case err != nil && (!seen || prev == nil):
+			slog.Warn("Dependency is not ready", "dependency", name, "error", err)
+		case err == nil && seen && prev != nil:
+			slog.Info("Dependency is ready again", "dependency", name)
+		}
+	}
+	c.results = results
+	c.checked = true
+	if c.stopping {
+		return
+	}
+	status := healthpb.HealthCheckResponse_SERVING
+	if !c.readyLocked() {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	for _, s := range c.services {
+		c.server.SetServingStatus(s, status)
+	}
+}
+
+// readyLocked reports whether all the dependencies that are not only watched passed
+// their last check, c.mu must be held
+func (c *Checker) readyLocked() bool {
+	if !c.checked || c.stopping {
+		return false
+	}
+	for name, err := range c.results {
+		if err != nil && !c.watched[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// serveReady writes the readiness of the service and the state of its dependencies
+func (c *Checker) serveReady(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	ready := c.readyLocked()
+	checks := make(map[string]string, len(c.results))
+	for name, err := range c.results {
+		checks[name] = "ok"
+		if err != nil {
+			checks[name] = err.Error()
+		}
+	}
+	c.mu.Unlock()
+
+	res := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks,omitempty"`
+	}{Status: "ready", Checks: checks}
+	code := http.StatusOK
+	if !ready {
+		res.Status = "not ready"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
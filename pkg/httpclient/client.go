@@ -0,0 +1,323 @@
+// Package httpclient is the HTTP client of the services calling upstream APIs. It limits the
+// request rate per host, accounts requests against a daily quota, retries throttled and failed
+// requests with exponential backoff and bounds every request with a timeout.
+package httpclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	tracing "github.com/etesami/air-quality-monitoring/pkg/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/etesami/air-quality-monitoring/pkg/httpclient"
+
+// ErrQuotaExceeded is returned when the daily quota of a key is used up
+var ErrQuotaExceeded = errors.New("daily quota exceeded")
+
+// StatusError is returned for responses with a status other than 200
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status: %d %s", e.Code, http.StatusText(e.Code))
+}
+
+// Options configures a Client, zero values take the defaults
+type Options struct {
+	// Timeout bounds every attempt of a request, 10s by default
+	Timeout time.Duration
+	// Rate is the number of requests per second to a host, unlimited when 0
+	Rate float64
+	// Burst is the number of requests to a host sent at once, 1 by default
+	Burst int
+	// DailyQuota is the number of requests per key and UTC day, unlimited when 0
+	DailyQuota int
+	// MaxRetries is the number of retries of throttled or failed requests
+	MaxRetries int
+	// Backoff is the delay before the first retry, doubled on every retry, 1s by default
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries, 30s by default. A request the
+	// server asks to retry later than MaxBackoff with Retry-After is given up.
+	MaxBackoff time.Duration
+	// FailureThreshold is the number of attempts in a row failing to reach the
+	// upstream after which it is reported unreachable, 3 by default
+	FailureThreshold int
+	// Header is added to every request
+	Header http.Header
+}
+
+// Client sends GET requests to upstream APIs, it is safe for concurrent use
+type Client struct {
+	opts Options
+	http *http.Client
+
+	mu       sync.Mutex
+	limiters map[string]*bucket
+	day      string
+	used     map[string]int
+	// failures counts the attempts in a row not reaching the upstream
+	failures    int
+	lastFailure error
+}
+
+// New returns a client with the given options
+func New(opts Options) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = 1
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 3
+	}
+	return &Client{
+		opts:     opts,
+		http:     &http.Client{Timeout: opts.Timeout},
+		limiters: map[string]*bucket{},
+		used:     map[string]int{},
+	}
+}
+
+// GetJSON fetches rawURL and decodes its JSON body into v. Every attempt counts
+// against the daily quota of key, requests with an empty key are not counted.
+func (c *Client) GetJSON(ctx context.Context, rawURL, key string, v any) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	// the query may hold a token, keep it out of errors and logs
+	target := u.Host + u.Path
+
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.get(ctx, u, key, v, attempt)
+		if err == nil {
+			return nil
+		}
+		if !retryable(err) || attempt >= c.opts.MaxRetries {
+			return fmt.Errorf("GET %s: %w", target, err)
+		}
+
+		// Waiting longer would hold up the caller and its shutdown
+		if retryAfter > c.opts.MaxBackoff {
+			return fmt.Errorf("GET %s: %w, retry asked in %s", target, err, retryAfter.Round(time.Second))
+		}
+		delay := c.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		slog.WarnContext(ctx, "Request failed, retrying", "target", target, "error", err,
+			"delay", delay.Round(time.Millisecond).String(), "attempt", attempt+1, "maxRetries", c.opts.MaxRetries)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("GET %s: %w", target, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Reachable returns an error once FailureThreshold attempts in a row failed to reach
+// the upstream, with a network error or a server error. The other failures, e.g. a
+// missing station or a used up quota, tell nothing about the upstream and are not counted.
+func (c *Client) Reachable() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < c.opts.FailureThreshold {
+		return nil
+	}
+	return fmt.Errorf("%d attempts in a row failed, last: %v", c.failures, c.lastFailure)
+}
+
+// reached records whether an attempt reached the upstream, err is its failure otherwise
+func (c *Client) reached(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	c.lastFailure = err
+}
+
+// Used returns the number of requests of key sent today
+func (c *Client) Used(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rollover(time.Now())
+	return c.used[key]
+}
+
+// get sends a single attempt, it returns the delay asked by the server with the error
+func (c *Client) get(ctx context.Context, u *url.URL, key string, v any, attempt int) (delay time.Duration, err error) {
+	// The span covers the wait for the rate limiter. Only the host and path are
+	// recorded, the query may hold a token.
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "GET "+u.Host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodGet,
+			semconv.ServerAddress(u.Host),
+			semconv.URLPath(u.Path),
+			semconv.HTTPRequestResendCount(attempt),
+		))
+	defer func() { tracing.End(span, err) }()
+
+	if err := c.take(key); err != nil {
+		return 0, err
+	}
+	if err := c.limiter(u.Host).wait(ctx); err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	for k, values := range c.opts.Header {
+		for _, value := range values {
+			req.Header.Add(k, value)
+		}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		// a request cancelled by the caller says nothing about the upstream
+		if ctx.Err() == nil {
+			c.reached(err)
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		c.reached(&StatusError{Code: resp.StatusCode})
+	} else {
+		c.reached(nil)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return parseRetryAfter(resp.Header.Get("Retry-After")), &StatusError{Code: resp.StatusCode}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return 0, &decodeError{err}
+	}
+	return 0, nil
+}
+
+// take counts a request of key against the daily quota
+func (c *Client) take(key string) error {
+	if key == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rollover(time.Now())
+	if c.opts.DailyQuota > 0 && c.used[key] >= c.opts.DailyQuota {
+		return ErrQuotaExceeded
+	}
+	c.used[key]++
+	if c.used[key] == c.opts.DailyQuota {
+		slog.Warn("Daily quota is used up, requests are rejected until midnight UTC", "quota", c.opts.DailyQuota)
+	}
+	return nil
+}
+
+// rollover resets the quota at the start of a UTC day, c.mu must be held
+func (c *Client) rollover(now time.Time) {
+	day := now.UTC().Format(time.DateOnly)
+	if day == c.day {
+		return
+	}
+	for _, n := range c.used {
+		slog.Info("Daily requests sent", "requests", n, "day", c.day)
+	}
+	c.day = day
+	c.used = map[string]int{}
+}
+
+// limiter returns the token bucket of host
+func (c *Client) limiter(host string) *bucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.limiters[host]
+	if !ok {
+		b = newBucket(c.opts.Rate, c.opts.Burst)
+		c.limiters[host] = b
+	}
+	return b
+}
+
+// backoff returns the delay before the retry after attempt, with full jitter
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.opts.Backoff << attempt
+	if d <= 0 || d > c.opts.MaxBackoff {
+		d = c.opts.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// decodeError is an invalid response body, which is not retried
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("error decoding JSON: %v", e.err)
+}
+
+// retryable reports whether err is worth another attempt:
+// throttling, server errors and network errors
+func retryable(err error) bool {
+	if errors.Is(err, ErrQuotaExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code == http.StatusTooManyRequests || statusErr.Code >= 500
+	}
+	var decodeErr *decodeError
+	return !errors.As(err, &decodeErr)
+}
+
+// parseRetryAfter returns the delay of a Retry-After header in seconds or as a date
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
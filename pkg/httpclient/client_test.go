@@ -0,0 +1,249 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReachable(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	c := New(Options{FailureThreshold: 2, Backoff: time.Millisecond})
+	steps := []struct {
+		name          string
+		url           string
+		status        int
+		wantReachable bool
+	}{
+		{name: "no request sent", wantReachable: true},
+		{name: "ok", url: srv.URL, status: http.StatusOK, wantReachable: true},
+		{name: "not found is reached", url: srv.URL, status: http.StatusNotFound, wantReachable: true},
+		{name: "first server error", url: srv.URL, status: http.StatusBadGateway, wantReachable: true},
+		{name: "second server error", url: srv.URL, status: http.StatusBadGateway},
+		{name: "not found resets the failures", url: srv.URL, status: http.StatusNotFound, wantReachable: true},
+		{name: "first connection refused", url: down.URL, wantReachable: true},
+		{name: "second connection refused", url: down.URL},
+		{name: "ok again", url: srv.URL, status: http.StatusOK, wantReachable: true},
+	}
+	for _, step := range steps {
+		if step.url != "" {
+			status = step.status
+			var v map[string]any
+			c.GetJSON(context.Background(), step.url, "", &v)
+		}
+		if err := c.Reachable(); (err == nil) != step.wantReachable {
+			t.Errorf("%s: Reachable() = %v, want reachable %v", step.name, err, step.wantReachable)
+		}
+	}
+}
+
+func TestReachableCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	c := New(Options{FailureThreshold: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var v map[string]any
+	if err := c.GetJSON(ctx, srv.URL, "", &v); err == nil {
+		t.Fatal("GetJSON() succeeded, want the deadline exceeded")
+	}
+	if err := c.Reachable(); err != nil {
+		t.Errorf("Reachable() = %v after a request cancelled by the caller", err)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBucket(2, 3)
+	b.last = start
+	steps := []struct {
+		name  string
+		after time.Duration
+		want  time.Duration
+	}{
+		{name: "first of the burst", want: 0},
+		{name: "second of the burst", want: 0},
+		{name: "third of the burst", want: 0},
+		{name: "burst used up", want: 500 * time.Millisecond},
+		{name: "half a token refilled", after: 250 * time.Millisecond, want: 250 * time.Millisecond},
+		{name: "token refilled", after: 500 * time.Millisecond, want: 0},
+		{name: "refill capped at the burst", after: time.Hour, want: 0},
+		{name: "second after the idle hour", after: time.Hour, want: 0},
+		{name: "third after the idle hour", after: time.Hour, want: 0},
+		{name: "burst used up again", after: time.Hour, want: 500 * time.Millisecond},
+	}
+	for _, step := range steps {
+		if got := b.reserve(start.Add(step.after)); got != step.want {
+			t.Errorf("%s: reserve() = %s, want %s", step.name, got, step.want)
+		}
+	}
+}
+
+func TestBucketWait(t *testing.T) {
+	if err := newBucket(0, 1).wait(context.Background()); err != nil {
+		t.Errorf("wait() without a rate = %v", err)
+	}
+
+	b := newBucket(0.001, 1)
+	if err := b.wait(context.Background()); err != nil {
+		t.Fatalf("wait() of the burst = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait() with the burst used up = %v, want the deadline exceeded", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	c := New(Options{DailyQuota: 2})
+	get := func(key string) error {
+		var v map[string]any
+		return c.GetJSON(context.Background(), srv.URL, key, &v)
+	}
+	for i := 0; i < 2; i++ {
+		if err := get("a"); err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+	}
+	if err := get("a"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("request over the quota = %v, want ErrQuotaExceeded", err)
+	}
+	if err := get("b"); err != nil {
+		t.Errorf("request of another key = %v", err)
+	}
+	if err := get(""); err != nil {
+		t.Errorf("request without a key = %v", err)
+	}
+	if requests != 4 {
+		t.Errorf("server got %d requests, want 4", requests)
+	}
+	if got := c.Used("a"); got != 2 {
+		t.Errorf("Used(a) = %d, want 2", got)
+	}
+
+	// the quota is reset on the next UTC day
+	c.mu.Lock()
+	c.day = "2000-01-01"
+	c.mu.Unlock()
+	if got := c.Used("a"); got != 0 {
+		t.Errorf("Used(a) on the next day = %d, want 0", got)
+	}
+	if err := get("a"); err != nil {
+		t.Errorf("request on the next day = %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := New(Options{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second})
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 0, max: 100 * time.Millisecond},
+		{attempt: 1, max: 200 * time.Millisecond},
+		{attempt: 3, max: 800 * time.Millisecond},
+		{attempt: 4, max: time.Second},
+		{attempt: 100, max: time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := c.backoff(tt.attempt); d <= 0 || d > tt.max {
+				t.Fatalf("backoff(%d) = %s, want in (0, %s]", tt.attempt, d, tt.max)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{name: "none"},
+		{name: "seconds", value: "120", min: 2 * time.Minute, max: 2 * time.Minute},
+		{name: "date", value: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), min: 58 * time.Minute, max: time.Hour},
+		{name: "invalid", value: "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %s, want in [%s, %s]", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestGetJSONRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		retryAfter   string
+		maxRetries   int
+		wantRequests int
+		wantErr      string
+	}{
+		{name: "ok", statuses: []int{200}, maxRetries: 3, wantRequests: 1},
+		{name: "server error retried", statuses: []int{503, 502, 200}, maxRetries: 3, wantRequests: 3},
+		{name: "throttled retried", statuses: []int{429, 200}, retryAfter: "0", maxRetries: 3, wantRequests: 2},
+		{name: "retries exhausted", statuses: []int{500, 500, 500}, maxRetries: 2, wantRequests: 3, wantErr: "500 Internal Server Error"},
+		{name: "not found not retried", statuses: []int{404}, maxRetries: 3, wantRequests: 1, wantErr: "404 Not Found"},
+		{name: "retry after beyond the max backoff given up", statuses: []int{429}, retryAfter: "3600", maxRetries: 3, wantRequests: 1, wantErr: "retry asked in 1h0m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[min(requests, len(tt.statuses)-1)]
+				requests++
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+				w.Write([]byte("{}"))
+			}))
+			defer srv.Close()
+
+			c := New(Options{MaxRetries: tt.maxRetries, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+			var v map[string]any
+			err := c.GetJSON(context.Background(), srv.URL+"/feed?token=secret", "", &v)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("GetJSON() error = %v, want %q", err, tt.wantErr)
+				}
+				if strings.Contains(err.Error(), "secret") {
+					t.Errorf("GetJSON() error %q holds the token", err)
+				}
+			} else if err != nil {
+				t.Fatalf("GetJSON(): %v", err)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("server got %d requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// metadataKey is the gRPC metadata the correlation ID is sent in
+const metadataKey = "x-correlation-id"
+
+type correlationKey struct{}
+
+// NewID returns a new random correlation ID
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithCorrelationID returns a copy of ctx carrying the correlation ID id
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID of ctx, empty if it has none
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// ServerOption takes the correlation ID of the RPCs served from their metadata, or
+// starts a new one, and logs the RPCs at the debug level, the failed ones as warnings
+func ServerOption() grpc.ServerOption {
+	return grpc.StatsHandler(statsHandler{})
+}
+
+// DialOption sends the correlation ID of the context of the RPCs, or a new one, in
+// their metadata and logs the RPCs at the debug level, the failed ones as warnings
+func DialOption() grpc.DialOption {
+	return grpc.WithStatsHandler(statsHandler{client: true})
+}
+
+type methodKey struct{}
+
+type statsHandler struct {
+	client bool
+}
+
+func (h statsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	ctx = context.WithValue(ctx, methodKey{}, info.FullMethodName)
+	if h.client {
+		id := CorrelationID(ctx)
+		if id == "" {
+			id = NewID()
+			ctx = WithCorrelationID(ctx, id)
+		}
+		return metadata.AppendToOutgoingContext(ctx, metadataKey, id)
+	}
+	id := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(metadataKey); len(v) > 0 {
+			id = v[0]
+		}
+	}
+	if id == "" {
+		id = NewID()
+	}
+	return WithCorrelationID(ctx, id)
+}
+
+func (h statsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	end, ok := s.(*stats.End)
+	if !ok {
+		return
+	}
+	method, _ := ctx.Value(methodKey{}).(string)
+	// The periodic round-trip time pings are only logged when they fail
+	level := slog.LevelDebug
+	if end.Error != nil {
+		level = slog.LevelWarn
+	} else if strings.HasSuffix(method, "/CheckConnection") {
+		return
+	}
+	args := []any{
+		"method", method,
+		"client", h.client,
+		"code", status.Code(end.Error).String(),
+		"duration_ms", end.EndTime.Sub(end.BeginTime).Milliseconds(),
+	}
+	if end.Error != nil {
+		args = append(args, "error", end.Error)
+	}
+	slog.Log(ctx, level, "RPC finished", args...)
+}
+
+func (h statsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h statsHandler) HandleConn(context.Context, stats.ConnStats) {}
@@ -0,0 +1,143 @@
+// Package logging sets up the structured logs of the services on log/slog. Records
+// carry the correlation ID of the request or batch they belong to, propagated between
+// the services in the gRPC metadata, and the ID of its trace. Repeated records below
+// the warning level are sampled so that per-record logs do not flood the output.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config configures the logs of a service
+type Config struct {
+	Level            slog.Level `config:"level" env:"LOG_LEVEL" default:"info" usage:"minimum level of the logs: debug, info, warn or error"`
+	Format           string     `config:"format" env:"LOG_FORMAT" default:"json" usage:"format of the logs: json or text"`
+	SampleFirst      int        `config:"sampleFirst" env:"LOG_SAMPLE_FIRST" default:"10" usage:"records of a message logged every second before sampling it, 0 to log all"`
+	SampleThereafter int        `config:"sampleThereafter" env:"LOG_SAMPLE_THEREAFTER" default:"100" usage:"once sampled, every nth record of a message is logged, 0 to drop the rest"`
+}
+
+func (c *Config) Validate() error {
+	if c.Format != "json" && c.Format != "text" {
+		return fmt.Errorf("unknown format %q", c.Format)
+	}
+	if c.SampleFirst < 0 || c.SampleThereafter < 0 {
+		return fmt.Errorf("sampleFirst and sampleThereafter may not be negative")
+	}
+	return nil
+}
+
+// level is the level of the default logger, it can be changed at runtime with SetLevel
+var level = new(slog.LevelVar)
+
+// Setup makes the logger of service the default one, the log package included
+func Setup(service string, cfg Config) {
+	slog.SetDefault(New(os.Stderr, service, cfg))
+}
+
+// New returns the logger of service writing to w
+func New(w io.Writer, service string, cfg Config) *slog.Logger {
+	level.Set(cfg.Level)
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewJSONHandler(w, opts)
+	if cfg.Format == "text" {
+		h = slog.NewTextHandler(w, opts)
+	}
+	h = &handler{Handler: h, sampler: newSampler(cfg.SampleFirst, cfg.SampleThereafter, time.Second)}
+	return slog.New(h).With("service", service)
+}
+
+// SetLevel changes the level of the loggers returned by New
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
+// Fatal logs msg at the error level and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// handler adds the correlation and trace IDs of the context to the records
+// and samples the repeated ones
+type handler struct {
+	slog.Handler
+	sampler *sampler
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn && !h.sampler.allow(r.Level, r.Message, r.Time) {
+		return nil
+	}
+	if id := CorrelationID(ctx); id != "" {
+		r.AddAttrs(slog.String("correlation_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{Handler: h.Handler.WithAttrs(attrs), sampler: h.sampler}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{Handler: h.Handler.WithGroup(name), sampler: h.sampler}
+}
+
+// sampler logs the first records of a message in every tick, then every
+// thereafter-th one
+type sampler struct {
+	first      int
+	thereafter int
+	tick       time.Duration
+
+	mu     sync.Mutex
+	counts map[sampleKey]*sampleCount
+}
+
+type sampleKey struct {
+	level   slog.Level
+	message string
+}
+
+type sampleCount struct {
+	start time.Time
+	n     int
+}
+
+func newSampler(first, thereafter int, tick time.Duration) *sampler {
+	if first == 0 {
+		return nil
+	}
+	return &sampler{first: first, thereafter: thereafter, tick: tick, counts: map[sampleKey]*sampleCount{}}
+}
+
+// allow reports whether the record of message at t is logged
+func (s *sampler) allow(level slog.Level, message string, t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := sampleKey{level, message}
+	c, ok := s.counts[key]
+	if !ok || t.Sub(c.start) >= s.tick {
+		c = &sampleCount{start: t}
+		s.counts[key] = c
+	}
+	c.n++
+	if c.n <= s.first {
+		return true
+	}
+	return s.thereafter > 0 && (c.n-s.first)%s.thereafter == 0
+}
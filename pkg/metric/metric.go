@@ -1,104 +1,321 @@
+// Package metric records the Prometheus metrics of a service. Every Metrics has
+// a registry of its own, served by its Handler, so that several can live side by side.
 package metric
 
 import (
-	"sync"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
 
+	api "github.com/etesami/air-quality-monitoring/api"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var (
+// Buckets are the buckets of the histograms, the defaults are used for the nil ones
+type Buckets struct {
+	SentData []float64
+	ProcTime []float64
+	RttTime  []float64
+	Latency  []float64
+}
 
-	// should be initialized in main
-	sentDataBytesHistogram *prometheus.HistogramVec
-	procTimeHistogram      prometheus.Histogram
-	rttTimeHistogram       *prometheus.HistogramVec
+// defaultLatencyBuckets span from seconds to a day, readings are collected
+// every few minutes and stations report them up to hours late
+var defaultLatencyBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 7200, 14400, 43200, 86400}
 
-	procTime = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "processing_time_ms",
-			Help: "Gauge of processing times.",
-		},
-	)
-	rTTTimes = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "rtt_times_ms",
-			Help: "Gauge of round-trip times for different services.",
-		},
-		[]string{"service"})
-)
+// Metrics are the metrics of a service
+type Metrics struct {
+	registry *prometheus.Registry
+
+	sentDataBytes *prometheus.HistogramVec
+	procTime      *prometheus.HistogramVec
+	rttTime       *prometheus.HistogramVec
+	rtt           *prometheus.GaugeVec
+	freshness     *prometheus.HistogramVec
+	latency       *prometheus.HistogramVec
+
+	received  prometheus.Counter
+	accepted  prometheus.Counter
+	rejected  *prometheus.CounterVec
+	forwarded *prometheus.CounterVec
+	inFlight  *prometheus.GaugeVec
 
-func (m *Metric) RegisterMetrics(sentDataBuckets, procTimeBuckets, rttTimeBuckets []float64) {
+	queueDepth    *prometheus.GaugeVec
+	queueRejected *prometheus.CounterVec
+
+	connReady       *prometheus.GaugeVec
+	connTransitions *prometheus.CounterVec
+
+	denied *prometheus.CounterVec
+}
 
-	if sentDataBuckets == nil {
-		sentDataBuckets = prometheus.DefBuckets
+// New creates the metrics of service in a new registry, along with the Go runtime
+// and process metrics and the build_info of the service
+func New(service string, b Buckets) *Metrics {
+	if b.SentData == nil {
+		b.SentData = prometheus.DefBuckets
 	}
-	if procTimeBuckets == nil {
-		procTimeBuckets = prometheus.DefBuckets
+	if b.ProcTime == nil {
+		b.ProcTime = prometheus.DefBuckets
 	}
-	if rttTimeBuckets == nil {
-		rttTimeBuckets = prometheus.DefBuckets
+	if b.RttTime == nil {
+		b.RttTime = prometheus.DefBuckets
+	}
+	if b.Latency == nil {
+		b.Latency = defaultLatencyBuckets
 	}
 
-	sentDataBytesHistogram = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "sent_data_bytes_histogram",
-			Help:    "Histogram of sent data bytes.",
-			Buckets: sentDataBuckets,
-		},
-		[]string{"service"},
-	)
-	procTimeHistogram = prometheus.NewHistogram(
-		prometheus.HistogramOpts{
-			Name:    "processing_time_ms_histogram",
-			Help:    "Histogram of processing times.",
-			Buckets: procTimeBuckets,
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		sentDataBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "sent_data_bytes_histogram",
+				Help:    "Histogram of sent data bytes.",
+				Buckets: b.SentData,
+			},
+			[]string{"service"},
+		),
+		procTime: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "processing_time_seconds",
+				Help:    "Histogram of processing times by stage.",
+				Buckets: b.ProcTime,
+			},
+			[]string{"stage"},
+		),
+		rttTime: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "rtt_times_ms_histogram",
+				Help:    "Histogram of round-trip times.",
+				Buckets: b.RttTime,
+			},
+			[]string{"service"},
+		),
+		rtt: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "rtt_times_ms",
+				Help: "Gauge of round-trip times for different services.",
+			},
+			[]string{"service"},
+		),
+		freshness: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "reading_freshness_seconds",
+				Help:    "Histogram of the age of readings, since they were observed at the station, when they reach a stage.",
+				Buckets: b.Latency,
+			},
+			[]string{"stage", "station"},
+		),
+		latency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "reading_latency_seconds",
+				Help:    "Histogram of the end-to-end latency of readings, since they were collected, when they reach a stage.",
+				Buckets: b.Latency,
+			},
+			[]string{"stage", "station"},
+		),
+		received: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "records_received_total",
+				Help: "Counter of records received.",
+			},
+		),
+		accepted: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "records_accepted_total",
+				Help: "Counter of records that passed validation.",
+			},
+		),
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "records_rejected_total",
+				Help: "Counter of the rejections of records by reason.",
+			},
+			[]string{"reason"},
+		),
+		forwarded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "records_forwarded_total",
+				Help: "Counter of records sent to the next service.",
+			},
+			[]string{"service"},
+		),
+		inFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "in_flight",
+				Help: "Gauge of the requests and payloads being handled by stage.",
+			},
+			[]string{"stage"},
+		),
+		queueDepth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "queue_depth",
+				Help: "Gauge of the work waiting in the queue of a worker pool.",
+			},
+			[]string{"pool"},
+		),
+		queueRejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "queue_rejected_total",
+				Help: "Counter of the work turned away by a worker pool with a full queue.",
+			},
+			[]string{"pool"},
+		),
+		connReady: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "client_connection_ready",
+				Help: "Gauge of the connections to the next services, 1 while ready.",
+			},
+			[]string{"service"},
+		),
+		connTransitions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "client_connection_state_changes_total",
+				Help: "Counter of the connectivity states entered by the connections to the next services.",
+			},
+			[]string{"service", "state"},
+		),
+		denied: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "auth_denied_total",
+				Help: "Counter of the calls denied by method and status code.",
+			},
+			[]string{"method", "code"},
+		),
+	}
+
+	buildInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "build_info",
+			Help: "Build information of the service, always 1.",
 		},
+		[]string{"service", "version", "revision", "goversion"},
 	)
-	rttTimeHistogram = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "rtt_times_ms_histogram",
-			Help:    "Histogram of round-trip times.",
-			Buckets: rttTimeBuckets,
-		},
-		[]string{"service"},
+	version, revision := buildVersion()
+	buildInfo.WithLabelValues(service, version, revision, runtime.Version()).Set(1)
+
+	m.registry.MustRegister(
+		m.sentDataBytes, m.procTime, m.rttTime, m.rtt, m.freshness, m.latency,
+		m.received, m.accepted, m.rejected, m.forwarded, m.inFlight, m.queueDepth, m.queueRejected,
+		m.connReady, m.connTransitions, m.denied, buildInfo,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
+	return m
+}
+
+// buildVersion returns the module version and VCS revision the binary was built from
+func buildVersion() (version, revision string) {
+	version, revision = "unknown", "unknown"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if info.Main.Version != "" {
+		version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			revision = s.Value
+		}
+	}
+	return
+}
+
+// Handler serves the metrics of the registry
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// Gatherer returns the registry of the metrics
+func (m *Metrics) Gatherer() prometheus.Gatherer {
+	return m.registry
+}
+
+// AddSentDataBytes records the size of a message sent to service
+func (m *Metrics) AddSentDataBytes(service string, bytes float64) {
+	m.sentDataBytes.WithLabelValues(service).Observe(bytes)
+}
 
-	// Register the metrics with Prometheus
-	prometheus.MustRegister(sentDataBytesHistogram)
-	prometheus.MustRegister(procTimeHistogram)
-	prometheus.MustRegister(rttTimeHistogram)
-	prometheus.MustRegister(procTime)
-	prometheus.MustRegister(rTTTimes)
+// AddProcessingTime records the seconds spent in stage
+func (m *Metrics) AddProcessingTime(stage string, seconds float64) {
+	m.procTime.WithLabelValues(stage).Observe(seconds)
 }
 
-type Metric struct {
-	mu sync.Mutex
+// AddRttTime records the round-trip time to service in milliseconds
+func (m *Metrics) AddRttTime(service string, time float64) {
+	m.rttTime.WithLabelValues(service).Observe(time)
+	m.rtt.WithLabelValues(service).Set(time)
 }
 
-func (m *Metric) AddSentDataBytes(s string, bytes float64) {
-	m.lock()
-	defer m.unlock()
-	sentDataBytesHistogram.WithLabelValues(s).Observe(bytes)
+// AddReceived counts n records received
+func (m *Metrics) AddReceived(n int) {
+	m.received.Add(float64(n))
 }
 
-func (m *Metric) AddProcessingTime(s string, time float64) {
-	m.lock()
-	defer m.unlock()
-	procTimeHistogram.Observe(time)
-	procTime.Set(time)
+// AddAccepted counts n records that passed validation
+func (m *Metrics) AddAccepted(n int) {
+	m.accepted.Add(float64(n))
 }
 
-func (m *Metric) AddRttTime(s string, time float64) {
-	m.lock()
-	defer m.unlock()
-	rttTimeHistogram.WithLabelValues(s).Observe(time)
-	rTTTimes.WithLabelValues(s).Set(time)
+// AddRejected counts a record rejected for the given reason
+func (m *Metrics) AddRejected(reason string) {
+	m.rejected.WithLabelValues(reason).Inc()
 }
 
-func (m *Metric) lock() {
-	m.mu.Lock()
+// AddForwarded counts n records sent to service
+func (m *Metrics) AddForwarded(service string, n int) {
+	m.forwarded.WithLabelValues(service).Add(float64(n))
 }
 
-func (m *Metric) unlock() {
-	m.mu.Unlock()
+// InFlight counts a request or payload being handled in stage until
+// the returned function is called
+func (m *Metrics) InFlight(stage string) func() {
+	g := m.inFlight.WithLabelValues(stage)
+	g.Inc()
+	return g.Dec
+}
+
+// SetQueueDepth records the work waiting in the queue of pool
+func (m *Metrics) SetQueueDepth(pool string, depth int) {
+	m.queueDepth.WithLabelValues(pool).Set(float64(depth))
+}
+
+// AddQueueRejected counts work turned away by pool
+func (m *Metrics) AddQueueRejected(pool string) {
+	m.queueRejected.WithLabelValues(pool).Inc()
+}
+
+// SetConnState records that the connection to service entered state
+func (m *Metrics) SetConnState(service, state string, ready bool) {
+	m.connTransitions.WithLabelValues(service, state).Inc()
+	v := 0.0
+	if ready {
+		v = 1
+	}
+	m.connReady.WithLabelValues(service).Set(v)
+}
+
+// AddDenied counts a call of method denied with code
+func (m *Metrics) AddDenied(method, code string) {
+	m.denied.WithLabelValues(method, code).Inc()
+}
+
+// AddLineage records the freshness and end-to-end latency of a reading of station
+// that reached stage. Readings that were not collected live, e.g. backfilled ones,
+// are left out since their age says nothing about the pipeline.
+func (m *Metrics) AddLineage(station int, stage api.Stage, l api.Lineage) {
+	if _, ok := l.At(api.StageCollected); !ok {
+		return
+	}
+	labels := []string{string(stage), strconv.Itoa(station)}
+	if d, ok := l.Freshness(stage); ok {
+		m.freshness.WithLabelValues(labels...).Observe(d.Seconds())
+	}
+	if d, ok := l.Latency(stage); ok && stage != api.StageCollected {
+		m.latency.WithLabelValues(labels...).Observe(d.Seconds())
+	}
 }
@@ -0,0 +1,135 @@
+// Package pool runs the work handed off by the handlers of a service on a fixed
+// number of workers fed by a bounded queue. Once the queue is full the work is
+// turned away, so that a burst is pushed back to the callers instead of piling
+// up goroutines until the service runs out of memory.
+package pool
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/etesami/air-quality-monitoring/pkg/metric"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The errors of Submit and Do are gRPC statuses, handlers return them as they are
+var (
+	// ErrFull tells the caller to back off and retry later
+	ErrFull = status.Error(codes.ResourceExhausted, "processing queue is full, retry later")
+	// ErrClosed is returned once the pool is shutting down
+	ErrClosed = status.Error(codes.Unavailable, "service is shutting down")
+)
+
+// Config configures a pool
+type Config struct {
+	Workers   int `config:"workers" env:"WORKERS" default:"8" usage:"number of payloads processed at once"`
+	QueueSize int `config:"queueSize" env:"QUEUE_SIZE" default:"100" usage:"number of payloads waiting for a worker before the calls are turned away"`
+}
+
+func (c *Config) Validate() error {
+	if c.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1")
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("queueSize may not be negative")
+	}
+	return nil
+}
+
+// Pool runs work on its workers, it is safe for concurrent use
+type Pool struct {
+	name   string
+	metric *metric.Metrics
+	queue  chan func()
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New starts the workers of the pool name, its queue depth and
+// rejections are recorded in m
+func New(name string, cfg Config, m *metric.Metrics) *Pool {
+	p := &Pool{
+		name:   name,
+		metric: m,
+		queue:  make(chan func(), cfg.QueueSize),
+		done:   make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	for range cfg.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(p.done)
+	}()
+	m.SetQueueDepth(name, 0)
+	return p
+}
+
+// work runs the queued work until the queue is closed and drained
+func (p *Pool) work() {
+	for f := range p.queue {
+		p.metric.SetQueueDepth(p.name, len(p.queue))
+		f()
+	}
+}
+
+// Submit queues f, it returns ErrFull without waiting when the queue is full
+func (p *Pool) Submit(f func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	select {
+	case p.queue <- f:
+		p.metric.SetQueueDepth(p.name, len(p.queue))
+		return nil
+	default:
+		p.metric.AddQueueRejected(p.name)
+		return ErrFull
+	}
+}
+
+// Do runs f on a worker and returns its error once it is done, it returns ErrFull
+// or ErrClosed without running f as Submit does. Once ctx is done Do returns its
+// error as a gRPC status without waiting any longer, f still runs.
+func (p *Pool) Do(ctx context.Context, f func() error) error {
+	done := make(chan error, 1)
+	if err := p.Submit(func() { done <- f() }); err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// Wait stops the pool from taking more work and waits until the queued
+// and running work is done or ctx is done
+func (p *Pool) Wait(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("work still queued or running: %v", ctx.Err())
+	}
+}
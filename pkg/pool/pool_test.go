@@ -0,0 +1,171 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/etesami/air-quality-monitoring/pkg/metric"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newPool(t *testing.T, workers, queueSize int) *Pool {
+	t.Helper()
+	return New("test", Config{Workers: workers, QueueSize: queueSize}, metric.New("test", metric.Buckets{}))
+}
+
+// block occupies all the workers of p until the returned func is called
+func block(t *testing.T, p *Pool, workers int) func() {
+	t.Helper()
+	release := make(chan struct{})
+	started := make(chan struct{}, workers)
+	for range workers {
+		if err := p.Submit(func() {
+			started <- struct{}{}
+			<-release
+		}); err != nil {
+			t.Fatalf("Submit(): %v", err)
+		}
+	}
+	for range workers {
+		<-started
+	}
+	return func() { close(release) }
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "valid", cfg: Config{Workers: 8, QueueSize: 100}},
+		{name: "no queue", cfg: Config{Workers: 1, QueueSize: 0}},
+		{name: "no workers", cfg: Config{Workers: 0, QueueSize: 10}, wantErr: true},
+		{name: "negative queue", cfg: Config{Workers: 1, QueueSize: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	tests := []struct {
+		name      string
+		workers   int
+		queueSize int
+		submit    int
+		wantFull  int
+	}{
+		{name: "queue has room", workers: 2, queueSize: 3, submit: 3},
+		{name: "queue is full", workers: 2, queueSize: 3, submit: 5, wantFull: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPool(t, tt.workers, tt.queueSize)
+			release := block(t, p, tt.workers)
+
+			var ran atomic.Int32
+			full := 0
+			for range tt.submit {
+				err := p.Submit(func() { ran.Add(1) })
+				switch {
+				case errors.Is(err, ErrFull):
+					full++
+				case err != nil:
+					t.Fatalf("Submit(): %v", err)
+				}
+			}
+			if full != tt.wantFull {
+				t.Errorf("Submit() turned away %d, want %d", full, tt.wantFull)
+			}
+			if status.Code(ErrFull) != codes.ResourceExhausted {
+				t.Errorf("ErrFull has code %s", status.Code(ErrFull))
+			}
+
+			release()
+			if err := p.Wait(context.Background()); err != nil {
+				t.Fatalf("Wait(): %v", err)
+			}
+			if got, want := int(ran.Load()), tt.submit-tt.wantFull; got != want {
+				t.Errorf("ran %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	p := newPool(t, 1, 1)
+	release := block(t, p, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Wait(ctx); err == nil {
+		t.Error("Wait() with running work = nil, want an error")
+	}
+	if err := p.Submit(func() {}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Submit() after Wait = %v, want ErrClosed", err)
+	}
+	if err := p.Do(context.Background(), func() error { return nil }); !errors.Is(err, ErrClosed) {
+		t.Errorf("Do() after Wait = %v, want ErrClosed", err)
+	}
+
+	release()
+	if err := p.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() = %v", err)
+	}
+}
+
+func TestDo(t *testing.T) {
+	errStore := errors.New("store failed")
+	tests := []struct {
+		name     string
+		full     bool
+		f        func() error
+		timeout  time.Duration
+		wantErr  error
+		wantCode codes.Code
+	}{
+		{name: "success", f: func() error { return nil }},
+		{name: "error of f", f: func() error { return errStore }, wantErr: errStore},
+		{name: "queue is full", full: true, f: func() error { return nil }, wantErr: ErrFull},
+		{name: "deadline", f: func() error { time.Sleep(200 * time.Millisecond); return nil },
+			timeout: 10 * time.Millisecond, wantCode: codes.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPool(t, 1, 1)
+			defer p.Wait(context.Background())
+			if tt.full {
+				defer block(t, p, 1)()
+				if err := p.Submit(func() {}); err != nil {
+					t.Fatalf("Submit(): %v", err)
+				}
+			}
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			err := p.Do(ctx, tt.f)
+			switch {
+			case tt.wantCode != codes.OK:
+				if status.Code(err) != tt.wantCode {
+					t.Errorf("Do() = %v, want code %s", err, tt.wantCode)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Errorf("Do() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
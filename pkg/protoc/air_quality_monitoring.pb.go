@@ -79,6 +79,7 @@ type DataResponse struct {
 	Payload           string                 `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
 	ReceivedTimestamp string                 `protobuf:"bytes,3,opt,name=received_timestamp,json=receivedTimestamp,proto3" json:"received_timestamp,omitempty"`
 	SentTimestamp     string                 `protobuf:"bytes,4,opt,name=sent_timestamp,json=sentTimestamp,proto3" json:"sent_timestamp,omitempty"`
+	Chunk             []byte                 `protobuf:"bytes,5,opt,name=chunk,proto3" json:"chunk,omitempty"`
 	unknownFields     protoimpl.UnknownFields
 	sizeCache         protoimpl.SizeCache
 }
@@ -141,6 +142,13 @@ func (x *DataResponse) GetSentTimestamp() string {
 	return ""
 }
 
+func (x *DataResponse) GetChunk() []byte {
+	if x != nil {
+		return x.Chunk
+	}
+	return nil
+}
+
 type Ack struct {
 	state                 protoimpl.MessageState `protogen:"open.v1"`
 	Status                string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
@@ -216,21 +224,30 @@ const file_air_quality_monitoring_proto_rawDesc = "" +
 	"\x1cair_quality_monitoring.proto\x12\x16air_quality_monitoring\"G\n" +
 	"\x04Data\x12\x18\n" +
 	"\apayload\x18\x01 \x01(\tR\apayload\x12%\n" +
-	"\x0esent_timestamp\x18\x02 \x01(\tR\rsentTimestamp\"\x96\x01\n" +
+	"\x0esent_timestamp\x18\x02 \x01(\tR\rsentTimestamp\"\xac\x01\n" +
 	"\fDataResponse\x12\x16\n" +
 	"\x06status\x18\x01 \x01(\tR\x06status\x12\x18\n" +
 	"\apayload\x18\x02 \x01(\tR\apayload\x12-\n" +
 	"\x12received_timestamp\x18\x03 \x01(\tR\x11receivedTimestamp\x12%\n" +
-	"\x0esent_timestamp\x18\x04 \x01(\tR\rsentTimestamp\"\xb2\x01\n" +
+	"\x0esent_timestamp\x18\x04 \x01(\tR\rsentTimestamp\x12\x14\n" +
+	"\x05chunk\x18\x05 \x01(\fR\x05chunk\"\xb2\x01\n" +
 	"\x03Ack\x12\x16\n" +
 	"\x06status\x18\x01 \x01(\tR\x06status\x126\n" +
 	"\x17original_sent_timestamp\x18\x02 \x01(\tR\x15originalSentTimestamp\x12-\n" +
 	"\x12received_timestamp\x18\x03 \x01(\tR\x11receivedTimestamp\x12,\n" +
-	"\x12ack_sent_timestamp\x18\x04 \x01(\tR\x10ackSentTimestamp2\x90\x02\n" +
+	"\x12ack_sent_timestamp\x18\x04 \x01(\tR\x10ackSentTimestamp2\xe4\x02\n" +
 	"\x14AirQualityMonitoring\x12M\n" +
 	"\x10SendDataToServer\x12\x1c.air_quality_monitoring.Data\x1a\x1b.air_quality_monitoring.Ack\x12[\n" +
 	"\x15ReceiveDataFromServer\x12\x1c.air_quality_monitoring.Data\x1a$.air_quality_monitoring.DataResponse\x12L\n" +
-	"\x0fCheckConnection\x12\x1c.air_quality_monitoring.Data\x1a\x1b.air_quality_monitoring.AckB2Z0github.com/etesami/air-quality-monitoring/protocb\x06proto3"
+	"\x0fCheckConnection\x12\x1c.air_quality_monitoring.Data\x1a\x1b.air_quality_monitoring.Ack\x12R\n" +
+	"\n" +
+	"ExportData\x12\x1c.air_quality_monitoring.Data\x1a$.air_quality_monitoring.DataResponse0\x012\xd8\x02\n" +
+	"\n" +
+	"DeadLetter\x12U\n" +
+	"\x0fListDeadLetters\x12\x1c.air_quality_monitoring.Data\x1a$.air_quality_monitoring.DataResponse\x12S\n" +
+	"\rGetDeadLetter\x12\x1c.air_quality_monitoring.Data\x1a$.air_quality_monitoring.DataResponse\x12O\n" +
+	"\x12ReinjectDeadLetter\x12\x1c.air_quality_monitoring.Data\x1a\x1b.air_quality_monitoring.Ack\x12M\n" +
+	"\x10DeleteDeadLetter\x12\x1c.air_quality_monitoring.Data\x1a\x1b.air_quality_monitoring.AckB2Z0github.com/etesami/air-quality-monitoring/protocb\x06proto3"
 
 var (
 	file_air_quality_monitoring_proto_rawDescOnce sync.Once
@@ -254,11 +271,21 @@ var file_air_quality_monitoring_proto_depIdxs = []int32{
 	0, // 0: air_quality_monitoring.AirQualityMonitoring.SendDataToServer:input_type -> air_quality_monitoring.Data
 	0, // 1: air_quality_monitoring.AirQualityMonitoring.ReceiveDataFromServer:input_type -> air_quality_monitoring.Data
 	0, // 2: air_quality_monitoring.AirQualityMonitoring.CheckConnection:input_type -> air_quality_monitoring.Data
-	2, // 3: air_quality_monitoring.AirQualityMonitoring.SendDataToServer:output_type -> air_quality_monitoring.Ack
-	1, // 4: air_quality_monitoring.AirQualityMonitoring.ReceiveDataFromServer:output_type -> air_quality_monitoring.DataResponse
-	2, // 5: air_quality_monitoring.AirQualityMonitoring.CheckConnection:output_type -> air_quality_monitoring.Ack
-	3, // [3:6] is the sub-list for method output_type
-	0, // [0:3] is the sub-list for method input_type
+	0, // 3: air_quality_monitoring.AirQualityMonitoring.ExportData:input_type -> air_quality_monitoring.Data
+	0, // 4: air_quality_monitoring.DeadLetter.ListDeadLetters:input_type -> air_quality_monitoring.Data
+	0, // 5: air_quality_monitoring.DeadLetter.GetDeadLetter:input_type -> air_quality_monitoring.Data
+	0, // 6: air_quality_monitoring.DeadLetter.ReinjectDeadLetter:input_type -> air_quality_monitoring.Data
+	0, // 7: air_quality_monitoring.DeadLetter.DeleteDeadLetter:input_type -> air_quality_monitoring.Data
+	2, // 8: air_quality_monitoring.AirQualityMonitoring.SendDataToServer:output_type -> air_quality_monitoring.Ack
+	1, // 9: air_quality_monitoring.AirQualityMonitoring.ReceiveDataFromServer:output_type -> air_quality_monitoring.DataResponse
+	2, // 10: air_quality_monitoring.AirQualityMonitoring.CheckConnection:output_type -> air_quality_monitoring.Ack
+	1, // 11: air_quality_monitoring.AirQualityMonitoring.ExportData:output_type -> air_quality_monitoring.DataResponse
+	1, // 12: air_quality_monitoring.DeadLetter.ListDeadLetters:output_type -> air_quality_monitoring.DataResponse
+	1, // 13: air_quality_monitoring.DeadLetter.GetDeadLetter:output_type -> air_quality_monitoring.DataResponse
+	2, // 14: air_quality_monitoring.DeadLetter.ReinjectDeadLetter:output_type -> air_quality_monitoring.Ack
+	2, // 15: air_quality_monitoring.DeadLetter.DeleteDeadLetter:output_type -> air_quality_monitoring.Ack
+	8, // [8:16] is the sub-list for method output_type
+	0, // [0:8] is the sub-list for method input_type
 	0, // [0:0] is the sub-list for extension type_name
 	0, // [0:0] is the sub-list for extension extendee
 	0, // [0:0] is the sub-list for field type_name
@@ -277,7 +304,7 @@ func file_air_quality_monitoring_proto_init() {
 			NumEnums:      0,
 			NumMessages:   3,
 			NumExtensions: 0,
-			NumServices:   1,
+			NumServices:   2,
 		},
 		GoTypes:           file_air_quality_monitoring_proto_goTypes,
 		DependencyIndexes: file_air_quality_monitoring_proto_depIdxs,
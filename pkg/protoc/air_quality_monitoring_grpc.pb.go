@@ -22,6 +22,7 @@ const (
 	AirQualityMonitoring_SendDataToServer_FullMethodName      = "/air_quality_monitoring.AirQualityMonitoring/SendDataToServer"
 	AirQualityMonitoring_ReceiveDataFromServer_FullMethodName = "/air_quality_monitoring.AirQualityMonitoring/ReceiveDataFromServer"
 	AirQualityMonitoring_CheckConnection_FullMethodName       = "/air_quality_monitoring.AirQualityMonitoring/CheckConnection"
+	AirQualityMonitoring_ExportData_FullMethodName            = "/air_quality_monitoring.AirQualityMonitoring/ExportData"
 )
 
 // AirQualityMonitoringClient is the client API for AirQualityMonitoring service.
@@ -36,6 +37,8 @@ type AirQualityMonitoringClient interface {
 	// A simple RPC to send a ping to the service and receive a pong primarily for
 	// testing the connection and latency
 	CheckConnection(ctx context.Context, in *Data, opts ...grpc.CallOption) (*Ack, error)
+	// A server-streaming RPC to export stored data in chunks
+	ExportData(ctx context.Context, in *Data, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DataResponse], error)
 }
 
 type airQualityMonitoringClient struct {
@@ -76,6 +79,25 @@ func (c *airQualityMonitoringClient) CheckConnection(ctx context.Context, in *Da
 	return out, nil
 }
 
+func (c *airQualityMonitoringClient) ExportData(ctx context.Context, in *Data, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DataResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AirQualityMonitoring_ServiceDesc.Streams[0], AirQualityMonitoring_ExportData_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Data, DataResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AirQualityMonitoring_ExportDataClient = grpc.ServerStreamingClient[DataResponse]
+
 // AirQualityMonitoringServer is the server API for AirQualityMonitoring service.
 // All implementations must embed UnimplementedAirQualityMonitoringServer
 // for forward compatibility.
@@ -88,6 +110,8 @@ type AirQualityMonitoringServer interface {
 	// A simple RPC to send a ping to the service and receive a pong primarily for
 	// testing the connection and latency
 	CheckConnection(context.Context, *Data) (*Ack, error)
+	// A server-streaming RPC to export stored data in chunks
+	ExportData(*Data, grpc.ServerStreamingServer[DataResponse]) error
 	mustEmbedUnimplementedAirQualityMonitoringServer()
 }
 
@@ -107,6 +131,9 @@ func (UnimplementedAirQualityMonitoringServer) ReceiveDataFromServer(context.Con
 func (UnimplementedAirQualityMonitoringServer) CheckConnection(context.Context, *Data) (*Ack, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method CheckConnection not implemented")
 }
+func (UnimplementedAirQualityMonitoringServer) ExportData(*Data, grpc.ServerStreamingServer[DataResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ExportData not implemented")
+}
 func (UnimplementedAirQualityMonitoringServer) mustEmbedUnimplementedAirQualityMonitoringServer() {}
 func (UnimplementedAirQualityMonitoringServer) testEmbeddedByValue()                              {}
 
@@ -182,6 +209,17 @@ func _AirQualityMonitoring_CheckConnection_Handler(srv interface{}, ctx context.
 	return interceptor(ctx, in, info, handler)
 }
 
+func _AirQualityMonitoring_ExportData_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Data)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AirQualityMonitoringServer).ExportData(m, &grpc.GenericServerStream[Data, DataResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AirQualityMonitoring_ExportDataServer = grpc.ServerStreamingServer[DataResponse]
+
 // AirQualityMonitoring_ServiceDesc is the grpc.ServiceDesc for AirQualityMonitoring service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -202,6 +240,244 @@ var AirQualityMonitoring_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _AirQualityMonitoring_CheckConnection_Handler,
 		},
 	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ExportData",
+			Handler:       _AirQualityMonitoring_ExportData_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "air_quality_monitoring.proto",
+}
+
+const (
+	DeadLetter_ListDeadLetters_FullMethodName    = "/air_quality_monitoring.DeadLetter/ListDeadLetters"
+	DeadLetter_GetDeadLetter_FullMethodName      = "/air_quality_monitoring.DeadLetter/GetDeadLetter"
+	DeadLetter_ReinjectDeadLetter_FullMethodName = "/air_quality_monitoring.DeadLetter/ReinjectDeadLetter"
+	DeadLetter_DeleteDeadLetter_FullMethodName   = "/air_quality_monitoring.DeadLetter/DeleteDeadLetter"
+)
+
+// DeadLetterClient is the client API for DeadLetter service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// DeadLetter exposes the records a service rejected. The payloads of the
+// requests and responses are JSON documents defined in pkg/deadletter.
+type DeadLetterClient interface {
+	// Lists the rejected records matching the query in the payload
+	ListDeadLetters(ctx context.Context, in *Data, opts ...grpc.CallOption) (*DataResponse, error)
+	// Returns the rejected record with the ID in the payload
+	GetDeadLetter(ctx context.Context, in *Data, opts ...grpc.CallOption) (*DataResponse, error)
+	// Processes the record with the ID in the payload again, and
+	// removes it unless processing fails
+	ReinjectDeadLetter(ctx context.Context, in *Data, opts ...grpc.CallOption) (*Ack, error)
+	// Removes the record with the ID in the payload
+	DeleteDeadLetter(ctx context.Context, in *Data, opts ...grpc.CallOption) (*Ack, error)
+}
+
+type deadLetterClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDeadLetterClient(cc grpc.ClientConnInterface) DeadLetterClient {
+	return &deadLetterClient{cc}
+}
+
+func (c *deadLetterClient) ListDeadLetters(ctx context.Context, in *Data, opts ...grpc.CallOption) (*DataResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DataResponse)
+	err := c.cc.Invoke(ctx, DeadLetter_ListDeadLetters_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deadLetterClient) GetDeadLetter(ctx context.Context, in *Data, opts ...grpc.CallOption) (*DataResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DataResponse)
+	err := c.cc.Invoke(ctx, DeadLetter_GetDeadLetter_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deadLetterClient) ReinjectDeadLetter(ctx context.Context, in *Data, opts ...grpc.CallOption) (*Ack, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Ack)
+	err := c.cc.Invoke(ctx, DeadLetter_ReinjectDeadLetter_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deadLetterClient) DeleteDeadLetter(ctx context.Context, in *Data, opts ...grpc.CallOption) (*Ack, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Ack)
+	err := c.cc.Invoke(ctx, DeadLetter_DeleteDeadLetter_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeadLetterServer is the server API for DeadLetter service.
+// All implementations must embed UnimplementedDeadLetterServer
+// for forward compatibility.
+//
+// DeadLetter exposes the records a service rejected. The payloads of the
+// requests and responses are JSON documents defined in pkg/deadletter.
+type DeadLetterServer interface {
+	// Lists the rejected records matching the query in the payload
+	ListDeadLetters(context.Context, *Data) (*DataResponse, error)
+	// Returns the rejected record with the ID in the payload
+	GetDeadLetter(context.Context, *Data) (*DataResponse, error)
+	// Processes the record with the ID in the payload again, and
+	// removes it unless processing fails
+	ReinjectDeadLetter(context.Context, *Data) (*Ack, error)
+	// Removes the record with the ID in the payload
+	DeleteDeadLetter(context.Context, *Data) (*Ack, error)
+	mustEmbedUnimplementedDeadLetterServer()
+}
+
+// UnimplementedDeadLetterServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedDeadLetterServer struct{}
+
+func (UnimplementedDeadLetterServer) ListDeadLetters(context.Context, *Data) (*DataResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDeadLetters not implemented")
+}
+func (UnimplementedDeadLetterServer) GetDeadLetter(context.Context, *Data) (*DataResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDeadLetter not implemented")
+}
+func (UnimplementedDeadLetterServer) ReinjectDeadLetter(context.Context, *Data) (*Ack, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReinjectDeadLetter not implemented")
+}
+func (UnimplementedDeadLetterServer) DeleteDeadLetter(context.Context, *Data) (*Ack, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteDeadLetter not implemented")
+}
+func (UnimplementedDeadLetterServer) mustEmbedUnimplementedDeadLetterServer() {}
+func (UnimplementedDeadLetterServer) testEmbeddedByValue()                    {}
+
+// UnsafeDeadLetterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DeadLetterServer will
+// result in compilation errors.
+type UnsafeDeadLetterServer interface {
+	mustEmbedUnimplementedDeadLetterServer()
+}
+
+func RegisterDeadLetterServer(s grpc.ServiceRegistrar, srv DeadLetterServer) {
+	// If the following call pancis, it indicates UnimplementedDeadLetterServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&DeadLetter_ServiceDesc, srv)
+}
+
+func _DeadLetter_ListDeadLetters_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Data)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeadLetterServer).ListDeadLetters(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeadLetter_ListDeadLetters_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeadLetterServer).ListDeadLetters(ctx, req.(*Data))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeadLetter_GetDeadLetter_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Data)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeadLetterServer).GetDeadLetter(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeadLetter_GetDeadLetter_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeadLetterServer).GetDeadLetter(ctx, req.(*Data))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeadLetter_ReinjectDeadLetter_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Data)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeadLetterServer).ReinjectDeadLetter(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeadLetter_ReinjectDeadLetter_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeadLetterServer).ReinjectDeadLetter(ctx, req.(*Data))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeadLetter_DeleteDeadLetter_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Data)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeadLetterServer).DeleteDeadLetter(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeadLetter_DeleteDeadLetter_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeadLetterServer).DeleteDeadLetter(ctx, req.(*Data))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// DeadLetter_ServiceDesc is the grpc.ServiceDesc for DeadLetter service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DeadLetter_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "air_quality_monitoring.DeadLetter",
+	HandlerType: (*DeadLetterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListDeadLetters",
+			Handler:    _DeadLetter_ListDeadLetters_Handler,
+		},
+		{
+			MethodName: "GetDeadLetter",
+			Handler:    _DeadLetter_GetDeadLetter_Handler,
+		},
+		{
+			MethodName: "ReinjectDeadLetter",
+			Handler:    _DeadLetter_ReinjectDeadLetter_Handler,
+		},
+		{
+			MethodName: "DeleteDeadLetter",
+			Handler:    _DeadLetter_DeleteDeadLetter_Handler,
+		},
+	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "air_quality_monitoring.proto",
 }
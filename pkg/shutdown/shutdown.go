@@ -0,0 +1,166 @@
+// Package shutdown stops the services gracefully on SIGTERM. The servers stop
+// taking requests, the work in flight gets until a deadline to finish, and the
+// telemetry is flushed and the databases closed last.
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+
+	"google.golang.org/grpc"
+)
+
+// grace is the time given to the steps left once the deadline passed,
+// so that the telemetry is flushed and the databases closed anyway
+const grace = 2 * time.Second
+
+// Config configures the graceful shutdown
+type Config struct {
+	Timeout config.Duration `config:"timeout" env:"SHUTDOWN_TIMEOUT" default:"25s" usage:"time the work in flight gets to finish on SIGTERM before it is dropped"`
+}
+
+func (c *Config) Validate() error {
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	return nil
+}
+
+// Signals returns a context cancelled on SIGTERM or interrupt
+func Signals() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// Group tracks the work handed off to goroutines, e.g. the processing that outlives
+// an RPC, so that the shutdown waits for it. A nil Group tracks nothing.
+type Group struct {
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// Go runs f in a goroutine, it returns false without running f once the group is waited for
+func (g *Group) Go(f func()) bool {
+	if g == nil {
+		go f()
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// Wait stops the group from taking more work and waits for the goroutines
+// running until ctx is done
+func (g *Group) Wait(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("work still in flight: %v", ctx.Err())
+	}
+}
+
+// Step is a stage of the shutdown
+type Step struct {
+	Name string
+	Stop func(ctx context.Context) error
+}
+
+// Run runs the steps in order, they share the deadline of timeout
+func Run(timeout time.Duration, steps ...Step) {
+	slog.Info("Shutting down", "timeout", timeout.String())
+	deadline := time.Now().Add(timeout)
+	for _, step := range steps {
+		d := time.Until(deadline)
+		if d < grace {
+			d = grace
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		err := step.Stop(ctx)
+		cancel()
+		if err != nil {
+			slog.Warn("Error during shutdown", "step", step.Name, "error", err)
+			continue
+		}
+		slog.Debug("Stopped", "step", step.Name)
+	}
+	slog.Info("Shut down")
+}
+
+// GRPC stops s from taking RPCs and waits for the running ones,
+// they are cancelled once the deadline passed
+func GRPC(s *grpc.Server) Step {
+	return Step{Name: "grpc server", Stop: func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			s.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			s.Stop()
+			return fmt.Errorf("RPCs cancelled: %v", ctx.Err())
+		}
+	}}
+}
+
+// HTTP stops srv from taking requests and waits for the running ones
+func HTTP(name string, srv *http.Server) Step {
+	return Step{Name: name, Stop: srv.Shutdown}
+}
+
+// Waiter is work the shutdown waits for, such as a Group
+type Waiter interface {
+	Wait(ctx context.Context) error
+}
+
+// Wait waits for the work of w
+func Wait(name string, w Waiter) Step {
+	return Step{Name: name, Stop: w.Wait}
+}
+
+// Close closes c, e.g. a database or a client connection
+func Close(name string, c io.Closer) Step {
+	return Step{Name: name, Stop: func(context.Context) error { return c.Close() }}
+}
+
+// Do runs f, e.g. to report the service as not serving
+func Do(name string, f func()) Step {
+	return Step{Name: name, Stop: func(context.Context) error {
+		f()
+		return nil
+	}}
+}
@@ -0,0 +1,283 @@
+// Package tlsconfig secures the gRPC traffic between the services with TLS, and with
+// mutual TLS once the peers are verified against a CA. The certificate, its key and
+// the CA are read from PEM files and read again when the files change, so that
+// rotated certificates are picked up without a restart.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+)
+
+// Config configures the TLS of a server or a client
+type Config struct {
+	Enabled        bool            `config:"enabled" env:"ENABLED" default:"false" usage:"use TLS, the traffic is in plain text otherwise"`
+	Cert           string          `config:"cert" env:"CERT" usage:"PEM file of the certificate presented to the peers, required by servers"`
+	Key            string          `config:"key" env:"KEY" usage:"PEM file of the private key of the certificate"`
+	CA             string          `config:"ca" env:"CA" usage:"PEM file of the CAs the peers are verified against, servers then require client certificates; the system CAs by default"`
+	ServerName     string          `config:"serverName" env:"SERVER_NAME" usage:"name the certificate of the server is verified for, the host of the target by default"`
+	ReloadInterval config.Duration `config:"reloadInterval" env:"RELOAD_INTERVAL" default:"1m" usage:"interval between checks of the files for rotated certificates"`
+}
+
+func (c *Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if (c.Cert == "") != (c.Key == "") {
+		return fmt.Errorf("cert and key must be set together")
+	}
+	if c.ReloadInterval <= 0 {
+		return fmt.Errorf("reloadInterval must be positive")
+	}
+	return nil
+}
+
+// Flags registers the flags of the TLS of a client on fs, for the command line tools
+func Flags(fs *flag.FlagSet) *Config {
+	c := &Config{ReloadInterval: config.Duration(time.Minute)}
+	fs.BoolVar(&c.Enabled, "tls", false, "connect with TLS")
+	fs.StringVar(&c.Cert, "cert", "", "PEM file of the client certificate, for mutual TLS")
+	fs.StringVar(&c.Key, "key", "", "PEM file of the private key of the client certificate")
+	fs.StringVar(&c.CA, "ca", "", "PEM file of the CAs the server is verified against (default the system CAs)")
+	fs.StringVar(&c.ServerName, "server-name", "", "name the certificate of the server is verified for (default the host of the address)")
+	return c
+}
+
+// ServerOption returns the credentials of a server, a server with a CA
+// requires and verifies the certificates of its clients
+func ServerOption(cfg Config) (grpc.ServerOption, error) {
+	if !cfg.Enabled {
+		return grpc.Creds(insecure.NewCredentials()), nil
+	}
+	c, err := serverConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.Creds(credentials.NewTLS(c)), nil
+}
+
+// serverConfig returns the TLS config of a server of cfg
+func serverConfig(cfg Config) (*tls.Config, error) {
+	if cfg.Cert == "" {
+		return nil, fmt.Errorf("a server needs a certificate and a key")
+	}
+	f, err := load(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Every handshake gets the certificate and the CA as of now
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := f.current()
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if pool != nil {
+				c.ClientCAs = pool
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}, nil
+}
+
+// DialOption returns the credentials of a client, it presents its
+// certificate to the servers asking for one
+func DialOption(cfg Config) (grpc.DialOption, error) {
+	if !cfg.Enabled {
+		return grpc.WithTransportCredentials(insecure.NewCredentials()), nil
+	}
+	c, err := clientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(c)), nil
+}
+
+// clientConfig returns the TLS config of a client of cfg
+func clientConfig(cfg Config) (*tls.Config, error) {
+	f, err := load(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: cfg.ServerName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert, _ := f.current(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+	}
+	if cfg.CA != "" {
+		// The server is verified against the CA as of now instead of the
+		// one read on start, the verification of crypto/tls is replaced
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			_, pool := f.current()
+			return verify(cs, pool)
+		}
+	}
+	return c, nil
+}
+
+// verify verifies the certificate chain of the server of cs against roots
+func verify(cs tls.ConnectionState, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// Identity is who the peer of an RPC proved to be with its certificate
+type Identity struct {
+	CommonName string
+	DNSNames   []string
+	// URIs are e.g. the SPIFFE IDs of the peer
+	URIs []string
+}
+
+// Names returns the common name, the DNS names and the URIs of the identity
+func (id Identity) Names() []string {
+	var names []string
+	if id.CommonName != "" {
+		names = append(names, id.CommonName)
+	}
+	names = append(names, id.DNSNames...)
+	return append(names, id.URIs...)
+}
+
+// PeerIdentity returns the identity of the client of the RPC of ctx, false
+// unless the client presented a certificate the server verified
+func PeerIdentity(ctx context.Context) (Identity, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return Identity{}, false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return Identity{}, false
+	}
+	cert := info.State.VerifiedChains[0][0]
+	id := Identity{CommonName: cert.Subject.CommonName, DNSNames: cert.DNSNames}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+	}
+	return id, true
+}
+
+// files keeps the certificate and the CA read from the files of a config,
+// they are read again once the files changed
+type files struct {
+	cfg Config
+
+	mu      sync.Mutex
+	checked time.Time
+	stats   map[string]os.FileInfo
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+// load reads the files of cfg
+func load(cfg Config) (*files, error) {
+	f := &files{cfg: cfg}
+	if err := f.read(); err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+	return f, nil
+}
+
+// read reads the certificate, its key and the CA, they are kept only if all could be read
+func (f *files) read() error {
+	stats := map[string]os.FileInfo{}
+	for _, path := range []string{f.cfg.Cert, f.cfg.Key, f.cfg.CA} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", path, err)
+		}
+		stats[path] = info
+	}
+
+	var cert *tls.Certificate
+	if f.cfg.Cert != "" {
+		c, err := tls.LoadX509KeyPair(f.cfg.Cert, f.cfg.Key)
+		if err != nil {
+			return fmt.Errorf("error loading certificate: %v", err)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if f.cfg.CA != "" {
+		pem, err := os.ReadFile(f.cfg.CA)
+		if err != nil {
+			return fmt.Errorf("error reading CA: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in CA %s", f.cfg.CA)
+		}
+	}
+	f.stats, f.cert, f.pool = stats, cert, pool
+	return nil
+}
+
+// current returns the certificate and the CA, the files are checked for
+// changes at most every reload interval
+func (f *files) current() (*tls.Certificate, *x509.CertPool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checked) >= f.cfg.ReloadInterval.Duration() {
+		f.checked = time.Now()
+		if f.changed() {
+			// A rotation caught half way fails to load, the current files are
+			// kept until the next check
+			if err := f.read(); err != nil {
+				slog.Warn("Error reloading certificates, keeping the current ones", "error", err)
+			} else {
+				slog.Info("Reloaded certificates", "cert", f.cfg.Cert, "ca", f.cfg.CA)
+			}
+		}
+	}
+	return f.cert, f.pool
+}
+
+// changed reports whether any file was modified since it was read
+func (f *files) changed() bool {
+	for path, prev := range f.stats {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(prev.ModTime()) || info.Size() != prev.Size() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,341 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+)
+
+// authority is a CA issuing the certificates of a test
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// template returns the template of a certificate of cn valid for an hour
+func template(cn string) *x509.Certificate {
+	serial++
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
+
+func newAuthority(t *testing.T, name string) *authority {
+	t.Helper()
+	key := newKey(t)
+	tmpl := template(name)
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authority{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of cn, valid for the DNS name cn
+func (a *authority) issue(t *testing.T, cn string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key := newKey(t)
+	tmpl := template(cn)
+	tmpl.DNSNames = []string{cn}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// write writes data to path, moving its modification time forward so that a
+// rewrite is seen as a change whatever the resolution of the file system
+func write(t *testing.T, path string, data []byte) {
+	t.Helper()
+	var mtime time.Time
+	if info, err := os.Stat(path); err == nil {
+		mtime = info.ModTime()
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if mtime.IsZero() {
+		return
+	}
+	if err := os.Chtimes(path, mtime.Add(time.Second), mtime.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// peerFiles writes the certificate of cn issued by a and the CA ca to dir,
+// they are left out of the returned config when nil
+func peerFiles(t *testing.T, dir string, a *authority, cn string, ca *authority) Config {
+	t.Helper()
+	cfg := Config{Enabled: true, ReloadInterval: config.Duration(time.Minute)}
+	if a != nil {
+		certPEM, keyPEM := a.issue(t, cn)
+		cfg.Cert, cfg.Key = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		write(t, cfg.Cert, certPEM)
+		write(t, cfg.Key, keyPEM)
+	}
+	if ca != nil {
+		cfg.CA = filepath.Join(dir, "ca.pem")
+		write(t, cfg.CA, ca.pem)
+	}
+	return cfg
+}
+
+// handshake runs a TLS handshake of a client of clientCfg with a server of serverCfg,
+// it returns the state of the client and the errors of both ends
+func handshake(t *testing.T, serverCfg, clientCfg *tls.Config) (tls.ConnectionState, error, error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		c := tls.Server(conn, serverCfg)
+		err = c.Handshake()
+		if err == nil {
+			// a client certificate is rejected once the client finished its handshake,
+			// the client learns of it on its first read
+			_, err = c.Write([]byte{1})
+		}
+		serverErr <- err
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := tls.Client(conn, clientCfg)
+	clientErr := c.Handshake()
+	if clientErr == nil {
+		_, clientErr = c.Read(make([]byte, 1))
+	}
+	if clientErr != nil {
+		conn.Close()
+	}
+	return c.ConnectionState(), clientErr, <-serverErr
+}
+
+func TestHandshake(t *testing.T) {
+	ca := newAuthority(t, "ca")
+	other := newAuthority(t, "other")
+
+	tests := []struct {
+		name          string
+		server        func(dir string) Config
+		client        func(dir string) Config
+		serverName    string
+		wantClientErr string
+		wantServerErr string
+	}{
+		{
+			name:   "server verified",
+			server: func(dir string) Config { return peerFiles(t, dir, ca, "server.test", nil) },
+			client: func(dir string) Config { return peerFiles(t, dir, nil, "", ca) },
+		},
+		{
+			name:          "server of another CA",
+			server:        func(dir string) Config { return peerFiles(t, dir, other, "server.test", nil) },
+			client:        func(dir string) Config { return peerFiles(t, dir, nil, "", ca) },
+			wantClientErr: "certificate signed by unknown authority",
+		},
+		{
+			name:          "server of another name",
+			server:        func(dir string) Config { return peerFiles(t, dir, ca, "server.test", nil) },
+			client:        func(dir string) Config { return peerFiles(t, dir, nil, "", ca) },
+			serverName:    "other.test",
+			wantClientErr: "not other.test",
+		},
+		{
+			name:   "mutual",
+			server: func(dir string) Config { return peerFiles(t, dir, ca, "server.test", ca) },
+			client: func(dir string) Config { return peerFiles(t, dir, ca, "client.test", ca) },
+		},
+		{
+			name:          "client without a certificate",
+			server:        func(dir string) Config { return peerFiles(t, dir, ca, "server.test", ca) },
+			client:        func(dir string) Config { return peerFiles(t, dir, nil, "", ca) },
+			wantServerErr: "client didn't provide a certificate",
+		},
+		{
+			name:          "client of another CA",
+			server:        func(dir string) Config { return peerFiles(t, dir, ca, "server.test", ca) },
+			client:        func(dir string) Config { return peerFiles(t, dir, other, "client.test", ca) },
+			wantServerErr: "certificate signed by unknown authority",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := serverConfig(tt.server(t.TempDir()))
+			if err != nil {
+				t.Fatalf("serverConfig(): %v", err)
+			}
+			clientCfg := tt.client(t.TempDir())
+			clientCfg.ServerName = "server.test"
+			if tt.serverName != "" {
+				clientCfg.ServerName = tt.serverName
+			}
+			cc, err := clientConfig(clientCfg)
+			if err != nil {
+				t.Fatalf("clientConfig(): %v", err)
+			}
+
+			state, clientErr, serverErr := handshake(t, sc, cc)
+			if tt.wantClientErr != "" {
+				if clientErr == nil || !strings.Contains(clientErr.Error(), tt.wantClientErr) {
+					t.Errorf("client error = %v, want %q", clientErr, tt.wantClientErr)
+				}
+				return
+			}
+			if tt.wantServerErr != "" {
+				if serverErr == nil || !strings.Contains(serverErr.Error(), tt.wantServerErr) {
+					t.Errorf("server error = %v, want %q", serverErr, tt.wantServerErr)
+				}
+				if clientErr == nil {
+					t.Error("client connected, want the handshake rejected")
+				}
+				return
+			}
+			if clientErr != nil || serverErr != nil {
+				t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+			}
+			if cn := state.PeerCertificates[0].Subject.CommonName; cn != "server.test" {
+				t.Errorf("server is %s, want server.test", cn)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	ca := newAuthority(t, "ca")
+	serverCfg := peerFiles(t, t.TempDir(), ca, "server.test", nil)
+	clientCfg := peerFiles(t, t.TempDir(), nil, "", ca)
+	serverCfg.ReloadInterval = config.Duration(time.Nanosecond)
+	clientCfg.ReloadInterval = config.Duration(time.Nanosecond)
+	clientCfg.ServerName = "server.test"
+	sc, err := serverConfig(serverCfg)
+	if err != nil {
+		t.Fatalf("serverConfig(): %v", err)
+	}
+	cc, err := clientConfig(clientCfg)
+	if err != nil {
+		t.Fatalf("clientConfig(): %v", err)
+	}
+	// serverSerial returns the serial number of the certificate the server presents
+	serverSerial := func(step string) *big.Int {
+		t.Helper()
+		state, clientErr, serverErr := handshake(t, sc, cc)
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("%s: handshake: client %v, server %v", step, clientErr, serverErr)
+		}
+		return state.PeerCertificates[0].SerialNumber
+	}
+	first := serverSerial("first")
+
+	// the server presents its rotated certificate
+	certPEM, keyPEM := ca.issue(t, "server.test")
+	write(t, serverCfg.Cert, certPEM)
+	write(t, serverCfg.Key, keyPEM)
+	rotated := serverSerial("rotated certificate")
+	if rotated.Cmp(first) == 0 {
+		t.Fatalf("server presents certificate %s, want the rotated one", first)
+	}
+
+	// a certificate caught half way through its rotation is not loaded, the
+	// server keeps the current one
+	write(t, serverCfg.Cert, []byte("garbage"))
+	if got := serverSerial("half rotated"); got.Cmp(rotated) != 0 {
+		t.Errorf("server presents certificate %s, want %s kept", got, rotated)
+	}
+
+	// both ends move to a new CA
+	next := newAuthority(t, "next")
+	certPEM, keyPEM = next.issue(t, "server.test")
+	write(t, serverCfg.Cert, certPEM)
+	write(t, serverCfg.Key, keyPEM)
+	write(t, clientCfg.CA, next.pem)
+	serverSerial("new CA")
+
+	// the client no longer trusts a server of the previous CA
+	old, err := serverConfig(peerFiles(t, t.TempDir(), ca, "server.test", nil))
+	if err != nil {
+		t.Fatalf("serverConfig(): %v", err)
+	}
+	if _, clientErr, _ := handshake(t, old, cc); clientErr == nil || !strings.Contains(clientErr.Error(), "unknown authority") {
+		t.Errorf("client error = %v with a server of the previous CA, want unknown authority", clientErr)
+	}
+}
+
+func TestCurrentInterval(t *testing.T) {
+	ca := newAuthority(t, "ca")
+	cfg := peerFiles(t, t.TempDir(), ca, "server.test", nil)
+	f, err := load(cfg)
+	if err != nil {
+		t.Fatalf("load(): %v", err)
+	}
+	first, _ := f.current()
+
+	// the files are not checked again before the reload interval
+	certPEM, keyPEM := ca.issue(t, "server.test")
+	write(t, cfg.Cert, certPEM)
+	write(t, cfg.Key, keyPEM)
+	if cert, _ := f.current(); cert != first {
+		t.Error("certificate reloaded before the reload interval")
+	}
+	f.mu.Lock()
+	f.checked = time.Now().Add(-time.Minute)
+	f.mu.Unlock()
+	if cert, _ := f.current(); cert == first {
+		t.Error("certificate not reloaded after the reload interval")
+	}
+}
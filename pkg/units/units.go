@@ -0,0 +1,192 @@
+// Package units tags measurements with their unit and kind and converts between units.
+// Values of the same kind are only comparable once converted to the same unit, and
+// values of different kinds, e.g. an AQI sub-index and a concentration, never are.
+package units
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kind is the physical quantity a unit measures
+type Kind string
+
+const (
+	KindConcentration Kind = "concentration"
+	KindIndex         Kind = "index"
+	KindTemperature   Kind = "temperature"
+	KindPressure      Kind = "pressure"
+	KindSpeed         Kind = "speed"
+	KindHumidity      Kind = "humidity"
+)
+
+// Unit is the unit of a measurement, written as its symbol
+type Unit string
+
+const (
+	// Mass concentrations
+	MicrogramsPerCubicMeter Unit = "µg/m³"
+	MilligramsPerCubicMeter Unit = "mg/m³"
+	// Volume mixing ratios, converted to mass concentrations with ConvertGas
+	PartsPerBillion Unit = "ppb"
+	PartsPerMillion Unit = "ppm"
+	// Index is a US EPA AQI (sub-)index, as reported by WAQI
+	Index Unit = "index"
+
+	Celsius    Unit = "°C"
+	Fahrenheit Unit = "°F"
+	Kelvin     Unit = "K"
+
+	Hectopascal Unit = "hPa"
+	Pascal      Unit = "Pa"
+	Kilopascal  Unit = "kPa"
+
+	MetersPerSecond   Unit = "m/s"
+	KilometersPerHour Unit = "km/h"
+
+	// Percent is a relative humidity
+	Percent Unit = "%"
+)
+
+// definition places a unit on the scale of the canonical unit of its
+// dimension: canonical = value*scale + offset
+type definition struct {
+	kind      Kind
+	canonical Unit
+	scale     float64
+	offset    float64
+}
+
+var definitions = map[Unit]definition{
+	MicrogramsPerCubicMeter: {KindConcentration, MicrogramsPerCubicMeter, 1, 0},
+	MilligramsPerCubicMeter: {KindConcentration, MicrogramsPerCubicMeter, 1000, 0},
+	PartsPerBillion:         {KindConcentration, PartsPerBillion, 1, 0},
+	PartsPerMillion:         {KindConcentration, PartsPerBillion, 1000, 0},
+	Index:                   {KindIndex, Index, 1, 0},
+	Celsius:                 {KindTemperature, Celsius, 1, 0},
+	Fahrenheit:              {KindTemperature, Celsius, 5.0 / 9.0, -32 * 5.0 / 9.0},
+	Kelvin:                  {KindTemperature, Celsius, 1, -273.15},
+	Hectopascal:             {KindPressure, Hectopascal, 1, 0},
+	Pascal:                  {KindPressure, Hectopascal, 0.01, 0},
+	Kilopascal:              {KindPressure, Hectopascal, 10, 0},
+	MetersPerSecond:         {KindSpeed, MetersPerSecond, 1, 0},
+	KilometersPerHour:       {KindSpeed, MetersPerSecond, 1 / 3.6, 0},
+	Percent:                 {KindHumidity, Percent, 1, 0},
+}
+
+// aliases are the other spellings of the units found in exports
+var aliases = map[string]Unit{
+	"ug/m3":  MicrogramsPerCubicMeter,
+	"µg/m3":  MicrogramsPerCubicMeter,
+	"μg/m³":  MicrogramsPerCubicMeter,
+	"μg/m3":  MicrogramsPerCubicMeter,
+	"mg/m3":  MilligramsPerCubicMeter,
+	"ppbv":   PartsPerBillion,
+	"ppmv":   PartsPerMillion,
+	"aqi":    Index,
+	"c":      Celsius,
+	"°c":     Celsius,
+	"degc":   Celsius,
+	"f":      Fahrenheit,
+	"°f":     Fahrenheit,
+	"degf":   Fahrenheit,
+	"k":      Kelvin,
+	"kelvin": Kelvin,
+	"hpa":    Hectopascal,
+	"mbar":   Hectopascal,
+	"pa":     Pascal,
+	"kpa":    Kilopascal,
+	"kph":    KilometersPerHour,
+	"km/hr":  KilometersPerHour,
+	"m s-1":  MetersPerSecond,
+	"rh":     Percent,
+	"%rh":    Percent,
+}
+
+// Parse returns the unit written as s, matched case-insensitively against the
+// symbols and their common spellings
+func Parse(s string) (Unit, error) {
+	s = strings.TrimSpace(s)
+	if _, ok := definitions[Unit(s)]; ok {
+		return Unit(s), nil
+	}
+	if u, ok := aliases[strings.ToLower(s)]; ok {
+		return u, nil
+	}
+	return "", fmt.Errorf("unknown unit %q", s)
+}
+
+// Valid reports whether u is a known unit
+func (u Unit) Valid() bool {
+	_, ok := definitions[u]
+	return ok
+}
+
+// Kind returns the kind of u, empty for unknown units
+func (u Unit) Kind() Kind {
+	return definitions[u].kind
+}
+
+// Canonical returns the unit values of u are stored in: µg/m³ for mass
+// concentrations, ppb for mixing ratios, °C, hPa, m/s, % and index
+func (u Unit) Canonical() Unit {
+	return definitions[u].canonical
+}
+
+// Convert converts v from one unit to another of the same kind. Mass
+// concentrations and mixing ratios are only converted by ConvertGas.
+func Convert(v float64, from, to Unit) (float64, error) {
+	f, ok := definitions[from]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", from)
+	}
+	t, ok := definitions[to]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", to)
+	}
+	if f.kind != t.kind {
+		return 0, fmt.Errorf("cannot convert %s (%s) to %s (%s)", from, f.kind, to, t.kind)
+	}
+	if f.canonical != t.canonical {
+		return 0, fmt.Errorf("cannot convert %s to %s without the molar mass of the gas", from, to)
+	}
+	return (v*f.scale + f.offset - t.offset) / t.scale, nil
+}
+
+// molarVolume is the volume of a mole of gas in litres at 25 °C and 1 atm,
+// the reference conditions of the US EPA
+const molarVolume = 24.45
+
+// molarMasses are the molar masses of the gaseous pollutants in g/mol
+var molarMasses = map[string]float64{
+	"o3":  48.00,
+	"no2": 46.01,
+	"so2": 64.07,
+	"co":  28.01,
+}
+
+// ConvertGas converts a concentration of a gaseous pollutant (o3, no2, so2 or co)
+// between mass concentrations and mixing ratios at 25 °C and 1 atm
+func ConvertGas(v float64, from, to Unit, pollutant string) (float64, error) {
+	if from.Kind() != KindConcentration || to.Kind() != KindConcentration {
+		return Convert(v, from, to)
+	}
+	if from.Canonical() == to.Canonical() {
+		return Convert(v, from, to)
+	}
+	mass, ok := molarMasses[strings.ToLower(pollutant)]
+	if !ok {
+		return 0, fmt.Errorf("unknown molar mass of %q", pollutant)
+	}
+	// Go through ppb and µg/m³: µg/m³ = ppb * M / molarVolume
+	canonical, err := Convert(v, from, from.Canonical())
+	if err != nil {
+		return 0, err
+	}
+	if from.Canonical() == PartsPerBillion {
+		canonical = canonical * mass / molarVolume
+	} else {
+		canonical = canonical * molarVolume / mass
+	}
+	return Convert(canonical, to.Canonical(), to)
+}
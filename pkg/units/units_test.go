@@ -0,0 +1,182 @@
+package units
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Unit
+		wantErr bool
+	}{
+		{in: "µg/m³", want: MicrogramsPerCubicMeter},
+		{in: "ug/m3", want: MicrogramsPerCubicMeter},
+		{in: "UG/M3", want: MicrogramsPerCubicMeter},
+		{in: "μg/m³", want: MicrogramsPerCubicMeter},
+		{in: "mg/m3", want: MilligramsPerCubicMeter},
+		{in: " ppb ", want: PartsPerBillion},
+		{in: "ppbv", want: PartsPerBillion},
+		{in: "PPMV", want: PartsPerMillion},
+		{in: "AQI", want: Index},
+		{in: "°C", want: Celsius},
+		{in: "degC", want: Celsius},
+		{in: "F", want: Fahrenheit},
+		{in: "K", want: Kelvin},
+		{in: "mbar", want: Hectopascal},
+		{in: "Pa", want: Pascal},
+		{in: "kPa", want: Kilopascal},
+		{in: "m s-1", want: MetersPerSecond},
+		{in: "kph", want: KilometersPerHour},
+		{in: "km/hr", want: KilometersPerHour},
+		{in: "%RH", want: Percent},
+		{in: "", wantErr: true},
+		{in: "furlongs", wantErr: true},
+		{in: "g/m3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse(%q) = %q, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKindAndCanonical(t *testing.T) {
+	tests := []struct {
+		unit      Unit
+		kind      Kind
+		canonical Unit
+	}{
+		{MicrogramsPerCubicMeter, KindConcentration, MicrogramsPerCubicMeter},
+		{MilligramsPerCubicMeter, KindConcentration, MicrogramsPerCubicMeter},
+		{PartsPerBillion, KindConcentration, PartsPerBillion},
+		{PartsPerMillion, KindConcentration, PartsPerBillion},
+		{Index, KindIndex, Index},
+		{Celsius, KindTemperature, Celsius},
+		{Fahrenheit, KindTemperature, Celsius},
+		{Kelvin, KindTemperature, Celsius},
+		{Hectopascal, KindPressure, Hectopascal},
+		{Pascal, KindPressure, Hectopascal},
+		{Kilopascal, KindPressure, Hectopascal},
+		{MetersPerSecond, KindSpeed, MetersPerSecond},
+		{KilometersPerHour, KindSpeed, MetersPerSecond},
+		{Percent, KindHumidity, Percent},
+		{"furlongs", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.unit), func(t *testing.T) {
+			if got := tt.unit.Valid(); got != (tt.kind != "") {
+				t.Errorf("Valid() = %v", got)
+			}
+			if got := tt.unit.Kind(); got != tt.kind {
+				t.Errorf("Kind() = %q, want %q", got, tt.kind)
+			}
+			if got := tt.unit.Canonical(); got != tt.canonical {
+				t.Errorf("Canonical() = %q, want %q", got, tt.canonical)
+			}
+		})
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name     string
+		v        float64
+		from, to Unit
+		want     float64
+		wantErr  bool
+	}{
+		{name: "µg/m³ to µg/m³", v: 12.5, from: MicrogramsPerCubicMeter, to: MicrogramsPerCubicMeter, want: 12.5},
+		{name: "mg/m³ to µg/m³", v: 1.2, from: MilligramsPerCubicMeter, to: MicrogramsPerCubicMeter, want: 1200},
+		{name: "µg/m³ to mg/m³", v: 350, from: MicrogramsPerCubicMeter, to: MilligramsPerCubicMeter, want: 0.35},
+		{name: "ppm to ppb", v: 0.07, from: PartsPerMillion, to: PartsPerBillion, want: 70},
+		{name: "ppb to ppm", v: 9000, from: PartsPerBillion, to: PartsPerMillion, want: 9},
+		{name: "index to index", v: 42, from: Index, to: Index, want: 42},
+		{name: "°F to °C", v: 212, from: Fahrenheit, to: Celsius, want: 100},
+		{name: "°F to °C below zero", v: -40, from: Fahrenheit, to: Celsius, want: -40},
+		{name: "°C to °F", v: 37, from: Celsius, to: Fahrenheit, want: 98.6},
+		{name: "K to °C", v: 273.15, from: Kelvin, to: Celsius, want: 0},
+		{name: "°C to K", v: 25, from: Celsius, to: Kelvin, want: 298.15},
+		{name: "K to °F", v: 373.15, from: Kelvin, to: Fahrenheit, want: 212},
+		{name: "Pa to hPa", v: 101325, from: Pascal, to: Hectopascal, want: 1013.25},
+		{name: "kPa to hPa", v: 101.325, from: Kilopascal, to: Hectopascal, want: 1013.25},
+		{name: "hPa to kPa", v: 1000, from: Hectopascal, to: Kilopascal, want: 100},
+		{name: "km/h to m/s", v: 36, from: KilometersPerHour, to: MetersPerSecond, want: 10},
+		{name: "m/s to km/h", v: 5, from: MetersPerSecond, to: KilometersPerHour, want: 18},
+		{name: "% to %", v: 55, from: Percent, to: Percent, want: 55},
+		{name: "unknown source", v: 1, from: "furlongs", to: MetersPerSecond, wantErr: true},
+		{name: "unknown target", v: 1, from: MetersPerSecond, to: "furlongs", wantErr: true},
+		{name: "different kinds", v: 1, from: Index, to: MicrogramsPerCubicMeter, wantErr: true},
+		{name: "temperature to pressure", v: 1, from: Celsius, to: Hectopascal, wantErr: true},
+		{name: "mass to mixing ratio", v: 1, from: MicrogramsPerCubicMeter, to: PartsPerBillion, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Convert(tt.v, tt.from, tt.to)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Convert(%v, %q, %q) = %v, want an error", tt.v, tt.from, tt.to, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Convert(%v, %q, %q): %v", tt.v, tt.from, tt.to, err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Convert(%v, %q, %q) = %v, want %v", tt.v, tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertGas(t *testing.T) {
+	tests := []struct {
+		name      string
+		v         float64
+		from, to  Unit
+		pollutant string
+		want      float64
+		wantErr   bool
+	}{
+		{name: "o3 ppb to µg/m³", v: 24.45, from: PartsPerBillion, to: MicrogramsPerCubicMeter, pollutant: "o3", want: 48},
+		{name: "o3 µg/m³ to ppb", v: 48, from: MicrogramsPerCubicMeter, to: PartsPerBillion, pollutant: "O3", want: 24.45},
+		{name: "no2 ppb to µg/m³", v: 100, from: PartsPerBillion, to: MicrogramsPerCubicMeter, pollutant: "no2", want: 100 * 46.01 / 24.45},
+		{name: "so2 µg/m³ to ppb", v: 64.07, from: MicrogramsPerCubicMeter, to: PartsPerBillion, pollutant: "so2", want: 24.45},
+		{name: "co ppm to mg/m³", v: 1, from: PartsPerMillion, to: MilligramsPerCubicMeter, pollutant: "co", want: 28.01 / 24.45},
+		{name: "co mg/m³ to ppm", v: 28.01, from: MilligramsPerCubicMeter, to: PartsPerMillion, pollutant: "co", want: 24.45},
+		{name: "same scale needs no molar mass", v: 2, from: PartsPerMillion, to: PartsPerBillion, pollutant: "pm25", want: 2000},
+		{name: "other kinds fall back to Convert", v: 36, from: KilometersPerHour, to: MetersPerSecond, want: 10},
+		{name: "unknown pollutant", v: 1, from: PartsPerBillion, to: MicrogramsPerCubicMeter, pollutant: "pm25", wantErr: true},
+		{name: "different kinds", v: 1, from: Index, to: PartsPerBillion, pollutant: "o3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ConvertGas(tt.v, tt.from, tt.to, tt.pollutant)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ConvertGas(%v, %q, %q, %q) = %v, want an error", tt.v, tt.from, tt.to, tt.pollutant, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ConvertGas(%v, %q, %q, %q): %v", tt.v, tt.from, tt.to, tt.pollutant, err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("ConvertGas(%v, %q, %q, %q) = %v, want %v", tt.v, tt.from, tt.to, tt.pollutant, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"log/slog"
 	"strconv"
 	"strings"
 	"time"
@@ -45,8 +46,7 @@ func ParseBuckets(env string) []float64 {
 		if f, err := strconv.ParseFloat(strings.TrimSpace(p), 64); err == nil {
 			buckets = append(buckets, f)
 		} else {
-			// print error
-			fmt.Printf("Error parsing bucket value '%s': %v\n", p, err)
+			slog.Warn("Error parsing bucket value", "value", p, "error", err)
 			return nil
 		}
 	}
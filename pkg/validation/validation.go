@@ -0,0 +1,209 @@
+// Package validation checks the payloads received from upstream providers and other services.
+// Invalid records are described by structured rejections, which services count in their metrics
+// and may keep in a dead-letter store.
+package validation
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	api "github.com/etesami/air-quality-monitoring/api"
+	units "github.com/etesami/air-quality-monitoring/pkg/units"
+)
+
+// Reason is the class of a rejection, used as a metric label
+type Reason string
+
+const (
+	ReasonMalformed    Reason = "malformed"
+	ReasonStatus       Reason = "bad_status"
+	ReasonMissingField Reason = "missing_field"
+	ReasonCoordinates  Reason = "invalid_coordinates"
+	ReasonRange        Reason = "out_of_range"
+	ReasonUnit         Reason = "unit_mismatch"
+	ReasonTimestamp    Reason = "invalid_timestamp"
+)
+
+// Rejection is why a record, or one of its fields, is invalid
+type Rejection struct {
+	Reason Reason `json:"reason"`
+	Field  string `json:"field,omitempty"`
+	Detail string `json:"detail"`
+}
+
+func (r *Rejection) Error() string {
+	if r.Field == "" {
+		return fmt.Sprintf("%s: %s", r.Reason, r.Detail)
+	}
+	return fmt.Sprintf("%s: %s: %s", r.Reason, r.Field, r.Detail)
+}
+
+func reject(reason Reason, field, format string, args ...any) *Rejection {
+	return &Rejection{Reason: reason, Field: field, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Malformed returns the rejection of a payload that could not be decoded
+func Malformed(err error) *Rejection {
+	return reject(ReasonMalformed, "", "%v", err)
+}
+
+// limit is the plausible range of a measurement
+type limit struct {
+	min, max float64
+}
+
+// limits are the plausible ranges of the measurements in the canonical units
+var limits = map[units.Unit]limit{
+	units.Percent:                 {0, 100},
+	units.Hectopascal:             {850, 1100},
+	units.Index:                   {0, 999},
+	units.Celsius:                 {-90, 60},
+	units.MetersPerSecond:         {0, 150},
+	units.MicrogramsPerCubicMeter: {0, 10000},
+	units.PartsPerBillion:         {0, 100000},
+}
+
+// fieldLimits are the ranges of the measurements narrower than the one of their unit
+var fieldLimits = map[string]limit{
+	"iaqi.w": {0, 120},
+}
+
+// Rules are the checks of a record besides its shape, zero durations disable their check
+type Rules struct {
+	// MaxAge rejects readings older than it
+	MaxAge time.Duration
+	// MaxSkew rejects readings further than it in the future
+	MaxSkew time.Duration
+}
+
+// Rejected is an observation that failed validation with its reasons
+type Rejected struct {
+	Observation api.Observation `json:"observation"`
+	Rejections  []Rejection     `json:"rejections"`
+}
+
+// AirQualityData splits the observations of data into the valid and rejected ones
+func (r Rules) AirQualityData(data *api.AirQualityData, now time.Time) ([]api.Observation, []Rejected) {
+	accepted := make([]api.Observation, 0, len(data.Obs))
+	var rejected []Rejected
+	for _, obs := range data.Obs {
+		if rejections := r.Observation(&obs, now); len(rejections) > 0 {
+			rejected = append(rejected, Rejected{Observation: obs, Rejections: rejections})
+			continue
+		}
+		accepted = append(accepted, obs)
+	}
+	return accepted, rejected
+}
+
+// Observation returns the rejections of obs, none when it is valid
+func (r Rules) Observation(obs *api.Observation, now time.Time) []Rejection {
+	var rejections []Rejection
+	if obs.Status != "" && obs.Status != "ok" {
+		rejections = append(rejections, *reject(ReasonStatus, "status", "status is %q", obs.Status))
+	}
+	rejections = append(rejections, r.Msg(&obs.Msg)...)
+	if _, rej := r.Time(&obs.Msg.Time, now); rej != nil {
+		rejections = append(rejections, *rej)
+	}
+	return rejections
+}
+
+// Msg returns the rejections of the station, location and measurements of msg.
+// The measurements are tagged with their unit and converted to its canonical unit.
+func (r Rules) Msg(msg *api.Msg) []Rejection {
+	var rejections []Rejection
+	if msg.Idx <= 0 {
+		rejections = append(rejections, *reject(ReasonMissingField, "idx", "station index is %d", msg.Idx))
+	}
+	if msg.City.Name == "" {
+		rejections = append(rejections, *reject(ReasonMissingField, "city.name", "city name is empty"))
+	}
+	if rej := Geo(msg.City.Geo); rej != nil {
+		rejections = append(rejections, *rej)
+	}
+	if msg.Aqi < 0 || msg.Aqi > 999 {
+		rejections = append(rejections, *reject(ReasonRange, "aqi", "%d is out of range [0, 999]", msg.Aqi))
+	}
+	for _, f := range msg.IAQI.Fields() {
+		if f.Missing() {
+			continue
+		}
+		field := "iaqi." + f.Key
+		tagged := f.Unit != ""
+		if err := f.Normalize(); err != nil {
+			rejections = append(rejections, *reject(ReasonUnit, field, "%v", err))
+			continue
+		}
+		if rej := checkLimit(field, f.Unit, f.V, tagged); rej != nil {
+			rejections = append(rejections, *rej)
+		}
+	}
+	return rejections
+}
+
+// Geo returns the rejection of a [lat, lng] pair, nil when it is valid
+func Geo(geo []float64) *Rejection {
+	if len(geo) != 2 {
+		return reject(ReasonCoordinates, "city.geo", "expected [lat, lng], got %d values", len(geo))
+	}
+	return Coordinates(geo[0], geo[1])
+}
+
+// Coordinates returns the rejection of a location, nil when it is valid
+func Coordinates(lat, lng float64) *Rejection {
+	switch {
+	case math.IsNaN(lat) || math.IsNaN(lng):
+		return reject(ReasonCoordinates, "city.geo", "coordinates are not numbers")
+	case lat < -90 || lat > 90:
+		return reject(ReasonCoordinates, "city.geo", "latitude %f is out of range [-90, 90]", lat)
+	case lng < -180 || lng > 180:
+		return reject(ReasonCoordinates, "city.geo", "longitude %f is out of range [-180, 180]", lng)
+	case lat == 0 && lng == 0:
+		return reject(ReasonCoordinates, "city.geo", "coordinates are [0, 0]")
+	}
+	return nil
+}
+
+// Time returns the time of a reading, or the rejection of its timestamp
+func (r Rules) Time(t *api.Time, now time.Time) (time.Time, *Rejection) {
+	var parsed time.Time
+	var err error
+	switch {
+	case t.ISO != "":
+		parsed, err = time.Parse(time.RFC3339, t.ISO)
+	case t.S != "" && t.TZ != "":
+		parsed, err = time.Parse("2006-01-02 15:04:05-07:00", t.S+t.TZ)
+	case t.V > 0:
+		parsed = time.Unix(t.V, 0)
+	default:
+		return time.Time{}, reject(ReasonTimestamp, "time", "timestamp is missing")
+	}
+	if err != nil {
+		return time.Time{}, reject(ReasonTimestamp, "time", "%v", err)
+	}
+	if r.MaxAge > 0 && now.Sub(parsed) > r.MaxAge {
+		return parsed, reject(ReasonTimestamp, "time", "reading of %s is older than %s", parsed.Format(time.RFC3339), r.MaxAge)
+	}
+	if r.MaxSkew > 0 && parsed.Sub(now) > r.MaxSkew {
+		return parsed, reject(ReasonTimestamp, "time", "reading of %s is in the future", parsed.Format(time.RFC3339))
+	}
+	return parsed, nil
+}
+
+// checkLimit rejects values out of the range of their field and unit. Untagged
+// pressures reported in Pa instead of hPa are told apart from implausible values.
+func checkLimit(field string, u units.Unit, v float64, tagged bool) *Rejection {
+	l, ok := fieldLimits[field]
+	if !ok {
+		l = limits[u]
+	}
+	if !tagged && u == units.Hectopascal && v >= l.min*100 && v <= l.max*100 {
+		return reject(ReasonUnit, field, "%g looks like Pa, expected %s", v, u)
+	}
+	if v < l.min || v > l.max {
+		return reject(ReasonRange, field, "%g %s is out of range [%g, %g]", v, u, l.min, l.max)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package validation
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/etesami/air-quality-monitoring/api"
+	units "github.com/etesami/air-quality-monitoring/pkg/units"
+)
+
+var now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// reported returns a measurement of v in u, untagged when u is empty
+func reported(v float64, u units.Unit) api.Measurement {
+	return api.Measurement{V: v, Unit: u, Reported: true}
+}
+
+// validObs returns an observation passing the checks at now
+func validObs() api.Observation {
+	return api.Observation{
+		Status: "ok",
+		Msg: api.Msg{
+			Idx:  1,
+			Aqi:  42,
+			City: api.City{Name: "city", Geo: []float64{45.5, -73.6}},
+			IAQI: api.IAQI{
+				H:    reported(40, ""),
+				P:    reported(1013, ""),
+				T:    reported(20, ""),
+				W:    reported(3, ""),
+				PM25: reported(42, ""),
+			},
+			Time: api.Time{ISO: "2024-01-01T11:00:00Z"},
+		},
+	}
+}
+
+func TestObservation(t *testing.T) {
+	rules := Rules{MaxAge: 24 * time.Hour, MaxSkew: time.Hour}
+	tests := []struct {
+		name       string
+		edit       func(obs *api.Observation)
+		wantReason Reason
+		wantField  string
+	}{
+		{name: "valid", edit: func(obs *api.Observation) {}},
+		{name: "no status", edit: func(obs *api.Observation) { obs.Status = "" }},
+		{name: "unreported measurement", edit: func(obs *api.Observation) { obs.Msg.IAQI.H = api.Measurement{V: 500} }},
+		{name: "tagged Pa", edit: func(obs *api.Observation) { obs.Msg.IAQI.P = reported(101325, units.Pascal) }},
+		{name: "tagged concentration", edit: func(obs *api.Observation) { obs.Msg.IAQI.PM25 = reported(12, units.MicrogramsPerCubicMeter) }},
+		{name: "bad status", edit: func(obs *api.Observation) { obs.Status = "error" },
+			wantReason: ReasonStatus, wantField: "status"},
+		{name: "no station index", edit: func(obs *api.Observation) { obs.Msg.Idx = 0 },
+			wantReason: ReasonMissingField, wantField: "idx"},
+		{name: "no city name", edit: func(obs *api.Observation) { obs.Msg.City.Name = "" },
+			wantReason: ReasonMissingField, wantField: "city.name"},
+		{name: "no coordinates", edit: func(obs *api.Observation) { obs.Msg.City.Geo = nil },
+			wantReason: ReasonCoordinates, wantField: "city.geo"},
+		{name: "latitude out of range", edit: func(obs *api.Observation) { obs.Msg.City.Geo = []float64{91, 0} },
+			wantReason: ReasonCoordinates, wantField: "city.geo"},
+		{name: "longitude out of range", edit: func(obs *api.Observation) { obs.Msg.City.Geo = []float64{45, -181} },
+			wantReason: ReasonCoordinates, wantField: "city.geo"},
+		{name: "null island", edit: func(obs *api.Observation) { obs.Msg.City.Geo = []float64{0, 0} },
+			wantReason: ReasonCoordinates, wantField: "city.geo"},
+		{name: "coordinates not numbers", edit: func(obs *api.Observation) { obs.Msg.City.Geo = []float64{math.NaN(), 0} },
+			wantReason: ReasonCoordinates, wantField: "city.geo"},
+		{name: "aqi out of range", edit: func(obs *api.Observation) { obs.Msg.Aqi = 1000 },
+			wantReason: ReasonRange, wantField: "aqi"},
+		{name: "negative aqi", edit: func(obs *api.Observation) { obs.Msg.Aqi = -1 },
+			wantReason: ReasonRange, wantField: "aqi"},
+		{name: "humidity out of range", edit: func(obs *api.Observation) { obs.Msg.IAQI.H = reported(120, "") },
+			wantReason: ReasonRange, wantField: "iaqi.h"},
+		{name: "wind out of the range of its field", edit: func(obs *api.Observation) { obs.Msg.IAQI.W = reported(130, "") },
+			wantReason: ReasonRange, wantField: "iaqi.w"},
+		{name: "converted temperature out of range", edit: func(obs *api.Observation) { obs.Msg.IAQI.T = reported(212, units.Fahrenheit) },
+			wantReason: ReasonRange, wantField: "iaqi.t"},
+		{name: "untagged Pa", edit: func(obs *api.Observation) { obs.Msg.IAQI.P = reported(101325, "") },
+			wantReason: ReasonUnit, wantField: "iaqi.p"},
+		{name: "unknown unit", edit: func(obs *api.Observation) { obs.Msg.IAQI.T = reported(20, "furlong") },
+			wantReason: ReasonUnit, wantField: "iaqi.t"},
+		{name: "unit of another kind", edit: func(obs *api.Observation) { obs.Msg.IAQI.P = reported(300, units.Kelvin) },
+			wantReason: ReasonUnit, wantField: "iaqi.p"},
+		{name: "no timestamp", edit: func(obs *api.Observation) { obs.Msg.Time = api.Time{} },
+			wantReason: ReasonTimestamp, wantField: "time"},
+		{name: "old reading", edit: func(obs *api.Observation) { obs.Msg.Time.ISO = "2023-12-30T12:00:00Z" },
+			wantReason: ReasonTimestamp, wantField: "time"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obs := validObs()
+			tt.edit(&obs)
+			rejections := rules.Observation(&obs, now)
+			if tt.wantReason == "" {
+				if len(rejections) != 0 {
+					t.Errorf("Observation() = %v, want no rejections", rejections)
+				}
+				return
+			}
+			if len(rejections) != 1 || rejections[0].Reason != tt.wantReason || rejections[0].Field != tt.wantField {
+				t.Errorf("Observation() = %v, want one %s of %s", rejections, tt.wantReason, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestObservationRejections(t *testing.T) {
+	obs := validObs()
+	obs.Status = "error"
+	obs.Msg.Idx = 0
+	obs.Msg.IAQI.H = reported(-1, "")
+	obs.Msg.Time = api.Time{}
+	rejections := Rules{}.Observation(&obs, now)
+	var fields []string
+	for _, rej := range rejections {
+		fields = append(fields, rej.Field)
+	}
+	if got := strings.Join(fields, ","); got != "status,idx,iaqi.h,time" {
+		t.Errorf("rejected fields = %s, want status,idx,iaqi.h,time", got)
+	}
+}
+
+func TestCheckLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		field      string
+		unit       units.Unit
+		v          float64
+		tagged     bool
+		wantReason Reason
+	}{
+		{name: "pressure", field: "iaqi.p", unit: units.Hectopascal, v: 1013},
+		{name: "pressure at the bounds", field: "iaqi.p", unit: units.Hectopascal, v: 850},
+		{name: "low pressure", field: "iaqi.p", unit: units.Hectopascal, v: 849, wantReason: ReasonRange},
+		{name: "untagged pressure in Pa", field: "iaqi.p", unit: units.Hectopascal, v: 101325, wantReason: ReasonUnit},
+		{name: "untagged pressure at the Pa bounds", field: "iaqi.p", unit: units.Hectopascal, v: 85000, wantReason: ReasonUnit},
+		{name: "untagged pressure beyond Pa", field: "iaqi.p", unit: units.Hectopascal, v: 200000, wantReason: ReasonRange},
+		{name: "tagged hPa of a Pa value", field: "iaqi.p", unit: units.Hectopascal, v: 101325, tagged: true, wantReason: ReasonRange},
+		{name: "untagged humidity in Pa range", field: "iaqi.h", unit: units.Percent, v: 101325, wantReason: ReasonRange},
+		{name: "wind", field: "iaqi.w", unit: units.MetersPerSecond, v: 120},
+		{name: "wind over its field limit", field: "iaqi.w", unit: units.MetersPerSecond, v: 121, wantReason: ReasonRange},
+		{name: "gust within the unit limit", field: "iaqi.wg", unit: units.MetersPerSecond, v: 121},
+		{name: "cold", field: "iaqi.t", unit: units.Celsius, v: -91, wantReason: ReasonRange},
+		{name: "index", field: "iaqi.pm25", unit: units.Index, v: 999},
+		{name: "index out of range", field: "iaqi.pm25", unit: units.Index, v: 1000, wantReason: ReasonRange},
+		{name: "negative concentration", field: "iaqi.pm25", unit: units.MicrogramsPerCubicMeter, v: -1, wantReason: ReasonRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rej := checkLimit(tt.field, tt.unit, tt.v, tt.tagged)
+			if tt.wantReason == "" {
+				if rej != nil {
+					t.Errorf("checkLimit() = %v, want nil", rej)
+				}
+				return
+			}
+			if rej == nil || rej.Reason != tt.wantReason || rej.Field != tt.field {
+				t.Errorf("checkLimit() = %v, want a %s of %s", rej, tt.wantReason, tt.field)
+			}
+		})
+	}
+}
+
+func TestTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   Rules
+		time    api.Time
+		want    time.Time
+		wantErr string
+	}{
+		{name: "iso", time: api.Time{ISO: "2024-01-01T10:00:00-01:00"}, want: now.Add(-time.Hour)},
+		{name: "iso over local time", time: api.Time{ISO: "2024-01-01T11:00:00Z", S: "2000-01-01 00:00:00", TZ: "+00:00"},
+			want: now.Add(-time.Hour)},
+		{name: "local time", time: api.Time{S: "2024-01-01 07:00:00", TZ: "-05:00"}, want: now},
+		{name: "epoch", time: api.Time{V: now.Unix()}, want: now},
+		{name: "local time without zone falls to epoch", time: api.Time{S: "2024-01-01 07:00:00", V: now.Unix()}, want: now},
+		{name: "missing", time: api.Time{}, wantErr: "timestamp is missing"},
+		{name: "local time without zone", time: api.Time{S: "2024-01-01 07:00:00"}, wantErr: "timestamp is missing"},
+		{name: "bad iso", time: api.Time{ISO: "yesterday"}, wantErr: "cannot parse"},
+		{name: "bad local time", time: api.Time{S: "2024-01-01", TZ: "-05:00"}, wantErr: "cannot parse"},
+		{name: "old", rules: Rules{MaxAge: time.Hour}, time: api.Time{ISO: "2024-01-01T10:59:59Z"},
+			want: now.Add(-time.Hour - time.Second), wantErr: "older than 1h0m0s"},
+		{name: "within the max age", rules: Rules{MaxAge: time.Hour}, time: api.Time{ISO: "2024-01-01T11:00:00Z"}, want: now.Add(-time.Hour)},
+		{name: "future", rules: Rules{MaxSkew: time.Minute}, time: api.Time{ISO: "2024-01-01T12:01:01Z"},
+			want: now.Add(time.Minute + time.Second), wantErr: "in the future"},
+		{name: "within the skew", rules: Rules{MaxSkew: time.Minute}, time: api.Time{ISO: "2024-01-01T12:01:00Z"}, want: now.Add(time.Minute)},
+		{name: "checks disabled", time: api.Time{ISO: "1990-01-01T00:00:00Z"}, want: time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rej := tt.rules.Time(&tt.time, now)
+			if tt.wantErr != "" {
+				if rej == nil || rej.Reason != ReasonTimestamp || !strings.Contains(rej.Detail, tt.wantErr) {
+					t.Errorf("Time() rejection = %v, want %q", rej, tt.wantErr)
+				}
+			} else if rej != nil {
+				t.Errorf("Time() rejection = %v", rej)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("Time() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+
+	api "github.com/etesami/air-quality-monitoring/api"
+)
+
+// waqiResponse is the envelope of the WAQI API responses,
+// data holds the error message when the status is not ok
+type waqiResponse struct {
+	Status string          `json:"status"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// WAQIStation is a station of a WAQI map bounds response
+type WAQIStation struct {
+	UID int     `json:"uid"`
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	// AQI is "-" for stations without a current reading
+	AQI     string `json:"aqi"`
+	Station struct {
+		Name string `json:"name"`
+		Time string `json:"time"`
+	} `json:"station"`
+}
+
+// WAQIBounds decodes a WAQI map bounds response into its valid stations
+// and the rejections of the others. The error is a *Rejection.
+func WAQIBounds(raw []byte) ([]WAQIStation, []Rejection, error) {
+	data, err := waqiData(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	var stations []WAQIStation
+	if err := json.Unmarshal(data, &stations); err != nil {
+		return nil, nil, Malformed(err)
+	}
+
+	valid := make([]WAQIStation, 0, len(stations))
+	var rejections []Rejection
+	for _, s := range stations {
+		if s.UID <= 0 {
+			rejections = append(rejections, *reject(ReasonMissingField, "uid", "station uid is %d", s.UID))
+			continue
+		}
+		if rej := Coordinates(s.Lat, s.Lon); rej != nil {
+			rej.Field = "lat,lon"
+			rej.Detail = fmt.Sprintf("station %d: %s", s.UID, rej.Detail)
+			rejections = append(rejections, *rej)
+			continue
+		}
+		valid = append(valid, s)
+	}
+	return valid, rejections, nil
+}
+
+// WAQIFeed decodes a WAQI station feed response and returns its data,
+// which must decode into api.AirQualityData. The error is a *Rejection.
+func WAQIFeed(raw []byte) (json.RawMessage, error) {
+	data, err := waqiData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &api.AirQualityData{}); err != nil {
+		return nil, Malformed(err)
+	}
+	return data, nil
+}
+
+// waqiData checks the status of a WAQI response and returns its data
+func waqiData(raw []byte) (json.RawMessage, error) {
+	var res waqiResponse
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, Malformed(err)
+	}
+	if res.Status != "ok" {
+		var msg string
+		json.Unmarshal(res.Data, &msg)
+		return nil, reject(ReasonStatus, "status", "status is %q: %s", res.Status, msg)
+	}
+	if len(res.Data) == 0 || string(res.Data) == "null" {
+		return nil, reject(ReasonMissingField, "data", "data field is missing")
+	}
+	return res.Data, nil
+}
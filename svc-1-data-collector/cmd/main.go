@@ -1,143 +1,163 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"reflect"
 	"time"
 
-	api "github.com/etesami/air-quality-monitoring/api"
+	auth "github.com/etesami/air-quality-monitoring/pkg/auth"
+	config "github.com/etesami/air-quality-monitoring/pkg/config"
+	deadletter "github.com/etesami/air-quality-monitoring/pkg/deadletter"
+	grpcclient "github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	health "github.com/etesami/air-quality-monitoring/pkg/health"
+	httpclient "github.com/etesami/air-quality-monitoring/pkg/httpclient"
+	logging "github.com/etesami/air-quality-monitoring/pkg/logging"
 	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
 	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
-	utils "github.com/etesami/air-quality-monitoring/pkg/utils"
+	shutdown "github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	tlsconfig "github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+	tracing "github.com/etesami/air-quality-monitoring/pkg/tracing"
 	internal "github.com/etesami/air-quality-monitoring/svc-data-collector/internal"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 func main() {
 
-	Lat1, err1 := strconv.ParseFloat(os.Getenv("LAT1"), 64)
-	Lng1, err2 := strconv.ParseFloat(os.Getenv("LNG1"), 64)
-	Lat2, err3 := strconv.ParseFloat(os.Getenv("LAT2"), 64)
-	Lng2, err4 := strconv.ParseFloat(os.Getenv("LNG2"), 64)
-	token := os.Getenv("TOKEN")
-	locationIdentifier := ""
+	cfg := &internal.Config{}
+	if err := config.Load(cfg, flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	logging.Setup("collector", cfg.Log)
+
+	ctx, stop := shutdown.Signals()
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "collector", cfg.Tracing)
+	if err != nil {
+		logging.Fatal("Error setting up tracing", "error", err)
+	}
 
-	var locData *internal.LocationData
+	m := metric.New("collector", metric.Buckets{
+		SentData: cfg.Metrics.SentDataBuckets,
+		ProcTime: cfg.Metrics.ProcTimeBuckets,
+		RttTime:  cfg.Metrics.RttTimeBuckets,
+		Latency:  cfg.Metrics.LatencyBuckets,
+	})
 
-	// if the coordinates are not set, use a random city location,
-	// we ensure at least 5 locations are returned
-	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
-		log.Printf("Error parsing coordinates. Using a random city location coordinate.")
+	client, err := grpcclient.New("ingestor", cfg.Ingestion.HostPort(), cfg.Client, m)
+	if err != nil {
+		logging.Fatal("Failed to create the client of target service", "error", err)
+	}
+	// Collecting starts once the ingestion service is ready to take the readings
+	if err := health.Wait(ctx, client.Conn(), pb.AirQualityMonitoring_ServiceDesc.ServiceName, 3*time.Second); err != nil {
+		return
+	}
 
-		hostname, err := os.Hostname()
+	httpClient := httpclient.New(cfg.HTTP.Options())
+	collector := internal.NewCollector(client, m, httpClient)
+	collector.Apply(cfg)
+	pending := &shutdown.Group{}
+	collector.Pending = pending
+
+	checker := health.New(cfg.Health, pb.DeadLetter_ServiceDesc.ServiceName)
+	checker.Add("ingestor", health.Serving(client.Conn(), ""))
+	// A failed request, e.g. a missing station, does not make the collector
+	// unready, only the providers not being reachable for a while does
+	checker.Add("upstream-api", func(context.Context) error { return httpClient.Reachable() })
+	go checker.Run(ctx)
+
+	var grpcServer *grpc.Server
+	if cfg.DeadLetter.Dir != "" {
+		store, err := deadletter.Open(cfg.DeadLetter.Dir, "collector")
 		if err != nil {
-			fmt.Printf("Error getting hostname: %v\n", err)
-			return
+			logging.Fatal("Error opening dead-letter store", "error", err)
 		}
-		locationIdentifier = hostname
-
-		for {
-			coordinates := internal.GetRandomBoxCoordination(locationIdentifier)
-			Lat1 = coordinates[0]
-			Lng1 = coordinates[1]
-			Lat2 = coordinates[2]
-			Lng2 = coordinates[3]
-			locData = &internal.LocationData{
-				Lat1:  Lat1,
-				Lng1:  Lng1,
-				Lat2:  Lat2,
-				Lng2:  Lng2,
-				Token: token,
+		collector.DeadLetter = store
+		slog.Info("Keeping rejected readings", "dir", cfg.DeadLetter.Dir)
+
+		// The collector serves no other RPC, the server is only started
+		// to inspect and reinject the rejected readings
+		if cfg.DeadLetter.Port != "" {
+			listener, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.DeadLetter.Port))
+			if err != nil {
+				logging.Fatal("Failed to listen", "error", err)
 			}
-			log.Printf("Using random box coordinates: [%f, %f, %f, %f]\n", Lat1, Lng1, Lat2, Lng2)
-			data, err := locData.CollectLocationsIds()
+			creds, err := tlsconfig.ServerOption(cfg.TLS)
 			if err != nil {
-				log.Printf("Error getting location IDs: %v", err)
-				time.Sleep(5 * time.Second)
-				continue
+				logging.Fatal("Error setting up TLS", "error", err)
 			}
-			ids, err := internal.GetLocationIds(data)
-			// we need at least 5 locations to continue
-			if err != nil || len(ids) >= 4 {
-				break
+			// The dead-letter methods require the admin role, or a local caller
+			// when the calls are not authenticated
+			authz, err := auth.New(cfg.Auth, m)
+			if err != nil {
+				logging.Fatal("Error setting up authentication", "error", err)
 			}
-			log.Printf("Not enough locations found [%d]/4.", len(ids))
-			locationIdentifier = fmt.Sprintf("%s%d", locationIdentifier, time.Now().UnixNano())
-			time.Sleep(1 * time.Second)
+			grpcServer = grpc.NewServer(creds, tracing.ServerOption(), logging.ServerOption(), grpcclient.ServerOption(),
+				authz.Unary(), authz.Stream())
+			pb.RegisterDeadLetterServer(grpcServer, deadletter.Server{Store: store, Reinject: collector.Reinject})
+			checker.Register(grpcServer)
+			go func() {
+				slog.Info("Dead-letter gRPC server is running", "port", cfg.DeadLetter.Port)
+				if err := grpcServer.Serve(listener); err != nil {
+					logging.Fatal("Failed to serve", "error", err)
+				}
+			}()
 		}
-		log.Printf("Using random box coordinates: %f, %f, %f, %f\n", Lat1, Lng1, Lat2, Lng2)
-	} else {
-		locData = &internal.LocationData{
-			Lat1:  Lat1,
-			Lng1:  Lng1,
-			Lat2:  Lat2,
-			Lng2:  Lng2,
-			Token: token,
-		}
-	}
-
-	svcAddress := os.Getenv("SVC_INGESTION_ADDR")
-	svcPort := os.Getenv("SVC_INGESTION_PORT")
-	svc := &api.Service{
-		Address: svcAddress,
-		Port:    svcPort,
 	}
 
-	for {
-		if err := svc.ServiceReachable(); err == nil {
-			break
-		} else {
-			log.Printf("Service [%s:%s] is not reachable: %v", svc.Address, svc.Port, err)
-			time.Sleep(3 * time.Second)
+	// regions, their schedules, the token and the log level are reloaded
+	// when the config file changes or on SIGHUP, the rest needs a restart
+	reload := func() {
+		newCfg := &internal.Config{}
+		if err := config.Load(newCfg, flag.NewFlagSet(os.Args[0], flag.ContinueOnError), os.Args[1:]); err != nil {
+			slog.Error("Error reloading config, keeping the current one", "error", err)
+			return
 		}
+		// Only the level of the logs is applied on the fly
+		logCfg := newCfg.Log
+		logCfg.Level = cfg.Log.Level
+		if !reflect.DeepEqual(newCfg.Ingestion, cfg.Ingestion) || newCfg.Client != cfg.Client || !reflect.DeepEqual(newCfg.Metrics, cfg.Metrics) ||
+			newCfg.HTTP != cfg.HTTP || newCfg.DeadLetter != cfg.DeadLetter || newCfg.TLS != cfg.TLS || newCfg.Auth != cfg.Auth || newCfg.Tracing != cfg.Tracing ||
+			logCfg != cfg.Log || newCfg.Health != cfg.Health || newCfg.Shutdown != cfg.Shutdown ||
+			newCfg.WatchInterval != cfg.WatchInterval {
+			slog.Warn("Ingestion, client, metrics, HTTP, dead-letter, TLS, auth, tracing, log format and sampling, health, shutdown and watch interval changes are applied on restart only")
+		}
+		collector.Apply(newCfg)
+		logging.SetLevel(newCfg.Log.Level)
+		slog.Info("Config reloaded")
 	}
-
-	conn, err := grpc.NewClient(svc.Address+":"+svc.Port, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		log.Fatalf("did not connect to [%s:%s]: %v", svc.Address, svc.Port, err)
-	}
-	defer conn.Close()
-	log.Printf("Connected to target service: [%s:%s]\n", svc.Address, svc.Port)
-
-	sentDataBuckets := utils.ParseBuckets(os.Getenv("SENT_DATA_BUCKETS"))
-	procTimeBuckets := utils.ParseBuckets(os.Getenv("PROC_TIME_BUCKETS"))
-	rttTimeBuckets := utils.ParseBuckets(os.Getenv("RTT_TIME_BUCKETS"))
-
-	m := &metric.Metric{}
-	m.RegisterMetrics(sentDataBuckets, procTimeBuckets, rttTimeBuckets)
-
-	client := pb.NewAirQualityMonitoringClient(conn)
-
-	// First call to processTicker
-	if err := internal.ProcessTicker(&client, "ingestor", locData, m); err != nil {
-		log.Printf("Error during processing: %v", err)
-	}
-
-	updateFrequencyStr := os.Getenv("UPDATE_FREQUENCY")
-	updateFrequency, err := strconv.Atoi(updateFrequencyStr)
-	if err != nil {
-		log.Fatalf("Error parsing update frequency: %v", err)
-	}
-	ticker := time.NewTicker(time.Duration(updateFrequency) * time.Second)
-	defer ticker.Stop()
-
-	go func(c *pb.AirQualityMonitoringClient, metricList *metric.Metric) {
-		for range ticker.C {
-			if err := internal.ProcessTicker(c, "ingestor", locData, metricList); err != nil {
-				log.Printf("Error during processing: %v", err)
-			}
+	go config.Watch(ctx, config.File(flag.CommandLine), cfg.WatchInterval.Duration(), reload)
+	go collector.Run(ctx)
+
+	http.Handle("/metrics", m.Handler())
+	checker.RegisterHTTP(http.DefaultServeMux)
+	metricsServer := &http.Server{Addr: cfg.Metrics.HostPort()}
+	go func() {
+		slog.Info("Starting metrics server", "port", cfg.Metrics.Port)
+		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatal("Error starting metrics server", "error", err)
 		}
-	}(&client, m)
+	}()
 
-	metricAddr := os.Getenv("METRIC_ADDR")
-	metricPort := os.Getenv("METRIC_PORT")
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Starting server on :%s\n", metricPort)
-	http.ListenAndServe(fmt.Sprintf("%s:%s", metricAddr, metricPort), nil)
+	// On SIGTERM the collection stops and the collections in flight are finished
+	<-ctx.Done()
+	steps := []shutdown.Step{shutdown.Do("health", checker.Shutdown)}
+	if grpcServer != nil {
+		steps = append(steps, shutdown.GRPC(grpcServer))
+	}
+	steps = append(steps,
+		shutdown.Wait("collections", pending),
+		shutdown.Close("ingestor client", client),
+		shutdown.HTTP("metrics server", metricsServer),
+		shutdown.Step{Name: "tracing", Stop: shutdownTracing},
+	)
+	shutdown.Run(cfg.Shutdown.Timeout.Duration(), steps...)
 }
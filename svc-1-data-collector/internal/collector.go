@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	deadletter "github.com/etesami/air-quality-monitoring/pkg/deadletter"
+	grpcclient "github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	httpclient "github.com/etesami/air-quality-monitoring/pkg/httpclient"
+	logging "github.com/etesami/air-quality-monitoring/pkg/logging"
+	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
+	shutdown "github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	validation "github.com/etesami/air-quality-monitoring/pkg/validation"
+)
+
+// Plan is the set of regions the collector fetches
+type Plan struct {
+	Locations []*LocationData
+	// Jitter is the maximum random delay added to every collection
+	Jitter time.Duration
+}
+
+// Collector fetches every region of its current plan on the region's own schedule.
+// The plan can be replaced at any time and takes effect between collections.
+type Collector struct {
+	Client *grpcclient.Client
+	Metric *metric.Metrics
+	// DeadLetter keeps the readings failing validation, if set
+	DeadLetter *deadletter.Store
+	// Pending is the collections in flight, the shutdown waits for them
+	Pending *shutdown.Group
+
+	plan      atomic.Pointer[Plan]
+	changed   chan struct{}
+	providers map[string]Provider
+}
+
+// schedule is a region and the time it is collected next
+type schedule struct {
+	loc     *LocationData
+	next    time.Time
+	running *atomic.Bool
+	sel     *Selector
+}
+
+// NewCollector returns a collector sending to client and fetching
+// the providers with httpClient, Apply must be called before Run
+func NewCollector(client *grpcclient.Client, m *metric.Metrics, httpClient *httpclient.Client) *Collector {
+	c := &Collector{
+		Client:    client,
+		Metric:    m,
+		changed:   make(chan struct{}, 1),
+		providers: map[string]Provider{},
+	}
+	for name, newProvider := range providers {
+		c.providers[name] = newProvider(httpClient)
+	}
+	return c
+}
+
+// Apply replaces the plan with the regions, schedules and token of cfg
+func (c *Collector) Apply(cfg *Config) {
+	locations := cfg.Locations()
+	c.plan.Store(&Plan{
+		Locations: locations,
+		Jitter:    cfg.Jitter.Duration(),
+	})
+	for _, loc := range locations {
+		slog.Info("Collecting region", "region", loc.Name, "interval", loc.Interval.String(), "provider", loc.Provider,
+			"strategy", loc.Strategy, "bounds", []float64{loc.Lat1, loc.Lng1, loc.Lat2, loc.Lng2})
+	}
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run collects the regions when they are due until ctx is done.
+// The first collection of a region happens within the jitter of its start.
+func (c *Collector) Run(ctx context.Context) {
+	plan := c.plan.Load()
+	schedules := reschedule(nil, plan, time.Now())
+
+	timer := time.NewTimer(time.Until(nextDue(schedules)))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.changed:
+			plan = c.plan.Load()
+			schedules = reschedule(schedules, plan, time.Now())
+		case <-timer.C:
+			c.collectDue(ctx, schedules, plan.Jitter, time.Now())
+		}
+		timer.Stop()
+		timer.Reset(time.Until(nextDue(schedules)))
+	}
+}
+
+// collectDue starts the collection of the due regions by decreasing priority
+// and schedules their next collection
+func (c *Collector) collectDue(ctx context.Context, schedules []*schedule, jitter time.Duration, now time.Time) {
+	var due []*schedule
+	for _, s := range schedules {
+		if !s.next.After(now) {
+			due = append(due, s)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].loc.Priority > due[j].loc.Priority
+	})
+
+	go PingServer(c.Client, "ingestor", c.Metric)
+	for _, s := range due {
+		s.next = now.Add(s.loc.Interval + randomDelay(jitter))
+		if !s.running.CompareAndSwap(false, true) {
+			slog.Warn("Region is still being collected, skipping", "region", s.loc.Name)
+			continue
+		}
+		started := c.Pending.Go(func() {
+			defer s.running.Store(false)
+			// Every collection of a region is a batch of its own in the logs,
+			// one started before the shutdown is finished
+			ctx := logging.WithCorrelationID(context.WithoutCancel(ctx), logging.NewID())
+			provider := c.providers[s.loc.Provider]
+			reject := func(payload json.RawMessage, err error) {
+				c.reject(s.loc.Provider, payload, err)
+			}
+			if err := ProcessRegion(ctx, c.Client, s.loc, provider, s.sel, c.Metric, reject); err != nil {
+				slog.ErrorContext(ctx, "Error during processing region", "region", s.loc.Name, "error", err)
+			}
+		})
+		if !started {
+			s.running.Store(false)
+		}
+	}
+}
+
+// reject counts a reading of provider failing validation and keeps it in the dead-letter store, if any
+func (c *Collector) reject(provider string, payload json.RawMessage, err error) {
+	countRejection(c.Metric, err)
+	if c.DeadLetter == nil {
+		return
+	}
+	var rej *validation.Rejection
+	if !errors.As(err, &rej) {
+		r := deadletter.Failed(err)
+		rej = &r
+	}
+	if _, err := c.DeadLetter.Reject("collect", provider, string(payload), []validation.Rejection{*rej}); err != nil {
+		slog.Error("Error writing to dead-letter store", "error", err)
+	}
+}
+
+// Reinject validates a dead-letter reading again and sends it to the ingestion service
+func (c *Collector) Reinject(ctx context.Context, rec *deadletter.Record) error {
+	provider, ok := c.providers[rec.Source]
+	if !ok {
+		return fmt.Errorf("unknown provider %q", rec.Source)
+	}
+	data, err := provider.Validate(json.RawMessage(rec.Payload))
+	if err == nil {
+		data, err = stampCollected(data, time.Now(), c.Metric)
+	}
+	if err != nil {
+		c.reject(rec.Source, json.RawMessage(rec.Payload), err)
+		return nil
+	}
+	c.Metric.AddAccepted(1)
+	bytes, err := sendToDataIngestionService(ctx, c.Client, data)
+	if err != nil {
+		return fmt.Errorf("error sending data to ingestion service: %v", err)
+	}
+	c.Metric.AddSentDataBytes("ingestor", float64(bytes))
+	c.Metric.AddForwarded("ingestor", 1)
+	return nil
+}
+
+// reschedule returns the schedules of the regions of plan. Regions kept from the
+// previous schedules keep their selection state, and their next collection time
+// if their interval is unchanged.
+func reschedule(previous []*schedule, plan *Plan, now time.Time) []*schedule {
+	byName := make(map[string]*schedule, len(previous))
+	for _, s := range previous {
+		byName[s.loc.Name] = s
+	}
+
+	schedules := make([]*schedule, 0, len(plan.Locations))
+	for _, loc := range plan.Locations {
+		s := &schedule{
+			loc:     loc,
+			next:    now.Add(randomDelay(plan.Jitter)),
+			running: &atomic.Bool{},
+			sel:     NewSelector(),
+		}
+		if old, ok := byName[loc.Name]; ok {
+			s.running = old.running
+			s.sel = old.sel
+			if old.loc.Interval == loc.Interval {
+				s.next = old.next
+			}
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules
+}
+
+// nextDue returns the earliest next collection time of the schedules
+func nextDue(schedules []*schedule) time.Time {
+	next := time.Now().Add(time.Hour)
+	for _, s := range schedules {
+		if s.next.Before(next) {
+			next = s.next
+		}
+	}
+	return next
+}
+
+// randomDelay returns a random duration in [0, limit)
+func randomDelay(limit time.Duration) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
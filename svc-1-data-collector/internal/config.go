@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"fmt"
+
+	auth "github.com/etesami/air-quality-monitoring/pkg/auth"
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+	grpcclient "github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	health "github.com/etesami/air-quality-monitoring/pkg/health"
+	httpclient "github.com/etesami/air-quality-monitoring/pkg/httpclient"
+	logging "github.com/etesami/air-quality-monitoring/pkg/logging"
+	shutdown "github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	tlsconfig "github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+	tracing "github.com/etesami/air-quality-monitoring/pkg/tracing"
+)
+
+// Config is the configuration of the collector service
+type Config struct {
+	Region          Region            `config:"region"`
+	Regions         []Region          `config:"regions" usage:"named regions collected along with region"`
+	Token           string            `config:"token" env:"TOKEN" required:"true" secret:"true" usage:"WAQI API token"`
+	UpdateFrequency config.Duration   `config:"updateFrequency" env:"UPDATE_FREQUENCY" default:"15s" unit:"s" usage:"interval between collections of regions without their own"`
+	MaxStations     int               `config:"maxStations" env:"MAX_STATIONS" default:"5" usage:"stations collected per region without its own cap, 0 for all"`
+	Strategy        string            `config:"strategy" env:"SELECTION_STRATEGY" default:"random" usage:"selection of the stations of regions without their own: random, all, roundRobin, spatial or leastRecent"`
+	Jitter          config.Duration   `config:"jitter" env:"JITTER" default:"0s" usage:"maximum random delay added to every collection to spread requests"`
+	Ingestion       config.Endpoint   `config:"ingestion" env:"SVC_INGESTION" required:"true"`
+	Client          grpcclient.Config `config:"client" env:"CLIENT"`
+	HTTP            HTTP              `config:"http" env:"HTTP"`
+	DeadLetter      DeadLetter        `config:"deadLetter" env:"DEAD_LETTER"`
+	// TLS secures the dead-letter gRPC server and Auth restricts it to admins
+	TLS      tlsconfig.Config `config:"tls" env:"TLS"`
+	Auth     auth.Config      `config:"auth" env:"AUTH"`
+	Metrics  config.Metrics   `config:"metrics"`
+	Tracing  tracing.Config   `config:"tracing"`
+	Log      logging.Config   `config:"log"`
+	Health   health.Config    `config:"health"`
+	Shutdown shutdown.Config  `config:"shutdown"`
+	// WatchInterval is how often the config file is checked for changes
+	WatchInterval config.Duration `config:"watchInterval" env:"CONFIG_WATCH_INTERVAL" default:"10s" usage:"interval between checks of the config file for changes"`
+}
+
+// DeadLetter configures where the readings failing validation are kept
+// and the gRPC server they are inspected and reinjected through
+type DeadLetter struct {
+	Dir  string `config:"dir" env:"DIR" default:"deadletter" usage:"directory the rejected readings are kept in, none when empty"`
+	Port string `config:"port" env:"PORT" default:"50052" usage:"port of the dead-letter gRPC server, none when empty"`
+}
+
+// HTTP configures the requests to the providers
+type HTTP struct {
+	Timeout          config.Duration `config:"timeout" env:"TIMEOUT" default:"10s" usage:"timeout of a request"`
+	Rate             float64         `config:"rate" env:"RATE" default:"5" usage:"requests per second to a provider host, 0 for unlimited"`
+	Burst            int             `config:"burst" env:"BURST" default:"5" usage:"requests sent at once to a provider host"`
+	DailyQuota       int             `config:"dailyQuota" env:"DAILY_QUOTA" default:"0" usage:"requests per token and UTC day, 0 for unlimited"`
+	MaxRetries       int             `config:"maxRetries" env:"MAX_RETRIES" default:"3" usage:"retries of throttled or failed requests"`
+	Backoff          config.Duration `config:"backoff" env:"BACKOFF" default:"1s" usage:"delay before the first retry, doubled on every retry"`
+	MaxBackoff       config.Duration `config:"maxBackoff" env:"MAX_BACKOFF" default:"30s" usage:"maximum delay between retries"`
+	FailureThreshold int             `config:"failureThreshold" env:"FAILURE_THRESHOLD" default:"3" usage:"requests in a row failing to reach a provider before the collector is not ready"`
+}
+
+// Options returns the options of the HTTP client
+func (h HTTP) Options() httpclient.Options {
+	return httpclient.Options{
+		Timeout:          h.Timeout.Duration(),
+		Rate:             h.Rate,
+		Burst:            h.Burst,
+		DailyQuota:       h.DailyQuota,
+		MaxRetries:       h.MaxRetries,
+		Backoff:          h.Backoff.Duration(),
+		MaxBackoff:       h.MaxBackoff.Duration(),
+		FailureThreshold: h.FailureThreshold,
+	}
+}
+
+func (h *HTTP) Validate() error {
+	if h.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	if h.Rate < 0 || h.Burst < 1 || h.DailyQuota < 0 || h.MaxRetries < 0 {
+		return fmt.Errorf("rate, dailyQuota and maxRetries may not be negative and burst must be positive")
+	}
+	if h.FailureThreshold < 1 {
+		return fmt.Errorf("failureThreshold must be positive")
+	}
+	if h.Backoff <= 0 || h.MaxBackoff < h.Backoff {
+		return fmt.Errorf("backoff must be positive and at most maxBackoff")
+	}
+	return nil
+}
+
+// Region is the bounding box of the collected stations and its schedule
+type Region struct {
+	Name        string          `config:"name" usage:"name of the region in the logs"`
+	Lat1        *float64        `config:"lat1" env:"LAT1" usage:"latitude of the first corner"`
+	Lng1        *float64        `config:"lng1" env:"LNG1" usage:"longitude of the first corner"`
+	Lat2        *float64        `config:"lat2" env:"LAT2" usage:"latitude of the second corner"`
+	Lng2        *float64        `config:"lng2" env:"LNG2" usage:"longitude of the second corner"`
+	Interval    config.Duration `config:"interval" usage:"interval between collections of the region, updateFrequency when unset"`
+	MaxStations *int            `config:"maxStations" usage:"stations collected in the region, maxStations when unset"`
+	Priority    int             `config:"priority" usage:"regions due at the same time are collected by decreasing priority"`
+	Provider    string          `config:"provider" usage:"air quality provider of the region, waqi when unset"`
+	Strategy    string          `config:"strategy" usage:"selection of the stations of the region, strategy when unset"`
+	Allow       []string        `config:"allow" usage:"IDs of the only stations collected in the region"`
+	Deny        []string        `config:"deny" usage:"IDs of the stations never collected in the region"`
+}
+
+// Locations returns the configured regions with the defaults of c applied
+func (c *Config) Locations() []*LocationData {
+	regions := c.Regions
+	if !c.Region.IsZero() {
+		regions = append([]Region{c.Region}, regions...)
+	}
+	locations := make([]*LocationData, 0, len(regions))
+	for _, r := range regions {
+		loc := &LocationData{
+			Name:        r.Name,
+			Lat1:        *r.Lat1,
+			Lng1:        *r.Lng1,
+			Lat2:        *r.Lat2,
+			Lng2:        *r.Lng2,
+			Token:       c.Token,
+			Interval:    c.UpdateFrequency.Duration(),
+			MaxStations: c.MaxStations,
+			Priority:    r.Priority,
+			Provider:    defaultProvider,
+			Strategy:    c.Strategy,
+			Allow:       r.Allow,
+			Deny:        r.Deny,
+		}
+		if loc.Name == "" {
+			loc.Name = fmt.Sprintf("%f,%f,%f,%f", loc.Lat1, loc.Lng1, loc.Lat2, loc.Lng2)
+		}
+		if r.Interval > 0 {
+			loc.Interval = r.Interval.Duration()
+		}
+		if r.MaxStations != nil {
+			loc.MaxStations = *r.MaxStations
+		}
+		if r.Provider != "" {
+			loc.Provider = r.Provider
+		}
+		if r.Strategy != "" {
+			loc.Strategy = r.Strategy
+		}
+		locations = append(locations, loc)
+	}
+	return locations
+}
+
+// IsZero reports whether no corner is set
+func (r Region) IsZero() bool {
+	return r.Lat1 == nil && r.Lng1 == nil && r.Lat2 == nil && r.Lng2 == nil
+}
+
+func (r *Region) Validate() error {
+	if r.IsZero() {
+		return nil
+	}
+	if r.Lat1 == nil || r.Lng1 == nil || r.Lat2 == nil || r.Lng2 == nil {
+		return fmt.Errorf("all of lat1, lng1, lat2 and lng2 must be set")
+	}
+	for _, lat := range []float64{*r.Lat1, *r.Lat2} {
+		if lat < -90 || lat > 90 {
+			return fmt.Errorf("latitude %f is out of range [-90, 90]", lat)
+		}
+	}
+	for _, lng := range []float64{*r.Lng1, *r.Lng2} {
+		if lng < -180 || lng > 180 {
+			return fmt.Errorf("longitude %f is out of range [-180, 180]", lng)
+		}
+	}
+	if r.Interval < 0 {
+		return fmt.Errorf("interval may not be negative")
+	}
+	if r.MaxStations != nil && *r.MaxStations < 0 {
+		return fmt.Errorf("maxStations may not be negative")
+	}
+	if _, ok := providers[r.Provider]; r.Provider != "" && !ok {
+		return fmt.Errorf("unknown provider %q", r.Provider)
+	}
+	if _, ok := strategies[r.Strategy]; r.Strategy != "" && !ok {
+		return fmt.Errorf("unknown strategy %q", r.Strategy)
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if c.UpdateFrequency <= 0 {
+		return fmt.Errorf("updateFrequency must be positive")
+	}
+	if c.WatchInterval <= 0 {
+		return fmt.Errorf("watchInterval must be positive")
+	}
+	if c.MaxStations < 0 {
+		return fmt.Errorf("maxStations may not be negative")
+	}
+	if _, ok := strategies[c.Strategy]; !ok {
+		return fmt.Errorf("unknown strategy %q", c.Strategy)
+	}
+	if c.Jitter < 0 {
+		return fmt.Errorf("jitter may not be negative")
+	}
+	if c.Region.IsZero() && len(c.Regions) == 0 {
+		return fmt.Errorf("no region is set, set lat1, lng1, lat2 and lng2 or a list of regions")
+	}
+	names := map[string]bool{}
+	for i, r := range c.Regions {
+		if r.IsZero() {
+			return fmt.Errorf("regions[%d]: lat1, lng1, lat2 and lng2 must be set", i)
+		}
+		if r.Name != "" && names[r.Name] {
+			return fmt.Errorf("regions[%d]: duplicate name %q", i, r.Name)
+		}
+		names[r.Name] = true
+	}
+	return nil
+}
@@ -3,131 +3,85 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"math/rand"
-	"net/http"
+	"log/slog"
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/protobuf/proto"
 
+	api "github.com/etesami/air-quality-monitoring/api"
+	grpcclient "github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	httpclient "github.com/etesami/air-quality-monitoring/pkg/httpclient"
 	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
 	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+	tracing "github.com/etesami/air-quality-monitoring/pkg/tracing"
 	utils "github.com/etesami/air-quality-monitoring/pkg/utils"
+	validation "github.com/etesami/air-quality-monitoring/pkg/validation"
 )
 
+// LocationData is a region to collect and its schedule
 type LocationData struct {
-	Lat1  float64 `json:"lat1"`
-	Lng1  float64 `json:"lng1"`
-	Lat2  float64 `json:"lat2"`
-	Lng2  float64 `json:"lng2"`
-	Token string  `json:"token"`
+	Name        string        `json:"name,omitempty"`
+	Lat1        float64       `json:"lat1"`
+	Lng1        float64       `json:"lng1"`
+	Lat2        float64       `json:"lat2"`
+	Lng2        float64       `json:"lng2"`
+	Token       string        `json:"token"`
+	Interval    time.Duration `json:"interval"`
+	MaxStations int           `json:"maxStations"`
+	Priority    int           `json:"priority"`
+	Provider    string        `json:"provider"`
+	Strategy    string        `json:"strategy"`
+	Allow       []string      `json:"allow,omitempty"`
+	Deny        []string      `json:"deny,omitempty"`
 }
 
-func (l *LocationData) CollectLocationsIds() (map[string]any, error) {
+// CollectLocationsIds fetches the stations in the bounding box
+func (l *LocationData) CollectLocationsIds(ctx context.Context, client *httpclient.Client) (json.RawMessage, error) {
 	url := fmt.Sprintf(
 		"https://api.waqi.info/v2/map/bounds?latlng=%f,%f,%f,%f&token=%s",
 		l.Lat1, l.Lng1, l.Lat2, l.Lng2, l.Token)
 
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch data: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to fetch data: %d", resp.StatusCode)
-	}
-
-	var res map[string]any
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return nil, fmt.Errorf("error Decoding JSON: %v", err)
+	var res json.RawMessage
+	if err := client.GetJSON(ctx, url, l.Token, &res); err != nil {
+		return nil, fmt.Errorf("failed to fetch data: %w", err)
 	}
 	return res, nil
 }
 
-// validateData validates the fetched data and ensures it
-// contains the status and data fields
-func validateDataLocIds(data map[string]any) error {
-	if data == nil {
-		return fmt.Errorf("data is nil")
-	}
-
-	if v, ok := data["status"]; !ok || v.(string) != "ok" {
-		return fmt.Errorf("invalid status: %v", v)
-	}
-	if _, ok := data["data"]; !ok {
-		return fmt.Errorf("data field is missing")
-	}
-	return nil
-}
-
-// validateDataLocDetails validates the fetched data and ensures it
-// contains the status and rxs fields
-func validateDataLocDetails(data map[string]any) error {
-	if data == nil {
-		return fmt.Errorf("data is nil")
-	}
-
-	_, ok := data["data"]
-	if !ok {
-		return fmt.Errorf("key 'data' not found in data")
-	}
-	if vv, ok := data["status"]; !ok || vv.(string) != "ok" {
-		return fmt.Errorf("invalid status: %v", vv)
-	}
-	return nil
-}
-
-// GetLocationIds extracts the location IDs from the fetched data
-func GetLocationIds(data map[string]any) ([]string, error) {
-	if data == nil {
-		return nil, fmt.Errorf("data is nil")
-	}
-
-	var locationIds []string
-	for _, item := range data["data"].([]any) {
-		if v, ok := item.(map[string]any)["uid"]; ok {
-			locationIds = append(locationIds, fmt.Sprintf("%d", int(v.(float64))))
-		}
-	}
-	return locationIds, nil
+// Station is a station found in a region
+type Station struct {
+	ID  string
+	Lat float64
+	Lng float64
 }
 
 // getLocationData fetches data for a specific location ID
-func getLocationData(locationId, token string) (map[string]any, error) {
+func getLocationData(ctx context.Context, client *httpclient.Client, locationId, token string) (json.RawMessage, error) {
 	url := fmt.Sprintf(
 		"https://api.waqi.info/feed/@%s/?token=%s",
 		locationId, token)
 
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch data for location %s: %v", locationId, err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to fetch data for location %s: %d", locationId, resp.StatusCode)
-	}
-
-	var res map[string]any
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return nil, fmt.Errorf("error decoding JSON for location %s: %v", locationId, err)
+	var res json.RawMessage
+	if err := client.GetJSON(ctx, url, token, &res); err != nil {
+		return nil, fmt.Errorf("failed to fetch data for location %s: %w", locationId, err)
 	}
 	return res, nil
 }
 
 // sendToDataIngestionService sends the data to the data ingestion service
 // It takes a gRPC client and the data to be sent as parameters
-func sendToDataIngestionService(client pb.AirQualityMonitoringClient, data any) (int, error) {
+func sendToDataIngestionService(ctx context.Context, client pb.AirQualityMonitoringClient, data any) (int, error) {
 
 	byteData, err := json.Marshal(data)
 	if err != nil {
 		return 0, fmt.Errorf("failed to marshal data: %v", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	sentTimestamp := time.Now()
@@ -141,96 +95,137 @@ func sendToDataIngestionService(client pb.AirQualityMonitoringClient, data any)
 	}
 
 	bytesSent := proto.Size(res)
-	log.Printf("Sent [%d] bytes. Ack recevied, status: [%s]\n", bytesSent, ack.Status)
+	slog.DebugContext(ctx, "Sent data", "bytes", bytesSent, "status", ack.Status)
 
 	return bytesSent, nil
 }
 
-// processTicker processes the ticker event
-func ProcessTicker(client *pb.AirQualityMonitoringClient, serverName string, locData *LocationData, metricList *metric.Metric) error {
-
-	go func(m *metric.Metric) {
-		if *client == nil {
-			log.Printf("Client is not ready yet")
-			return
-		}
-		ping := &pb.Data{
-			Payload:       "ping",
-			SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
-		}
-		pong, err := (*client).CheckConnection(context.Background(), ping)
-		if err != nil {
-			log.Printf("Error checking connection: %v", err)
-			return
+// stampCollected records in the lineage of the readings of data when they were
+// observed at the station and collected
+func stampCollected(data json.RawMessage, t time.Time, m *metric.Metrics) (json.RawMessage, error) {
+	aqData := &api.AirQualityData{}
+	if err := json.Unmarshal(data, aqData); err != nil {
+		return nil, validation.Malformed(err)
+	}
+	for i := range aqData.Obs {
+		msg := &aqData.Obs[i].Msg
+		if observed, ok := msg.ObservedAt(); ok {
+			msg.Lineage.Stamp(api.StageObserved, observed)
 		}
-		rtt, err := utils.CalculateRtt(ping.SentTimestamp, pong.ReceivedTimestamp, pong.AckSentTimestamp, time.Now())
-		if err != nil {
-			log.Printf("Error calculating RTT: %v", err)
-			return
-		}
-		m.AddRttTime(serverName, float64(rtt)/1000.0)
-		log.Printf("RTT to [%s] service: [%.2f] ms\n", serverName, float64(rtt)/1000.0)
+		msg.Lineage.Stamp(api.StageCollected, t)
+		m.AddLineage(msg.Idx, api.StageCollected, msg.Lineage)
+	}
+	return json.Marshal(aqData)
+}
 
-	}(metricList)
+// countRejection counts err in the metrics if it is a validation rejection
+func countRejection(m *metric.Metrics, err error) {
+	var rej *validation.Rejection
+	if errors.As(err, &rej) {
+		m.AddRejected(string(rej.Reason))
+	}
+}
 
-	data, err := locData.CollectLocationsIds()
+// PingServer measures the round-trip time to the server
+func PingServer(client *grpcclient.Client, serverName string, m *metric.Metrics) {
+	if !client.Ready() {
+		slog.Warn("Client is not ready yet")
+		return
+	}
+	ping := &pb.Data{
+		Payload:       "ping",
+		SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
+	}
+	pong, err := client.CheckConnection(context.Background(), ping)
 	if err != nil {
-		return fmt.Errorf("fetching data: %w", err)
+		slog.Warn("Error checking connection", "service", serverName, "error", err)
+		return
 	}
+	rtt, err := utils.CalculateRtt(ping.SentTimestamp, pong.ReceivedTimestamp, pong.AckSentTimestamp, time.Now())
+	if err != nil {
+		slog.Warn("Error calculating RTT", "service", serverName, "error", err)
+		return
+	}
+	m.AddRttTime(serverName, float64(rtt)/1000.0)
+	slog.Debug("RTT to service", "service", serverName, "rtt_ms", float64(rtt)/1000.0)
+}
 
-	var pTime int64
-	st := time.Now()
+// ProcessRegion collects the stations of the region and sends them to the ingestion service,
+// sel picks the stations to collect and the readings failing validation are passed to reject
+func ProcessRegion(ctx context.Context, client *grpcclient.Client, locData *LocationData,
+	provider Provider, sel *Selector, metricList *metric.Metrics, reject func(json.RawMessage, error)) (err error) {
 
-	if err := validateDataLocIds(data); err != nil {
-		return fmt.Errorf("validating data: %w", err)
-	}
-	locationIds, err := GetLocationIds(data)
+	ctx, span := tracing.Start(ctx, "collect region",
+		attribute.String("region", locData.Name), attribute.String("provider", locData.Provider))
+	defer func() { tracing.End(span, err) }()
+
+	stations, rejections, err := provider.Stations(ctx, locData)
 	if err != nil {
+		countRejection(metricList, err)
 		return fmt.Errorf("getting location IDs: %w", err)
 	}
-	// panic if no locations found
-	if len(locationIds) == 0 {
-		panic(fmt.Errorf("no location IDs found: [%v]", data))
+	for _, rej := range rejections {
+		slog.InfoContext(ctx, "Skipping station", "region", locData.Name, "rejection", &rej)
+		metricList.AddRejected(string(rej.Reason))
 	}
-	log.Printf("Received [%d] location IDs: [%v] \n", len(locationIds), locationIds)
 
-	pTime = time.Since(st).Milliseconds()
+	var pTime int64
+	st := time.Now()
+	if len(stations) == 0 {
+		slog.InfoContext(ctx, "No stations found, nothing to collect", "region", locData.Name)
+		return nil
+	}
+	slog.DebugContext(ctx, "Received stations", "region", locData.Name, "stations", len(stations))
 
-	// if there are more than 5 locations, we only process the 5 location selected randomly
-	if len(locationIds) > 5 {
-		// randomly select 5 locations
-		rand.Shuffle(len(locationIds), func(i, j int) {
-			locationIds[i], locationIds[j] = locationIds[j], locationIds[i]
-		})
-		locationIds = locationIds[:5]
-		log.Printf("Processing only the first 5 location IDs: [%v] \n", locationIds)
+	stations = sel.Select(locData, stations)
+	locationIds := make([]string, 0, len(stations))
+	for _, station := range stations {
+		locationIds = append(locationIds, station.ID)
 	}
+	slog.InfoContext(ctx, "Collecting stations", "region", locData.Name, "strategy", locData.Strategy, "stations", locationIds)
+	span.SetAttributes(attribute.Int("stations", len(locationIds)))
+
+	pTime = time.Since(st).Milliseconds()
 
 	var wg sync.WaitGroup
 	for _, locationId := range locationIds {
 
 		wg.Add(1)
-		go func(locationId string, m *metric.Metric, pt int64) {
+		go func(locationId string, m *metric.Metrics, pt int64) {
 			defer wg.Done()
+			defer m.InFlight("collect")()
 
-			locationData, err := getLocationData(locationId, locData.Token)
+			ctx, span := tracing.Start(ctx, "collect station", attribute.String("station", locationId))
+			var err error
+			defer func() { tracing.End(span, err) }()
+
+			locationData, err := provider.Station(ctx, locationId, locData.Token)
 			if err != nil {
-				log.Printf("Error getting location data for ID %s: %v", locationId, err)
+				slog.WarnContext(ctx, "Error getting station data", "station", locationId, "error", err)
 				return
 			}
+			m.AddReceived(1)
 
 			st := time.Now()
-			if err := validateDataLocDetails(locationData); err != nil {
-				log.Printf("Error validating location data for ID %s: %v", locationId, err)
+			data, err := provider.Validate(locationData)
+			if err == nil {
+				data, err = stampCollected(data, st, m)
+			}
+			if err != nil {
+				slog.InfoContext(ctx, "Rejected station data", "station", locationId, "error", err)
+				reject(locationData, err)
 				return
 			}
+			m.AddAccepted(1)
 			pt += time.Since(st).Milliseconds()
-			m.AddProcessingTime("processing", float64(pt)/1000.0)
+			m.AddProcessingTime("collect", float64(pt)/1000.0)
 
-			if bytes, err := sendToDataIngestionService(*client, locationData["data"]); err != nil {
-				log.Printf("Error sending data to ingestion service: %v", err)
+			var bytes int
+			if bytes, err = sendToDataIngestionService(ctx, client, data); err != nil {
+				slog.ErrorContext(ctx, "Error sending data to ingestion service", "station", locationId, "error", err)
 			} else {
 				m.AddSentDataBytes("ingestor", float64(bytes))
+				m.AddForwarded("ingestor", 1)
 			}
 
 		}(locationId, metricList, pTime)
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	httpclient "github.com/etesami/air-quality-monitoring/pkg/httpclient"
+	validation "github.com/etesami/air-quality-monitoring/pkg/validation"
+)
+
+const defaultProvider = "waqi"
+
+// Provider is a source of air quality stations and their readings.
+// Invalid responses are reported as *validation.Rejection errors.
+type Provider interface {
+	// Stations fetches the valid stations in the bounding box of the location
+	// and the rejections of the invalid ones
+	Stations(ctx context.Context, loc *LocationData) ([]Station, []validation.Rejection, error)
+	// Station fetches the latest reading of a station
+	Station(ctx context.Context, id, token string) (json.RawMessage, error)
+	// Validate validates a fetched reading and returns the data to send
+	Validate(raw json.RawMessage) (json.RawMessage, error)
+}
+
+// providers create the providers a region can be collected from, by name
+var providers = map[string]func(client *httpclient.Client) Provider{
+	defaultProvider: func(client *httpclient.Client) Provider { return waqi{client: client} },
+}
+
+// waqi is the World Air Quality Index project API
+type waqi struct {
+	client *httpclient.Client
+}
+
+func (w waqi) Stations(ctx context.Context, loc *LocationData) ([]Station, []validation.Rejection, error) {
+	raw, err := loc.CollectLocationsIds(ctx, w.client)
+	if err != nil {
+		return nil, nil, err
+	}
+	found, rejections, err := validation.WAQIBounds(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	stations := make([]Station, 0, len(found))
+	for _, s := range found {
+		stations = append(stations, Station{ID: fmt.Sprintf("%d", s.UID), Lat: s.Lat, Lng: s.Lon})
+	}
+	return stations, rejections, nil
+}
+
+func (w waqi) Station(ctx context.Context, id, token string) (json.RawMessage, error) {
+	return getLocationData(ctx, w.client, id, token)
+}
+
+func (waqi) Validate(raw json.RawMessage) (json.RawMessage, error) {
+	return validation.WAQIFeed(raw)
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultStrategy = "random"
+
+// strategies pick limit stations of a region.
+// The stations are sorted by ID and filtered by the allow and deny lists of the region.
+var strategies = map[string]func(sel *Selector, loc *LocationData, stations []Station, limit int) []Station{
+	// random picks a different sample on every collection
+	"random": func(_ *Selector, _ *LocationData, stations []Station, limit int) []Station {
+		rand.Shuffle(len(stations), func(i, j int) {
+			stations[i], stations[j] = stations[j], stations[i]
+		})
+		return stations[:limit]
+	},
+	// all collects every station regardless of the cap
+	"all": func(_ *Selector, _ *LocationData, stations []Station, _ int) []Station {
+		return stations
+	},
+	// roundRobin goes through all stations across collections
+	"roundRobin": func(sel *Selector, _ *LocationData, stations []Station, limit int) []Station {
+		start := sel.cursor % len(stations)
+		sel.cursor = start + limit
+		picked := make([]Station, 0, limit)
+		for i := 0; i < limit; i++ {
+			picked = append(picked, stations[(start+i)%len(stations)])
+		}
+		return picked
+	},
+	// spatial spreads the stations over a grid covering the bounding box
+	"spatial": func(_ *Selector, loc *LocationData, stations []Station, limit int) []Station {
+		return selectSpatial(loc, stations, limit)
+	},
+	// leastRecent prefers the stations picked the longest time ago, or never. It
+	// knows nothing of the readings stored, a station failing to be collected waits
+	// its turn like the others rather than being retried on every collection.
+	"leastRecent": func(sel *Selector, _ *LocationData, stations []Station, limit int) []Station {
+		sel.mu.Lock()
+		defer sel.mu.Unlock()
+		sort.SliceStable(stations, func(i, j int) bool {
+			return sel.picked[stations[i].ID].Before(sel.picked[stations[j].ID])
+		})
+		now := sel.now()
+		for _, s := range stations[:limit] {
+			sel.picked[s.ID] = now
+		}
+		return stations[:limit]
+	},
+}
+
+// Selector picks the stations of a region to collect and keeps the state of
+// its strategy between collections, e.g. the round-robin position
+type Selector struct {
+	cursor int
+	now    func() time.Time
+
+	mu     sync.Mutex
+	picked map[string]time.Time
+}
+
+// NewSelector returns a selector without history
+func NewSelector() *Selector {
+	return &Selector{now: time.Now, picked: map[string]time.Time{}}
+}
+
+// Select returns the stations to collect with the strategy of the region
+func (sel *Selector) Select(loc *LocationData, stations []Station) []Station {
+	allow := toSet(loc.Allow)
+	deny := toSet(loc.Deny)
+	filtered := make([]Station, 0, len(stations))
+	for _, s := range stations {
+		if (len(allow) == 0 || allow[s.ID]) && !deny[s.ID] {
+			filtered = append(filtered, s)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		return lessID(filtered[i].ID, filtered[j].ID)
+	})
+
+	limit := loc.MaxStations
+	if limit <= 0 || limit > len(filtered) {
+		limit = len(filtered)
+	}
+	if limit == 0 {
+		return filtered
+	}
+	strategy, ok := strategies[loc.Strategy]
+	if !ok {
+		strategy = strategies[defaultStrategy]
+	}
+	return strategy(sel, loc, filtered, limit)
+}
+
+// selectSpatial divides the bounding box in a grid of about limit cells and takes
+// the stations from every cell in turn, so dense areas do not crowd out the rest
+func selectSpatial(loc *LocationData, stations []Station, limit int) []Station {
+	n := int(math.Ceil(math.Sqrt(float64(limit))))
+	minLat, maxLat := math.Min(loc.Lat1, loc.Lat2), math.Max(loc.Lat1, loc.Lat2)
+	minLng, maxLng := math.Min(loc.Lng1, loc.Lng2), math.Max(loc.Lng1, loc.Lng2)
+	cellOf := func(v, lo, hi float64) int {
+		if hi <= lo {
+			return 0
+		}
+		c := int((v - lo) / (hi - lo) * float64(n))
+		return int(math.Max(0, math.Min(float64(n-1), float64(c))))
+	}
+
+	cells := make([][]Station, n*n)
+	for _, s := range stations {
+		c := cellOf(s.Lat, minLat, maxLat)*n + cellOf(s.Lng, minLng, maxLng)
+		cells[c] = append(cells[c], s)
+	}
+
+	picked := make([]Station, 0, limit)
+	for round := 0; len(picked) < limit; round++ {
+		for _, cell := range cells {
+			if round < len(cell) && len(picked) < limit {
+				picked = append(picked, cell[round])
+			}
+		}
+	}
+	return picked
+}
+
+// lessID orders numeric IDs by value and others lexically
+func lessID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
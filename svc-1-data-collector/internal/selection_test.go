@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// ids returns the IDs of the stations
+func ids(stations []Station) []string {
+	out := make([]string, 0, len(stations))
+	for _, s := range stations {
+		out = append(out, s.ID)
+	}
+	return out
+}
+
+// grid returns n stations with IDs 1..n spread on a line from (0, 0) to (1, 1)
+func grid(n int) []Station {
+	stations := make([]Station, 0, n)
+	for i := 1; i <= n; i++ {
+		v := float64(i-1) / float64(n)
+		stations = append(stations, Station{ID: strconv.Itoa(i), Lat: v, Lng: v})
+	}
+	return stations
+}
+
+func TestSelectFilters(t *testing.T) {
+	stations := []Station{{ID: "10"}, {ID: "9"}, {ID: "100"}, {ID: "2"}, {ID: "@1"}}
+	tests := []struct {
+		name string
+		loc  LocationData
+		want []string
+	}{
+		{name: "sorted by numeric ID", loc: LocationData{Strategy: "all"}, want: []string{"2", "9", "10", "@1", "100"}},
+		{name: "allow list", loc: LocationData{Strategy: "all", Allow: []string{"9", "100", "404"}}, want: []string{"9", "100"}},
+		{name: "deny list", loc: LocationData{Strategy: "all", Deny: []string{"9", "@1"}}, want: []string{"2", "10", "100"}},
+		{name: "deny wins over allow", loc: LocationData{Strategy: "all", Allow: []string{"9", "10"}, Deny: []string{"9"}}, want: []string{"10"}},
+		{name: "all ignores the cap", loc: LocationData{Strategy: "all", MaxStations: 2}, want: []string{"2", "9", "10", "@1", "100"}},
+		{name: "nothing left", loc: LocationData{Strategy: "roundRobin", Allow: []string{"404"}}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ids(NewSelector().Select(&tt.loc, slices.Clone(stations)))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Select() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectRandom(t *testing.T) {
+	stations := grid(10)
+	for _, loc := range []LocationData{{Strategy: "random", MaxStations: 4}, {Strategy: "unknown", MaxStations: 4}} {
+		got := ids(NewSelector().Select(&loc, slices.Clone(stations)))
+		if len(got) != 4 {
+			t.Fatalf("%s: Select() = %v, want 4 stations", loc.Strategy, got)
+		}
+		seen := map[string]bool{}
+		for _, id := range got {
+			if seen[id] {
+				t.Errorf("%s: Select() = %v, %s picked twice", loc.Strategy, got, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestSelectRoundRobin(t *testing.T) {
+	sel := NewSelector()
+	loc := &LocationData{Strategy: "roundRobin", MaxStations: 2}
+	want := [][]string{{"1", "2"}, {"3", "4"}, {"5", "1"}, {"2", "3"}}
+	for i, w := range want {
+		if got := ids(sel.Select(loc, grid(5))); !slices.Equal(got, w) {
+			t.Errorf("collection %d: Select() = %v, want %v", i, got, w)
+		}
+	}
+	// the position, past the 3rd station, wraps around when stations disappear
+	if got := ids(sel.Select(loc, grid(3))); !slices.Equal(got, []string{"1", "2"}) {
+		t.Errorf("after shrinking: Select() = %v, want [1 2]", got)
+	}
+}
+
+func TestSelectSpatial(t *testing.T) {
+	loc := &LocationData{Strategy: "spatial", MaxStations: 4, Lat1: 0, Lng1: 0, Lat2: 1, Lng2: 1}
+	// four stations crowd the south-west corner, one in every other cell
+	stations := []Station{
+		{ID: "1", Lat: 0.1, Lng: 0.1}, {ID: "2", Lat: 0.2, Lng: 0.1}, {ID: "3", Lat: 0.1, Lng: 0.2}, {ID: "4", Lat: 0.2, Lng: 0.2},
+		{ID: "5", Lat: 0.1, Lng: 0.9}, {ID: "6", Lat: 0.9, Lng: 0.1}, {ID: "7", Lat: 0.9, Lng: 0.9},
+	}
+	got := ids(NewSelector().Select(loc, stations))
+	if !slices.Equal(got, []string{"1", "5", "6", "7"}) {
+		t.Errorf("Select() = %v, want one station per cell [1 5 6 7]", got)
+	}
+
+	// stations on a degenerate box all fall in the first cell
+	loc = &LocationData{Strategy: "spatial", MaxStations: 2, Lat1: 1, Lng1: 1, Lat2: 1, Lng2: 1}
+	if got := ids(NewSelector().Select(loc, grid(3))); !slices.Equal(got, []string{"1", "2"}) {
+		t.Errorf("degenerate box: Select() = %v, want [1 2]", got)
+	}
+}
+
+func TestSelectLeastRecent(t *testing.T) {
+	sel := NewSelector()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sel.now = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	loc := &LocationData{Strategy: "leastRecent", MaxStations: 2}
+	want := [][]string{{"1", "2"}, {"3", "4"}, {"5", "1"}, {"2", "3"}}
+	for i, w := range want {
+		if got := ids(sel.Select(loc, grid(5))); !slices.Equal(got, w) {
+			t.Errorf("collection %d: Select() = %v, want %v", i, got, w)
+		}
+	}
+	// a new station was never picked and comes first
+	stations := append(grid(5), Station{ID: "6"})
+	if got := ids(sel.Select(loc, stations)); !slices.Equal(got, []string{"6", "4"}) {
+		t.Errorf("new station: Select() = %v, want [6 4]", got)
+	}
+}
@@ -1,117 +1,157 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"time"
 
 	api "github.com/etesami/air-quality-monitoring/api"
+	auth "github.com/etesami/air-quality-monitoring/pkg/auth"
+	config "github.com/etesami/air-quality-monitoring/pkg/config"
+	deadletter "github.com/etesami/air-quality-monitoring/pkg/deadletter"
+	grpcclient "github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	health "github.com/etesami/air-quality-monitoring/pkg/health"
+	logging "github.com/etesami/air-quality-monitoring/pkg/logging"
 	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
+	pool "github.com/etesami/air-quality-monitoring/pkg/pool"
 	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
-	utils "github.com/etesami/air-quality-monitoring/pkg/utils"
+	shutdown "github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	tlsconfig "github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+	tracing "github.com/etesami/air-quality-monitoring/pkg/tracing"
 	internal "github.com/etesami/air-quality-monitoring/svc-data-ingestion/internal"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 func main() {
-	// Target service initialization
-	svcTargetAddress := os.Getenv("SVC_STRG_ADDR")
-	svcTargetPort := os.Getenv("SVC_STRG_PORT")
-	targetSvc := &api.Service{
-		Address: svcTargetAddress,
-		Port:    svcTargetPort,
+
+	cfg := &internal.Config{}
+	if err := config.Load(cfg, flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatalf("Error loading config: %v", err)
 	}
+	logging.Setup("ingestor", cfg.Log)
 
-	var conn *grpc.ClientConn
-	var clientStrg pb.AirQualityMonitoringClient
-	go func() {
-		for {
-			if err := targetSvc.ServiceReachable(); err == nil {
-				var err error
-				conn, err = grpc.NewClient(
-					targetSvc.Address+":"+targetSvc.Port,
-					grpc.WithTransportCredentials(insecure.NewCredentials()))
-				if err != nil {
-					log.Printf("Failed to connect to target service: %v", err)
-					return
-				}
-				clientStrg = pb.NewAirQualityMonitoringClient(conn)
-				log.Printf("Connected to target service: %s:%s\n", targetSvc.Address, targetSvc.Port)
-				return
-			} else {
-				log.Printf("Target service is not reachable: %v", err)
-				time.Sleep(5 * time.Second)
-			}
-		}
-	}()
-	defer conn.Close()
+	ctx, stop := shutdown.Signals()
+	defer stop()
 
-	sentDataBuckets := utils.ParseBuckets(os.Getenv("SENT_DATA_BUCKETS"))
-	procTimeBuckets := utils.ParseBuckets(os.Getenv("PROC_TIME_BUCKETS"))
-	rttTimeBuckets := utils.ParseBuckets(os.Getenv("RTT_TIME_BUCKETS"))
+	shutdownTracing, err := tracing.Setup(context.Background(), "ingestor", cfg.Tracing)
+	if err != nil {
+		logging.Fatal("Error setting up tracing", "error", err)
+	}
+	m := metric.New("ingestor", metric.Buckets{
+		SentData: cfg.Metrics.SentDataBuckets,
+		ProcTime: cfg.Metrics.ProcTimeBuckets,
+		RttTime:  cfg.Metrics.RttTimeBuckets,
+		Latency:  cfg.Metrics.LatencyBuckets,
+	})
 
-	m := &metric.Metric{}
-	m.RegisterMetrics(sentDataBuckets, procTimeBuckets, rttTimeBuckets)
+	// The calls to the target service wait for it to be ready
+	clientStrg, err := grpcclient.New("local-storage", cfg.Storage.HostPort(), cfg.Client, m)
+	if err != nil {
+		logging.Fatal("Failed to create the client of target service", "error", err)
+	}
 
 	// Local service initialization
-	svcAddress := os.Getenv("SVC_INGST_ADDR")
-	svcPort := os.Getenv("SVC_INGST_PORT")
 	localSvc := &api.Service{
-		Address: svcAddress,
-		Port:    svcPort,
+		Address: cfg.Listen.Address,
+		Port:    cfg.Listen.Port,
 	}
 
 	// We listen on all interfaces
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", localSvc.Port))
 	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+		logging.Fatal("Failed to listen", "error", err)
 	}
 
-	grpcServer := grpc.NewServer()
-	pb.RegisterAirQualityMonitoringServer(grpcServer, &internal.Server{
-		Client: &clientStrg,
+	workers := pool.New("ingest", cfg.Pool, m)
+	server := &internal.Server{
+		Client: clientStrg,
 		Metric: m,
-	})
+		Rules:  cfg.Validation.Rules(),
+		Pool:   workers,
+	}
+	if cfg.DeadLetterDir != "" {
+		store, err := deadletter.Open(cfg.DeadLetterDir, "ingestor")
+		if err != nil {
+			logging.Fatal("Error opening dead-letter store", "error", err)
+		}
+		server.DeadLetter = store
+		slog.Info("Keeping rejected observations", "dir", cfg.DeadLetterDir)
+	}
+
+	creds, err := tlsconfig.ServerOption(cfg.TLS)
+	if err != nil {
+		logging.Fatal("Error setting up TLS", "error", err)
+	}
+	authz, err := auth.New(cfg.Auth, m)
+	if err != nil {
+		logging.Fatal("Error setting up authentication", "error", err)
+	}
+	grpcServer := grpc.NewServer(creds, tracing.ServerOption(), logging.ServerOption(), grpcclient.ServerOption(),
+		authz.Unary(), authz.Stream())
+	pb.RegisterAirQualityMonitoringServer(grpcServer, server)
+	if server.DeadLetter != nil {
+		pb.RegisterDeadLetterServer(grpcServer, deadletter.Server{Store: server.DeadLetter, Reinject: server.Reinject})
+	}
+
+	checker := health.New(cfg.Health, pb.AirQualityMonitoring_ServiceDesc.ServiceName)
+	checker.Add("local-storage", health.Serving(clientStrg.Conn(), ""))
+	checker.Register(grpcServer)
+	go checker.Run(ctx)
 
 	go func() {
-		log.Printf("starting gRPC server on port %s:%s\n", localSvc.Address, localSvc.Port)
+		slog.Info("Starting gRPC server", "address", net.JoinHostPort(localSvc.Address, localSvc.Port))
 		if err := grpcServer.Serve(listener); err != nil {
-			log.Fatalf("Failed to serve: %v", err)
+			logging.Fatal("Failed to serve", "error", err)
 		}
 	}()
 
 	// First call to processTicker
-	if err := internal.ProcessTicker(&clientStrg, "local-storage", m); err != nil {
-		log.Printf("Error during processing: %v", err)
+	if err := internal.ProcessTicker(clientStrg, "local-storage", m); err != nil {
+		slog.Error("Error during processing", "error", err)
 	}
 
 	// Set up a ticker to periodically call the gRPC server to measure the RTT
-	updateFrequencyStr := os.Getenv("UPDATE_FREQUENCY")
-	updateFrequency, err := strconv.Atoi(updateFrequencyStr)
-	if err != nil {
-		log.Fatalf("Error parsing update frequency: %v", err)
-	}
-	ticker := time.NewTicker(time.Duration(updateFrequency) * time.Minute)
+	ticker := time.NewTicker(cfg.UpdateFrequency.Duration())
 	defer ticker.Stop()
 
-	go func(m *metric.Metric, c *pb.AirQualityMonitoringClient) {
-		for range ticker.C {
+	go func(m *metric.Metrics, c *grpcclient.Client) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
 			if err := internal.ProcessTicker(c, "local-storage", m); err != nil {
-				log.Printf("Error during processing: %v", err)
+				slog.Error("Error during processing", "error", err)
 			}
 		}
-	}(m, &clientStrg)
+	}(m, clientStrg)
+
+	http.Handle("/metrics", m.Handler())
+	checker.RegisterHTTP(http.DefaultServeMux)
+	metricsServer := &http.Server{Addr: cfg.Metrics.HostPort()}
+	go func() {
+		slog.Info("Starting metrics server", "port", cfg.Metrics.Port)
+		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatal("Error starting metrics server", "error", err)
+		}
+	}()
 
-	metricAddr := os.Getenv("METRIC_ADDR")
-	metricPort := os.Getenv("METRIC_PORT")
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Starting server on :%s\n", metricPort)
-	http.ListenAndServe(fmt.Sprintf("%s:%s", metricAddr, metricPort), nil)
+	// On SIGTERM the service stops taking requests and finishes the ones in flight
+	<-ctx.Done()
+	shutdown.Run(cfg.Shutdown.Timeout.Duration(),
+		shutdown.Do("health", checker.Shutdown),
+		shutdown.GRPC(grpcServer),
+		shutdown.Wait("processing", workers),
+		shutdown.Close("storage client", clientStrg),
+		shutdown.HTTP("metrics server", metricsServer),
+		shutdown.Step{Name: "tracing", Stop: shutdownTracing},
+	)
 }
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/etesami/air-quality-monitoring/pkg/auth"
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+	"github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	"github.com/etesami/air-quality-monitoring/pkg/health"
+	"github.com/etesami/air-quality-monitoring/pkg/logging"
+	"github.com/etesami/air-quality-monitoring/pkg/pool"
+	"github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	"github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+	"github.com/etesami/air-quality-monitoring/pkg/tracing"
+	"github.com/etesami/air-quality-monitoring/pkg/validation"
+)
+
+// Config is the configuration of the ingestion service
+type Config struct {
+	Listen          config.Listener   `config:"listen" env:"SVC_INGST"`
+	TLS             tlsconfig.Config  `config:"tls" env:"TLS"`
+	Auth            auth.Config       `config:"auth" env:"AUTH"`
+	Storage         config.Endpoint   `config:"storage" env:"SVC_STRG" required:"true"`
+	Client          grpcclient.Config `config:"client" env:"CLIENT"`
+	UpdateFrequency config.Duration   `config:"updateFrequency" env:"UPDATE_FREQUENCY" default:"30m" unit:"m" usage:"interval between round-trip time measurements"`
+	Validation      Validation        `config:"validation" env:"VALIDATION"`
+	DeadLetterDir   string            `config:"deadLetterDir" env:"DEAD_LETTER_DIR" default:"deadletter" usage:"directory the rejected observations are kept in, none when empty"`
+	Pool            pool.Config       `config:"pool" env:"POOL"`
+	Metrics         config.Metrics    `config:"metrics"`
+	Tracing         tracing.Config    `config:"tracing"`
+	Log             logging.Config    `config:"log"`
+	Health          health.Config     `config:"health"`
+	Shutdown        shutdown.Config   `config:"shutdown"`
+}
+
+// Validation configures the checks of the received observations
+type Validation struct {
+	MaxAge  config.Duration `config:"maxAge" env:"MAX_AGE" default:"72h" usage:"observations older than it are rejected, 0 to accept any"`
+	MaxSkew config.Duration `config:"maxSkew" env:"MAX_SKEW" default:"1h" usage:"observations further than it in the future are rejected, 0 to accept any"`
+}
+
+// Rules returns the validation rules of the observations
+func (v Validation) Rules() validation.Rules {
+	return validation.Rules{MaxAge: v.MaxAge.Duration(), MaxSkew: v.MaxSkew.Duration()}
+}
+
+func (c *Config) Validate() error {
+	if c.UpdateFrequency <= 0 {
+		return fmt.Errorf("updateFrequency must be positive")
+	}
+	if c.Validation.MaxAge < 0 || c.Validation.MaxSkew < 0 {
+		return fmt.Errorf("validation.maxAge and validation.maxSkew may not be negative")
+	}
+	return nil
+}
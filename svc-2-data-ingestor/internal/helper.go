@@ -4,21 +4,32 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"strconv"
 	"time"
 
 	api "github.com/etesami/air-quality-monitoring/api"
+	deadletter "github.com/etesami/air-quality-monitoring/pkg/deadletter"
+	grpcclient "github.com/etesami/air-quality-monitoring/pkg/grpcclient"
 	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
+	pool "github.com/etesami/air-quality-monitoring/pkg/pool"
 	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+	tracing "github.com/etesami/air-quality-monitoring/pkg/tracing"
 	utils "github.com/etesami/air-quality-monitoring/pkg/utils"
+	validation "github.com/etesami/air-quality-monitoring/pkg/validation"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
 type Server struct {
 	pb.UnimplementedAirQualityMonitoringServer
-	Client *pb.AirQualityMonitoringClient
-	Metric *metric.Metric
+	Client     *grpcclient.Client
+	Metric     *metric.Metrics
+	Rules      validation.Rules
+	DeadLetter *deadletter.Store
+	Pool       *pool.Pool
 }
 
 // CheckConnection is a simple ping-pong method to respond for the health check
@@ -36,53 +47,28 @@ func (s Server) CheckConnection(ctx context.Context, recData *pb.Data) (*pb.Ack,
 func (s Server) SendDataToServer(ctx context.Context, recData *pb.Data) (*pb.Ack, error) {
 	st := time.Now()
 	recTimestamp := st.UnixMilli()
-	log.Printf("Received at [%s]: [%d]\n", st.Format("2006-01-02 15:04:05"), len(recData.Payload))
-
-	go func(payload string, st time.Time) {
-
-		// TODO: Here you can preprocess the data as needed
-		data := &api.AirQualityData{}
-		if err := json.Unmarshal([]byte(payload), &data); err != nil {
-			log.Printf("Error unmarshalling JSON: %v", err)
-			return
-		}
-
-		pTime := time.Since(st).Milliseconds()
-
-		// Sneding to the storage
-		if *s.Client == nil {
-			log.Printf("Client is not ready yet")
-			s.Metric.AddProcessingTime("processing", float64(pTime)/1000.0)
-			return
-		}
-
-		// Make sure there is no empty data (with enpty city name)
-		preprocessedData := &api.AirQualityData{
-			Status: data.Status,
-			Ver:    data.Ver,
+	slog.DebugContext(ctx, "Received data", "bytes", len(recData.Payload))
+
+	// The processing waits for a worker, the call is turned away when too many wait
+	// already so that the caller backs off. The call is acknowledged once the valid
+	// observations are forwarded, or kept in the dead-letter store once the retries to
+	// the local storage are exhausted. Without a store the caller retries the payload.
+	// Processing outliving the call still completes and continues its trace.
+	procCtx := context.WithoutCancel(ctx)
+	if err := s.Pool.Do(ctx, func() error {
+		unsent, err := s.process(procCtx, recData.Payload, st)
+		if err == nil {
+			return nil
 		}
-		for _, obs := range data.Obs {
-			if obs.Msg.City.Name == "" {
-				log.Printf("City name is empty, skipping observation")
-				continue
-			}
-			preprocessedData.Obs = append(preprocessedData.Obs, obs)
+		slog.ErrorContext(procCtx, "Error during processing", "error", err)
+		if s.DeadLetter == nil {
+			return status.Error(codes.Unavailable, "error forwarding data, retry later")
 		}
-		if len(preprocessedData.Obs) == 0 {
-			log.Printf("No valid observations found, skipping data")
-			return
-		}
-		pTime = time.Since(st).Milliseconds()
-		s.Metric.AddProcessingTime("processing", float64(pTime)/1000.0)
-
-		if sentBytes, err := sendDataToStorage(*s.Client, preprocessedData); err != nil {
-			log.Printf("Error sending data to storage: %v", err)
-			return
-		} else {
-			s.Metric.AddSentDataBytes("local-storage", float64(sentBytes))
-		}
-
-	}(recData.Payload, st)
+		s.reject(procCtx, unsent, []validation.Rejection{deadletter.Failed(err)})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 
 	ack := &pb.Ack{
 		Status:                "ok",
@@ -94,8 +80,96 @@ func (s Server) SendDataToServer(ctx context.Context, recData *pb.Data) (*pb.Ack
 	return ack, nil
 }
 
-func sendDataToStorage(client pb.AirQualityMonitoringClient, d *api.AirQualityData) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// Reinject processes a dead-letter record again
+func (s Server) Reinject(ctx context.Context, rec *deadletter.Record) error {
+	_, err := s.process(ctx, rec.Payload, time.Now())
+	return err
+}
+
+// process validates payload and sends its valid observations to the storage. When
+// they could not be sent it returns them, without the observations rejected already.
+func (s Server) process(ctx context.Context, payload string, st time.Time) (unsent string, err error) {
+	defer s.Metric.InFlight("ingest")()
+	ctx, span := tracing.Start(ctx, "ingest")
+	defer func() { tracing.End(span, err) }()
+
+	data := &api.AirQualityData{}
+	if err := json.Unmarshal([]byte(payload), &data); err != nil {
+		s.reject(ctx, payload, []validation.Rejection{*validation.Malformed(err)})
+		return "", nil
+	}
+	s.Metric.AddReceived(len(data.Obs))
+
+	// Keep the valid observations only, each rejected one is kept
+	// on its own so that it can be reinjected once fixed
+	accepted, rejected := s.Rules.AirQualityData(data, time.Now())
+	span.SetAttributes(attribute.Int("accepted", len(accepted)), attribute.Int("rejected", len(rejected)))
+	s.Metric.AddAccepted(len(accepted))
+	for _, r := range rejected {
+		obs, _ := json.Marshal(&api.AirQualityData{
+			Status: data.Status,
+			Ver:    data.Ver,
+			Obs:    []api.Observation{r.Observation},
+		})
+		s.reject(ctx, string(obs), r.Rejections)
+	}
+	for i := range accepted {
+		stampIngested(&accepted[i].Msg, st)
+		s.Metric.AddLineage(accepted[i].Msg.Idx, api.StageIngested, accepted[i].Msg.Lineage)
+	}
+
+	pTime := time.Since(st).Milliseconds()
+
+	// Sneding to the storage
+	preprocessedData := &api.AirQualityData{
+		Status: data.Status,
+		Ver:    data.Ver,
+		Obs:    accepted,
+	}
+	if len(preprocessedData.Obs) == 0 {
+		slog.InfoContext(ctx, "No valid observations found, skipping data")
+		return "", nil
+	}
+	pTime = time.Since(st).Milliseconds()
+	s.Metric.AddProcessingTime("ingest", float64(pTime)/1000.0)
+
+	sentBytes, err := sendDataToStorage(ctx, s.Client, preprocessedData)
+	if err != nil {
+		b, _ := json.Marshal(preprocessedData)
+		return string(b), fmt.Errorf("error sending data to storage: %v", err)
+	}
+	s.Metric.AddSentDataBytes("local-storage", float64(sentBytes))
+	s.Metric.AddForwarded("local-storage", len(preprocessedData.Obs))
+	return "", nil
+}
+
+// stampIngested records in the lineage of msg when it was ingested, and when it was
+// observed if the collector did not, e.g. for readings sent by older collectors
+func stampIngested(msg *api.Msg, t time.Time) {
+	if _, ok := msg.Lineage.At(api.StageObserved); !ok {
+		if observed, ok := msg.ObservedAt(); ok {
+			msg.Lineage.Stamp(api.StageObserved, observed)
+		}
+	}
+	msg.Lineage.Stamp(api.StageIngested, t)
+}
+
+// reject logs and counts the rejections of payload and keeps it in the dead-letter store, if any
+func (s Server) reject(ctx context.Context, payload string, rejections []validation.Rejection) {
+	for _, r := range rejections {
+		slog.InfoContext(ctx, "Rejected observation", "rejection", &r)
+		s.Metric.AddRejected(string(r.Reason))
+	}
+	if s.DeadLetter == nil {
+		return
+	}
+	if _, err := s.DeadLetter.Reject("ingest", "collector", payload, rejections); err != nil {
+		slog.ErrorContext(ctx, "Error writing to dead-letter store", "error", err)
+	}
+}
+
+func sendDataToStorage(ctx context.Context, client pb.AirQualityMonitoringClient, d *api.AirQualityData) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	// Marhal the data to JSON
@@ -118,34 +192,34 @@ func sendDataToStorage(client pb.AirQualityMonitoringClient, d *api.AirQualityDa
 	}
 
 	bytesSent := proto.Size(res)
-	log.Printf("Sent [%d] bytes. Ack recevied, status: [%s]\n", bytesSent, ack.Status)
+	slog.DebugContext(ctx, "Sent data", "bytes", bytesSent, "status", ack.Status)
 
 	return bytesSent, nil
 }
 
 // processTicker processes the ticker event
-func ProcessTicker(client *pb.AirQualityMonitoringClient, serverName string, metricList *metric.Metric) error {
-	if *client == nil {
-		log.Printf("Client is not ready yet")
+func ProcessTicker(client *grpcclient.Client, serverName string, metricList *metric.Metrics) error {
+	if !client.Ready() {
+		slog.Warn("Client is not ready yet")
 		return nil
 	}
-	go func(m *metric.Metric) {
+	go func(m *metric.Metrics) {
 		ping := &pb.Data{
 			Payload:       "ping",
 			SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
 		}
-		pong, err := (*client).CheckConnection(context.Background(), ping)
+		pong, err := client.CheckConnection(context.Background(), ping)
 		if err != nil {
-			log.Printf("Error checking connection: %v", err)
+			slog.Warn("Error checking connection", "service", serverName, "error", err)
 			return
 		}
 		rtt, err := utils.CalculateRtt(ping.SentTimestamp, pong.ReceivedTimestamp, pong.AckSentTimestamp, time.Now())
 		if err != nil {
-			log.Printf("Error calculating RTT: %v", err)
+			slog.Warn("Error calculating RTT", "service", serverName, "error", err)
 			return
 		}
 		m.AddRttTime(serverName, float64(rtt)/1000.0)
-		log.Printf("RTT to [%s] service: [%.2f] ms\n", serverName, float64(rtt)/1000.0)
+		slog.Debug("RTT to service", "service", serverName, "rtt_ms", float64(rtt)/1000.0)
 	}(metricList)
 
 	return nil
@@ -3,24 +3,32 @@ package main
 import (
 	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"time"
 
 	api "github.com/etesami/air-quality-monitoring/api"
+	auth "github.com/etesami/air-quality-monitoring/pkg/auth"
+	config "github.com/etesami/air-quality-monitoring/pkg/config"
+	deadletter "github.com/etesami/air-quality-monitoring/pkg/deadletter"
+	grpcclient "github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	health "github.com/etesami/air-quality-monitoring/pkg/health"
+	logging "github.com/etesami/air-quality-monitoring/pkg/logging"
 	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
+	pool "github.com/etesami/air-quality-monitoring/pkg/pool"
 	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
-	utils "github.com/etesami/air-quality-monitoring/pkg/utils"
+	shutdown "github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	tlsconfig "github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+	tracing "github.com/etesami/air-quality-monitoring/pkg/tracing"
 	internal "github.com/etesami/air-quality-monitoring/svc-local-storage/internal"
 
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 func createTables(db *sql.DB) error {
@@ -36,113 +44,185 @@ func createTables(db *sql.DB) error {
   				dominentpol TEXT,
   				forecast TEXT,
   				iaqi TEXT,
-					status TEXT
+					status TEXT,
+					lineage TEXT,
+					traceparent TEXT
 			);`
-	_, err := db.Exec(query)
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+	// Databases created before the observations were traced lack the traceparent column
+	if err := addColumn(db, "air_quality", "traceparent", "TEXT"); err != nil {
+		return err
+	}
+	// and the ones created before their lineage was recorded lack the lineage column
+	return addColumn(db, "air_quality", "lineage", "TEXT")
+}
+
+// addColumn adds a column to a table unless it already has it
+func addColumn(db *sql.DB, table, column, columnType string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	slog.Info("Adding column", "table", table, "column", column)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, columnType))
 	return err
 }
 
 func main() {
 
-	// Target service initialization
-	svcTargetAddress := os.Getenv("SVC_PROCESSOR_ADDR")
-	svcTargetPort := os.Getenv("SVC_PROCESSOR_PORT")
-	targetSvc := &api.Service{
-		Address: svcTargetAddress,
-		Port:    svcTargetPort,
+	cfg := &internal.Config{}
+	if err := config.Load(cfg, flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatalf("Error loading config: %v", err)
 	}
+	logging.Setup("local-storage", cfg.Log)
 
-	var conn *grpc.ClientConn
-	var clientProcessor pb.AirQualityMonitoringClient
-	go func() {
-		for {
-			if err := targetSvc.ServiceReachable(); err == nil {
-				var err error
-				conn, err = grpc.NewClient(
-					targetSvc.Address+":"+targetSvc.Port,
-					grpc.WithTransportCredentials(insecure.NewCredentials()))
-				if err != nil {
-					log.Printf("Failed to connect to target service: %v", err)
-					return
-				}
-				clientProcessor = pb.NewAirQualityMonitoringClient(conn)
-				log.Printf("Connected to target service: %s:%s\n", targetSvc.Address, targetSvc.Port)
-				return
-			} else {
-				log.Printf("Target service is not reachable: %v", err)
-				time.Sleep(5 * time.Second)
-			}
-		}
-	}()
-	defer conn.Close()
+	ctx, stop := shutdown.Signals()
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "local-storage", cfg.Tracing)
+	if err != nil {
+		logging.Fatal("Error setting up tracing", "error", err)
+	}
 
-	svcAddress := os.Getenv("SVC_STRG_ADDR")
-	svcPort := os.Getenv("SVC_STRG_PORT")
 	thisSvc := &api.Service{
-		Address: svcAddress,
-		Port:    svcPort,
+		Address: cfg.Listen.Address,
+		Port:    cfg.Listen.Port,
 	}
 
-	sentDataBuckets := utils.ParseBuckets(os.Getenv("SENT_DATA_BUCKETS"))
-	procTimeBuckets := utils.ParseBuckets(os.Getenv("PROC_TIME_BUCKETS"))
-	rttTimeBuckets := utils.ParseBuckets(os.Getenv("RTT_TIME_BUCKETS"))
+	m := metric.New("local-storage", metric.Buckets{
+		SentData: cfg.Metrics.SentDataBuckets,
+		ProcTime: cfg.Metrics.ProcTimeBuckets,
+		RttTime:  cfg.Metrics.RttTimeBuckets,
+		Latency:  cfg.Metrics.LatencyBuckets,
+	})
 
-	m := &metric.Metric{}
-	m.RegisterMetrics(sentDataBuckets, procTimeBuckets, rttTimeBuckets)
+	// The batches wait for the target service to be ready
+	clientProcessor, err := grpcclient.New("processor", cfg.Processor.HostPort(), cfg.Client, m)
+	if err != nil {
+		logging.Fatal("Failed to create the client of target service", "error", err)
+	}
 
-	db, err := sql.Open("sqlite3", "./data.db")
+	db, err := sql.Open("sqlite3", cfg.DbPath)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Error opening database", "error", err)
 	}
-	defer db.Close()
 
 	err = createTables(db)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Error creating tables", "error", err)
 	}
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", thisSvc.Port))
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to listen", "error", err)
+	}
+	workers := pool.New("store", cfg.Pool, m)
+	server := &internal.Server{Db: db, Metric: m, Pool: workers}
+	if cfg.DeadLetterDir != "" {
+		store, err := deadletter.Open(cfg.DeadLetterDir, "local-storage")
+		if err != nil {
+			logging.Fatal("Error opening dead-letter store", "error", err)
+		}
+		server.DeadLetter = store
+		slog.Info("Keeping rejected observations", "dir", cfg.DeadLetterDir)
+	}
+
+	creds, err := tlsconfig.ServerOption(cfg.TLS)
+	if err != nil {
+		logging.Fatal("Error setting up TLS", "error", err)
+	}
+	authz, err := auth.New(cfg.Auth, m)
+	if err != nil {
+		logging.Fatal("Error setting up authentication", "error", err)
 	}
-	grpcServer := grpc.NewServer()
-	pb.RegisterAirQualityMonitoringServer(grpcServer, &internal.Server{Db: db, Metric: m})
+	grpcServer := grpc.NewServer(creds, tracing.ServerOption(), logging.ServerOption(), grpcclient.ServerOption(),
+		authz.Unary(), authz.Stream())
+	pb.RegisterAirQualityMonitoringServer(grpcServer, server)
+	if server.DeadLetter != nil {
+		pb.RegisterDeadLetterServer(grpcServer, deadletter.Server{Store: server.DeadLetter, Reinject: server.Reinject})
+	}
+
+	checker := health.New(cfg.Health, pb.AirQualityMonitoring_ServiceDesc.ServiceName)
+	checker.Add("database", health.Writable(db))
+	// Observations are kept until the processor is back, it does not make the service unready
+	checker.Watch("processor", health.Serving(clientProcessor.Conn(), ""))
+	checker.Register(grpcServer)
+	go checker.Run(ctx)
 
 	go func() {
-		log.Printf("gRPC server is running on port :%s\n", thisSvc.Port)
+		slog.Info("gRPC server is running", "port", thisSvc.Port)
 		if err := grpcServer.Serve(listener); err != nil {
-			log.Fatal(err)
+			logging.Fatal("Failed to serve", "error", err)
 		}
 	}()
 
-	// First call to processTicker
-	ctx := context.Background()
-	if err := internal.ProcessTicker(ctx, &clientProcessor, db, "processor", m); err != nil {
-		log.Printf("Error during processing: %v", err)
+	// First call to processTicker. A batch that was not sent, e.g. turned away by
+	// a busy processor, is sent again with the next one.
+	batchCtx := context.Background()
+	if err := internal.ProcessTicker(batchCtx, clientProcessor, db, "processor", m); err != nil {
+		slog.Error("Error during processing", "error", err)
+	} else {
+		batchCtx = context.WithValue(batchCtx, "lastCallTime", time.Now())
 	}
-	ctx = context.WithValue(ctx, "lastCallTime", time.Now())
 
-	// Frequently send new data to the processor service
-	updateFrequencyStr := os.Getenv("UPDATE_FREQUENCY")
-	updateFrequency, err := strconv.Atoi(updateFrequencyStr)
-	if err != nil {
-		log.Fatalf("Error parsing update frequency: %v", err)
-	}
-	ticker := time.NewTicker(time.Duration(updateFrequency) * time.Minute)
+	// Frequently send new data to the processor service, the batch being
+	// sent on shutdown is finished
+	ticker := time.NewTicker(cfg.UpdateFrequency.Duration())
 	defer ticker.Stop()
 
-	go func(m *metric.Metric, c *pb.AirQualityMonitoringClient) {
-		for range ticker.C {
-			if err := internal.ProcessTicker(ctx, c, db, "processor", m); err != nil {
-				log.Printf("Error during processing: %v", err)
+	batches := &shutdown.Group{}
+	batches.Go(func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := internal.ProcessTicker(batchCtx, clientProcessor, db, "processor", m); err != nil {
+				slog.Error("Error during processing", "error", err)
+				continue
 			}
-			ctx = context.WithValue(ctx, "lastCallTime", time.Now())
+			batchCtx = context.WithValue(batchCtx, "lastCallTime", time.Now())
 		}
-	}(m, &clientProcessor)
+	})
+
+	http.Handle("/metrics", m.Handler())
+	checker.RegisterHTTP(http.DefaultServeMux)
+	metricsServer := &http.Server{Addr: cfg.Metrics.HostPort()}
+	go func() {
+		slog.Info("Starting metrics server", "port", cfg.Metrics.Port)
+		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatal("Error starting metrics server", "error", err)
+		}
+	}()
 
-	metricAddr := os.Getenv("METRIC_ADDR")
-	metricPort := os.Getenv("METRIC_PORT")
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Starting server on :%s\n", metricPort)
-	http.ListenAndServe(fmt.Sprintf("%s:%s", metricAddr, metricPort), nil)
+	// On SIGTERM the service stops taking requests and finishes the ones in flight
+	<-ctx.Done()
+	shutdown.Run(cfg.Shutdown.Timeout.Duration(),
+		shutdown.Do("health", checker.Shutdown),
+		shutdown.GRPC(grpcServer),
+		shutdown.Wait("insertions", workers),
+		shutdown.Wait("batches", batches),
+		shutdown.Close("processor client", clientProcessor),
+		shutdown.HTTP("metrics server", metricsServer),
+		shutdown.Step{Name: "tracing", Stop: shutdownTracing},
+		shutdown.Close("database", db),
+	)
 }
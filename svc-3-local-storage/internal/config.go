@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/etesami/air-quality-monitoring/pkg/auth"
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+	"github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	"github.com/etesami/air-quality-monitoring/pkg/health"
+	"github.com/etesami/air-quality-monitoring/pkg/logging"
+	"github.com/etesami/air-quality-monitoring/pkg/pool"
+	"github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	"github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+	"github.com/etesami/air-quality-monitoring/pkg/tracing"
+)
+
+// Config is the configuration of the local storage service
+type Config struct {
+	Listen          config.Listener   `config:"listen" env:"SVC_STRG"`
+	TLS             tlsconfig.Config  `config:"tls" env:"TLS"`
+	Auth            auth.Config       `config:"auth" env:"AUTH"`
+	Processor       config.Endpoint   `config:"processor" env:"SVC_PROCESSOR" required:"true"`
+	Client          grpcclient.Config `config:"client" env:"CLIENT"`
+	DbPath          string            `config:"dbPath" env:"DB_PATH" default:"./data.db" usage:"path of the SQLite database"`
+	DeadLetterDir   string            `config:"deadLetterDir" env:"DEAD_LETTER_DIR" default:"deadletter" usage:"directory the rejected observations are kept in, none when empty"`
+	UpdateFrequency config.Duration   `config:"updateFrequency" env:"UPDATE_FREQUENCY" default:"1m" unit:"m" usage:"interval between batches sent to the processor"`
+	Pool            pool.Config       `config:"pool" env:"POOL"`
+	Metrics         config.Metrics    `config:"metrics"`
+	Tracing         tracing.Config    `config:"tracing"`
+	Log             logging.Config    `config:"log"`
+	Health          health.Config     `config:"health"`
+	Shutdown        shutdown.Config   `config:"shutdown"`
+}
+
+func (c *Config) Validate() error {
+	if c.UpdateFrequency <= 0 {
+		return fmt.Errorf("updateFrequency must be positive")
+	}
+	return nil
+}
@@ -5,13 +5,23 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	api "github.com/etesami/air-quality-monitoring/api"
+	deadletter "github.com/etesami/air-quality-monitoring/pkg/deadletter"
+	"github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	"github.com/etesami/air-quality-monitoring/pkg/logging"
 	"github.com/etesami/air-quality-monitoring/pkg/metric"
+	pool "github.com/etesami/air-quality-monitoring/pkg/pool"
 	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+	tracing "github.com/etesami/air-quality-monitoring/pkg/tracing"
 	utils "github.com/etesami/air-quality-monitoring/pkg/utils"
+	validation "github.com/etesami/air-quality-monitoring/pkg/validation"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 
 	localapi "github.com/etesami/air-quality-monitoring/api/local-storage"
@@ -20,8 +30,10 @@ import (
 
 type Server struct {
 	pb.UnimplementedAirQualityMonitoringServer
-	Metric *metric.Metric
-	Db     *sql.DB
+	Metric     *metric.Metrics
+	Db         *sql.DB
+	DeadLetter *deadletter.Store
+	Pool       *pool.Pool
 }
 
 // CheckConnection is a simple ping-pong method to respond for the health check
@@ -40,21 +52,22 @@ func (s Server) CheckConnection(ctx context.Context, recData *pb.Data) (*pb.Ack,
 func (s Server) SendDataToServer(ctx context.Context, recData *pb.Data) (*pb.Ack, error) {
 	st := time.Now()
 	recTimestamp := st.UnixMilli()
-	log.Printf("Received at [%s]: [%d]\n", st.Format("2006-01-02 15:04:05"), len(recData.Payload))
-
-	go func(data string, db *sql.DB, m *metric.Metric, start time.Time) {
-		aqData := &api.AirQualityData{}
-		if err := json.Unmarshal([]byte(recData.Payload), &aqData); err != nil {
-			log.Printf("Error unmarshalling JSON: %v", err)
-			return
-		}
-		// Insert data into the database
-		if err := insertToAirQualityDb(db, *aqData); err != nil {
-			log.Printf("Error inserting data into database: %v", err)
-			return
+	slog.DebugContext(ctx, "Received data", "bytes", len(recData.Payload))
+
+	// The insertion waits for a worker, the call is turned away when too many wait
+	// already so that the caller backs off. The call is acknowledged once the data is
+	// stored, otherwise the caller retries it and keeps it once its retries are
+	// exhausted. An insertion outliving the call still completes and continues its trace.
+	procCtx := context.WithoutCancel(ctx)
+	if err := s.Pool.Do(ctx, func() error {
+		if err := s.process(procCtx, recData.Payload, st); err != nil {
+			slog.ErrorContext(procCtx, "Error inserting data into database", "error", err)
+			return status.Error(codes.Unavailable, "error storing data, retry later")
 		}
-		m.AddProcessingTime("processing", float64(time.Since(start).Milliseconds())/1000.0)
-	}(recData.Payload, s.Db, s.Metric, st)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 
 	ack := &pb.Ack{
 		Status:                "ok",
@@ -65,15 +78,77 @@ func (s Server) SendDataToServer(ctx context.Context, recData *pb.Data) (*pb.Ack
 	return ack, nil
 }
 
-// requestDataFromDb fetches data from the database after the given timestamp
-func requestDataFromDb(db *sql.DB, t time.Time) ([]api.Msg, error) {
+// Reinject stores a dead-letter record again
+func (s Server) Reinject(ctx context.Context, rec *deadletter.Record) error {
+	return s.process(ctx, rec.Payload, time.Now())
+}
+
+// process stores the observations of payload, the error is returned
+// when the database could not be updated
+func (s Server) process(ctx context.Context, payload string, start time.Time) (err error) {
+	defer s.Metric.InFlight("store")()
+	ctx, span := tracing.Start(ctx, "store")
+	defer func() { tracing.End(span, err) }()
+
+	aqData := &api.AirQualityData{}
+	if err := json.Unmarshal([]byte(payload), &aqData); err != nil {
+		s.reject(ctx, payload, []validation.Rejection{*validation.Malformed(err)})
+		return nil
+	}
+	s.Metric.AddReceived(len(aqData.Obs))
+	// Insert data into the database
+	stored, err := insertToAirQualityDb(ctx, s.Db, *aqData, s.rejectObservation)
+	if err != nil {
+		return err
+	}
+	s.Metric.AddAccepted(len(stored))
+	for _, msg := range stored {
+		s.Metric.AddLineage(msg.Idx, api.StageStoredLocally, msg.Lineage)
+	}
+	s.Metric.AddProcessingTime("store", float64(time.Since(start).Milliseconds())/1000.0)
+	return nil
+}
+
+// reject logs and counts the rejections of payload and keeps it in the dead-letter store, if any
+func (s Server) reject(ctx context.Context, payload string, rejections []validation.Rejection) {
+	for _, r := range rejections {
+		slog.InfoContext(ctx, "Rejected data", "rejection", &r)
+		s.Metric.AddRejected(string(r.Reason))
+	}
+	if s.DeadLetter == nil {
+		return
+	}
+	if _, err := s.DeadLetter.Reject("store", "ingestor", payload, rejections); err != nil {
+		slog.ErrorContext(ctx, "Error writing to dead-letter store", "error", err)
+	}
+}
+
+// rejectObservation rejects a single observation of a payload
+func (s Server) rejectObservation(ctx context.Context, obs api.Observation, r validation.Rejection) {
+	payload, err := json.Marshal(&api.AirQualityData{Status: "ok", Obs: []api.Observation{obs}})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshalling rejected observation", "error", err)
+		return
+	}
+	s.reject(ctx, string(payload), []validation.Rejection{r})
+}
+
+// requestDataFromDb fetches data from the database after the given timestamp,
+// along with the links to the spans the observations were stored in
+func requestDataFromDb(ctx context.Context, db *sql.DB, t time.Time) ([]api.Msg, []trace.Link, error) {
 	msgList := make([]localapi.DataResponse, 0)
+	links := make([]trace.Link, 0)
 
-	log.Printf("Requesting data from the database after [%s]\n", t.Format("2006-01-02 15:04:05"))
+	slog.DebugContext(ctx, "Requesting data from the database", "after", t)
 
-	rows, err := db.Query("SELECT * FROM air_quality WHERE timestamp > $1", t)
+	ctx, span := tracing.StartSQL(ctx, "SELECT", "air_quality")
+	defer span.End()
+
+	rows, err := db.QueryContext(ctx, `SELECT id, aqi, idx, timestamp, attributions, city, dominentpol, forecast, iaqi, status, lineage, traceparent
+		FROM air_quality WHERE timestamp > $1`, t)
 	if err != nil {
-		return nil, err
+		span.RecordError(err)
+		return nil, nil, err
 	}
 	defer rows.Close()
 
@@ -83,27 +158,38 @@ func requestDataFromDb(db *sql.DB, t time.Time) ([]api.Msg, error) {
 		var city string
 		var forecast string
 		var iaqi string
+		var lineage sql.NullString
+		var traceParent sql.NullString
 		if err := rows.Scan(
 			&msg.ID, &msg.Aqi, &msg.Idx, &msg.Timestamp,
 			&atr, &city, &msg.DominentPol,
-			&forecast, &iaqi, &msg.Status); err != nil {
-			log.Printf("Error scanning row: %v", err)
+			&forecast, &iaqi, &msg.Status, &lineage, &traceParent); err != nil {
+			slog.ErrorContext(ctx, "Error scanning row", "error", err)
 			continue
 		}
+		// Observations stored before their lineage was recorded have none
+		if lineage.Valid {
+			if err := json.Unmarshal([]byte(lineage.String), &msg.Lineage); err != nil {
+				slog.WarnContext(ctx, "Error unmarshalling lineage", "id", msg.ID, "error", err)
+			}
+		}
+		if link, ok := tracing.Link(traceParent.String); ok {
+			links = append(links, link)
+		}
 		if err := json.Unmarshal([]byte(atr), &msg.Attributions); err != nil {
-			log.Printf("Error unmarshalling attributions: %v", err)
+			slog.WarnContext(ctx, "Error unmarshalling attributions", "id", msg.ID, "error", err)
 			continue
 		}
 		if err := json.Unmarshal([]byte(city), &msg.City); err != nil {
-			log.Printf("Error unmarshalling city: %v", err)
+			slog.WarnContext(ctx, "Error unmarshalling city", "id", msg.ID, "error", err)
 			continue
 		}
 		if err := json.Unmarshal([]byte(forecast), &msg.Forecast); err != nil {
-			log.Printf("Error unmarshalling forecast: %v", err)
+			slog.WarnContext(ctx, "Error unmarshalling forecast", "id", msg.ID, "error", err)
 			continue
 		}
 		if err := json.Unmarshal([]byte(iaqi), &msg.IAQI); err != nil {
-			log.Printf("Error unmarshalling iaqi: %v", err)
+			slog.WarnContext(ctx, "Error unmarshalling iaqi", "id", msg.ID, "error", err)
 			continue
 		}
 		msgList = append(msgList, msg)
@@ -120,19 +206,21 @@ func requestDataFromDb(db *sql.DB, t time.Time) ([]api.Msg, error) {
 			IAQI:         msg.IAQI,
 			Time:         api.Time{ISO: msg.Timestamp.Format(time.RFC3339)},
 			Forecast:     msg.Forecast,
+			Lineage:      msg.Lineage,
 		})
 	}
-	log.Printf("Found [%d] items in the database for req.\n", len(dataList))
+	slog.DebugContext(ctx, "Found items in the database", "items", len(dataList))
+	span.SetAttributes(attribute.Int("db.rows", len(dataList)))
 
-	return dataList, nil
+	return dataList, links, nil
 }
 
 // timestampIsNewer compares the given timestamp with the latest one in the database
 // and returns true if the given timestamp is newer
-func timestampIsNewer(db *sql.DB, sId string, timestamp time.Time) (bool, error) {
+func timestampIsNewer(ctx context.Context, db *sql.DB, sId string, timestamp time.Time) (bool, error) {
 	var maxTimeStr sql.NullString
 
-	row := db.QueryRow("SELECT MAX(timestamp) FROM air_quality WHERE idx = $1", sId)
+	row := db.QueryRowContext(ctx, "SELECT MAX(timestamp) FROM air_quality WHERE idx = $1", sId)
 	err := row.Scan(&maxTimeStr)
 	if err != nil && err != sql.ErrNoRows {
 		return false, err
@@ -153,57 +241,62 @@ func timestampIsNewer(db *sql.DB, sId string, timestamp time.Time) (bool, error)
 	return false, nil
 }
 
-func printObject(obj api.Observation) {
-	// Convert the object to JSON
-	objByte, err := json.Marshal(obj)
-	if err != nil {
-		log.Printf("Error marshalling object for printing: %v", err)
-		return
-	}
-	log.Printf("Object: %s\n", string(objByte))
-}
-
-func insertToAirQualityDb(db *sql.DB, data api.AirQualityData) error {
+// insertToAirQualityDb inserts the new observations of data and returns their messages,
+// the ones that cannot be stored are passed to reject
+func insertToAirQualityDb(ctx context.Context, db *sql.DB, data api.AirQualityData, reject func(context.Context, api.Observation, validation.Rejection)) ([]api.Msg, error) {
 	// Use a transaction for safety
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	// The observations are linked from the batch they are sent to the processor in
+	traceParent := sql.NullString{String: tracing.TraceParent(ctx)}
+	traceParent.Valid = traceParent.String != ""
 
-	count := 0
+	stored := make([]api.Msg, 0, len(data.Obs))
 	for _, obs := range data.Obs {
 		// If any error occurs, we return error and do not continue
 		// with the rest of the observation
 		if obs.Status != "ok" {
-			log.Printf("Received status is not ok: %s", obs.Status)
-			printObject(obs)
+			reject(ctx, obs, validation.Rejection{
+				Reason: validation.ReasonStatus,
+				Field:  "status",
+				Detail: fmt.Sprintf("status is %q", obs.Status),
+			})
 			continue
 		}
 
 		tt, err := time.Parse(time.RFC3339, obs.Msg.Time.ISO)
 		if err != nil {
-			log.Printf("Error parsing timestamp: %v", err)
-			printObject(obs)
+			reject(ctx, obs, validation.Rejection{
+				Reason: validation.ReasonTimestamp,
+				Field:  "msg.time.iso",
+				Detail: err.Error(),
+			})
 			continue
 		}
 
-		newer, err := timestampIsNewer(db, fmt.Sprintf("%d", obs.Msg.Idx), tt)
+		newer, err := timestampIsNewer(ctx, db, fmt.Sprintf("%d", obs.Msg.Idx), tt)
 		if err != nil {
-			log.Printf("Error comparing timestamp: %v", err)
-			return err
+			slog.ErrorContext(ctx, "Error comparing timestamp", "error", err)
+			tx.Rollback()
+			return nil, err
 		}
 		if !newer {
-			// log.Printf("Data is not newer than the latest record, skipping insertion")
+			slog.DebugContext(ctx, "Data is not newer than the latest record, skipping insertion", "station", obs.Msg.Idx)
 			continue
 		}
 
+		obs.Msg.Lineage.Stamp(api.StageStoredLocally, time.Now())
 		// convert to JSON string
 		fields, err := obs.ToMap()
 		if err != nil {
-			log.Printf("Error marshalling data: %v", err)
-			return err
+			slog.ErrorContext(ctx, "Error marshalling data", "error", err)
+			tx.Rollback()
+			return nil, err
 		}
-		_, err = tx.Exec("INSERT INTO air_quality (aqi, idx, timestamp, attributions, city, dominentpol, forecast, iaqi, status) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		sqlCtx, span := tracing.StartSQL(ctx, "INSERT", "air_quality")
+		_, err = tx.ExecContext(sqlCtx, "INSERT INTO air_quality (aqi, idx, timestamp, attributions, city, dominentpol, forecast, iaqi, status, lineage, traceparent) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
 			fields["aqi"],
 			fields["idx"],
 			tt,
@@ -213,44 +306,52 @@ func insertToAirQualityDb(db *sql.DB, data api.AirQualityData) error {
 			fields["forecast"],
 			fields["iaqi"],
 			fields["status"],
+			fields["lineage"],
+			traceParent,
 		)
+		tracing.End(span, err)
 		if err != nil {
 			tx.Rollback()
-			return err
+			return nil, err
 		}
-		count++
-		log.Printf("Inserted data into the database: [%s]", obs.Msg.Time.ISO)
+		stored = append(stored, obs.Msg)
+		slog.InfoContext(ctx, "Inserted data into the database", "station", obs.Msg.Idx, "time", obs.Msg.Time.ISO)
 	}
 
-	if count > 0 {
-		log.Printf("Inserted [%d]/[%d] items in total.", count, len(data.Obs))
+	if len(stored) > 0 {
+		slog.InfoContext(ctx, "Inserted items in total", "inserted", len(stored), "received", len(data.Obs))
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
-	return tx.Commit()
+	return stored, nil
 }
 
 // processTicker processes the ticker event
-func ProcessTicker(ctx context.Context, client *pb.AirQualityMonitoringClient, db *sql.DB, serverName string, metricList *metric.Metric) error {
-	if *client == nil {
-		log.Printf("Client is not ready yet")
-		return nil
-	}
-	go func(m *metric.Metric) {
+func ProcessTicker(ctx context.Context, client *grpcclient.Client, db *sql.DB, serverName string, metricList *metric.Metrics) (err error) {
+	go func(m *metric.Metrics) {
+		// The round-trip time is measured on a ready connection only, the batch
+		// below waits for it
+		if !client.Ready() {
+			slog.Warn("Client is not ready yet")
+			return
+		}
 		ping := &pb.Data{
 			Payload:       "ping",
 			SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
 		}
-		pong, err := (*client).CheckConnection(context.Background(), ping)
+		pong, err := client.CheckConnection(context.Background(), ping)
 		if err != nil {
-			log.Printf("Error checking connection: %v", err)
+			slog.Warn("Error checking connection", "service", serverName, "error", err)
 			return
 		}
 		rtt, err := utils.CalculateRtt(ping.SentTimestamp, pong.ReceivedTimestamp, pong.AckSentTimestamp, time.Now())
 		if err != nil {
-			log.Printf("Error calculating RTT: %v", err)
+			slog.Warn("Error calculating RTT", "service", serverName, "error", err)
 			return
 		}
 		m.AddRttTime(serverName, float64(rtt)/1000.0)
-		log.Printf("RTT to [%s] service: [%.2f] ms\n", serverName, float64(rtt)/1000.0)
+		slog.Debug("RTT to service", "service", serverName, "rtt_ms", float64(rtt)/1000.0)
 	}(metricList)
 
 	// Check if there is any data to be sent
@@ -267,32 +368,42 @@ func ProcessTicker(ctx context.Context, client *pb.AirQualityMonitoringClient, d
 		lastCallTime = time.Now().Add(-24 * time.Hour)
 	}
 
-	dataToBeSent, err := requestDataFromDb(db, lastCallTime)
+	// Every batch starts a trace, linked to the traces the observations were stored in,
+	// and is correlated in the logs of the services it goes through
+	ctx = logging.WithCorrelationID(ctx, logging.NewID())
+	ctx, span := tracing.Start(ctx, "send batch")
+	defer func() { tracing.End(span, err) }()
+
+	dataToBeSent, links, err := requestDataFromDb(ctx, db, lastCallTime)
 	if err != nil {
-		log.Printf("Error requesting new data after [%s]: %v", lastCallTime.String(), err)
+		slog.ErrorContext(ctx, "Error requesting new data", "after", lastCallTime, "error", err)
 		return err
 	}
+	if len(dataToBeSent) == 0 {
+		return nil
+	}
+	for _, link := range links {
+		span.AddLink(link)
+	}
+	span.SetAttributes(attribute.Int("observations", len(dataToBeSent)))
 
 	dataToBeSentByte, err := json.Marshal(dataToBeSent)
 	if err != nil {
 		return fmt.Errorf("Error marshalling data: %v", err)
 	}
 
-	if len(dataToBeSent) > 0 {
-		res := &pb.Data{
-			Payload:       string(dataToBeSentByte),
-			SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
-		}
-		metricList.AddProcessingTime("processing", float64(time.Since(st).Milliseconds())/1000.0)
+	res := &pb.Data{
+		Payload:       string(dataToBeSentByte),
+		SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
+	}
+	metricList.AddProcessingTime("batch", float64(time.Since(st).Milliseconds())/1000.0)
 
-		sentBytes := proto.Size(res)
-		_, err := (*client).SendDataToServer(context.Background(), res)
-		if err != nil {
-			return fmt.Errorf("Error sending data to server: %v", err)
-		} else {
-			metricList.AddSentDataBytes("processor", float64(sentBytes))
-		}
+	sentBytes := proto.Size(res)
+	if _, err = client.SendDataToServer(ctx, res); err != nil {
+		return fmt.Errorf("Error sending data to server: %v", err)
 	}
+	metricList.AddSentDataBytes("processor", float64(sentBytes))
+	metricList.AddForwarded("processor", len(dataToBeSent))
 
 	return nil
 }
@@ -1,111 +1,149 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"time"
 
 	api "github.com/etesami/air-quality-monitoring/api"
+	auth "github.com/etesami/air-quality-monitoring/pkg/auth"
+	config "github.com/etesami/air-quality-monitoring/pkg/config"
+	deadletter "github.com/etesami/air-quality-monitoring/pkg/deadletter"
+	grpcclient "github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	health "github.com/etesami/air-quality-monitoring/pkg/health"
+	logging "github.com/etesami/air-quality-monitoring/pkg/logging"
 	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
+	pool "github.com/etesami/air-quality-monitoring/pkg/pool"
 	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
-	utils "github.com/etesami/air-quality-monitoring/pkg/utils"
+	shutdown "github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	tlsconfig "github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+	tracing "github.com/etesami/air-quality-monitoring/pkg/tracing"
 	internal "github.com/etesami/air-quality-monitoring/svc-data-processing/internal"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 func main() {
 
-	sentDataBuckets := utils.ParseBuckets(os.Getenv("SENT_DATA_BUCKETS"))
-	procTimeBuckets := utils.ParseBuckets(os.Getenv("PROC_TIME_BUCKETS"))
-	rttTimeBuckets := utils.ParseBuckets(os.Getenv("RTT_TIME_BUCKETS"))
+	cfg := &internal.Config{}
+	if err := config.Load(cfg, flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	logging.Setup("processor", cfg.Log)
 
-	m := &metric.Metric{}
-	m.RegisterMetrics(sentDataBuckets, procTimeBuckets, rttTimeBuckets)
+	ctx, stop := shutdown.Signals()
+	defer stop()
 
-	// Aggregated storage service initialization
-	svcTargetAggrAddress := os.Getenv("SVC_AGGR_STRG_ADDR")
-	svcTargetAggrPort := os.Getenv("SVC_AGGR_STRG_PORT")
-	targetSvc := &api.Service{
-		Address: svcTargetAggrAddress,
-		Port:    svcTargetAggrPort,
+	shutdownTracing, err := tracing.Setup(context.Background(), "processor", cfg.Tracing)
+	if err != nil {
+		logging.Fatal("Error setting up tracing", "error", err)
+	}
+
+	m := metric.New("processor", metric.Buckets{
+		SentData: cfg.Metrics.SentDataBuckets,
+		ProcTime: cfg.Metrics.ProcTimeBuckets,
+		RttTime:  cfg.Metrics.RttTimeBuckets,
+		Latency:  cfg.Metrics.LatencyBuckets,
+	})
+
+	// Aggregated storage service initialization, the calls to it wait for it to be ready
+	clientAggr, err := grpcclient.New("central-storage", cfg.CentralStorage.HostPort(), cfg.Client, m)
+	if err != nil {
+		logging.Fatal("Failed to create the client of target service", "error", err)
 	}
-	var conn *grpc.ClientConn
-	var clientAggr pb.AirQualityMonitoringClient
-	go func() {
-		for {
-			if err := targetSvc.ServiceReachable(); err == nil {
-				var err error
-				conn, err = grpc.NewClient(
-					targetSvc.Address+":"+targetSvc.Port,
-					grpc.WithTransportCredentials(insecure.NewCredentials()))
-				if err != nil {
-					log.Printf("Failed to connect to target service: %v", err)
-					return
-				}
-				clientAggr = pb.NewAirQualityMonitoringClient(conn)
-				log.Printf("Connected to target service: %s:%s\n", targetSvc.Address, targetSvc.Port)
-				return
-			} else {
-				log.Printf("Target service is not reachable: %v", err)
-				time.Sleep(5 * time.Second)
-			}
-		}
-	}()
-	defer conn.Close()
 
-	svcAddress := os.Getenv("SVC_PROCESSOR_ADDR")
-	svcPort := os.Getenv("SVC_PROCESSOR_PORT")
 	thisSvc := &api.Service{
-		Address: svcAddress,
-		Port:    svcPort,
+		Address: cfg.Listen.Address,
+		Port:    cfg.Listen.Port,
 	}
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", thisSvc.Port))
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to listen", "error", err)
+	}
+	workers := pool.New("process", cfg.Pool, m)
+	server := &internal.Server{Client: clientAggr, Metric: m, Pool: workers, AlertLookups: cfg.AlertLookups}
+	if cfg.DeadLetterDir != "" {
+		store, err := deadletter.Open(cfg.DeadLetterDir, "processor")
+		if err != nil {
+			logging.Fatal("Error opening dead-letter store", "error", err)
+		}
+		server.DeadLetter = store
+		slog.Info("Keeping rejected items", "dir", cfg.DeadLetterDir)
+	}
+
+	creds, err := tlsconfig.ServerOption(cfg.TLS)
+	if err != nil {
+		logging.Fatal("Error setting up TLS", "error", err)
+	}
+	authz, err := auth.New(cfg.Auth, m)
+	if err != nil {
+		logging.Fatal("Error setting up authentication", "error", err)
 	}
-	grpcServer := grpc.NewServer()
-	pb.RegisterAirQualityMonitoringServer(grpcServer, &internal.Server{Client: &clientAggr, Metric: m})
+	grpcServer := grpc.NewServer(creds, tracing.ServerOption(), logging.ServerOption(), grpcclient.ServerOption(),
+		authz.Unary(), authz.Stream())
+	pb.RegisterAirQualityMonitoringServer(grpcServer, server)
+	if server.DeadLetter != nil {
+		pb.RegisterDeadLetterServer(grpcServer, deadletter.Server{Store: server.DeadLetter, Reinject: server.Reinject})
+	}
+
+	checker := health.New(cfg.Health, pb.AirQualityMonitoring_ServiceDesc.ServiceName)
+	checker.Add("central-storage", health.Serving(clientAggr.Conn(), ""))
+	checker.Register(grpcServer)
+	go checker.Run(ctx)
 
 	go func() {
-		log.Printf("gRPC server is running on port :%s\n", thisSvc.Port)
+		slog.Info("gRPC server is running", "port", thisSvc.Port)
 		if err := grpcServer.Serve(listener); err != nil {
-			log.Fatal(err)
+			logging.Fatal("Failed to serve", "error", err)
 		}
 	}()
 
 	// First call to processTicker
-	if err := internal.ProcessTicker(&clientAggr, "central-storage", m); err != nil {
-		log.Printf("Error during processing: %v", err)
+	if err := internal.ProcessTicker(clientAggr, "central-storage", m); err != nil {
+		slog.Error("Error during processing", "error", err)
 	}
 
-	updateFrequencyStr := os.Getenv("UPDATE_FREQUENCY")
-	updateFrequency, err := strconv.Atoi(updateFrequencyStr)
-	if err != nil {
-		log.Fatalf("Error parsing update frequency: %v", err)
-	}
-	ticker := time.NewTicker(time.Duration(updateFrequency) * time.Second)
+	ticker := time.NewTicker(cfg.UpdateFrequency.Duration())
 	defer ticker.Stop()
 
-	go func(m *metric.Metric, clientAggr *pb.AirQualityMonitoringClient) {
-		// Target local storage service initialization
-		for range ticker.C {
+	go func(m *metric.Metrics, clientAggr *grpcclient.Client) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
 			if err := internal.ProcessTicker(clientAggr, "central-storage", m); err != nil {
-				log.Printf("Error during processing: %v", err)
+				slog.Error("Error during processing", "error", err)
 			}
 		}
-	}(m, &clientAggr)
+	}(m, clientAggr)
+
+	http.Handle("/metrics", m.Handler())
+	checker.RegisterHTTP(http.DefaultServeMux)
+	metricsServer := &http.Server{Addr: cfg.Metrics.HostPort()}
+	go func() {
+		slog.Info("Starting metrics server", "port", cfg.Metrics.Port)
+		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatal("Error starting metrics server", "error", err)
+		}
+	}()
 
-	metricAddr := os.Getenv("METRIC_ADDR")
-	metricPort := os.Getenv("METRIC_PORT")
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Starting server on :%s\n", metricPort)
-	http.ListenAndServe(fmt.Sprintf("%s:%s", metricAddr, metricPort), nil)
+	// On SIGTERM the service stops taking requests and finishes the ones in flight
+	<-ctx.Done()
+	shutdown.Run(cfg.Shutdown.Timeout.Duration(),
+		shutdown.Do("health", checker.Shutdown),
+		shutdown.GRPC(grpcServer),
+		shutdown.Wait("processing", workers),
+		shutdown.Close("central storage client", clientAggr),
+		shutdown.HTTP("metrics server", metricsServer),
+		shutdown.Step{Name: "tracing", Stop: shutdownTracing},
+	)
 }
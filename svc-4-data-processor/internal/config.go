@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/etesami/air-quality-monitoring/pkg/auth"
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+	"github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	"github.com/etesami/air-quality-monitoring/pkg/health"
+	"github.com/etesami/air-quality-monitoring/pkg/logging"
+	"github.com/etesami/air-quality-monitoring/pkg/pool"
+	"github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	"github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+	"github.com/etesami/air-quality-monitoring/pkg/tracing"
+)
+
+// Config is the configuration of the processing service
+type Config struct {
+	Listen          config.Listener   `config:"listen" env:"SVC_PROCESSOR"`
+	TLS             tlsconfig.Config  `config:"tls" env:"TLS"`
+	Auth            auth.Config       `config:"auth" env:"AUTH"`
+	CentralStorage  config.Endpoint   `config:"centralStorage" env:"SVC_AGGR_STRG" required:"true"`
+	Client          grpcclient.Config `config:"client" env:"CLIENT"`
+	UpdateFrequency config.Duration   `config:"updateFrequency" env:"UPDATE_FREQUENCY" default:"15s" unit:"s" usage:"interval between round-trip time measurements"`
+	DeadLetterDir   string            `config:"deadLetterDir" env:"DEAD_LETTER_DIR" default:"deadletter" usage:"directory the rejected items are kept in, none when empty"`
+	Pool            pool.Config       `config:"pool" env:"POOL"`
+	AlertLookups    int               `config:"alertLookups" env:"ALERT_LOOKUPS" default:"4" usage:"number of weather alerts looked up at once per payload"`
+	Metrics         config.Metrics    `config:"metrics"`
+	Tracing         tracing.Config    `config:"tracing"`
+	Log             logging.Config    `config:"log"`
+	Health          health.Config     `config:"health"`
+	Shutdown        shutdown.Config   `config:"shutdown"`
+}
+
+func (c *Config) Validate() error {
+	if c.UpdateFrequency <= 0 {
+		return fmt.Errorf("updateFrequency must be positive")
+	}
+	if c.AlertLookups < 1 {
+		return fmt.Errorf("alertLookups must be at least 1")
+	}
+	return nil
+}
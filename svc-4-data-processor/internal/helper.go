@@ -4,15 +4,24 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/etesami/air-quality-monitoring/api"
+	"github.com/etesami/air-quality-monitoring/pkg/deadletter"
+	"github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	"github.com/etesami/air-quality-monitoring/pkg/httpclient"
 	"github.com/etesami/air-quality-monitoring/pkg/metric"
+	"github.com/etesami/air-quality-monitoring/pkg/pool"
 	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+	"github.com/etesami/air-quality-monitoring/pkg/tracing"
 	"github.com/etesami/air-quality-monitoring/pkg/utils"
+	"github.com/etesami/air-quality-monitoring/pkg/validation"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 
 	dpapi "github.com/etesami/air-quality-monitoring/api/data-processing"
@@ -20,8 +29,12 @@ import (
 
 type Server struct {
 	pb.UnimplementedAirQualityMonitoringServer
-	Metric *metric.Metric
-	Client *pb.AirQualityMonitoringClient
+	Metric     *metric.Metrics
+	Client     *grpcclient.Client
+	DeadLetter *deadletter.Store
+	Pool       *pool.Pool
+	// AlertLookups is the number of alerts looked up at once per payload
+	AlertLookups int
 }
 
 // CheckConnection is a simple ping-pong method to respond for the health check
@@ -39,38 +52,28 @@ func (s Server) CheckConnection(ctx context.Context, recData *pb.Data) (*pb.Ack,
 func (s Server) SendDataToServer(ctx context.Context, recData *pb.Data) (*pb.Ack, error) {
 	st := time.Now()
 	recTimestamp := st.UnixMilli()
-	log.Printf("Received at [%s]: [%d]\n", st.Format("2006-01-02 15:04:05"), len(recData.Payload))
+	slog.DebugContext(ctx, "Received data", "bytes", len(recData.Payload))
 
-	go func(data string, m *metric.Metric, start time.Time) {
-		processedData, err := processData(data)
-		if err != nil {
-			log.Printf("Error processing data: %v", err)
-		}
-
-		if len(processedData) == 0 {
-			log.Printf("No data to be sent to aggregated storage")
-			return
-		}
-		log.Printf("Processed [%d] items.\n", len(processedData))
-
-		procResBytes, err := json.Marshal(processedData)
-		if err != nil {
-			log.Printf("Error marshalling processed data: %v", err)
-		}
-
-		s.Metric.AddProcessingTime("processing", float64(time.Since(st).Milliseconds())/1000.0)
-
-		// Sneding to the storage
-		if *s.Client == nil {
-			log.Printf("Client is not ready yet")
-			return
+	// The processing waits for a worker, the call is turned away when too many wait
+	// already so that the caller backs off. The call is acknowledged once the items are
+	// forwarded, or kept in the dead-letter store once the retries to the central storage
+	// are exhausted. Without a store the caller retries the payload. Processing
+	// outliving the call still completes and continues its trace.
+	procCtx := context.WithoutCancel(ctx)
+	if err := s.Pool.Do(ctx, func() error {
+		unsent, err := s.process(procCtx, recData.Payload, st)
+		if err == nil {
+			return nil
 		}
-		if sentBytes, err := sendDataToStorage(*s.Client, string(procResBytes)); err != nil {
-			log.Printf("Error sending data to storage: %v", err)
-		} else {
-			s.Metric.AddSentDataBytes("central-storage", float64(sentBytes))
+		slog.ErrorContext(procCtx, "Error during processing", "error", err)
+		if s.DeadLetter == nil {
+			return status.Error(codes.Unavailable, "error forwarding data, retry later")
 		}
-	}(recData.Payload, s.Metric, st)
+		s.reject(procCtx, unsent, []validation.Rejection{deadletter.Failed(err)})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 
 	ack := &pb.Ack{
 		Status:                "ok",
@@ -81,104 +84,188 @@ func (s Server) SendDataToServer(ctx context.Context, recData *pb.Data) (*pb.Ack
 	return ack, nil
 }
 
+// Reinject processes a dead-letter record again
+func (s Server) Reinject(ctx context.Context, rec *deadletter.Record) error {
+	_, err := s.process(ctx, rec.Payload, time.Now())
+	return err
+}
+
+// process enhances the items of payload and sends them to the central storage. When
+// they could not be sent it returns the items of payload they were made of, so that
+// they are kept without the items rejected already.
+func (s Server) process(ctx context.Context, payload string, start time.Time) (unsent string, err error) {
+	defer s.Metric.InFlight("process")()
+	ctx, span := tracing.Start(ctx, "process")
+	defer func() { tracing.End(span, err) }()
+
+	processedData, sources := processData(ctx, payload, s.AlertLookups, s.reject, s.Metric)
+	span.SetAttributes(attribute.Int("items", len(processedData)))
+	if len(processedData) == 0 {
+		slog.InfoContext(ctx, "No data to be sent to aggregated storage")
+		return "", nil
+	}
+	sourceBytes, err := json.Marshal(sources)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling items: %v", err)
+	}
+	unsent = string(sourceBytes)
+	slog.InfoContext(ctx, "Processed items", "items", len(processedData))
+	s.Metric.AddAccepted(len(processedData))
+	for _, item := range processedData {
+		s.Metric.AddLineage(int(item.City.Idx), api.StageProcessed, item.Lineage)
+	}
+
+	procResBytes, err := json.Marshal(processedData)
+	if err != nil {
+		return unsent, fmt.Errorf("error marshalling processed data: %v", err)
+	}
+
+	s.Metric.AddProcessingTime("process", float64(time.Since(start).Milliseconds())/1000.0)
+
+	// Sneding to the storage
+	sentBytes, err := sendDataToStorage(ctx, s.Client, string(procResBytes))
+	if err != nil {
+		return unsent, fmt.Errorf("error sending data to storage: %v", err)
+	}
+	s.Metric.AddSentDataBytes("central-storage", float64(sentBytes))
+	s.Metric.AddForwarded("central-storage", len(processedData))
+	return "", nil
+}
+
+// reject logs and counts the rejections of payload and keeps it in the dead-letter store, if any
+func (s Server) reject(ctx context.Context, payload string, rejections []validation.Rejection) {
+	for _, r := range rejections {
+		slog.InfoContext(ctx, "Rejected data", "rejection", &r)
+		s.Metric.AddRejected(string(r.Reason))
+	}
+	if s.DeadLetter == nil {
+		return
+	}
+	if _, err := s.DeadLetter.Reject("process", "local-storage", payload, rejections); err != nil {
+		slog.ErrorContext(ctx, "Error writing to dead-letter store", "error", err)
+	}
+}
+
 // processData performs a few calculation along with enhancing data with additional information
-// from api.weather.gov
-func processData(res string) ([]dpapi.EnhancedDataResponse, error) {
+// from api.weather.gov, looking up the alerts of at most lookups items at once. Items that
+// cannot be processed are passed to reject. The items the processed ones were made of
+// are returned as well.
+func processData(ctx context.Context, res string, lookups int, reject func(context.Context, string, []validation.Rejection), m *metric.Metrics) ([]dpapi.EnhancedDataResponse, []api.Msg) {
 	// Expect response to be a list of items
 	msgList := make([]api.Msg, 0)
 	if err := json.Unmarshal([]byte(res), &msgList); err != nil {
-		return nil, fmt.Errorf("error unmarshalling JSON: %v", err)
+		reject(ctx, res, []validation.Rejection{*validation.Malformed(err)})
+		return nil, nil
 	}
-	log.Printf("Received [%d] items from local storage\n", len(msgList))
+	slog.DebugContext(ctx, "Received items from local storage", "items", len(msgList))
+	m.AddReceived(len(msgList))
 
-	var wg sync.WaitGroup
-	respChan := make(chan dpapi.EnhancedDataResponse)
-	for _, msg := range msgList {
-		wg.Add(1)
-		go func(m api.Msg) {
-			defer wg.Done()
-
-			geoAlerts, err := getAlertsforPoint(msg.City.Geo[0], msg.City.Geo[1])
-			if err != nil {
-				log.Printf("error getting alerts for point: %v", err)
-				return
-			}
+	// Each rejected item is kept on its own so that it can be reinjected once fixed
+	rejectMsg := func(msg api.Msg, r validation.Rejection) {
+		b, _ := json.Marshal([]api.Msg{msg})
+		reject(ctx, string(b), []validation.Rejection{r})
+	}
 
-			alert := &dpapi.Alert{}
-			if geoAlerts == nil {
-				log.Printf("no alerts found for point: %f, %f\n", msg.City.Geo[0], msg.City.Geo[1])
-				alert = nil
-			} else {
-				alert.AlertDesc = geoAlerts.Description
-				alert.AlertEffective = geoAlerts.Effective
-				alert.AlertExpires = geoAlerts.Expires
-				alert.AlertStatus = geoAlerts.Status
-				alert.AlertCertainty = geoAlerts.Certainty
-				alert.AlertUrgency = geoAlerts.Urgency
-				alert.AlertSeverity = geoAlerts.Severity
-				alert.AlertHeadline = geoAlerts.Headline
-				alert.AlertDescription = geoAlerts.Description
-				alert.AlertEvent = geoAlerts.Event
-			}
+	// Items without a location cannot be looked up for alerts
+	valid := msgList[:0]
+	for _, msg := range msgList {
+		if rej := validation.Geo(msg.City.Geo); rej != nil {
+			rejectMsg(msg, *rej)
+			continue
+		}
+		if err := msg.IAQI.Normalize(); err != nil {
+			rejectMsg(msg, validation.Rejection{Reason: validation.ReasonUnit, Field: "iaqi", Detail: err.Error()})
+			continue
+		}
+		valid = append(valid, msg)
+	}
+	msgList = valid
 
-			procRes := dpapi.EnhancedDataResponse{
-				City: dpapi.City{
-					Idx:      int64(msg.Idx),
-					CityName: msg.City.Name,
-					Lat:      msg.City.Geo[0],
-					Lng:      msg.City.Geo[1],
-				},
-				AirQualityData: dpapi.AirQualityData{
-					Timestamp:   msg.Time.ISO,
-					Aqi:         int64(msg.Aqi),
-					DewPoint:    int64(msg.IAQI.H.V),
-					Humidity:    int64(msg.IAQI.H.V),
-					Pressure:    int64(msg.IAQI.P.V),
-					Temperature: int64(msg.IAQI.T.V),
-					WindSpeed:   int64(msg.IAQI.W.V),
-					WindGust:    int64(msg.IAQI.WG.V),
-					PM25:        int64(msg.IAQI.PM25.V),
-				},
-				Alert: alert,
-			}
-			respChan <- procRes
-		}(msg)
+	// At most lookups items are looked up at once, the others wait for their turn
+	if lookups < 1 {
+		lookups = 1
 	}
+	type processed struct {
+		res dpapi.EnhancedDataResponse
+		msg api.Msg
+	}
+	var wg sync.WaitGroup
+	respChan := make(chan processed)
+	limit := make(chan struct{}, lookups)
 	go func() {
+		for _, msg := range msgList {
+			limit <- struct{}{}
+			wg.Add(1)
+			go func(msg api.Msg) {
+				defer wg.Done()
+				defer func() { <-limit }()
+
+				geoAlerts, err := getAlertsforPoint(ctx, msg.City.Geo[0], msg.City.Geo[1])
+				if err != nil {
+					rejectMsg(msg, deadletter.Failed(fmt.Errorf("error getting alerts for point: %v", err)))
+					return
+				}
+
+				alert := &dpapi.Alert{}
+				if geoAlerts == nil {
+					slog.DebugContext(ctx, "No alerts found for point", "station", msg.Idx, "lat", msg.City.Geo[0], "lng", msg.City.Geo[1])
+					alert = nil
+				} else {
+					alert.AlertDesc = geoAlerts.Description
+					alert.AlertEffective = geoAlerts.Effective
+					alert.AlertExpires = geoAlerts.Expires
+					alert.AlertStatus = geoAlerts.Status
+					alert.AlertCertainty = geoAlerts.Certainty
+					alert.AlertUrgency = geoAlerts.Urgency
+					alert.AlertSeverity = geoAlerts.Severity
+					alert.AlertHeadline = geoAlerts.Headline
+					alert.AlertDescription = geoAlerts.Description
+					alert.AlertEvent = geoAlerts.Event
+				}
+				source := msg
+				msg.Lineage.Stamp(api.StageProcessed, time.Now())
+
+				procRes := dpapi.EnhancedDataResponse{
+					City: dpapi.City{
+						Idx:      int64(msg.Idx),
+						CityName: msg.City.Name,
+						Lat:      msg.City.Geo[0],
+						Lng:      msg.City.Geo[1],
+					},
+					AirQualityData: dpapi.NewAirQualityData(msg),
+					Alert:          alert,
+					Lineage:        msg.Lineage,
+				}
+				respChan <- processed{res: procRes, msg: source}
+			}(msg)
+		}
 		wg.Wait()
 		close(respChan)
 	}()
 
 	procRespList := make([]dpapi.EnhancedDataResponse, 0)
+	sources := make([]api.Msg, 0)
 	for response := range respChan {
-		procRespList = append(procRespList, response)
+		procRespList = append(procRespList, response.res)
+		sources = append(sources, response.msg)
 	}
-	return procRespList, nil
+	return procRespList, sources
 }
 
-func getAlertsforPoint(lat, lng float64) (*dpapi.AlertRaw, error) {
-	url := fmt.Sprintf("https://api.weather.gov/alerts?point=%f,%f", lat, lng)
+// alertsClient limits and retries the requests to the weather.gov API
+var alertsClient = httpclient.New(httpclient.Options{
+	Rate:       5,
+	Burst:      5,
+	MaxRetries: 3,
+	Header:     http.Header{"User-Agent": {"(skycluster.io, ehsan.etesami@utoronto.ca)"}},
+})
 
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("User-Agent", "(skycluster.io, ehsan.etesami@utoronto.ca)")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to perform request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch data: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
-	}
+func getAlertsforPoint(ctx context.Context, lat, lng float64) (*dpapi.AlertRaw, error) {
+	url := fmt.Sprintf("https://api.weather.gov/alerts?point=%f,%f", lat, lng)
 
 	var res map[string]any
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return nil, fmt.Errorf("error decoding JSON: %w", err)
+	if err := alertsClient.GetJSON(ctx, url, "", &res); err != nil {
+		return nil, fmt.Errorf("failed to fetch data: %w", err)
 	}
 	alert, err := generateAlertStruct(res)
 	if err != nil {
@@ -212,8 +299,8 @@ func generateAlertStruct(res map[string]any) (*dpapi.AlertRaw, error) {
 }
 
 // sendDataToStorage sends the processed data to the storage service
-func sendDataToStorage(client pb.AirQualityMonitoringClient, data string) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func sendDataToStorage(ctx context.Context, client pb.AirQualityMonitoringClient, data string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	sentTimestamp := time.Now()
@@ -230,34 +317,34 @@ func sendDataToStorage(client pb.AirQualityMonitoringClient, data string) (int,
 	}
 
 	bytesSent := proto.Size(res)
-	log.Printf("Sent [%d] bytes. Ack recevied, status: [%s]\n", bytesSent, ack.Status)
+	slog.DebugContext(ctx, "Sent data", "bytes", bytesSent, "status", ack.Status)
 
 	return bytesSent, nil
 }
 
 // processTicker processes the ticker event
-func ProcessTicker(client *pb.AirQualityMonitoringClient, serverName string, m *metric.Metric) error {
-	if *client == nil {
-		log.Printf("Client is not ready yet")
+func ProcessTicker(client *grpcclient.Client, serverName string, m *metric.Metrics) error {
+	if !client.Ready() {
+		slog.Warn("Client is not ready yet")
 		return nil
 	}
-	go func(m *metric.Metric) {
+	go func(m *metric.Metrics) {
 		ping := &pb.Data{
 			Payload:       "ping",
 			SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
 		}
-		pong, err := (*client).CheckConnection(context.Background(), ping)
+		pong, err := client.CheckConnection(context.Background(), ping)
 		if err != nil {
-			log.Printf("Error checking connection: %v", err)
+			slog.Warn("Error checking connection", "service", serverName, "error", err)
 			return
 		}
 		rtt, err := utils.CalculateRtt(ping.SentTimestamp, pong.ReceivedTimestamp, pong.AckSentTimestamp, time.Now())
 		if err != nil {
-			log.Printf("Error calculating RTT: %v", err)
+			slog.Warn("Error calculating RTT", "service", serverName, "error", err)
 			return
 		}
 		m.AddRttTime(serverName, float64(rtt)/1000.0)
-		log.Printf("RTT to [%s] service: [%.2f] ms\n", serverName, float64(rtt)/1000.0)
+		slog.Debug("RTT to service", "service", serverName, "rtt_ms", float64(rtt)/1000.0)
 	}(m)
 	return nil
 }
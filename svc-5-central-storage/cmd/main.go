@@ -1,22 +1,33 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 
 	api "github.com/etesami/air-quality-monitoring/api"
+	auth "github.com/etesami/air-quality-monitoring/pkg/auth"
+	config "github.com/etesami/air-quality-monitoring/pkg/config"
+	deadletter "github.com/etesami/air-quality-monitoring/pkg/deadletter"
+	grpcclient "github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	health "github.com/etesami/air-quality-monitoring/pkg/health"
+	logging "github.com/etesami/air-quality-monitoring/pkg/logging"
 	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
+	pool "github.com/etesami/air-quality-monitoring/pkg/pool"
 	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
-	utils "github.com/etesami/air-quality-monitoring/pkg/utils"
+	shutdown "github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	tlsconfig "github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+	tracing "github.com/etesami/air-quality-monitoring/pkg/tracing"
 
 	internal "github.com/etesami/air-quality-monitoring/svc-aggregated-storage/internal"
 
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 )
 
@@ -27,13 +38,16 @@ func createTables(db *sql.DB) error {
 				hash TEXT PRIMARY KEY UNIQUE,
 				aqi INTEGER,
 				timestamp DATETIME,
-				dewPoint INTEGER,
-				humidity INTEGER,
-				pressure INTEGER,
-				temperature INTEGER,
-				windSpeed INTEGER,
-				windGust INTEGER,
-				pm25 INTEGER,
+				dewPoint REAL,
+				humidity REAL,
+				pressure REAL,
+				temperature REAL,
+				windSpeed REAL,
+				windGust REAL,
+				pm25 REAL,
+				pm10 REAL,
+				units TEXT,
+				lineage TEXT,
 				city_id INTEGER,
 				FOREIGN KEY (city_id) REFERENCES city(idx)
 		);`,
@@ -62,57 +76,165 @@ func createTables(db *sql.DB) error {
 	for _, query := range queries {
 		_, err := db.Exec(query)
 		if err != nil {
-			log.Fatalf("Error executing query: %v", err)
+			logging.Fatal("Error executing query", "error", err)
 			return err
 		}
 	}
-	return nil
+	// Databases created before the measurements were tagged with their unit
+	// lack the units column. Their INTEGER columns keep fractional values
+	// as REAL, so only the column is added.
+	if err := addColumn(db, "air_quality", "units", "TEXT"); err != nil {
+		return err
+	}
+	// and the ones created before the lineage of the readings was recorded
+	// lack the lineage column
+	if err := addColumn(db, "air_quality", "lineage", "TEXT"); err != nil {
+		return err
+	}
+	// and the ones created before PM10 was stored lack the pm10 column, their
+	// readings have none
+	return addColumn(db, "air_quality", "pm10", "REAL")
+}
+
+// addColumn adds a column to a table unless it already has it
+func addColumn(db *sql.DB, table, column, columnType string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	slog.Info("Adding column", "table", table, "column", column)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, columnType))
+	return err
 }
 
 func main() {
 
-	svcAddress := os.Getenv("SVC_AGGR_STRG_ADDR")
-	svcPort := os.Getenv("SVC_AGGR_STRG_PORT")
-	thisSvc := &api.Service{
-		Address: svcAddress,
-		Port:    svcPort,
+	// Subcommands run once and exit instead of starting the service
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := internal.RunExport(os.Args[2:]); err != nil {
+			log.Fatalf("Error exporting data: %v", err)
+		}
+		return
 	}
 
-	sentDataBuckets := utils.ParseBuckets(os.Getenv("SENT_DATA_BUCKETS"))
-	procTimeBuckets := utils.ParseBuckets(os.Getenv("PROC_TIME_BUCKETS"))
-	rttTimeBuckets := utils.ParseBuckets(os.Getenv("RTT_TIME_BUCKETS"))
+	cfg := &internal.Config{}
+	if err := config.Load(cfg, flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	logging.Setup("central-storage", cfg.Log)
 
-	m := &metric.Metric{}
-	m.RegisterMetrics(sentDataBuckets, procTimeBuckets, rttTimeBuckets)
+	ctx, stop := shutdown.Signals()
+	defer stop()
 
-	db, err := sql.Open("sqlite3", "./data.db")
+	shutdownTracing, err := tracing.Setup(context.Background(), "central-storage", cfg.Tracing)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Error setting up tracing", "error", err)
+	}
+
+	thisSvc := &api.Service{
+		Address: cfg.Listen.Address,
+		Port:    cfg.Listen.Port,
+	}
+
+	m := metric.New("central-storage", metric.Buckets{
+		SentData: cfg.Metrics.SentDataBuckets,
+		ProcTime: cfg.Metrics.ProcTimeBuckets,
+		RttTime:  cfg.Metrics.RttTimeBuckets,
+		Latency:  cfg.Metrics.LatencyBuckets,
+	})
+
+	db, err := sql.Open("sqlite3", cfg.DbPath)
+	if err != nil {
+		logging.Fatal("Error opening database", "error", err)
 	}
-	defer db.Close()
 
 	err = createTables(db)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Error creating tables", "error", err)
 	}
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", thisSvc.Port))
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to listen", "error", err)
+	}
+	workers := pool.New("store", cfg.Pool, m)
+	server := &internal.Server{Db: db, Metric: m, Pool: workers}
+	if cfg.DeadLetterDir != "" {
+		store, err := deadletter.Open(cfg.DeadLetterDir, "central-storage")
+		if err != nil {
+			logging.Fatal("Error opening dead-letter store", "error", err)
+		}
+		server.DeadLetter = store
+		slog.Info("Keeping rejected items", "dir", cfg.DeadLetterDir)
 	}
-	grpcServer := grpc.NewServer()
-	pb.RegisterAirQualityMonitoringServer(grpcServer, &internal.Server{Db: db, Metric: m})
+
+	creds, err := tlsconfig.ServerOption(cfg.TLS)
+	if err != nil {
+		logging.Fatal("Error setting up TLS", "error", err)
+	}
+	authz, err := auth.New(cfg.Auth, m)
+	if err != nil {
+		logging.Fatal("Error setting up authentication", "error", err)
+	}
+	grpcServer := grpc.NewServer(creds, tracing.ServerOption(), logging.ServerOption(), grpcclient.ServerOption(),
+		authz.Unary(), authz.Stream())
+	pb.RegisterAirQualityMonitoringServer(grpcServer, server)
+	if server.DeadLetter != nil {
+		pb.RegisterDeadLetterServer(grpcServer, deadletter.Server{Store: server.DeadLetter, Reinject: server.Reinject})
+	}
+
+	checker := health.New(cfg.Health, pb.AirQualityMonitoring_ServiceDesc.ServiceName)
+	checker.Add("database", health.Writable(db))
+	checker.Register(grpcServer)
+	go checker.Run(ctx)
 
 	go func() {
-		log.Printf("gRPC server is running on port :%s\n", thisSvc.Port)
+		slog.Info("gRPC server is running", "port", thisSvc.Port)
 		if err := grpcServer.Serve(listener); err != nil {
-			log.Fatal(err)
+			logging.Fatal("Failed to serve", "error", err)
+		}
+	}()
+
+	// The data is served to the callers granted the read-data role, only the
+	// metrics and the probes are open
+	data := http.NewServeMux()
+	data.HandleFunc("/geojson", server.ServeGeoJSON)
+	server.RegisterREST(data)
+	http.Handle("/geojson", authz.HTTP(auth.RoleReadData, data))
+	http.Handle("/v1/", authz.HTTP(auth.RoleReadData, data))
+	http.Handle("/metrics", m.Handler())
+	checker.RegisterHTTP(http.DefaultServeMux)
+	metricsServer := &http.Server{Addr: cfg.Metrics.HostPort()}
+	go func() {
+		slog.Info("Starting metrics server", "port", cfg.Metrics.Port)
+		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatal("Error starting metrics server", "error", err)
 		}
 	}()
 
-	metricAddr := os.Getenv("METRIC_ADDR")
-	metricPort := os.Getenv("METRIC_PORT")
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Starting server on :%s\n", metricPort)
-	http.ListenAndServe(fmt.Sprintf("%s:%s", metricAddr, metricPort), nil)
+	// On SIGTERM the service stops taking requests and finishes the ones in flight
+	<-ctx.Done()
+	shutdown.Run(cfg.Shutdown.Timeout.Duration(),
+		shutdown.Do("health", checker.Shutdown),
+		shutdown.GRPC(grpcServer),
+		shutdown.HTTP("HTTP server", metricsServer),
+		shutdown.Wait("insertions", workers),
+		shutdown.Step{Name: "tracing", Stop: shutdownTracing},
+		shutdown.Close("database", db),
+	)
 }
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
+	auth "github.com/etesami/air-quality-monitoring/pkg/auth"
+	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+	tlsconfig "github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+
+	"google.golang.org/grpc"
+)
+
+// RunExport implements the export subcommand. Tables are read either from a local
+// database file or from a running central storage service through the ExportData stream,
+// and each table is written to its own file in the output directory.
+func RunExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dbPath := fs.String("db", "./data.db", "path to the local database file")
+	addr := fs.String("addr", "", "address (host:port) of a central storage service to export from instead of -db")
+	table := fs.String("table", "all", "table to export: air_quality, city, alert or all")
+	format := fs.String("format", string(agapi.ExportCSV), "output format: csv, ndjson or parquet")
+	from := fs.String("from", "", "start of the time range (RFC3339)")
+	to := fs.String("to", "", "end of the time range (RFC3339)")
+	bbox := fs.String("bbox", "", "region as minLat,minLng,maxLat,maxLng")
+	outDir := fs.String("out", ".", "output directory")
+	tlsCfg := tlsconfig.Flags(fs)
+	tokenFile := fs.String("token-file", "", "file of the API key or JWT to call the service with")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	region, err := parseBoundingBox(*bbox)
+	if err != nil {
+		return err
+	}
+
+	tables := []agapi.ExportTable{agapi.ExportTable(*table)}
+	if *table == "all" {
+		tables = []agapi.ExportTable{agapi.ExportAirQuality, agapi.ExportCity, agapi.ExportAlert}
+	}
+
+	if *tokenFile != "" && !tlsCfg.Enabled {
+		return fmt.Errorf("-token-file requires -tls, the token is not sent in plain text")
+	}
+
+	var db *sql.DB
+	var client pb.AirQualityMonitoringClient
+	if *addr != "" {
+		creds, err := tlsconfig.DialOption(*tlsCfg)
+		if err != nil {
+			return err
+		}
+		opts := []grpc.DialOption{creds}
+		if *tokenFile != "" {
+			token, err := auth.TokenFile(*tokenFile)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, token)
+		}
+		conn, err := grpc.NewClient(*addr, opts...)
+		if err != nil {
+			return fmt.Errorf("did not connect to [%s]: %v", *addr, err)
+		}
+		defer conn.Close()
+		client = pb.NewAirQualityMonitoringClient(conn)
+	} else {
+		db, err = sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", *dbPath))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+
+	for _, t := range tables {
+		req := &agapi.ExportRequest{
+			Table:     t,
+			Format:    agapi.ExportFormat(*format),
+			StartTime: *from,
+			EndTime:   *to,
+			Region:    region,
+		}
+		if err := validateExportRequest(req); err != nil {
+			return err
+		}
+
+		path := filepath.Join(*outDir, fmt.Sprintf("%s.%s", t, req.Format))
+		st := time.Now()
+		if client != nil {
+			err = exportRemote(client, req, path)
+		} else {
+			err = exportLocal(db, req, path)
+		}
+		if err != nil {
+			return fmt.Errorf("exporting [%s]: %w", t, err)
+		}
+		log.Printf("Exported [%s] to [%s] in [%s]\n", t, path, time.Since(st).Round(time.Millisecond))
+	}
+	return nil
+}
+
+func exportLocal(db *sql.DB, req *agapi.ExportRequest, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	count, err := exportTable(context.Background(), db, req, w)
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Wrote [%d] rows.\n", count)
+	return nil
+}
+
+func exportRemote(client pb.AirQualityMonitoringClient, req *agapi.ExportRequest, path string) error {
+	reqByte, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("error marshalling JSON: %v", err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stream, err := client.ExportData(context.Background(), &pb.Data{
+		Payload:       string(reqByte),
+		SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
+	})
+	if err != nil {
+		return fmt.Errorf("error requesting export: %v", err)
+	}
+
+	total := 0
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error receiving export: %v", err)
+		}
+		if _, err := f.Write(res.Chunk); err != nil {
+			return err
+		}
+		total += len(res.Chunk)
+	}
+	log.Printf("Received [%d] bytes.\n", total)
+	return nil
+}
+
+// parseBoundingBox parses a minLat,minLng,maxLat,maxLng string, an empty string means no region
+func parseBoundingBox(s string) (*agapi.BoundingBox, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bounding box must be minLat,minLng,maxLat,maxLng: [%s]", s)
+	}
+	v := make([]float64, 4)
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing bounding box value '%s': %v", p, err)
+		}
+		v[i] = f
+	}
+	return &agapi.BoundingBox{MinLat: v[0], MinLng: v[1], MaxLat: v[2], MaxLng: v[3]}, nil
+}
@@ -0,0 +1,27 @@
+package internal
+
+import (
+	"github.com/etesami/air-quality-monitoring/pkg/auth"
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+	"github.com/etesami/air-quality-monitoring/pkg/health"
+	"github.com/etesami/air-quality-monitoring/pkg/logging"
+	"github.com/etesami/air-quality-monitoring/pkg/pool"
+	"github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	"github.com/etesami/air-quality-monitoring/pkg/tlsconfig"
+	"github.com/etesami/air-quality-monitoring/pkg/tracing"
+)
+
+// Config is the configuration of the central storage service
+type Config struct {
+	Listen        config.Listener  `config:"listen" env:"SVC_AGGR_STRG"`
+	TLS           tlsconfig.Config `config:"tls" env:"TLS"`
+	Auth          auth.Config      `config:"auth" env:"AUTH"`
+	DbPath        string           `config:"dbPath" env:"DB_PATH" default:"./data.db" usage:"path of the SQLite database"`
+	DeadLetterDir string           `config:"deadLetterDir" env:"DEAD_LETTER_DIR" default:"deadletter" usage:"directory the rejected items are kept in, none when empty"`
+	Pool          pool.Config      `config:"pool" env:"POOL"`
+	Metrics       config.Metrics   `config:"metrics"`
+	Tracing       tracing.Config   `config:"tracing"`
+	Log           logging.Config   `config:"log"`
+	Health        health.Config    `config:"health"`
+	Shutdown      shutdown.Config  `config:"shutdown"`
+}
@@ -0,0 +1,393 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
+	dpapi "github.com/etesami/air-quality-monitoring/api/data-processing"
+	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+
+	"github.com/parquet-go/parquet-go"
+	"google.golang.org/grpc"
+)
+
+const (
+	// exportChunkSize is the maximum size of a chunk sent over the export stream
+	exportChunkSize = 64 * 1024
+	// parquetRowGroupSize is the number of rows buffered before a parquet row group is flushed
+	parquetRowGroupSize = 10000
+)
+
+// exportRow is a single exported record of one of the tables
+type exportRow interface {
+	header() []string
+	record() []string
+}
+
+type airQualityRow struct {
+	Hash            string  `json:"hash" parquet:"hash"`
+	CityIdx         int64   `json:"cityIdx" parquet:"city_id"`
+	Timestamp       string  `json:"timestamp" parquet:"timestamp"`
+	Aqi             int64   `json:"aqi" parquet:"aqi"`
+	DewPoint        float64 `json:"dewPoint" parquet:"dew_point"`
+	DewPointUnit    string  `json:"dewPointUnit" parquet:"dew_point_unit"`
+	Humidity        float64 `json:"humidity" parquet:"humidity"`
+	HumidityUnit    string  `json:"humidityUnit" parquet:"humidity_unit"`
+	Pressure        float64 `json:"pressure" parquet:"pressure"`
+	PressureUnit    string  `json:"pressureUnit" parquet:"pressure_unit"`
+	Temperature     float64 `json:"temperature" parquet:"temperature"`
+	TemperatureUnit string  `json:"temperatureUnit" parquet:"temperature_unit"`
+	WindSpeed       float64 `json:"windSpeed" parquet:"wind_speed"`
+	WindSpeedUnit   string  `json:"windSpeedUnit" parquet:"wind_speed_unit"`
+	WindGust        float64 `json:"windGust" parquet:"wind_gust"`
+	WindGustUnit    string  `json:"windGustUnit" parquet:"wind_gust_unit"`
+	PM25            float64 `json:"pm25" parquet:"pm25"`
+	PM25Unit        string  `json:"pm25Unit" parquet:"pm25_unit"`
+	PM10            float64 `json:"pm10" parquet:"pm10"`
+	PM10Unit        string  `json:"pm10Unit" parquet:"pm10_unit"`
+}
+
+func (airQualityRow) header() []string {
+	return []string{"hash", "city_id", "timestamp", "aqi", "dewPoint", "dewPointUnit", "humidity", "humidityUnit",
+		"pressure", "pressureUnit", "temperature", "temperatureUnit", "windSpeed", "windSpeedUnit",
+		"windGust", "windGustUnit", "pm25", "pm25Unit", "pm10", "pm10Unit"}
+}
+
+func (r airQualityRow) record() []string {
+	return []string{r.Hash, itoa(r.CityIdx), r.Timestamp, itoa(r.Aqi), ftoa(r.DewPoint), r.DewPointUnit,
+		ftoa(r.Humidity), r.HumidityUnit, ftoa(r.Pressure), r.PressureUnit, ftoa(r.Temperature), r.TemperatureUnit,
+		ftoa(r.WindSpeed), r.WindSpeedUnit, ftoa(r.WindGust), r.WindGustUnit, ftoa(r.PM25), r.PM25Unit, ftoa(r.PM10), r.PM10Unit}
+}
+
+// setUnits sets the unit columns of the measurements
+func (r *airQualityRow) setUnits(u dpapi.Units) {
+	r.DewPointUnit = string(u["dewPoint"])
+	r.HumidityUnit = string(u["humidity"])
+	r.PressureUnit = string(u["pressure"])
+	r.TemperatureUnit = string(u["temperature"])
+	r.WindSpeedUnit = string(u["windSpeed"])
+	r.WindGustUnit = string(u["windGust"])
+	r.PM25Unit = string(u["pm25"])
+	r.PM10Unit = string(u["pm10"])
+}
+
+type cityRow struct {
+	Idx      int64   `json:"idx" parquet:"idx"`
+	CityName string  `json:"cityName" parquet:"city_name"`
+	Lat      float64 `json:"lat" parquet:"lat"`
+	Lng      float64 `json:"lng" parquet:"lng"`
+}
+
+func (cityRow) header() []string {
+	return []string{"idx", "cityName", "lat", "lng"}
+}
+
+func (r cityRow) record() []string {
+	return []string{itoa(r.Idx), r.CityName, ftoa(r.Lat), ftoa(r.Lng)}
+}
+
+type alertRow struct {
+	Hash             string `json:"hash" parquet:"hash"`
+	CityIdx          int64  `json:"cityIdx" parquet:"city_id"`
+	AlertDesc        string `json:"alertDesc" parquet:"alert_desc"`
+	AlertEffective   string `json:"alertEffective" parquet:"alert_effective"`
+	AlertExpires     string `json:"alertExpires" parquet:"alert_expires"`
+	AlertStatus      string `json:"alertStatus" parquet:"alert_status"`
+	AlertCertainty   string `json:"alertCertainty" parquet:"alert_certainty"`
+	AlertUrgency     string `json:"alertUrgency" parquet:"alert_urgency"`
+	AlertSeverity    string `json:"alertSeverity" parquet:"alert_severity"`
+	AlertHeadline    string `json:"alertHeadline" parquet:"alert_headline"`
+	AlertDescription string `json:"alertDescription" parquet:"alert_description"`
+	AlertEvent       string `json:"alertEvent" parquet:"alert_event"`
+}
+
+func (alertRow) header() []string {
+	return []string{"hash", "city_id", "alertDesc", "alertEffective", "alertExpires", "alertStatus",
+		"alertCertainty", "alertUrgency", "alertSeverity", "alertHeadline", "alertDescription", "alertEvent"}
+}
+
+func (r alertRow) record() []string {
+	return []string{r.Hash, itoa(r.CityIdx), r.AlertDesc, r.AlertEffective, r.AlertExpires, r.AlertStatus,
+		r.AlertCertainty, r.AlertUrgency, r.AlertSeverity, r.AlertHeadline, r.AlertDescription, r.AlertEvent}
+}
+
+func itoa(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
+
+func ftoa(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// rowEncoder writes rows of one table in a specific file format
+type rowEncoder[T exportRow] interface {
+	encode(row T) error
+	close() error
+}
+
+type csvEncoder[T exportRow] struct {
+	w *csv.Writer
+}
+
+func (e *csvEncoder[T]) encode(row T) error {
+	return e.w.Write(row.record())
+}
+
+func (e *csvEncoder[T]) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonEncoder[T exportRow] struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonEncoder[T]) encode(row T) error {
+	return e.enc.Encode(row)
+}
+
+func (e *ndjsonEncoder[T]) close() error {
+	return nil
+}
+
+type parquetEncoder[T exportRow] struct {
+	w        *parquet.GenericWriter[T]
+	buffered int
+}
+
+func (e *parquetEncoder[T]) encode(row T) error {
+	if _, err := e.w.Write([]T{row}); err != nil {
+		return err
+	}
+	// Flush row groups regularly so the writer does not hold the whole export
+	e.buffered++
+	if e.buffered >= parquetRowGroupSize {
+		e.buffered = 0
+		return e.w.Flush()
+	}
+	return nil
+}
+
+func (e *parquetEncoder[T]) close() error {
+	return e.w.Close()
+}
+
+func newRowEncoder[T exportRow](w io.Writer, format agapi.ExportFormat) (rowEncoder[T], error) {
+	switch format {
+	case agapi.ExportCSV:
+		cw := csv.NewWriter(w)
+		var zero T
+		if err := cw.Write(zero.header()); err != nil {
+			return nil, err
+		}
+		return &csvEncoder[T]{w: cw}, nil
+	case agapi.ExportNDJSON:
+		return &ndjsonEncoder[T]{enc: json.NewEncoder(w)}, nil
+	case agapi.ExportParquet:
+		return &parquetEncoder[T]{w: parquet.NewGenericWriter[T](w)}, nil
+	}
+	return nil, fmt.Errorf("unsupported export format: [%s]", format)
+}
+
+// validateExportRequest checks the requested table, format and time range
+func validateExportRequest(req *agapi.ExportRequest) error {
+	switch req.Table {
+	case agapi.ExportAirQuality, agapi.ExportCity, agapi.ExportAlert:
+	default:
+		return fmt.Errorf("unsupported export table: [%s]", req.Table)
+	}
+	switch req.Format {
+	case agapi.ExportCSV, agapi.ExportNDJSON, agapi.ExportParquet:
+	default:
+		return fmt.Errorf("unsupported export format: [%s]", req.Format)
+	}
+	for _, t := range []string{req.StartTime, req.EndTime} {
+		if t == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, t); err != nil {
+			return fmt.Errorf("error parsing timestamp: %v", err)
+		}
+	}
+	return nil
+}
+
+// exportFilter builds the WHERE clause for the time range and the region of the request,
+// timeCol is compared to the range and the region is matched against the city table aliased as c
+func exportFilter(req *agapi.ExportRequest, timeCol string) (string, []any) {
+	conds := make([]string, 0)
+	args := make([]any, 0)
+	if req.StartTime != "" && timeCol != "" {
+		conds = append(conds, fmt.Sprintf("datetime(%s) >= datetime(?)", timeCol))
+		args = append(args, req.StartTime)
+	}
+	if req.EndTime != "" && timeCol != "" {
+		conds = append(conds, fmt.Sprintf("datetime(%s) < datetime(?)", timeCol))
+		args = append(args, req.EndTime)
+	}
+	if r := req.Region; r != nil {
+		conds = append(conds, "c.lat BETWEEN ? AND ? AND c.lng BETWEEN ? AND ?")
+		args = append(args, r.MinLat, r.MaxLat, r.MinLng, r.MaxLng)
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// exportTable streams the rows of the requested table to w and returns the number of rows written
+func exportTable(ctx context.Context, db *sql.DB, req *agapi.ExportRequest, w io.Writer) (int, error) {
+	switch req.Table {
+	case agapi.ExportAirQuality:
+		where, args := exportFilter(req, "a.timestamp")
+		query := `SELECT a.hash, a.city_id, a.timestamp, a.aqi, ` + measurementColumns + `, a.units
+			FROM air_quality a JOIN city c ON c.idx = a.city_id` + where + " ORDER BY datetime(a.timestamp)"
+		return exportRows(ctx, db, query, args, w, req.Format, func(rows *sql.Rows) (airQualityRow, error) {
+			var r airQualityRow
+			var u sql.NullString
+			err := rows.Scan(&r.Hash, &r.CityIdx, &r.Timestamp, &r.Aqi, &r.DewPoint, &r.Humidity, &r.Pressure,
+				&r.Temperature, &r.WindSpeed, &r.WindGust, &r.PM25, &r.PM10, &u)
+			r.setUnits(parseUnits(u))
+			return r, err
+		})
+	case agapi.ExportCity:
+		where, args := exportFilter(req, "")
+		query := "SELECT c.idx, c.cityName, c.lat, c.lng FROM city c" + where + " ORDER BY c.idx"
+		return exportRows(ctx, db, query, args, w, req.Format, func(rows *sql.Rows) (cityRow, error) {
+			var r cityRow
+			err := rows.Scan(&r.Idx, &r.CityName, &r.Lat, &r.Lng)
+			return r, err
+		})
+	case agapi.ExportAlert:
+		where, args := exportFilter(req, "al.alertEffective")
+		query := `SELECT al.hash, al.city_id, al.alertDesc, al.alertEffective, al.alertExpires, al.alertStatus,
+				al.alertCertainty, al.alertUrgency, al.alertSeverity, al.alertHeadline, al.alertDescription, al.alertEvent
+			FROM alert al JOIN city c ON c.idx = al.city_id` + where + " ORDER BY datetime(al.alertEffective)"
+		return exportRows(ctx, db, query, args, w, req.Format, func(rows *sql.Rows) (alertRow, error) {
+			var r alertRow
+			err := rows.Scan(&r.Hash, &r.CityIdx, &r.AlertDesc, &r.AlertEffective, &r.AlertExpires, &r.AlertStatus,
+				&r.AlertCertainty, &r.AlertUrgency, &r.AlertSeverity, &r.AlertHeadline, &r.AlertDescription, &r.AlertEvent)
+			return r, err
+		})
+	}
+	return 0, fmt.Errorf("unsupported export table: [%s]", req.Table)
+}
+
+// exportRows encodes the rows of the query one by one, so the result set is never held in memory
+func exportRows[T exportRow](ctx context.Context, db *sql.DB, query string, args []any, w io.Writer,
+	format agapi.ExportFormat, scan func(*sql.Rows) (T, error)) (int, error) {
+
+	enc, err := newRowEncoder[T](w, format)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		// A row that cannot be read fails the export, which would be incomplete otherwise
+		row, err := scan(rows)
+		if err != nil {
+			return count, fmt.Errorf("error scanning row %d: %v", count+1, err)
+		}
+		if err := enc.encode(row); err != nil {
+			return count, fmt.Errorf("error encoding row: %v", err)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Error iterating rows", "error", err)
+		return count, err
+	}
+	if err := enc.close(); err != nil {
+		return count, fmt.Errorf("error finalizing export: %v", err)
+	}
+	return count, nil
+}
+
+// chunkWriter buffers the written bytes and hands them out in chunks of a fixed size
+type chunkWriter struct {
+	buf  []byte
+	size int
+	sent int
+	send func([]byte) error
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for len(c.buf) >= c.size {
+		if err := c.flushN(c.size); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends the remaining buffered bytes
+func (c *chunkWriter) Flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	return c.flushN(len(c.buf))
+}
+
+func (c *chunkWriter) flushN(n int) error {
+	chunk := make([]byte, n)
+	copy(chunk, c.buf[:n])
+	c.buf = c.buf[n:]
+	c.sent += n
+	return c.send(chunk)
+}
+
+// ExportData streams the requested table in chunks so large exports are never held in memory
+func (s Server) ExportData(req *pb.Data, stream grpc.ServerStreamingServer[pb.DataResponse]) error {
+	recTime := time.Now()
+	recTimestamp := recTime.UnixMilli()
+	slog.InfoContext(stream.Context(), "Received export request", "request", req.Payload)
+
+	var exportReq agapi.ExportRequest
+	if err := json.Unmarshal([]byte(req.Payload), &exportReq); err != nil {
+		return fmt.Errorf("error unmarshalling JSON: %v", err)
+	}
+	if err := validateExportRequest(&exportReq); err != nil {
+		return err
+	}
+
+	cw := &chunkWriter{
+		size: exportChunkSize,
+		send: func(chunk []byte) error {
+			return stream.Send(&pb.DataResponse{
+				Status:            "ok",
+				Chunk:             chunk,
+				ReceivedTimestamp: fmt.Sprintf("%d", int(recTimestamp)),
+				SentTimestamp:     fmt.Sprintf("%d", int(time.Now().UnixMilli())),
+			})
+		},
+	}
+	count, err := exportTable(stream.Context(), s.Db, &exportReq, cw)
+	if err != nil {
+		return fmt.Errorf("error exporting data: %v", err)
+	}
+	if err := cw.Flush(); err != nil {
+		return fmt.Errorf("error sending data: %v", err)
+	}
+
+	s.Metric.AddProcessingTime("export", float64(time.Since(recTime).Milliseconds())/1000.0)
+	s.Metric.AddSentDataBytes("export", float64(cw.sent))
+	slog.InfoContext(stream.Context(), "Exported rows", "rows", count, "table", exportReq.Table, "format", exportReq.Format, "bytes", cw.sent)
+	return nil
+}
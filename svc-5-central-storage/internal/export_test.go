@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
+	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
+	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+
+	"github.com/parquet-go/parquet-go"
+	"google.golang.org/grpc"
+)
+
+// exportStream collects the chunks of an export
+type exportStream struct {
+	grpc.ServerStream
+	chunks [][]byte
+}
+
+func (s *exportStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *exportStream) Send(resp *pb.DataResponse) error {
+	if resp.Status != "ok" {
+		return nil
+	}
+	s.chunks = append(s.chunks, resp.Chunk)
+	return nil
+}
+
+func (s *exportStream) bytes() []byte {
+	return bytes.Join(s.chunks, nil)
+}
+
+// exportServer returns a server of three stations at (idx, -idx), the readings of
+// station 1 and 2 and an alert of station 3. The reading of station 2 did not report
+// its humidity.
+func exportServer(t *testing.T) Server {
+	t.Helper()
+	db := testDB(t)
+	addCity(t, db, 1, "one")
+	addCity(t, db, 2, "two")
+	addCity(t, db, 3, "three")
+	addReading(t, db, 1, "2024-01-01T00:00:00Z", 10)
+	addReading(t, db, 1, "2024-01-02T00:00:00Z", 11)
+	addReading(t, db, 2, "2024-01-03T00:00:00Z", 20)
+	exec(t, db, `UPDATE air_quality SET units = '{"humidity":"%","pressure":"hPa","pm25":"µg/m³"}' WHERE aqi != 20`)
+	exec(t, db, "UPDATE air_quality SET humidity = NULL WHERE aqi = 20")
+	addAlert(t, db, 3, "a", "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z")
+	return Server{Db: db, Metric: metric.New("test", metric.Buckets{})}
+}
+
+// export runs an export of the request and returns the exported bytes
+func export(t *testing.T, s Server, req agapi.ExportRequest) ([]byte, error) {
+	t.Helper()
+	payload, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &exportStream{}
+	err = s.ExportData(&pb.Data{Payload: string(payload)}, stream)
+	return stream.bytes(), err
+}
+
+func TestExportCSV(t *testing.T) {
+	s := exportServer(t)
+	tests := []struct {
+		name     string
+		req      agapi.ExportRequest
+		wantRows [][]string
+	}{
+		{name: "cities", req: agapi.ExportRequest{Table: agapi.ExportCity, Format: agapi.ExportCSV},
+			wantRows: [][]string{{"idx", "cityName", "lat", "lng"}, {"1", "one", "1", "-1"}, {"2", "two", "2", "-2"}, {"3", "three", "3", "-3"}}},
+		{name: "cities in a region", req: agapi.ExportRequest{Table: agapi.ExportCity, Format: agapi.ExportCSV,
+			Region: &agapi.BoundingBox{MinLat: 1.5, MaxLat: 3, MinLng: -3, MaxLng: -1.5}},
+			wantRows: [][]string{{"idx", "cityName", "lat", "lng"}, {"2", "two", "2", "-2"}, {"3", "three", "3", "-3"}}},
+		{name: "alerts", req: agapi.ExportRequest{Table: agapi.ExportAlert, Format: agapi.ExportCSV},
+			wantRows: [][]string{
+				{"hash", "city_id", "alertDesc", "alertEffective", "alertExpires", "alertStatus",
+					"alertCertainty", "alertUrgency", "alertSeverity", "alertHeadline", "alertDescription", "alertEvent"},
+				{"a", "3", "a", "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z", "Actual",
+					"Likely", "Expected", "Moderate", "headline", "description", "event"},
+			}},
+		{name: "nothing in range", req: agapi.ExportRequest{Table: agapi.ExportAlert, Format: agapi.ExportCSV, StartTime: "2025-01-01T00:00:00Z"},
+			wantRows: [][]string{{"hash", "city_id", "alertDesc", "alertEffective", "alertExpires", "alertStatus",
+				"alertCertainty", "alertUrgency", "alertSeverity", "alertHeadline", "alertDescription", "alertEvent"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := export(t, s, tt.req)
+			if err != nil {
+				t.Fatalf("ExportData(): %v", err)
+			}
+			rows, err := csv.NewReader(bytes.NewReader(out)).ReadAll()
+			if err != nil {
+				t.Fatalf("export is not CSV: %v", err)
+			}
+			if !slices.EqualFunc(rows, tt.wantRows, slices.Equal) {
+				t.Errorf("rows = %v, want %v", rows, tt.wantRows)
+			}
+		})
+	}
+}
+
+func TestExportReadingsCSV(t *testing.T) {
+	out, err := export(t, exportServer(t), agapi.ExportRequest{Table: agapi.ExportAirQuality, Format: agapi.ExportCSV,
+		StartTime: "2024-01-02T00:00:00Z"})
+	if err != nil {
+		t.Fatalf("ExportData(): %v", err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatalf("export is not CSV: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("rows = %v, want the header and 2 readings", rows)
+	}
+	col := func(row []string, name string) string {
+		return row[slices.Index(rows[0], name)]
+	}
+	if col(rows[1], "aqi") != "11" || col(rows[2], "aqi") != "20" || col(rows[2], "city_id") != "2" {
+		t.Errorf("readings = %v", rows[1:])
+	}
+	// the unreported humidity of the last reading has no unit
+	if col(rows[1], "humidity") != "2" || col(rows[1], "humidityUnit") != "%" {
+		t.Errorf("reported humidity = %s %s", col(rows[1], "humidity"), col(rows[1], "humidityUnit"))
+	}
+	if col(rows[2], "humidity") != "0" || col(rows[2], "humidityUnit") != "" || col(rows[2], "pm25Unit") != "µg/m³" {
+		t.Errorf("unreported humidity = %s %q, pm25 unit %s", col(rows[2], "humidity"), col(rows[2], "humidityUnit"), col(rows[2], "pm25Unit"))
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	out, err := export(t, exportServer(t), agapi.ExportRequest{Table: agapi.ExportAirQuality, Format: agapi.ExportNDJSON,
+		EndTime: "2024-01-02T00:00:00Z"})
+	if err != nil {
+		t.Fatalf("ExportData(): %v", err)
+	}
+	var rows []airQualityRow
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		var r airQualityRow
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("line %q is not JSON: %v", sc.Text(), err)
+		}
+		rows = append(rows, r)
+	}
+	if len(rows) != 1 || rows[0].Aqi != 10 || rows[0].CityIdx != 1 || rows[0].PressureUnit != "hPa" {
+		t.Errorf("rows = %+v, want the reading of the first day", rows)
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	out, err := export(t, exportServer(t), agapi.ExportRequest{Table: agapi.ExportAirQuality, Format: agapi.ExportParquet})
+	if err != nil {
+		t.Fatalf("ExportData(): %v", err)
+	}
+	rows, err := parquet.Read[airQualityRow](bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatalf("export is not parquet: %v", err)
+	}
+	var aqis []int64
+	for _, r := range rows {
+		aqis = append(aqis, r.Aqi)
+	}
+	if !slices.Equal(aqis, []int64{10, 11, 20}) {
+		t.Errorf("aqis = %v, want [10 11 20]", aqis)
+	}
+}
+
+func TestParquetRowGroups(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := newRowEncoder[cityRow](&buf, agapi.ExportParquet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 2*parquetRowGroupSize + parquetRowGroupSize/2
+	for i := 0; i < n; i++ {
+		if err := enc.encode(cityRow{Idx: int64(i), CityName: "city"}); err != nil {
+			t.Fatalf("encode(): %v", err)
+		}
+		// every full row group is flushed to the output
+		if i == parquetRowGroupSize && buf.Len() == 0 {
+			t.Fatal("first row group not flushed")
+		}
+	}
+	if err := enc.close(); err != nil {
+		t.Fatalf("close(): %v", err)
+	}
+	f, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("OpenFile(): %v", err)
+	}
+	var sizes []int64
+	for _, rg := range f.RowGroups() {
+		sizes = append(sizes, rg.NumRows())
+	}
+	want := []int64{parquetRowGroupSize, parquetRowGroupSize, parquetRowGroupSize / 2}
+	if !slices.Equal(sizes, want) {
+		t.Errorf("row groups = %v, want %v", sizes, want)
+	}
+}
+
+func TestChunkWriter(t *testing.T) {
+	var chunks [][]byte
+	cw := &chunkWriter{size: 4, send: func(chunk []byte) error {
+		chunks = append(chunks, chunk)
+		return nil
+	}}
+	for _, p := range []string{"ab", "cdefghij", "k"} {
+		if n, err := cw.Write([]byte(p)); err != nil || n != len(p) {
+			t.Fatalf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(chunks))
+	for _, c := range chunks {
+		got = append(got, string(c))
+	}
+	if !slices.Equal(got, []string{"abcd", "efgh", "ijk"}) || cw.sent != 11 {
+		t.Errorf("chunks = %q, sent %d", got, cw.sent)
+	}
+}
+
+func TestExportInvalidRequests(t *testing.T) {
+	s := exportServer(t)
+	tests := []struct {
+		name    string
+		req     agapi.ExportRequest
+		wantErr string
+	}{
+		{name: "table", req: agapi.ExportRequest{Table: "users", Format: agapi.ExportCSV}, wantErr: "unsupported export table"},
+		{name: "format", req: agapi.ExportRequest{Table: agapi.ExportCity, Format: "xlsx"}, wantErr: "unsupported export format"},
+		{name: "start time", req: agapi.ExportRequest{Table: agapi.ExportCity, Format: agapi.ExportCSV, StartTime: "today"}, wantErr: "error parsing timestamp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := export(t, s, tt.req)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ExportData() error = %v, want %q", err, tt.wantErr)
+			}
+			if len(out) != 0 {
+				t.Errorf("ExportData() sent %d bytes", len(out))
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
+	dpapi "github.com/etesami/air-quality-monitoring/api/data-processing"
+)
+
+// ServeGeoJSON serves the stations as a GeoJSON FeatureCollection over plain HTTP,
+// the cursors of the changes as of the snapshot are in the X-Readings-Cursor and
+// X-Alerts-Cursor headers
+func (s Server) ServeGeoJSON(w http.ResponseWriter, r *http.Request) {
+	st := time.Now()
+	snap, err := requestSnapshotFromDb(s.Db)
+	if err != nil {
+		slog.Error("Error building GeoJSON", "error", err)
+		http.Error(w, "error building GeoJSON", http.StatusInternalServerError)
+		return
+	}
+	s.Metric.AddProcessingTime("geojson", float64(time.Since(st).Milliseconds())/1000.0)
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Header().Set("X-Readings-Cursor", strconv.FormatInt(snap.ReadingsCursor, 10))
+	w.Header().Set("X-Alerts-Cursor", strconv.FormatInt(snap.AlertsCursor, 10))
+	if err := json.NewEncoder(w).Encode(snap.Stations); err != nil {
+		slog.Error("Error writing GeoJSON response", "error", err)
+	}
+}
+
+// requestSnapshotFromDb builds a GeoJSON FeatureCollection with one point per station,
+// carrying the latest reading and the currently active alert as properties. Its cursors
+// are taken first, the rows inserted while it is built are returned again as changes.
+func requestSnapshotFromDb(db *sql.DB) (*agapi.Snapshot, error) {
+	readingsCursor, alertsCursor, err := maxRowids(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`
+		SELECT c.idx, c.cityName, c.lat, c.lng,
+			a.timestamp, a.aqi, a.dewPoint, a.humidity, a.pressure,
+			a.temperature, a.windSpeed, a.windGust, a.pm25, a.pm10, a.units
+		FROM city c
+		LEFT JOIN air_quality a ON a.hash = (
+			SELECT hash FROM air_quality WHERE city_id = c.idx ORDER BY datetime(timestamp) DESC LIMIT 1
+		)
+		ORDER BY c.idx`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snap := &agapi.Snapshot{
+		Stations: agapi.FeatureCollection{
+			Type:     "FeatureCollection",
+			Features: make([]agapi.Feature, 0),
+		},
+		ReadingsCursor: readingsCursor,
+		AlertsCursor:   alertsCursor,
+	}
+	fc := &snap.Stations
+	for rows.Next() {
+		var lat, lng float64
+		var cityName, timestamp, u sql.NullString
+		var aqi sql.NullInt64
+		var dewPoint, humidity, pressure, temperature, windSpeed, windGust, pm25, pm10 sql.NullFloat64
+		p := agapi.StationProperties{}
+		if err := rows.Scan(&p.Idx, &cityName, &lat, &lng,
+			&timestamp, &aqi, &dewPoint, &humidity, &pressure,
+			&temperature, &windSpeed, &windGust, &pm25, &pm10, &u); err != nil {
+			slog.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		p.CityName = cityName.String
+		p.Timestamp = timestamp.String
+		p.Aqi = nullInt64Ptr(aqi)
+		p.DewPoint = nullFloat64Ptr(dewPoint)
+		p.Humidity = nullFloat64Ptr(humidity)
+		p.Pressure = nullFloat64Ptr(pressure)
+		p.Temperature = nullFloat64Ptr(temperature)
+		p.WindSpeed = nullFloat64Ptr(windSpeed)
+		p.WindGust = nullFloat64Ptr(windGust)
+		p.PM25 = nullFloat64Ptr(pm25)
+		p.PM10 = nullFloat64Ptr(pm10)
+		if timestamp.Valid {
+			p.Units = parseUnits(u)
+		}
+
+		fc.Features = append(fc.Features, agapi.Feature{
+			Type: "Feature",
+			Geometry: agapi.Geometry{
+				Type:        "Point",
+				Coordinates: []float64{lng, lat},
+			},
+			Properties: p,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Error iterating rows", "error", err)
+		return nil, err
+	}
+
+	alerts, err := activeAlertsFromDb(db, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for i := range fc.Features {
+		if alert, ok := alerts[fc.Features[i].Properties.Idx]; ok {
+			fc.Features[i].Properties.Alert = alert
+		}
+	}
+	return snap, nil
+}
+
+// activeAlertsFromDb returns the most recent non-expired alert of each city
+func activeAlertsFromDb(db *sql.DB, now time.Time) (map[int64]*dpapi.Alert, error) {
+	rows, err := db.Query(`
+		SELECT city_id, alertDesc, alertEffective, alertExpires, alertStatus, alertCertainty,
+			alertUrgency, alertSeverity, alertHeadline, alertDescription, alertEvent
+		FROM alert
+		WHERE datetime(alertExpires) > datetime(?)
+		ORDER BY city_id, datetime(alertEffective) DESC`, now.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := make(map[int64]*dpapi.Alert)
+	for rows.Next() {
+		var cityIdx int64
+		alert := &dpapi.Alert{}
+		if err := rows.Scan(&cityIdx, &alert.AlertDesc, &alert.AlertEffective, &alert.AlertExpires,
+			&alert.AlertStatus, &alert.AlertCertainty, &alert.AlertUrgency, &alert.AlertSeverity,
+			&alert.AlertHeadline, &alert.AlertDescription, &alert.AlertEvent); err != nil {
+			slog.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		// rows are ordered by effective time, the first one is the latest
+		if _, ok := alerts[cityIdx]; !ok {
+			alerts[cityIdx] = alert
+		}
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Error iterating rows", "error", err)
+		return nil, err
+	}
+	return alerts, nil
+}
+
+func nullInt64Ptr(v sql.NullInt64) *int64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Int64
+}
+
+func nullFloat64Ptr(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
+}
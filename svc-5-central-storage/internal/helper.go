@@ -7,22 +7,33 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
 	"time"
 
+	api "github.com/etesami/air-quality-monitoring/api"
 	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
 	dpapi "github.com/etesami/air-quality-monitoring/api/data-processing"
 	loapi "github.com/etesami/air-quality-monitoring/api/local-storage"
 
+	"github.com/etesami/air-quality-monitoring/pkg/deadletter"
 	"github.com/etesami/air-quality-monitoring/pkg/metric"
+	"github.com/etesami/air-quality-monitoring/pkg/pool"
 	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
+	"github.com/etesami/air-quality-monitoring/pkg/tracing"
+	"github.com/etesami/air-quality-monitoring/pkg/validation"
 	_ "github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Server struct {
 	pb.UnimplementedAirQualityMonitoringServer
-	Metric *metric.Metric
-	Db     *sql.DB
+	Metric     *metric.Metrics
+	Db         *sql.DB
+	DeadLetter *deadletter.Store
+	Pool       *pool.Pool
 }
 
 // CheckConnection is a simple ping-pong method to respond for the health check
@@ -40,7 +51,7 @@ func (s Server) CheckConnection(ctx context.Context, recData *pb.Data) (*pb.Ack,
 func (s Server) ReceiveDataFromServer(ctx context.Context, req *pb.Data) (*pb.DataResponse, error) {
 	recTime := time.Now()
 	recTimestamp := recTime.UnixMilli()
-	log.Printf("Received request for data: [%d]\n", len(req.Payload))
+	slog.DebugContext(ctx, "Received request for data", "bytes", len(req.Payload))
 
 	var dataRequest loapi.DataRequest
 	if err := json.Unmarshal([]byte(req.Payload), &dataRequest); err != nil {
@@ -51,10 +62,10 @@ func (s Server) ReceiveDataFromServer(ctx context.Context, req *pb.Data) (*pb.Da
 	if err != nil {
 		return nil, fmt.Errorf("error requesting data: %v", err)
 	}
-	s.Metric.AddProcessingTime("processing", float64(time.Since(recTime).Milliseconds())/1000.0)
+	s.Metric.AddProcessingTime("query", float64(time.Since(recTime).Milliseconds())/1000.0)
 
 	if dataToBeSent == "" {
-		log.Printf("No data to be sent")
+		slog.InfoContext(ctx, "No data to be sent")
 		return &pb.DataResponse{
 			Status:            "no_data_available",
 			Payload:           "",
@@ -75,22 +86,22 @@ func (s Server) ReceiveDataFromServer(ctx context.Context, req *pb.Data) (*pb.Da
 func (s Server) SendDataToServer(ctx context.Context, recData *pb.Data) (*pb.Ack, error) {
 	recTime := time.Now()
 	recTimestamp := recTime.UnixMilli()
-	log.Printf("Received at [%s]: [%d]\n", recTime.Format("2006-01-02 15:04:05"), len(recData.Payload))
-
-	go func(data string, db *sql.DB, m *metric.Metric, start time.Time) {
-		aqData := []dpapi.EnhancedDataResponse{}
-		if err := json.Unmarshal([]byte(recData.Payload), &aqData); err != nil {
-			log.Printf("Error unmarshalling JSON: %v", err)
-			return
-		}
-
-		// Insert data into the database
-		if err := insertToDb(db, aqData); err != nil {
-			log.Printf("Error inserting data into database: %v", err)
-			return
+	slog.DebugContext(ctx, "Received data", "bytes", len(recData.Payload))
+
+	// The insertion waits for a worker, the call is turned away when too many wait
+	// already so that the caller backs off. The call is acknowledged once the data is
+	// stored, otherwise the caller retries it and keeps it once its retries are
+	// exhausted. An insertion outliving the call still completes and continues its trace.
+	procCtx := context.WithoutCancel(ctx)
+	if err := s.Pool.Do(ctx, func() error {
+		if err := s.process(procCtx, recData.Payload, recTime); err != nil {
+			slog.ErrorContext(procCtx, "Error inserting data into database", "error", err)
+			return status.Error(codes.Unavailable, "error storing data, retry later")
 		}
-		m.AddProcessingTime("processing", float64(time.Since(start).Milliseconds())/1000.0)
-	}(recData.Payload, s.Db, s.Metric, recTime)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 
 	ack := &pb.Ack{
 		Status:                "ok",
@@ -101,22 +112,80 @@ func (s Server) SendDataToServer(ctx context.Context, recData *pb.Data) (*pb.Ack
 	return ack, nil
 }
 
-func insertToDb(db *sql.DB, data []dpapi.EnhancedDataResponse) error {
-	count := 0
+// Reinject stores a dead-letter record again
+func (s Server) Reinject(ctx context.Context, rec *deadletter.Record) error {
+	return s.process(ctx, rec.Payload, time.Now())
+}
+
+// process stores the items of payload, the error is returned
+// when the database could not be updated
+func (s Server) process(ctx context.Context, payload string, start time.Time) (err error) {
+	defer s.Metric.InFlight("store")()
+	ctx, span := tracing.Start(ctx, "store")
+	defer func() { tracing.End(span, err) }()
+
+	aqData := []dpapi.EnhancedDataResponse{}
+	if err := json.Unmarshal([]byte(payload), &aqData); err != nil {
+		s.reject(ctx, payload, []validation.Rejection{*validation.Malformed(err)})
+		return nil
+	}
+	s.Metric.AddReceived(len(aqData))
+
+	// Insert data into the database
+	stored, err := insertToDb(ctx, s.Db, aqData, s.rejectRecord)
+	if err != nil {
+		return err
+	}
+	s.Metric.AddAccepted(len(stored))
+	for _, record := range stored {
+		s.Metric.AddLineage(int(record.City.Idx), api.StageStoredCentrally, record.Lineage)
+	}
+	s.Metric.AddProcessingTime("store", float64(time.Since(start).Milliseconds())/1000.0)
+	return nil
+}
+
+// reject logs and counts the rejections of payload and keeps it in the dead-letter store, if any
+func (s Server) reject(ctx context.Context, payload string, rejections []validation.Rejection) {
+	for _, r := range rejections {
+		slog.InfoContext(ctx, "Rejected data", "rejection", &r)
+		s.Metric.AddRejected(string(r.Reason))
+	}
+	if s.DeadLetter == nil {
+		return
+	}
+	if _, err := s.DeadLetter.Reject("store", "processor", payload, rejections); err != nil {
+		slog.ErrorContext(ctx, "Error writing to dead-letter store", "error", err)
+	}
+}
+
+// rejectRecord rejects a single item of a payload
+func (s Server) rejectRecord(ctx context.Context, record dpapi.EnhancedDataResponse, r validation.Rejection) {
+	payload, err := json.Marshal([]dpapi.EnhancedDataResponse{record})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshalling rejected item", "error", err)
+		return
+	}
+	s.reject(ctx, string(payload), []validation.Rejection{r})
+}
+
+// insertToDb inserts the items of data and returns the ones inserted,
+// the ones that cannot be stored are passed to reject
+func insertToDb(ctx context.Context, db *sql.DB, data []dpapi.EnhancedDataResponse, reject func(context.Context, dpapi.EnhancedDataResponse, validation.Rejection)) ([]dpapi.EnhancedDataResponse, error) {
+	stored := make([]dpapi.EnhancedDataResponse, 0, len(data))
 	for _, record := range data {
-		tx, err := db.Begin()
+		tx, err := db.BeginTx(ctx, nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		_, err = tx.Exec("INSERT INTO city (idx, cityName, lat, lng) VALUES ($1, $2, $3, $4)",
+		err = insert(ctx, tx, "city", "INSERT INTO city (idx, cityName, lat, lng) VALUES ($1, $2, $3, $4)",
 			record.City.Idx,
 			record.City.CityName,
 			record.City.Lat,
 			record.City.Lng,
 		)
 		if err != nil && err.Error() != "UNIQUE constraint failed: city.idx" {
-			log.Printf("Error inserting city: %v\n", err)
+			reject(ctx, record, deadletter.Failed(fmt.Errorf("error inserting city: %v", err)))
 			tx.Rollback()
 			continue
 		}
@@ -126,27 +195,31 @@ func insertToDb(db *sql.DB, data []dpapi.EnhancedDataResponse) error {
 			"timestamp": record.AirQualityData.Timestamp,
 		})
 		if err != nil {
-			fmt.Printf("Error generating hash: %v\n", err)
+			reject(ctx, record, deadletter.Failed(fmt.Errorf("error generating hash: %v", err)))
 			tx.Rollback()
 			continue
 		}
 
-		_, err = tx.Exec("INSERT INTO air_quality (hash, aqi, timestamp, dewPoint, humidity, pressure, temperature, windSpeed, windGust, pm25, city_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+		record.Lineage.Stamp(api.StageStoredCentrally, time.Now())
+		err = insert(ctx, tx, "air_quality", "INSERT INTO air_quality (hash, aqi, timestamp, dewPoint, humidity, pressure, temperature, windSpeed, windGust, pm25, pm10, units, lineage, city_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)",
 			hash,
 			record.AirQualityData.Aqi,
 			record.AirQualityData.Timestamp,
-			record.AirQualityData.DewPoint,
-			record.AirQualityData.Humidity,
-			record.AirQualityData.Pressure,
-			record.AirQualityData.Temperature,
-			record.AirQualityData.WindSpeed,
-			record.AirQualityData.WindGust,
-			record.AirQualityData.PM25,
+			measurement(record.AirQualityData, "dewPoint", record.AirQualityData.DewPoint),
+			measurement(record.AirQualityData, "humidity", record.AirQualityData.Humidity),
+			measurement(record.AirQualityData, "pressure", record.AirQualityData.Pressure),
+			measurement(record.AirQualityData, "temperature", record.AirQualityData.Temperature),
+			measurement(record.AirQualityData, "windSpeed", record.AirQualityData.WindSpeed),
+			measurement(record.AirQualityData, "windGust", record.AirQualityData.WindGust),
+			measurement(record.AirQualityData, "pm25", record.AirQualityData.PM25),
+			measurement(record.AirQualityData, "pm10", record.AirQualityData.PM10),
+			formatUnits(record.AirQualityData.Units),
+			formatLineage(record.Lineage),
 			record.City.Idx,
 		)
 		if err != nil {
 			if err.Error() != "UNIQUE constraint failed: air_quality.hash" {
-				log.Printf("Error inserting air quality data: %v\n", err)
+				reject(ctx, record, deadletter.Failed(fmt.Errorf("error inserting air quality data: %v", err)))
 			}
 			tx.Rollback()
 			continue
@@ -154,21 +227,26 @@ func insertToDb(db *sql.DB, data []dpapi.EnhancedDataResponse) error {
 
 		if record.Alert != nil {
 
-			log.Printf("Alert: %v\n", record.Alert)
+			slog.DebugContext(ctx, "Alert", "station", record.City.Idx, "event", record.Alert.AlertEvent, "severity", record.Alert.AlertSeverity)
 			hash, err := generateHash(*record.Alert)
 			if err != nil {
+				reject(ctx, record, deadletter.Failed(fmt.Errorf("error generating alert hash: %v", err)))
 				tx.Rollback()
 				continue
 			}
 			effective, err1 := time.Parse(time.RFC3339, record.Alert.AlertEffective)
 			expires, err2 := time.Parse(time.RFC3339, record.Alert.AlertExpires)
 			if err1 != nil || err2 != nil {
-				fmt.Printf("error parsing timestamp: %v", fmt.Errorf("%v, %v", err1, err2))
+				reject(ctx, record, validation.Rejection{
+					Reason: validation.ReasonTimestamp,
+					Field:  "alert.alertEffective,alert.alertExpires",
+					Detail: fmt.Sprintf("%v, %v", err1, err2),
+				})
 				tx.Rollback()
 				continue
 			}
 
-			_, err = tx.Exec("INSERT INTO alert (hash, alertDesc, alertEffective, alertExpires, alertStatus, alertCertainty, alertUrgency, alertSeverity, alertHeadline, alertDescription, alertEvent, city_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)",
+			err = insert(ctx, tx, "alert", "INSERT INTO alert (hash, alertDesc, alertEffective, alertExpires, alertStatus, alertCertainty, alertUrgency, alertSeverity, alertHeadline, alertDescription, alertEvent, city_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)",
 				hash,
 				record.Alert.AlertDesc,
 				effective,
@@ -183,27 +261,85 @@ func insertToDb(db *sql.DB, data []dpapi.EnhancedDataResponse) error {
 				record.City.Idx,
 			)
 			if err != nil && err.Error() != "UNIQUE constraint failed: alert.hash" {
-				log.Printf("Error inserting alert data: %v\n", err)
+				reject(ctx, record, deadletter.Failed(fmt.Errorf("error inserting alert data: %v", err)))
 				tx.Rollback()
 				continue
 			}
 		}
 
 		if err := tx.Commit(); err != nil {
-			log.Printf("Error committing transaction: %v\n", err)
-			return err
+			slog.ErrorContext(ctx, "Error committing transaction", "error", err)
+			return nil, err
 		}
-		count++
+		stored = append(stored, record)
 	}
 
-	log.Printf("Inserted [%d]/[%d] items into the database.", count, len(data))
-	return nil
+	slog.InfoContext(ctx, "Inserted items into the database", "inserted", len(stored), "received", len(data))
+	return stored, nil
+}
+
+// insert runs an INSERT statement on table in a span of its own,
+// duplicates are expected and not recorded as errors of the span
+func insert(ctx context.Context, tx *sql.Tx, table, query string, args ...any) error {
+	ctx, span := tracing.StartSQL(ctx, "INSERT", table)
+	_, err := tx.ExecContext(ctx, query, args...)
+	if err != nil && strings.HasPrefix(err.Error(), "UNIQUE constraint failed") {
+		span.SetAttributes(attribute.Bool("duplicate", true))
+		span.End()
+		return err
+	}
+	tracing.End(span, err)
+	return err
+}
+
+// measurement returns the value of the measurement name of d, nil when the station did
+// not report it so that it is stored as NULL rather than 0
+func measurement(d dpapi.AirQualityData, name string, v float64) any {
+	if !d.Reported(name) {
+		return nil
+	}
+	return v
+}
+
+// formatUnits encodes the units of a reading for the units column, readings
+// without units are stored as NULL and read back with the default units
+func formatUnits(u dpapi.Units) any {
+	if len(u) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil
+	}
+	return string(b)
+}
+
+// formatLineage encodes the lineage of a reading for the lineage column,
+// readings processed before their lineage was recorded are stored as NULL
+func formatLineage(l api.Lineage) any {
+	if l == (api.Lineage{}) {
+		return nil
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return nil
+	}
+	return string(b)
+}
+
+// parseUnits decodes the units column of a reading
+func parseUnits(s sql.NullString) dpapi.Units {
+	u := dpapi.Units{}
+	if !s.Valid || json.Unmarshal([]byte(s.String), &u) != nil || len(u) == 0 {
+		return dpapi.DefaultUnits()
+	}
+	return u
 }
 
 func generateHash(data any) (string, error) {
 	byteAltert, err := json.Marshal(data)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %v", err)
+		slog.Error("Error marshalling JSON", "error", err)
 		return "", err
 	}
 	hash := sha256.Sum256([]byte(byteAltert))
@@ -213,13 +349,43 @@ func generateHash(data any) (string, error) {
 func requestDataFromDb(db *sql.DB, dataRequest *loapi.DataRequest) (string, error) {
 	// If Request Type is set it will be used
 	// - points: get all city data
-	// - alerts: get all alert data
-	// - airQuality: get all air quality data
-	// - all: get all data
+	// - alerts: get a page of alerts, optionally of one station (idx) and only active ones
+	// - readings: get a page of readings of one station (idx) in the given time range
+	// - geojson: get a GeoJSON FeatureCollection of stations with their latest reading, along with the cursors of the changes as of it
+	// - changes: get the readings and alerts inserted after the given cursors (readingsSince, alertsSince)
 
 	// Else points and times are required
 	// returns city data along with all air quality data and alerts in the given time range
 
+	var res any
+	var err error
+	switch dataRequest.RequestType {
+	case loapi.RequestGeoJSON:
+		res, err = requestSnapshotFromDb(db)
+	case loapi.RequestReadings:
+		res, err = requestReadingsFromDb(db, dataRequest)
+	case loapi.RequestAlerts:
+		var activeAt time.Time
+		if dataRequest.Active {
+			activeAt = time.Now()
+		}
+		limit, offset := pageBounds(dataRequest)
+		res, err = queryAlerts(db, dataRequest.Idx, activeAt, limit, offset)
+	case loapi.RequestChanges:
+		res, err = requestChangesFromDb(db, dataRequest)
+	}
+	if err != nil {
+		return "", err
+	}
+	if res != nil {
+		resByte, err := json.Marshal(res)
+		if err != nil {
+			slog.Error("Error marshalling JSON", "error", err)
+			return "", err
+		}
+		return string(resByte), nil
+	}
+
 	if dataRequest.RequestType == loapi.RequestPoints {
 		rows, err := db.Query("SELECT * FROM city")
 		if err != nil {
@@ -231,14 +397,14 @@ func requestDataFromDb(db *sql.DB, dataRequest *loapi.DataRequest) (string, erro
 		for rows.Next() {
 			var city dpapi.City
 			if err := rows.Scan(&city.Idx, &city.CityName, &city.Lat, &city.Lng); err != nil {
-				log.Printf("Error scanning row: %v", err)
+				slog.Error("Error scanning row", "error", err)
 				return "", err
 			}
 			cityData = append(cityData, city)
 		}
 
 		if err := rows.Err(); err != nil {
-			log.Printf("Error iterating rows: %v", err)
+			slog.Error("Error iterating rows", "error", err)
 			return "", err
 		}
 
@@ -253,7 +419,7 @@ func requestDataFromDb(db *sql.DB, dataRequest *loapi.DataRequest) (string, erro
 
 		resDataByte, err := json.Marshal(resData)
 		if err != nil {
-			log.Printf("Error marshalling JSON: %v", err)
+			slog.Error("Error marshalling JSON", "error", err)
 			return "", err
 		}
 		return string(resDataByte), nil
@@ -261,14 +427,14 @@ func requestDataFromDb(db *sql.DB, dataRequest *loapi.DataRequest) (string, erro
 
 	// If request type is not set, we need to check if start and end time are set
 	if dataRequest.StartTime == "" || dataRequest.EndTime == "" || dataRequest.LAT == 0 || dataRequest.LNG == 0 {
-		log.Printf("Error: Start and end time are required")
+		slog.Error("Start and end time are required")
 		return "", fmt.Errorf("start and end time and coordinates are required")
 	}
 
 	ttStart, err1 := time.Parse(time.RFC3339, dataRequest.StartTime)
 	ttEnd, err2 := time.Parse(time.RFC3339, dataRequest.EndTime)
 	if err1 != nil || err2 != nil {
-		log.Printf("Error parsing timestamp: %v", fmt.Errorf("%v, %v", err1, err2))
+		slog.Error("Error parsing timestamp", "error", fmt.Errorf("%v, %v", err1, err2))
 		return "", fmt.Errorf("%v, %v", err1, err2)
 	}
 	rows, err := db.Query("SELECT idx, cityName FROM city WHERE lat = ? AND lng = ?", dataRequest.LAT, dataRequest.LNG)
@@ -281,17 +447,17 @@ func requestDataFromDb(db *sql.DB, dataRequest *loapi.DataRequest) (string, erro
 	for rows.Next() {
 		var city dpapi.City
 		if err := rows.Scan(&city.Idx, &city.CityName); err != nil {
-			log.Printf("Error scanning row: %v", err)
+			slog.Error("Error scanning row", "error", err)
 			return "", err
 		}
 		cityData = append(cityData, city)
 	}
 	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating rows: %v", err)
+		slog.Error("Error iterating rows", "error", err)
 		return "", err
 	}
 	if len(cityData) == 0 {
-		log.Printf("No data found for the given coordinates")
+		slog.Info("No data found for the given coordinates")
 		return "", fmt.Errorf("no data found for the given coordinates")
 	}
 	var cityIdx int64
@@ -301,7 +467,8 @@ func requestDataFromDb(db *sql.DB, dataRequest *loapi.DataRequest) (string, erro
 	for _, city := range cityData {
 
 		cityIdx = city.Idx
-		rows, err := db.Query("SELECT * FROM air_quality WHERE timestamp > ? AND timestamp < ? AND city_id = ?", ttStart, ttEnd, cityIdx)
+		rows, err := db.Query(`SELECT aqi, timestamp, `+measurementColumns+`, units
+			FROM air_quality WHERE timestamp > ? AND timestamp < ? AND city_id = ?`, ttStart, ttEnd, cityIdx)
 		if err != nil {
 			return "", err
 		}
@@ -310,15 +477,17 @@ func requestDataFromDb(db *sql.DB, dataRequest *loapi.DataRequest) (string, erro
 		var msgList []dpapi.AirQualityData
 		for rows.Next() {
 			var msg dpapi.AirQualityData
-			if err := rows.Scan(&msg.Aqi, &msg.Timestamp, &msg.DewPoint, &msg.Humidity, &msg.Pressure, &msg.Temperature, &msg.WindSpeed, &msg.WindGust, &msg.PM25); err != nil {
-				log.Printf("Error scanning row: %v", err)
-				continue
+			var u sql.NullString
+			if err := rows.Scan(&msg.Aqi, &msg.Timestamp, &msg.DewPoint, &msg.Humidity, &msg.Pressure, &msg.Temperature, &msg.WindSpeed, &msg.WindGust, &msg.PM25, &msg.PM10, &u); err != nil {
+				slog.Error("Error scanning row", "error", err)
+				return "", err
 			}
+			msg.Units = parseUnits(u)
 			msgList = append(msgList, msg)
 		}
 
 		if err := rows.Err(); err != nil {
-			log.Printf("Error iterating rows: %v", err)
+			slog.Error("Error iterating rows", "error", err)
 			return "", err
 		}
 
@@ -333,14 +502,14 @@ func requestDataFromDb(db *sql.DB, dataRequest *loapi.DataRequest) (string, erro
 		for rows.Next() {
 			var alert dpapi.Alert
 			if err := rows.Scan(&alert.AlertDesc, &alert.AlertEffective, &alert.AlertExpires, &alert.AlertStatus, &alert.AlertCertainty, &alert.AlertUrgency, &alert.AlertSeverity, &alert.AlertHeadline, &alert.AlertDescription, &alert.AlertEvent); err != nil {
-				log.Printf("Error scanning row: %v", err)
-				continue
+				slog.Error("Error scanning row", "error", err)
+				return "", err
 			}
 			alertList = append(alertList, alert)
 		}
 
 		if err := rows.Err(); err != nil {
-			log.Printf("Error iterating rows: %v", err)
+			slog.Error("Error iterating rows", "error", err)
 			return "", err
 		}
 
@@ -354,9 +523,60 @@ func requestDataFromDb(db *sql.DB, dataRequest *loapi.DataRequest) (string, erro
 
 	allDataJson, err := json.Marshal(allResponses)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %v", err)
+		slog.Error("Error marshalling JSON", "error", err)
 		return "", err
 	}
 
 	return string(allDataJson), nil
 }
+
+// requestReadingsFromDb returns a page of readings of the requested station
+func requestReadingsFromDb(db *sql.DB, dataRequest *loapi.DataRequest) (*agapi.Page[dpapi.AirQualityData], error) {
+	if dataRequest.Idx == 0 {
+		return nil, fmt.Errorf("station index is required")
+	}
+	var from, to time.Time
+	var err error
+	if dataRequest.StartTime != "" {
+		if from, err = time.Parse(time.RFC3339, dataRequest.StartTime); err != nil {
+			return nil, fmt.Errorf("error parsing start time: %v", err)
+		}
+	}
+	if dataRequest.EndTime != "" {
+		if to, err = time.Parse(time.RFC3339, dataRequest.EndTime); err != nil {
+			return nil, fmt.Errorf("error parsing end time: %v", err)
+		}
+	}
+	limit, offset := pageBounds(dataRequest)
+	return queryReadings(db, dataRequest.Idx, from, to, limit, offset)
+}
+
+// requestChangesFromDb returns the rows inserted after the cursors of the request,
+// startTime optionally skips the older readings and the alerts expired before it
+func requestChangesFromDb(db *sql.DB, dataRequest *loapi.DataRequest) (*agapi.Changes, error) {
+	var from time.Time
+	var err error
+	if dataRequest.StartTime != "" {
+		if from, err = time.Parse(time.RFC3339, dataRequest.StartTime); err != nil {
+			return nil, fmt.Errorf("error parsing start time: %v", err)
+		}
+	}
+	limit, _ := pageBounds(dataRequest)
+	return queryChanges(db, dataRequest.ReadingsSince, dataRequest.AlertsSince, from, limit)
+}
+
+// pageBounds returns the requested page, falling back to the defaults of the REST API
+func pageBounds(dataRequest *loapi.DataRequest) (int, int) {
+	limit := dataRequest.Limit
+	if limit <= 0 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	offset := dataRequest.Offset
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	dpapi "github.com/etesami/air-quality-monitoring/api/data-processing"
+	validation "github.com/etesami/air-quality-monitoring/pkg/validation"
+)
+
+func TestInsertToDbUnreported(t *testing.T) {
+	db := testDB(t)
+	record := dpapi.EnhancedDataResponse{
+		City: dpapi.City{Idx: 1, CityName: "one", Lat: 1, Lng: -1},
+		AirQualityData: dpapi.AirQualityData{
+			Timestamp:   "2024-01-01T00:00:00Z",
+			Aqi:         42,
+			Temperature: 0,
+			PM25:        12,
+			Units:       dpapi.Units{"temperature": "°C", "pm25": "µg/m³"},
+		},
+	}
+	reject := func(_ context.Context, _ dpapi.EnhancedDataResponse, rej validation.Rejection) {
+		t.Errorf("record rejected: %v", &rej)
+	}
+	stored, err := insertToDb(context.Background(), db, []dpapi.EnhancedDataResponse{record}, reject)
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("insertToDb() = %d stored, %v", len(stored), err)
+	}
+
+	var temperature, pm25, humidity, pm10 sql.NullFloat64
+	if err := db.QueryRow("SELECT temperature, pm25, humidity, pm10 FROM air_quality").
+		Scan(&temperature, &pm25, &humidity, &pm10); err != nil {
+		t.Fatal(err)
+	}
+	if !temperature.Valid || temperature.Float64 != 0 || !pm25.Valid || pm25.Float64 != 12 {
+		t.Errorf("reported measurements = %v, %v, want 0 and 12", temperature, pm25)
+	}
+	if humidity.Valid || pm10.Valid {
+		t.Errorf("unreported measurements = %v, %v, want NULL", humidity, pm10)
+	}
+
+	// read back, the unreported measurements have no unit
+	page, err := queryReadings(db, 1, time.Time{}, time.Time{}, 10, 0)
+	if err != nil || len(page.Items) != 1 {
+		t.Fatalf("queryReadings() = %+v, %v", page, err)
+	}
+	r := page.Items[0]
+	if !r.Reported("temperature") || !r.Reported("pm25") || r.Reported("humidity") || r.Reported("pm10") {
+		t.Errorf("read back units = %v", r.Units)
+	}
+}
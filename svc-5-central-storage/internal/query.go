@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"database/sql"
+	"log/slog"
+	"strings"
+	"time"
+
+	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
+	dpapi "github.com/etesami/air-quality-monitoring/api/data-processing"
+)
+
+// measurementColumns selects the measurements of a reading. The ones a station did not
+// report are NULL and read as 0, the units of the reading tell them apart.
+const measurementColumns = `COALESCE(dewPoint, 0), COALESCE(humidity, 0), COALESCE(pressure, 0), COALESCE(temperature, 0),
+	COALESCE(windSpeed, 0), COALESCE(windGust, 0), COALESCE(pm25, 0), COALESCE(pm10, 0)`
+
+// queryStations returns a page of stations ordered by their index
+func queryStations(db *sql.DB, limit, offset int) (*agapi.Page[dpapi.City], error) {
+	page := &agapi.Page[dpapi.City]{Items: make([]dpapi.City, 0), Limit: limit, Offset: offset}
+	if err := db.QueryRow("SELECT COUNT(*) FROM city").Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT idx, cityName, lat, lng FROM city ORDER BY idx LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var city dpapi.City
+		if err := rows.Scan(&city.Idx, &city.CityName, &city.Lat, &city.Lng); err != nil {
+			slog.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		page.Items = append(page.Items, city)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Error iterating rows", "error", err)
+		return nil, err
+	}
+	return page, nil
+}
+
+// queryStation returns a single station, nil if it does not exist
+func queryStation(db *sql.DB, idx int64) (*dpapi.City, error) {
+	city := &dpapi.City{}
+	err := db.QueryRow("SELECT idx, cityName, lat, lng FROM city WHERE idx = ?", idx).
+		Scan(&city.Idx, &city.CityName, &city.Lat, &city.Lng)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return city, nil
+}
+
+// queryReadings returns a page of readings of a station within [from, to), ordered by time.
+// Zero times leave the range open.
+func queryReadings(db *sql.DB, idx int64, from, to time.Time, limit, offset int) (*agapi.Page[dpapi.AirQualityData], error) {
+	conds := []string{"city_id = ?"}
+	args := []any{idx}
+	if !from.IsZero() {
+		conds = append(conds, "datetime(timestamp) >= datetime(?)")
+		args = append(args, from.Format(time.RFC3339))
+	}
+	if !to.IsZero() {
+		conds = append(conds, "datetime(timestamp) < datetime(?)")
+		args = append(args, to.Format(time.RFC3339))
+	}
+	where := " WHERE " + strings.Join(conds, " AND ")
+
+	page := &agapi.Page[dpapi.AirQualityData]{Items: make([]dpapi.AirQualityData, 0), Limit: limit, Offset: offset}
+	if err := db.QueryRow("SELECT COUNT(*) FROM air_quality"+where, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT timestamp, aqi, `+measurementColumns+`, units
+		FROM air_quality`+where+" ORDER BY datetime(timestamp) LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg dpapi.AirQualityData
+		var u sql.NullString
+		if err := rows.Scan(&msg.Timestamp, &msg.Aqi, &msg.DewPoint, &msg.Humidity, &msg.Pressure,
+			&msg.Temperature, &msg.WindSpeed, &msg.WindGust, &msg.PM25, &msg.PM10, &u); err != nil {
+			slog.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		msg.Units = parseUnits(u)
+		page.Items = append(page.Items, msg)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Error iterating rows", "error", err)
+		return nil, err
+	}
+	return page, nil
+}
+
+// queryAlerts returns a page of alerts ordered by their effective time, newest first.
+// A non-zero activeAt keeps only the alerts not yet expired at that time and
+// a non-zero idx keeps only the alerts of that station.
+func queryAlerts(db *sql.DB, idx int64, activeAt time.Time, limit, offset int) (*agapi.Page[agapi.StationAlert], error) {
+	conds := make([]string, 0)
+	args := make([]any, 0)
+	if idx != 0 {
+		conds = append(conds, "city_id = ?")
+		args = append(args, idx)
+	}
+	if !activeAt.IsZero() {
+		conds = append(conds, "datetime(alertExpires) > datetime(?)")
+		args = append(args, activeAt.Format(time.RFC3339))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	page := &agapi.Page[agapi.StationAlert]{Items: make([]agapi.StationAlert, 0), Limit: limit, Offset: offset}
+	if err := db.QueryRow("SELECT COUNT(*) FROM alert"+where, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT city_id, alertDesc, alertEffective, alertExpires, alertStatus, alertCertainty,
+			alertUrgency, alertSeverity, alertHeadline, alertDescription, alertEvent
+		FROM alert`+where+" ORDER BY datetime(alertEffective) DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a agapi.StationAlert
+		if err := rows.Scan(&a.Idx, &a.AlertDesc, &a.AlertEffective, &a.AlertExpires,
+			&a.AlertStatus, &a.AlertCertainty, &a.AlertUrgency, &a.AlertSeverity,
+			&a.AlertHeadline, &a.AlertDescription, &a.AlertEvent); err != nil {
+			slog.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		page.Items = append(page.Items, a)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Error iterating rows", "error", err)
+		return nil, err
+	}
+	return page, nil
+}
+
+// queryChanges returns the readings and alerts inserted after the given row ids along with
+// their stations. A non-zero from skips the readings taken before it and the alerts expired
+// before it, the cursors still move past them.
+func queryChanges(db *sql.DB, readingsSince, alertsSince int64, from time.Time, limit int) (*agapi.Changes, error) {
+	changes := &agapi.Changes{
+		ReadingsCursor: readingsSince,
+		AlertsCursor:   alertsSince,
+		Stations:       make([]dpapi.City, 0),
+		Readings:       make([]agapi.StationReading, 0),
+		Alerts:         make([]agapi.StationAlert, 0),
+	}
+
+	maxReading, maxAlert, err := maxRowids(db)
+	if err != nil {
+		return nil, err
+	}
+	if readingsSince > maxReading || alertsSince > maxAlert {
+		changes.Reset = true
+		return changes, nil
+	}
+
+	stations := make(map[int64]bool)
+
+	// Scan one more row than the limit to learn whether there are more
+	rows, err := db.Query(`SELECT rowid, city_id, timestamp, aqi, `+measurementColumns+`, units
+		FROM air_quality WHERE rowid > ? ORDER BY rowid LIMIT ?`, readingsSince, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if len(changes.Readings) == limit {
+			changes.More = true
+			break
+		}
+		var rowid int64
+		var r agapi.StationReading
+		var u sql.NullString
+		if err := rows.Scan(&rowid, &r.Idx, &r.Timestamp, &r.Aqi, &r.DewPoint, &r.Humidity, &r.Pressure,
+			&r.Temperature, &r.WindSpeed, &r.WindGust, &r.PM25, &r.PM10, &u); err != nil {
+			slog.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		r.Units = parseUnits(u)
+		changes.ReadingsCursor = rowid
+		if !from.IsZero() {
+			if t, err := time.Parse(time.RFC3339, r.Timestamp); err == nil && t.Before(from) {
+				continue
+			}
+		}
+		changes.Readings = append(changes.Readings, r)
+		stations[r.Idx] = true
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Error iterating rows", "error", err)
+		return nil, err
+	}
+
+	rows, err = db.Query(`SELECT rowid, city_id, alertDesc, alertEffective, alertExpires, alertStatus, alertCertainty,
+			alertUrgency, alertSeverity, alertHeadline, alertDescription, alertEvent
+		FROM alert WHERE rowid > ? ORDER BY rowid LIMIT ?`, alertsSince, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := 0
+	for rows.Next() {
+		if alerts == limit {
+			changes.More = true
+			break
+		}
+		alerts++
+		var rowid int64
+		var a agapi.StationAlert
+		if err := rows.Scan(&rowid, &a.Idx, &a.AlertDesc, &a.AlertEffective, &a.AlertExpires,
+			&a.AlertStatus, &a.AlertCertainty, &a.AlertUrgency, &a.AlertSeverity,
+			&a.AlertHeadline, &a.AlertDescription, &a.AlertEvent); err != nil {
+			slog.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		changes.AlertsCursor = rowid
+		if !from.IsZero() {
+			if t, err := time.Parse(time.RFC3339, a.AlertExpires); err == nil && t.Before(from) {
+				continue
+			}
+		}
+		changes.Alerts = append(changes.Alerts, a)
+		stations[a.Idx] = true
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Error iterating rows", "error", err)
+		return nil, err
+	}
+
+	for idx := range stations {
+		city, err := queryStation(db, idx)
+		if err != nil {
+			return nil, err
+		}
+		if city != nil {
+			changes.Stations = append(changes.Stations, *city)
+		}
+	}
+	return changes, nil
+}
+
+// maxRowids returns the row ids of the last inserted reading and alert, the latest cursors
+func maxRowids(db *sql.DB) (int64, int64, error) {
+	var maxReading, maxAlert int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(rowid), 0) FROM air_quality").Scan(&maxReading); err != nil {
+		return 0, 0, err
+	}
+	if err := db.QueryRow("SELECT COALESCE(MAX(rowid), 0) FROM alert").Scan(&maxAlert); err != nil {
+		return 0, 0, err
+	}
+	return maxReading, maxAlert, nil
+}
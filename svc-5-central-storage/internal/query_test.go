@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
+	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
+)
+
+// testSchema is the schema of the central storage, as created by the service
+var testSchema = []string{
+	`CREATE TABLE air_quality (
+		hash TEXT PRIMARY KEY UNIQUE, aqi INTEGER, timestamp DATETIME, dewPoint REAL, humidity REAL,
+		pressure REAL, temperature REAL, windSpeed REAL, windGust REAL, pm25 REAL, pm10 REAL,
+		units TEXT, lineage TEXT, city_id INTEGER)`,
+	`CREATE TABLE city (idx INTEGER PRIMARY KEY UNIQUE, cityName TEXT, lat REAL, lng REAL)`,
+	`CREATE TABLE alert (
+		hash TEXT PRIMARY KEY UNIQUE, alertDesc TEXT, alertEffective DATETIME, alertExpires DATETIME,
+		alertStatus TEXT, alertCertainty TEXT, alertUrgency TEXT, alertSeverity TEXT,
+		alertHeadline TEXT, alertDescription TEXT, alertEvent TEXT, city_id INTEGER)`,
+}
+
+// testDB returns an empty in-memory central storage database. Its cache is shared
+// by the connections of db, the queries hold more than one.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	name := url.PathEscape(t.Name())
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=memory&cache=shared", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the database is dropped along with its last connection
+	db.SetMaxIdleConns(4)
+	t.Cleanup(func() { db.Close() })
+	for _, q := range testSchema {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("creating the schema: %v", err)
+		}
+	}
+	return db
+}
+
+// exec runs the statements on db, failing the test on errors
+func exec(t *testing.T, db *sql.DB, query string, args ...any) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+// addCity inserts a station
+func addCity(t *testing.T, db *sql.DB, idx int64, name string) {
+	t.Helper()
+	exec(t, db, "INSERT INTO city (idx, cityName, lat, lng) VALUES (?, ?, ?, ?)", idx, name, float64(idx), -float64(idx))
+}
+
+// addReading inserts a reading of station idx taken at ts, its aqi tells the readings apart
+func addReading(t *testing.T, db *sql.DB, idx int64, ts string, aqi int64) {
+	t.Helper()
+	exec(t, db, `INSERT INTO air_quality (hash, aqi, timestamp, dewPoint, humidity, pressure, temperature,
+		windSpeed, windGust, pm25, pm10, units, city_id) VALUES (?, ?, ?, 1, 2, 1013, 20, 3, 4, 5, 6, '{"pm25":"µg/m³"}', ?)`,
+		fmt.Sprintf("%s-%d", ts, aqi), aqi, ts, idx)
+}
+
+// addAlert inserts an alert of station idx described by desc
+func addAlert(t *testing.T, db *sql.DB, idx int64, desc, effective, expires string) {
+	t.Helper()
+	exec(t, db, `INSERT INTO alert (hash, alertDesc, alertEffective, alertExpires, alertStatus, alertCertainty,
+		alertUrgency, alertSeverity, alertHeadline, alertDescription, alertEvent, city_id)
+		VALUES (?, ?, ?, ?, 'Actual', 'Likely', 'Expected', 'Moderate', 'headline', 'description', 'event', ?)`,
+		desc, desc, effective, expires, idx)
+}
+
+func readingAqis(c *agapi.Changes) []int64 {
+	var aqis []int64
+	for _, r := range c.Readings {
+		aqis = append(aqis, r.Aqi)
+	}
+	return aqis
+}
+
+func alertDescs(c *agapi.Changes) []string {
+	var descs []string
+	for _, a := range c.Alerts {
+		descs = append(descs, a.AlertDesc)
+	}
+	return descs
+}
+
+func stationIdxs(c *agapi.Changes) []int64 {
+	var idxs []int64
+	for _, s := range c.Stations {
+		idxs = append(idxs, s.Idx)
+	}
+	slices.Sort(idxs)
+	return idxs
+}
+
+func TestQueryChangesPaging(t *testing.T) {
+	db := testDB(t)
+	addCity(t, db, 1, "one")
+	addCity(t, db, 2, "two")
+	addCity(t, db, 3, "three")
+	addReading(t, db, 1, "2024-01-01T00:00:00Z", 11)
+	addReading(t, db, 2, "2024-01-01T00:00:00Z", 21)
+	addReading(t, db, 1, "2024-01-01T01:00:00Z", 12)
+	addReading(t, db, 3, "2024-01-01T01:00:00Z", 31)
+	addReading(t, db, 2, "2024-01-01T02:00:00Z", 22)
+	addAlert(t, db, 3, "a", "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z")
+	addAlert(t, db, 3, "b", "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z")
+	addAlert(t, db, 2, "c", "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z")
+
+	pages := []struct {
+		wantReadings       []int64
+		wantAlerts         []string
+		wantStations       []int64
+		wantReadingsCursor int64
+		wantAlertsCursor   int64
+		wantMore           bool
+	}{
+		{wantReadings: []int64{11, 21}, wantAlerts: []string{"a", "b"}, wantStations: []int64{1, 2, 3},
+			wantReadingsCursor: 2, wantAlertsCursor: 2, wantMore: true},
+		{wantReadings: []int64{12, 31}, wantAlerts: []string{"c"}, wantStations: []int64{1, 2, 3},
+			wantReadingsCursor: 4, wantAlertsCursor: 3, wantMore: true},
+		{wantReadings: []int64{22}, wantStations: []int64{2},
+			wantReadingsCursor: 5, wantAlertsCursor: 3},
+		// caught up, the cursors stay
+		{wantReadingsCursor: 5, wantAlertsCursor: 3},
+	}
+	var readingsSince, alertsSince int64
+	for i, p := range pages {
+		c, err := queryChanges(db, readingsSince, alertsSince, time.Time{}, 2)
+		if err != nil {
+			t.Fatalf("page %d: queryChanges(): %v", i, err)
+		}
+		if got := readingAqis(c); !slices.Equal(got, p.wantReadings) {
+			t.Errorf("page %d: readings = %v, want %v", i, got, p.wantReadings)
+		}
+		if got := alertDescs(c); !slices.Equal(got, p.wantAlerts) {
+			t.Errorf("page %d: alerts = %v, want %v", i, got, p.wantAlerts)
+		}
+		if got := stationIdxs(c); !slices.Equal(got, p.wantStations) {
+			t.Errorf("page %d: stations = %v, want %v", i, got, p.wantStations)
+		}
+		if c.ReadingsCursor != p.wantReadingsCursor || c.AlertsCursor != p.wantAlertsCursor || c.More != p.wantMore || c.Reset {
+			t.Errorf("page %d: cursors = %d, %d, more %v, reset %v, want %d, %d, more %v", i,
+				c.ReadingsCursor, c.AlertsCursor, c.More, c.Reset, p.wantReadingsCursor, p.wantAlertsCursor, p.wantMore)
+		}
+		readingsSince, alertsSince = c.ReadingsCursor, c.AlertsCursor
+	}
+
+	// rows inserted after catching up come as the next changes
+	addReading(t, db, 3, "2024-01-01T03:00:00Z", 32)
+	c, err := queryChanges(db, readingsSince, alertsSince, time.Time{}, 2)
+	if err != nil {
+		t.Fatalf("queryChanges(): %v", err)
+	}
+	if got := readingAqis(c); !slices.Equal(got, []int64{32}) || c.ReadingsCursor != 6 || c.More {
+		t.Errorf("new reading: readings = %v, cursor %d, more %v", got, c.ReadingsCursor, c.More)
+	}
+}
+
+func TestQueryChangesFrom(t *testing.T) {
+	db := testDB(t)
+	addCity(t, db, 1, "one")
+	addReading(t, db, 1, "2024-01-01T00:00:00Z", 1)
+	addReading(t, db, 1, "2024-01-03T00:00:00Z", 2)
+	addReading(t, db, 1, "2024-01-01T12:00:00Z", 3)
+	addAlert(t, db, 1, "expired", "2024-01-01T00:00:00Z", "2024-01-01T06:00:00Z")
+	addAlert(t, db, 1, "active", "2024-01-01T00:00:00Z", "2024-01-05T00:00:00Z")
+
+	c, err := queryChanges(db, 0, 0, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), 10)
+	if err != nil {
+		t.Fatalf("queryChanges(): %v", err)
+	}
+	if got := readingAqis(c); !slices.Equal(got, []int64{2}) {
+		t.Errorf("readings = %v, want [2]", got)
+	}
+	if got := alertDescs(c); !slices.Equal(got, []string{"active"}) {
+		t.Errorf("alerts = %v, want [active]", got)
+	}
+	// the cursors move past the skipped rows
+	if c.ReadingsCursor != 3 || c.AlertsCursor != 2 {
+		t.Errorf("cursors = %d, %d, want 3, 2", c.ReadingsCursor, c.AlertsCursor)
+	}
+}
+
+func TestQueryChangesReset(t *testing.T) {
+	db := testDB(t)
+	addCity(t, db, 1, "one")
+	addReading(t, db, 1, "2024-01-01T00:00:00Z", 1)
+	addAlert(t, db, 1, "a", "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z")
+
+	tests := []struct {
+		name          string
+		readingsSince int64
+		alertsSince   int64
+		wantReset     bool
+	}{
+		{name: "up to date", readingsSince: 1, alertsSince: 1},
+		{name: "readings ahead", readingsSince: 2, alertsSince: 1, wantReset: true},
+		{name: "alerts ahead", readingsSince: 1, alertsSince: 5, wantReset: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := queryChanges(db, tt.readingsSince, tt.alertsSince, time.Time{}, 10)
+			if err != nil {
+				t.Fatalf("queryChanges(): %v", err)
+			}
+			if c.Reset != tt.wantReset || len(c.Readings) != 0 || len(c.Alerts) != 0 {
+				t.Errorf("queryChanges() = %+v, want reset %v and no rows", c, tt.wantReset)
+			}
+		})
+	}
+}
+
+func TestServeGeoJSONCursors(t *testing.T) {
+	db := testDB(t)
+	addCity(t, db, 1, "one")
+	addCity(t, db, 2, "two")
+	addReading(t, db, 1, "2024-01-01T00:00:00Z", 1)
+	addReading(t, db, 1, "2024-01-01T01:00:00Z", 2)
+	addAlert(t, db, 2, "a", "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z")
+
+	s := Server{Db: db, Metric: metric.New("test", metric.Buckets{})}
+	rec := httptest.NewRecorder()
+	s.ServeGeoJSON(rec, httptest.NewRequest(http.MethodGet, "/geojson", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("X-Readings-Cursor"); got != "2" {
+		t.Errorf("X-Readings-Cursor = %q, want 2", got)
+	}
+	if got := rec.Header().Get("X-Alerts-Cursor"); got != "1" {
+		t.Errorf("X-Alerts-Cursor = %q, want 1", got)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body is not JSON: %v", err)
+	}
+	for member := range body {
+		if member != "type" && member != "features" {
+			t.Errorf("FeatureCollection has the foreign member %q", member)
+		}
+	}
+	if features, _ := body["features"].([]any); len(features) != 2 {
+		t.Errorf("features = %v, want 2", body["features"])
+	}
+}
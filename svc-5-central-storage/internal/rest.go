@@ -0,0 +1,183 @@
+package internal
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+//go:embed openapi.json
+var openAPIDoc []byte
+
+// RegisterREST registers the HTTP/JSON API of the central storage on mux
+func (s Server) RegisterREST(mux *http.ServeMux) {
+	mux.HandleFunc("GET /v1/openapi.json", s.serveOpenAPI)
+	mux.HandleFunc("GET /v1/stations", s.serveStations)
+	mux.HandleFunc("GET /v1/stations/{idx}", s.serveStation)
+	mux.HandleFunc("GET /v1/stations/{idx}/readings", s.serveReadings)
+	mux.HandleFunc("GET /v1/alerts", s.serveAlerts)
+}
+
+func (s Server) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDoc)
+}
+
+func (s Server) serveStations(w http.ResponseWriter, r *http.Request) {
+	st := time.Now()
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	page, err := queryStations(s.Db, limit, offset)
+	if err != nil {
+		slog.Error("Error requesting stations", "error", err)
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("error requesting stations"))
+		return
+	}
+	s.Metric.AddProcessingTime("rest", float64(time.Since(st).Milliseconds())/1000.0)
+	writeJSON(w, page)
+}
+
+func (s Server) serveStation(w http.ResponseWriter, r *http.Request) {
+	idx, err := strconv.ParseInt(r.PathValue("idx"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid station index: %v", err))
+		return
+	}
+	city, err := queryStation(s.Db, idx)
+	if err != nil {
+		slog.Error("Error requesting station", "station", idx, "error", err)
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("error requesting station"))
+		return
+	}
+	if city == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("station [%d] not found", idx))
+		return
+	}
+	writeJSON(w, city)
+}
+
+func (s Server) serveReadings(w http.ResponseWriter, r *http.Request) {
+	st := time.Now()
+	idx, err := strconv.ParseInt(r.PathValue("idx"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid station index: %v", err))
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	page, err := queryReadings(s.Db, idx, from, to, limit, offset)
+	if err != nil {
+		slog.Error("Error requesting readings of station", "station", idx, "error", err)
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("error requesting readings"))
+		return
+	}
+	s.Metric.AddProcessingTime("rest", float64(time.Since(st).Milliseconds())/1000.0)
+	writeJSON(w, page)
+}
+
+func (s Server) serveAlerts(w http.ResponseWriter, r *http.Request) {
+	st := time.Now()
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var idx int64
+	if v := r.URL.Query().Get("idx"); v != "" {
+		if idx, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid station index: %v", err))
+			return
+		}
+	}
+	var activeAt time.Time
+	if v := r.URL.Query().Get("active"); v != "" {
+		active, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid active flag: %v", err))
+			return
+		}
+		if active {
+			activeAt = time.Now()
+		}
+	}
+	page, err := queryAlerts(s.Db, idx, activeAt, limit, offset)
+	if err != nil {
+		slog.Error("Error requesting alerts", "error", err)
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("error requesting alerts"))
+		return
+	}
+	s.Metric.AddProcessingTime("rest", float64(time.Since(st).Milliseconds())/1000.0)
+	writeJSON(w, page)
+}
+
+// parsePagination reads the limit and offset query parameters
+func parsePagination(r *http.Request) (int, int, error) {
+	limit, offset := defaultPageLimit, 0
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 || l > maxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		limit = l
+	}
+	if v := q.Get("offset"); v != "" {
+		o, err := strconv.Atoi(v)
+		if err != nil || o < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+		offset = o
+	}
+	return limit, offset, nil
+}
+
+// parseTimeParam reads an optional RFC3339 query parameter
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s timestamp: %v", name, err)
+	}
+	return t, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
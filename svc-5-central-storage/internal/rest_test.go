@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
+	dpapi "github.com/etesami/air-quality-monitoring/api/data-processing"
+	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
+)
+
+// restServer serves the REST API of a central storage holding three stations,
+// the readings of station 1 and alerts of stations 1 and 2
+func restServer(t *testing.T) http.Handler {
+	t.Helper()
+	db := testDB(t)
+	for idx, name := range map[int64]string{1: "one", 2: "two", 3: "three"} {
+		addCity(t, db, idx, name)
+	}
+	for h := 0; h < 5; h++ {
+		addReading(t, db, 1, time.Date(2024, 1, 1, h, 0, 0, 0, time.UTC).Format(time.RFC3339), int64(10+h))
+	}
+	addReading(t, db, 2, "2024-01-01T00:00:00Z", 20)
+	now := time.Now().UTC()
+	addAlert(t, db, 1, "expired", now.Add(-48*time.Hour).Format(time.RFC3339), now.Add(-24*time.Hour).Format(time.RFC3339))
+	addAlert(t, db, 1, "active", now.Add(-time.Hour).Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339))
+	addAlert(t, db, 2, "other", now.Add(-2*time.Hour).Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339))
+
+	mux := http.NewServeMux()
+	Server{Db: db, Metric: metric.New("test", metric.Buckets{})}.RegisterREST(mux)
+	return mux
+}
+
+// get serves a GET of target and decodes the JSON response into v
+func get(t *testing.T, h http.Handler, target string, v any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: Content-Type = %q", target, ct)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("%s: response is not JSON: %v: %s", target, err, rec.Body)
+	}
+	return rec.Code
+}
+
+func TestRESTStations(t *testing.T) {
+	h := restServer(t)
+	tests := []struct {
+		target    string
+		wantIdxs  []int64
+		wantTotal int
+		wantLimit int
+	}{
+		{target: "/v1/stations", wantIdxs: []int64{1, 2, 3}, wantTotal: 3, wantLimit: defaultPageLimit},
+		{target: "/v1/stations?limit=2", wantIdxs: []int64{1, 2}, wantTotal: 3, wantLimit: 2},
+		{target: "/v1/stations?limit=2&offset=2", wantIdxs: []int64{3}, wantTotal: 3, wantLimit: 2},
+		{target: "/v1/stations?offset=5", wantIdxs: nil, wantTotal: 3, wantLimit: defaultPageLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			var page agapi.Page[dpapi.City]
+			if code := get(t, h, tt.target, &page); code != http.StatusOK {
+				t.Fatalf("status = %d", code)
+			}
+			var idxs []int64
+			for _, c := range page.Items {
+				idxs = append(idxs, c.Idx)
+			}
+			if !slices.Equal(idxs, tt.wantIdxs) || page.Total != tt.wantTotal || page.Limit != tt.wantLimit {
+				t.Errorf("page = %v, total %d, limit %d, want %v, total %d, limit %d",
+					idxs, page.Total, page.Limit, tt.wantIdxs, tt.wantTotal, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestRESTStation(t *testing.T) {
+	h := restServer(t)
+	var city dpapi.City
+	if code := get(t, h, "/v1/stations/2", &city); code != http.StatusOK || city.Idx != 2 || city.CityName != "two" {
+		t.Errorf("station 2 = %d %+v", code, city)
+	}
+	var e map[string]string
+	if code := get(t, h, "/v1/stations/404", &e); code != http.StatusNotFound || !strings.Contains(e["error"], "not found") {
+		t.Errorf("missing station = %d %v", code, e)
+	}
+}
+
+func TestRESTReadings(t *testing.T) {
+	h := restServer(t)
+	tests := []struct {
+		target    string
+		wantAqis  []int64
+		wantTotal int
+	}{
+		{target: "/v1/stations/1/readings", wantAqis: []int64{10, 11, 12, 13, 14}, wantTotal: 5},
+		{target: "/v1/stations/1/readings?limit=2&offset=1", wantAqis: []int64{11, 12}, wantTotal: 5},
+		{target: "/v1/stations/1/readings?from=2024-01-01T01:00:00Z&to=2024-01-01T03:00:00Z", wantAqis: []int64{11, 12}, wantTotal: 2},
+		{target: "/v1/stations/1/readings?from=2024-01-01T03:00:00Z", wantAqis: []int64{13, 14}, wantTotal: 2},
+		{target: "/v1/stations/2/readings", wantAqis: []int64{20}, wantTotal: 1},
+		{target: "/v1/stations/3/readings", wantTotal: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			var page agapi.Page[dpapi.AirQualityData]
+			if code := get(t, h, tt.target, &page); code != http.StatusOK {
+				t.Fatalf("status = %d", code)
+			}
+			var aqis []int64
+			for _, r := range page.Items {
+				aqis = append(aqis, r.Aqi)
+			}
+			if !slices.Equal(aqis, tt.wantAqis) || page.Total != tt.wantTotal {
+				t.Errorf("page = %v, total %d, want %v, total %d", aqis, page.Total, tt.wantAqis, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestRESTAlerts(t *testing.T) {
+	h := restServer(t)
+	tests := []struct {
+		target    string
+		wantDescs []string
+		wantTotal int
+	}{
+		{target: "/v1/alerts", wantDescs: []string{"active", "other", "expired"}, wantTotal: 3},
+		{target: "/v1/alerts?active=true", wantDescs: []string{"active", "other"}, wantTotal: 2},
+		{target: "/v1/alerts?active=false", wantDescs: []string{"active", "other", "expired"}, wantTotal: 3},
+		{target: "/v1/alerts?idx=1", wantDescs: []string{"active", "expired"}, wantTotal: 2},
+		{target: "/v1/alerts?idx=1&active=1", wantDescs: []string{"active"}, wantTotal: 1},
+		{target: "/v1/alerts?limit=1&offset=1", wantDescs: []string{"other"}, wantTotal: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			var page agapi.Page[agapi.StationAlert]
+			if code := get(t, h, tt.target, &page); code != http.StatusOK {
+				t.Fatalf("status = %d", code)
+			}
+			var descs []string
+			for _, a := range page.Items {
+				descs = append(descs, a.AlertDesc)
+			}
+			if !slices.Equal(descs, tt.wantDescs) || page.Total != tt.wantTotal {
+				t.Errorf("page = %v, total %d, want %v, total %d", descs, page.Total, tt.wantDescs, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestRESTBadRequests(t *testing.T) {
+	h := restServer(t)
+	tests := []struct {
+		target  string
+		wantErr string
+	}{
+		{target: "/v1/stations?limit=0", wantErr: "limit must be between 1 and 1000"},
+		{target: "/v1/stations?limit=1001", wantErr: "limit must be between 1 and 1000"},
+		{target: "/v1/stations?limit=ten", wantErr: "limit must be between 1 and 1000"},
+		{target: "/v1/stations?offset=-1", wantErr: "offset must be a non-negative integer"},
+		{target: "/v1/stations/one", wantErr: "invalid station index"},
+		{target: "/v1/stations/one/readings", wantErr: "invalid station index"},
+		{target: "/v1/stations/1/readings?from=yesterday", wantErr: "invalid from timestamp"},
+		{target: "/v1/stations/1/readings?to=2024-01-01", wantErr: "invalid to timestamp"},
+		{target: "/v1/alerts?idx=one", wantErr: "invalid station index"},
+		{target: "/v1/alerts?active=maybe", wantErr: "invalid active flag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			var e map[string]string
+			if code := get(t, h, tt.target, &e); code != http.StatusBadRequest || !strings.Contains(e["error"], tt.wantErr) {
+				t.Errorf("response = %d %v, want 400 %q", code, e, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,92 +1,147 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"flag"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"time"
 
-	api "github.com/etesami/air-quality-monitoring/api"
+	config "github.com/etesami/air-quality-monitoring/pkg/config"
+	grpcclient "github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	health "github.com/etesami/air-quality-monitoring/pkg/health"
+	logging "github.com/etesami/air-quality-monitoring/pkg/logging"
 	metric "github.com/etesami/air-quality-monitoring/pkg/metric"
-	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
-	utils "github.com/etesami/air-quality-monitoring/pkg/utils"
+	shutdown "github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	tracing "github.com/etesami/air-quality-monitoring/pkg/tracing"
 	internal "github.com/etesami/air-quality-monitoring/svc-data-dashboard/internal"
-
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 func main() {
 
-	sentDataBuckets := utils.ParseBuckets(os.Getenv("SENT_DATA_BUCKETS"))
-	procTimeBuckets := utils.ParseBuckets(os.Getenv("PROC_TIME_BUCKETS"))
-	rttTimeBuckets := utils.ParseBuckets(os.Getenv("RTT_TIME_BUCKETS"))
-
-	m := &metric.Metric{}
-	m.RegisterMetrics(sentDataBuckets, procTimeBuckets, rttTimeBuckets)
+	// "tui" runs the dashboard in the terminal instead of serving it over HTTP
+	tuiMode := len(os.Args) > 1 && os.Args[1] == "tui"
+	tuiFlags := flag.NewFlagSet("tui", flag.ExitOnError)
+	tuiRefresh := tuiFlags.Duration("refresh", time.Second, "screen redraw interval")
+	tuiHours := tuiFlags.Int("hours", 24, "history window of the PM2.5 sparklines in hours")
+	tuiLog := tuiFlags.String("log", "", "file to write the logs to, discarded if empty")
+	fs, args := flag.CommandLine, os.Args[1:]
+	if tuiMode {
+		fs, args = tuiFlags, os.Args[2:]
+	}
 
-	// Aggregated storage service initialization
-	svcTargetAggrAddress := os.Getenv("SVC_AGGR_STRG_ADDR")
-	svcTargetAggrPort := os.Getenv("SVC_AGGR_STRG_PORT")
-	targetSvc := &api.Service{
-		Address: svcTargetAggrAddress,
-		Port:    svcTargetAggrPort,
+	cfg := &internal.Config{}
+	if err := config.Load(cfg, fs, args); err != nil {
+		log.Fatalf("Error loading config: %v", err)
 	}
+	logging.Setup("dashboard", cfg.Log)
 
-	var conn *grpc.ClientConn
-	var client pb.AirQualityMonitoringClient
-	go func() {
-		for {
-			if err := targetSvc.ServiceReachable(); err == nil {
-				var err error
-				conn, err = grpc.NewClient(
-					targetSvc.Address+":"+targetSvc.Port,
-					grpc.WithTransportCredentials(insecure.NewCredentials()))
-				if err != nil {
-					log.Printf("Failed to connect to target service: %v", err)
-					return
-				}
-				client = pb.NewAirQualityMonitoringClient(conn)
-				log.Printf("Connected to target service: %s:%s\n", targetSvc.Address, targetSvc.Port)
-				return
-			} else {
-				log.Printf("Target service is not reachable: %v", err)
-				time.Sleep(5 * time.Second)
-			}
-		}
-	}()
-	defer conn.Close()
+	ctx, stop := shutdown.Signals()
+	defer stop()
 
-	// First call to processTicker
-	if err := internal.ProcessTicker(&client, "central-storage", m); err != nil {
-		log.Printf("Error during processing: %v", err)
+	shutdownTracing, err := tracing.Setup(context.Background(), "dashboard", cfg.Tracing)
+	if err != nil {
+		logging.Fatal("Error setting up tracing", "error", err)
 	}
 
-	updateFrequencyStr := os.Getenv("UPDATE_FREQUENCY")
-	updateFrequency, err := strconv.Atoi(updateFrequencyStr)
+	m := metric.New("dashboard", metric.Buckets{
+		SentData: cfg.Metrics.SentDataBuckets,
+		ProcTime: cfg.Metrics.ProcTimeBuckets,
+		RttTime:  cfg.Metrics.RttTimeBuckets,
+		Latency:  cfg.Metrics.LatencyBuckets,
+	})
+
+	// Aggregated storage service initialization, the calls to it wait for it to be ready
+	client, err := grpcclient.New("central-storage", cfg.CentralStorage.HostPort(), cfg.Client, m)
 	if err != nil {
-		log.Fatalf("Error parsing update frequency: %v", err)
+		logging.Fatal("Failed to create the client of target service", "error", err)
+	}
+
+	d := &internal.Dashboard{Client: client, Metric: m, History: cfg.Dashboard.History.Duration()}
+
+	// First call to processTicker
+	if err := internal.ProcessTicker(client, "central-storage", m, d); err != nil {
+		slog.Error("Error during processing", "error", err)
 	}
 
-	go func(m *metric.Metric, c *pb.AirQualityMonitoringClient, u int) {
+	go func(m *metric.Metrics, c *grpcclient.Client, u time.Duration) {
 		// Target local storage service initialization
-		ticker := time.NewTicker(time.Duration(u) * time.Second)
+		ticker := time.NewTicker(u)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			if err := internal.ProcessTicker(c, "central-storage", m); err != nil {
-				log.Printf("Error during processing: %v", err)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := internal.ProcessTicker(c, "central-storage", m, d); err != nil {
+				slog.Error("Error during processing", "error", err)
+			}
+		}
+
+	}(m, client, cfg.UpdateFrequency.Duration())
+
+	if tuiMode {
+		// Logs would scroll the screen away
+		logOut := io.Discard
+		if *tuiLog != "" {
+			f, err := os.OpenFile(*tuiLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				logging.Fatal("Error opening log file", "error", err)
 			}
+			defer f.Close()
+			logOut = f
+		}
+		slog.SetDefault(logging.New(logOut, "dashboard", cfg.Log))
+
+		tui := &internal.TUI{Dashboard: d, Out: os.Stdout, Hours: *tuiHours}
+		err := tui.Run(ctx, *tuiRefresh)
+		logging.Setup("dashboard", cfg.Log)
+		if err != nil {
+			logging.Fatal("Error running terminal UI", "error", err)
 		}
+		shutdown.Run(cfg.Shutdown.Timeout.Duration(),
+			shutdown.Close("central storage client", client),
+			shutdown.Step{Name: "tracing", Stop: shutdownTracing},
+		)
+		return
+	}
 
-	}(m, &client, updateFrequency)
+	checker := health.New(cfg.Health)
+	// The readings already received are still served while central storage is away
+	checker.Watch("central-storage", health.Serving(client.Conn(), ""))
+	go checker.Run(ctx)
+
+	dashboardServer := &http.Server{Addr: net.JoinHostPort(cfg.Dashboard.Address, cfg.Dashboard.Port), Handler: d.Handler()}
+	go func() {
+		slog.Info("Starting dashboard", "port", cfg.Dashboard.Port)
+		if err := dashboardServer.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatal("Error starting dashboard", "error", err)
+		}
+	}()
+
+	http.Handle("/metrics", m.Handler())
+	checker.RegisterHTTP(http.DefaultServeMux)
+	metricsServer := &http.Server{Addr: cfg.Metrics.HostPort()}
+	go func() {
+		slog.Info("Starting metrics server", "port", cfg.Metrics.Port)
+		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatal("Error starting metrics server", "error", err)
+		}
+	}()
 
-	metricAddr := os.Getenv("METRIC_ADDR")
-	metricPort := os.Getenv("METRIC_PORT")
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Starting server on :%s\n", metricPort)
-	http.ListenAndServe(fmt.Sprintf("%s:%s", metricAddr, metricPort), nil)
+	// On SIGTERM the dashboard stops taking requests and finishes the ones in flight
+	<-ctx.Done()
+	shutdown.Run(cfg.Shutdown.Timeout.Duration(),
+		shutdown.Do("health", checker.Shutdown),
+		shutdown.HTTP("dashboard server", dashboardServer),
+		shutdown.Close("central storage client", client),
+		shutdown.HTTP("metrics server", metricsServer),
+		shutdown.Step{Name: "tracing", Stop: shutdownTracing},
+	)
 }
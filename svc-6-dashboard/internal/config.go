@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/etesami/air-quality-monitoring/pkg/config"
+	"github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	"github.com/etesami/air-quality-monitoring/pkg/health"
+	"github.com/etesami/air-quality-monitoring/pkg/logging"
+	"github.com/etesami/air-quality-monitoring/pkg/shutdown"
+	"github.com/etesami/air-quality-monitoring/pkg/tracing"
+)
+
+// Config is the configuration of the dashboard service
+type Config struct {
+	CentralStorage  config.Endpoint   `config:"centralStorage" env:"SVC_AGGR_STRG" required:"true"`
+	Client          grpcclient.Config `config:"client" env:"CLIENT"`
+	UpdateFrequency config.Duration   `config:"updateFrequency" env:"UPDATE_FREQUENCY" default:"20s" unit:"s" usage:"interval between syncs with the central storage"`
+	Dashboard       DashboardConfig   `config:"dashboard"`
+	Metrics         config.Metrics    `config:"metrics"`
+	Tracing         tracing.Config    `config:"tracing"`
+	Log             logging.Config    `config:"log"`
+	Health          health.Config     `config:"health"`
+	Shutdown        shutdown.Config   `config:"shutdown"`
+}
+
+// DashboardConfig configures the web UI
+type DashboardConfig struct {
+	Address string          `config:"address" env:"DASHBOARD_ADDR" usage:"address of the web UI"`
+	Port    string          `config:"port" env:"DASHBOARD_PORT" default:"8080" usage:"port of the web UI"`
+	History config.Duration `config:"history" env:"DASHBOARD_HISTORY" default:"24h" usage:"how far back the readings are kept in memory"`
+}
+
+func (c *Config) Validate() error {
+	if c.UpdateFrequency <= 0 {
+		return fmt.Errorf("updateFrequency must be positive")
+	}
+	if c.Dashboard.History <= 0 {
+		return fmt.Errorf("dashboard.history must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
+	dpapi "github.com/etesami/air-quality-monitoring/api/data-processing"
+	loapi "github.com/etesami/air-quality-monitoring/api/local-storage"
+	"github.com/etesami/air-quality-monitoring/pkg/grpcclient"
+	"github.com/etesami/air-quality-monitoring/pkg/logging"
+	"github.com/etesami/air-quality-monitoring/pkg/metric"
+)
+
+//go:embed web
+var webFS embed.FS
+
+// Dashboard keeps an in-memory model of the stations, their latest readings and recent
+// history pulled from the central storage and serves it to browsers along with the embedded web UI
+type Dashboard struct {
+	Client *grpcclient.Client
+	Metric *metric.Metrics
+	// History is how far back the readings of each station are kept in memory
+	History time.Duration
+
+	mu        sync.RWMutex
+	model     *model
+	stations  *agapi.FeatureCollection
+	updated   time.Time
+	lastError string
+	rtt       float64
+}
+
+// Health describes the state of the dashboard and of the pipeline feeding it
+type Health struct {
+	Connected     bool    `json:"connected"`
+	RttMs         float64 `json:"rttMs"`
+	LastRefresh   string  `json:"lastRefresh,omitempty"`
+	LastError     string  `json:"lastError,omitempty"`
+	Stations      int     `json:"stations"`
+	ActiveAlerts  int     `json:"activeAlerts"`
+	LatestReading string  `json:"latestReading,omitempty"`
+	// CachedReadings is the number of readings kept in memory
+	CachedReadings int `json:"cachedReadings"`
+	// FreshnessSec is the age of the most recent reading across all stations
+	FreshnessSec float64 `json:"freshnessSec,omitempty"`
+}
+
+// historyFrom returns the oldest time of the readings kept in memory
+func (d *Dashboard) historyFrom(now time.Time) time.Time {
+	if d.History <= 0 {
+		return now.Add(-24 * time.Hour)
+	}
+	return now.Add(-d.History)
+}
+
+// cursors returns the cursors of the model, and whether it has to be seeded first
+func (d *Dashboard) cursors() (int64, int64, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.model == nil {
+		return 0, 0, false
+	}
+	return d.model.readingsCursor, d.model.alertsCursor, d.model.seeded
+}
+
+// seed replaces the model with the stations of a snapshot
+func (d *Dashboard) seed(snap *agapi.Snapshot) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.model = newModel()
+	d.model.seed(snap)
+}
+
+// reset drops the model, the next sync starts over from a snapshot
+func (d *Dashboard) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.model = nil
+}
+
+// apply merges the changes into the model
+func (d *Dashboard) apply(changes *agapi.Changes) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.model.apply(changes, d.historyFrom(time.Now()))
+}
+
+// refresh prunes the model and materializes the view served to the clients
+func (d *Dashboard) refresh() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.model.prune(d.historyFrom(now), now)
+	d.stations = d.model.view()
+	d.updated = now
+	d.lastError = ""
+}
+
+func (d *Dashboard) setError(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastError = err.Error()
+}
+
+func (d *Dashboard) setRtt(rtt float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rtt = rtt
+}
+
+// Stations returns the latest stations, never nil
+func (d *Dashboard) Stations() *agapi.FeatureCollection {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.stations == nil {
+		return &agapi.FeatureCollection{Type: "FeatureCollection", Features: make([]agapi.Feature, 0)}
+	}
+	return d.stations
+}
+
+// Alerts returns the alerts not yet expired of all stations
+func (d *Dashboard) Alerts() []agapi.StationAlert {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	alerts := make([]agapi.StationAlert, 0)
+	if d.model == nil {
+		return alerts
+	}
+	now := time.Now()
+	for idx, s := range d.model.stations {
+		for _, a := range s.alerts {
+			if t, err := time.Parse(time.RFC3339, a.AlertExpires); err == nil && t.After(now) {
+				alerts = append(alerts, agapi.StationAlert{Idx: idx, Alert: a})
+			}
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].AlertEffective > alerts[j].AlertEffective
+	})
+	return alerts
+}
+
+// Health returns the current state of the dashboard
+func (d *Dashboard) Health() Health {
+	stations := d.Stations()
+
+	d.mu.RLock()
+	h := Health{
+		Connected: d.Client.Ready(),
+		RttMs:     d.rtt,
+		LastError: d.lastError,
+		Stations:  len(stations.Features),
+	}
+	if !d.updated.IsZero() {
+		h.LastRefresh = d.updated.Format(time.RFC3339)
+	}
+	if d.model != nil {
+		for _, s := range d.model.stations {
+			h.CachedReadings += len(s.history)
+		}
+	}
+	d.mu.RUnlock()
+
+	h.ActiveAlerts = len(d.Alerts())
+	var latest time.Time
+	for _, f := range stations.Features {
+		if t, err := time.Parse(time.RFC3339, f.Properties.Timestamp); err == nil && t.After(latest) {
+			latest = t
+		}
+	}
+	if !latest.IsZero() {
+		h.LatestReading = latest.Format(time.RFC3339)
+		h.FreshnessSec = time.Since(latest).Seconds()
+	}
+	return h
+}
+
+// Readings returns the readings of a station over the last given hours, from memory when
+// they are within the history window and from the central storage otherwise. The history
+// of a station requested for the whole window is kept in memory from then on.
+func (d *Dashboard) Readings(idx int64, hours int) (*agapi.Page[dpapi.AirQualityData], error) {
+	now := time.Now()
+	from := now.Add(-time.Duration(hours) * time.Hour)
+	if page, ok := d.cachedReadings(idx, from, now); ok {
+		return page, nil
+	}
+	payload, recBytes, err := requestNewData(d.Client, loapi.DataRequest{
+		RequestType: loapi.RequestReadings,
+		Idx:         idx,
+		StartTime:   from.Format(time.RFC3339),
+		Limit:       1000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	page := &agapi.Page[dpapi.AirQualityData]{Items: make([]dpapi.AirQualityData, 0)}
+	if payload == "" {
+		return page, nil
+	}
+	if err := json.Unmarshal([]byte(payload), page); err != nil {
+		return nil, fmt.Errorf("error unmarshalling JSON: %v", err)
+	}
+	d.Metric.AddSentDataBytes("central-storage", float64(recBytes))
+	if page.Total <= len(page.Items) {
+		d.loadHistory(idx, page.Items, from, now)
+	}
+	return page, nil
+}
+
+// cachedReadings returns the readings of a station since the given time if the history
+// window covers it and the history of the station is loaded
+func (d *Dashboard) cachedReadings(idx int64, from, now time.Time) (*agapi.Page[dpapi.AirQualityData], bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.model == nil || from.Before(d.historyFrom(now)) {
+		return nil, false
+	}
+	s, ok := d.model.stations[idx]
+	if !ok || !s.loaded {
+		return nil, false
+	}
+	page := &agapi.Page[dpapi.AirQualityData]{Items: make([]dpapi.AirQualityData, 0)}
+	for _, r := range s.history {
+		if !readingTime(r).Before(from) {
+			page.Items = append(page.Items, r)
+		}
+	}
+	page.Total, page.Limit = len(page.Items), len(page.Items)
+	return page, true
+}
+
+// loadHistory keeps the readings of a station requested since from in memory, when
+// they cover the history window
+func (d *Dashboard) loadHistory(idx int64, readings []dpapi.AirQualityData, from, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	historyFrom := d.historyFrom(now)
+	if d.model == nil || from.After(historyFrom) {
+		return
+	}
+	d.model.loadHistory(idx, readings, historyFrom)
+}
+
+// Handler returns the HTTP handler of the web UI and its JSON endpoints
+func (d *Dashboard) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	static, err := fs.Sub(webFS, "web")
+	if err != nil {
+		logging.Fatal("Error loading web assets", "error", err)
+	}
+	mux.Handle("GET /", http.FileServerFS(static))
+
+	mux.HandleFunc("GET /api/stations", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.Stations())
+	})
+	mux.HandleFunc("GET /api/alerts", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.Alerts())
+	})
+	mux.HandleFunc("GET /api/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.Health())
+	})
+	mux.HandleFunc("GET /api/stations/{idx}/readings", func(w http.ResponseWriter, r *http.Request) {
+		idx, err := strconv.ParseInt(r.PathValue("idx"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid station index", http.StatusBadRequest)
+			return
+		}
+		hours := 24
+		if v := r.URL.Query().Get("hours"); v != "" {
+			if hours, err = strconv.Atoi(v); err != nil || hours <= 0 {
+				http.Error(w, "invalid hours", http.StatusBadRequest)
+				return
+			}
+		}
+		page, err := d.Readings(idx, hours)
+		if err != nil {
+			slog.Error("Error requesting readings of station", "station", idx, "error", err)
+			http.Error(w, "error requesting readings", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, page)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
@@ -4,26 +4,24 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
 	loapi "github.com/etesami/air-quality-monitoring/api/local-storage"
 	"google.golang.org/protobuf/proto"
 
+	"github.com/etesami/air-quality-monitoring/pkg/grpcclient"
 	"github.com/etesami/air-quality-monitoring/pkg/metric"
 	pb "github.com/etesami/air-quality-monitoring/pkg/protoc"
 	"github.com/etesami/air-quality-monitoring/pkg/utils"
 )
 
-// requestNewData requests new data from the central storage service
-func requestNewData(client pb.AirQualityMonitoringClient) (string, int, error) {
+// requestNewData requests data from the central storage service
+func requestNewData(client pb.AirQualityMonitoringClient, reqBody loapi.DataRequest) (string, int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	reqBody := loapi.DataRequest{
-		RequestType: loapi.RequestPoints,
-	}
 	reqByte, err := json.Marshal(reqBody)
 	if err != nil {
 		return "", 0, fmt.Errorf("error marshalling JSON: %v", err)
@@ -35,68 +33,116 @@ func requestNewData(client pb.AirQualityMonitoringClient) (string, int, error) {
 		SentTimestamp: fmt.Sprintf("%d", int(sentTimestamp.UnixMilli())),
 	})
 	if err != nil {
-		return "", 0, fmt.Errorf("error requesting data from local storage: %v", err)
+		return "", 0, fmt.Errorf("error requesting data from central storage: %v", err)
 	}
 	if len(res.Payload) == 0 {
-		log.Printf("No data received from local storage.\n")
+		slog.Warn("No data received from central storage")
 		return "", 0, nil
 	}
-	log.Printf("Response from storage recevied, len: [%d]\n", len(res.Payload))
+	slog.Debug("Response from storage received", "bytes", len(res.Payload))
 
 	bytesRec := proto.Size(res)
 	return res.Payload, bytesRec, nil
 }
 
 // processTicker processes the ticker event
-// fetch data from the aggregated storage service in fixed intervals and show some statistics
-func ProcessTicker(client *pb.AirQualityMonitoringClient, serverName string, m *metric.Metric) error {
-	if *client == nil {
-		log.Printf("Client is not ready yet")
+// fetch the changes from the aggregated storage service in fixed intervals and refresh the dashboard
+func ProcessTicker(client *grpcclient.Client, serverName string, m *metric.Metrics, d *Dashboard) error {
+	if !client.Ready() {
+		slog.Warn("Client is not ready yet")
 		return nil
 	}
-	go func(m *metric.Metric) {
+	go func(m *metric.Metrics) {
 		ping := &pb.Data{
 			Payload:       "ping",
 			SentTimestamp: fmt.Sprintf("%d", int(time.Now().UnixMilli())),
 		}
-		pong, err := (*client).CheckConnection(context.Background(), ping)
+		pong, err := client.CheckConnection(context.Background(), ping)
 		if err != nil {
-			log.Printf("Error checking connection: %v", err)
+			slog.Warn("Error checking connection", "service", serverName, "error", err)
 			return
 		}
 		rtt, err := utils.CalculateRtt(ping.SentTimestamp, pong.ReceivedTimestamp, pong.AckSentTimestamp, time.Now())
 		if err != nil {
-			log.Printf("Error calculating RTT: %v", err)
+			slog.Warn("Error calculating RTT", "service", serverName, "error", err)
 			return
 		}
 		m.AddRttTime(serverName, float64(rtt)/1000.0)
-		log.Printf("RTT to [%s] service: [%.2f] ms\n", serverName, float64(rtt)/1000.0)
+		d.setRtt(float64(rtt) / 1000.0)
+		slog.Debug("RTT to service", "service", serverName, "rtt_ms", float64(rtt)/1000.0)
 	}(m)
 
-	recData, recBytes, err := requestNewData(*client)
-	if err != nil {
-		return fmt.Errorf("error requesting new data: %v", err)
-	}
-	if len(recData) == 0 || recBytes == 0 {
-		return fmt.Errorf("no data received from local storage service")
+	if err := syncDashboard(client, m, d); err != nil {
+		d.setError(err)
+		return err
 	}
+	return nil
+}
 
-	sProcssTime := time.Now()
-	dataRes := []agapi.EnhancedResponse{}
-	if err := json.Unmarshal([]byte(recData), &dataRes); err != nil {
-		return fmt.Errorf("error unmarshalling JSON: %v", err)
+// changesLimit is the number of readings and alerts requested at once while syncing
+const changesLimit = 1000
+
+// syncDashboard brings the in-memory model of the dashboard up to date.
+// A new model is seeded from a GeoJSON snapshot of the stations, and from then on only
+// the readings and alerts inserted since the snapshot or the last sync are requested.
+func syncDashboard(client pb.AirQualityMonitoringClient, m *metric.Metrics, d *Dashboard) error {
+	readingsSince, alertsSince, seeded := d.cursors()
+	if !seeded {
+		recData, recBytes, err := requestNewData(client, loapi.DataRequest{RequestType: loapi.RequestGeoJSON})
+		if err != nil {
+			return fmt.Errorf("error requesting stations: %v", err)
+		}
+		snap := &agapi.Snapshot{}
+		if recData != "" {
+			if err := json.Unmarshal([]byte(recData), snap); err != nil {
+				return fmt.Errorf("error unmarshalling JSON: %v", err)
+			}
+		}
+		d.seed(snap)
+		readingsSince, alertsSince = snap.ReadingsCursor, snap.AlertsCursor
+		m.AddSentDataBytes("central-storage", float64(recBytes))
+		slog.Info("Received stations", "stations", len(snap.Stations.Features))
 	}
-	m.AddProcessingTime("processing", time.Since(sProcssTime).Seconds())
-	m.AddSentDataBytes("central-storage", float64(recBytes))
-	log.Printf("Received [%d] items.", len(dataRes))
-	return nil
 
-	// We can also display the data
-	// resBytes, err := json.Marshal(recData)
-	// if err != nil {
-	// 	log.Printf("Error marshalling processed data: %v", err)
-	// }
-	// log.Printf("Processed data: %s\n", string(resBytes))
+	readings, alerts := 0, 0
+	for {
+		recData, recBytes, err := requestNewData(client, loapi.DataRequest{
+			RequestType:   loapi.RequestChanges,
+			ReadingsSince: readingsSince,
+			AlertsSince:   alertsSince,
+			StartTime:     d.historyFrom(time.Now()).Format(time.RFC3339),
+			Limit:         changesLimit,
+		})
+		if err != nil {
+			return fmt.Errorf("error requesting changes: %v", err)
+		}
+		if recData == "" {
+			return fmt.Errorf("no data received from central storage service")
+		}
 
+		sProcssTime := time.Now()
+		changes := &agapi.Changes{}
+		if err := json.Unmarshal([]byte(recData), changes); err != nil {
+			return fmt.Errorf("error unmarshalling JSON: %v", err)
+		}
+		m.AddSentDataBytes("central-storage", float64(recBytes))
+		if changes.Reset {
+			slog.Warn("Central storage is behind the dashboard cursors, starting over")
+			d.reset()
+			return syncDashboard(client, m, d)
+		}
+		d.apply(changes)
+		m.AddReceived(len(changes.Readings))
+		m.AddProcessingTime("sync", time.Since(sProcssTime).Seconds())
+
+		readings += len(changes.Readings)
+		alerts += len(changes.Alerts)
+		readingsSince, alertsSince = changes.ReadingsCursor, changes.AlertsCursor
+		if !changes.More {
+			break
+		}
+	}
+	d.refresh()
+	slog.Info("Received new readings and alerts", "readings", readings, "alerts", alerts)
 	return nil
 }
@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"sort"
+	"time"
+
+	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
+	dpapi "github.com/etesami/air-quality-monitoring/api/data-processing"
+)
+
+// station is the in-memory state of a station: its latest reading,
+// its readings within the history window and its alerts not yet expired
+type station struct {
+	city     dpapi.City
+	latest   *dpapi.AirQualityData
+	latestAt time.Time
+	history  []dpapi.AirQualityData
+	alerts   []dpapi.Alert
+	// loaded is set once the history holds every reading of the history window, the
+	// stations of a snapshot only have their latest reading until their history is loaded
+	loaded bool
+}
+
+// model is the in-memory copy of the central storage the dashboard serves reads from,
+// it is kept up to date by applying the changes since its cursors
+type model struct {
+	stations       map[int64]*station
+	readingsCursor int64
+	alertsCursor   int64
+	// seeded is set once the latest readings of all stations are loaded
+	seeded bool
+}
+
+func newModel() *model {
+	return &model{stations: make(map[int64]*station)}
+}
+
+func (m *model) station(city dpapi.City) *station {
+	s, ok := m.stations[city.Idx]
+	if !ok {
+		// The readings of the stations added after the snapshot all come as changes
+		s = &station{loaded: m.seeded}
+		m.stations[city.Idx] = s
+	}
+	if city.CityName != "" || city.Lat != 0 || city.Lng != 0 {
+		s.city = city
+	}
+	return s
+}
+
+// seed loads the stations along with their latest reading and alert from a GeoJSON snapshot,
+// the cursors move to the ones of the snapshot
+func (m *model) seed(snap *agapi.Snapshot) {
+	m.readingsCursor, m.alertsCursor = snap.ReadingsCursor, snap.AlertsCursor
+	for _, f := range snap.Stations.Features {
+		p := f.Properties
+		city := dpapi.City{Idx: p.Idx, CityName: p.CityName}
+		if len(f.Geometry.Coordinates) == 2 {
+			city.Lng, city.Lat = f.Geometry.Coordinates[0], f.Geometry.Coordinates[1]
+		}
+		s := m.station(city)
+		if p.Timestamp != "" {
+			s.setLatest(dpapi.AirQualityData{
+				Timestamp:   p.Timestamp,
+				Aqi:         valueOrZero(p.Aqi),
+				DewPoint:    valueOrZero(p.DewPoint),
+				Humidity:    valueOrZero(p.Humidity),
+				Pressure:    valueOrZero(p.Pressure),
+				Temperature: valueOrZero(p.Temperature),
+				WindSpeed:   valueOrZero(p.WindSpeed),
+				WindGust:    valueOrZero(p.WindGust),
+				PM25:        valueOrZero(p.PM25),
+				PM10:        valueOrZero(p.PM10),
+				Units:       p.Units,
+			})
+		}
+		if p.Alert != nil {
+			s.addAlert(*p.Alert)
+		}
+	}
+	m.seeded = true
+}
+
+// apply merges the changes into the model and moves its cursors,
+// readings taken before the given time are not kept in the history
+func (m *model) apply(changes *agapi.Changes, historyFrom time.Time) {
+	for _, city := range changes.Stations {
+		m.station(city)
+	}
+	for _, r := range changes.Readings {
+		s := m.station(dpapi.City{Idx: r.Idx})
+		s.setLatest(r.AirQualityData)
+		if t, err := time.Parse(time.RFC3339, r.Timestamp); err == nil && !t.Before(historyFrom) {
+			s.addReading(r.AirQualityData, t)
+		}
+	}
+	for _, a := range changes.Alerts {
+		m.station(dpapi.City{Idx: a.Idx}).addAlert(a.Alert)
+	}
+	m.readingsCursor = changes.ReadingsCursor
+	m.alertsCursor = changes.AlertsCursor
+}
+
+// loadHistory adds the readings of a station requested from the central storage to
+// its history, which then holds every reading of the window starting at historyFrom
+func (m *model) loadHistory(idx int64, readings []dpapi.AirQualityData, historyFrom time.Time) {
+	s, ok := m.stations[idx]
+	if !ok {
+		return
+	}
+	for _, r := range readings {
+		if t, err := time.Parse(time.RFC3339, r.Timestamp); err == nil && !t.Before(historyFrom) {
+			s.addReading(r, t)
+		}
+	}
+	s.loaded = true
+}
+
+// prune drops the readings older than the history window and the expired alerts
+func (m *model) prune(historyFrom, now time.Time) {
+	for _, s := range m.stations {
+		i := sort.Search(len(s.history), func(i int) bool {
+			return !readingTime(s.history[i]).Before(historyFrom)
+		})
+		s.history = s.history[i:]
+
+		alerts := s.alerts[:0]
+		for _, a := range s.alerts {
+			if t, err := time.Parse(time.RFC3339, a.AlertExpires); err == nil && t.After(now) {
+				alerts = append(alerts, a)
+			}
+		}
+		s.alerts = alerts
+	}
+}
+
+// view materializes the stations with their latest reading and latest alert
+func (m *model) view() *agapi.FeatureCollection {
+	fc := &agapi.FeatureCollection{Type: "FeatureCollection", Features: make([]agapi.Feature, 0, len(m.stations))}
+	for idx, s := range m.stations {
+		p := agapi.StationProperties{Idx: idx, CityName: s.city.CityName}
+		if s.latest != nil {
+			r := *s.latest
+			p.Timestamp = r.Timestamp
+			p.Aqi = &r.Aqi
+			p.DewPoint = reported(r, "dewPoint", &r.DewPoint)
+			p.Humidity = reported(r, "humidity", &r.Humidity)
+			p.Pressure = reported(r, "pressure", &r.Pressure)
+			p.Temperature = reported(r, "temperature", &r.Temperature)
+			p.WindSpeed = reported(r, "windSpeed", &r.WindSpeed)
+			p.WindGust = reported(r, "windGust", &r.WindGust)
+			p.PM25 = reported(r, "pm25", &r.PM25)
+			p.PM10 = reported(r, "pm10", &r.PM10)
+			p.Units = r.Units
+		}
+		if len(s.alerts) > 0 {
+			a := s.alerts[0]
+			p.Alert = &a
+		}
+		fc.Features = append(fc.Features, agapi.Feature{
+			Type:       "Feature",
+			Geometry:   agapi.Geometry{Type: "Point", Coordinates: []float64{s.city.Lng, s.city.Lat}},
+			Properties: p,
+		})
+	}
+	sort.Slice(fc.Features, func(i, j int) bool {
+		return fc.Features[i].Properties.Idx < fc.Features[j].Properties.Idx
+	})
+	return fc
+}
+
+// reported returns v when the reading holds the measurement name, nil otherwise
+func reported(r dpapi.AirQualityData, name string, v *float64) *float64 {
+	if !r.Reported(name) {
+		return nil
+	}
+	return v
+}
+
+func (s *station) setLatest(r dpapi.AirQualityData) {
+	t, err := time.Parse(time.RFC3339, r.Timestamp)
+	if err != nil || (s.latest != nil && !t.After(s.latestAt)) {
+		return
+	}
+	s.latest = &r
+	s.latestAt = t
+}
+
+// addReading inserts the reading keeping the history ordered by time
+func (s *station) addReading(r dpapi.AirQualityData, t time.Time) {
+	i := sort.Search(len(s.history), func(i int) bool {
+		return readingTime(s.history[i]).After(t)
+	})
+	if i > 0 && readingTime(s.history[i-1]).Equal(t) {
+		s.history[i-1] = r
+		return
+	}
+	s.history = append(s.history, dpapi.AirQualityData{})
+	copy(s.history[i+1:], s.history[i:])
+	s.history[i] = r
+}
+
+// addAlert inserts the alert keeping the alerts ordered by effective time, newest first
+func (s *station) addAlert(a dpapi.Alert) {
+	for _, existing := range s.alerts {
+		if existing == a {
+			return
+		}
+	}
+	s.alerts = append(s.alerts, a)
+	sort.SliceStable(s.alerts, func(i, j int) bool {
+		ti, _ := time.Parse(time.RFC3339, s.alerts[i].AlertEffective)
+		tj, _ := time.Parse(time.RFC3339, s.alerts[j].AlertEffective)
+		return ti.After(tj)
+	})
+}
+
+func readingTime(r dpapi.AirQualityData) time.Time {
+	t, _ := time.Parse(time.RFC3339, r.Timestamp)
+	return t
+}
+
+func valueOrZero[T int64 | float64](v *T) T {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
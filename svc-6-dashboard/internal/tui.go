@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	agapi "github.com/etesami/air-quality-monitoring/api/aggregated-storage"
+	units "github.com/etesami/air-quality-monitoring/pkg/units"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	ansiReset      = "\033[0m"
+	ansiBold       = "\033[1m"
+	ansiDim        = "\033[2m"
+	ansiClear      = "\033[H\033[2J"
+	ansiHideCursor = "\033[?25l"
+	ansiShowCursor = "\033[?25h"
+)
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// TUI renders the dashboard in a terminal using ANSI escape sequences
+type TUI struct {
+	Dashboard *Dashboard
+	Out       io.Writer
+	// Hours is the history window shown by the PM2.5 sparklines
+	Hours int
+	// Width is the number of points of each sparkline
+	Width int
+
+	history   map[int64][]float64
+	historyAt time.Time
+}
+
+// Run redraws the screen in the given interval until the context is cancelled
+func (t *TUI) Run(ctx context.Context, interval time.Duration) error {
+	if t.Hours <= 0 {
+		t.Hours = 24
+	}
+	if t.Width <= 0 {
+		t.Width = 24
+	}
+	fmt.Fprint(t.Out, ansiHideCursor)
+	defer fmt.Fprint(t.Out, ansiShowCursor)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := t.draw(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshHistory reads the readings of every station again once the dashboard is refreshed,
+// from the model of the dashboard, the central storage is only asked for the history of
+// the stations the model has not loaded yet
+func (t *TUI) refreshHistory() {
+	t.Dashboard.mu.RLock()
+	updated := t.Dashboard.updated
+	t.Dashboard.mu.RUnlock()
+	if updated.IsZero() || !updated.After(t.historyAt) {
+		return
+	}
+
+	history := make(map[int64][]float64)
+	for _, f := range t.Dashboard.Stations().Features {
+		page, err := t.Dashboard.Readings(f.Properties.Idx, t.Hours)
+		if err != nil {
+			slog.Error("Error requesting readings of station", "station", f.Properties.Idx, "error", err)
+			continue
+		}
+		// Sub-indices and concentrations are not drawn on the same line
+		values := make([]float64, 0, len(page.Items))
+		for _, r := range page.Items {
+			if r.Units["pm25"] == f.Properties.Units["pm25"] {
+				values = append(values, r.PM25)
+			}
+		}
+		history[f.Properties.Idx] = values
+	}
+	t.history = history
+	t.historyAt = updated
+}
+
+func (t *TUI) draw() error {
+	t.refreshHistory()
+
+	h := t.Dashboard.Health()
+	w := bufio.NewWriter(t.Out)
+	fmt.Fprint(w, ansiClear)
+	fmt.Fprintf(w, "%sAir Quality Dashboard%s  %s\n\n", ansiBold, ansiReset, time.Now().Format(time.DateTime))
+
+	status := colorize("connected", 28)
+	if !h.Connected {
+		status = colorize("unreachable", 160)
+	} else if h.LastError != "" {
+		status = colorize("error: "+h.LastError, 160)
+	}
+	fresh := "-"
+	if h.LatestReading != "" {
+		fresh = formatAge(time.Duration(h.FreshnessSec) * time.Second)
+	}
+	fmt.Fprintf(w, "central storage: %s  stations: %d  alerts: %d  latest reading: %s\n",
+		status, h.Stations, h.ActiveAlerts, fresh)
+	fmt.Fprintf(w, "%s\n\n", formatMetrics(t.Dashboard.Metric.Gatherer()))
+
+	features := append([]agapi.Feature(nil), t.Dashboard.Stations().Features...)
+	sort.SliceStable(features, func(i, j int) bool {
+		return valueOf(features[i].Properties.Aqi) > valueOf(features[j].Properties.Aqi)
+	})
+	fmt.Fprintf(w, "%s%-24s %5s %12s %8s %6s %-*s %s%s\n", ansiBold,
+		"STATION", "AQI", "PM2.5", "TEMP", "HUM", t.Width, fmt.Sprintf("PM2.5 (%dh)", t.Hours), "UPDATED", ansiReset)
+	for _, f := range features {
+		p := f.Properties
+		name := p.CityName
+		if name == "" {
+			name = fmt.Sprintf("%d", p.Idx)
+		}
+		updated := "-"
+		if ts, err := time.Parse(time.RFC3339, p.Timestamp); err == nil {
+			updated = formatAge(time.Since(ts))
+		}
+		aqi := fmt.Sprintf("%5s", formatInt(p.Aqi))
+		if p.Aqi != nil {
+			aqi = colorize(aqi, aqiColor(*p.Aqi))
+		}
+		fmt.Fprintf(w, "%-24s %s %12s %8s %6s %-*s %s\n",
+			truncate(name, 24), aqi, formatMeasurement(p.PM25, p.Units["pm25"]),
+			formatMeasurement(p.Temperature, p.Units["temperature"]), formatMeasurement(p.Humidity, p.Units["humidity"]),
+			t.Width, sparkline(t.history[p.Idx], t.Width), updated)
+	}
+
+	alerts := t.Dashboard.Alerts()
+	fmt.Fprintf(w, "\n%sActive alerts (%d)%s\n", ansiBold, len(alerts), ansiReset)
+	for _, a := range alerts {
+		headline := a.AlertHeadline
+		if headline == "" {
+			headline = a.AlertEvent
+		}
+		fmt.Fprintf(w, "  [%d] %s%s%s %s %s(expires %s)%s\n",
+			a.Idx, ansiBold, a.AlertSeverity, ansiReset, headline, ansiDim, a.AlertExpires, ansiReset)
+	}
+	fmt.Fprintf(w, "\n%sPress Ctrl-C to exit%s\n", ansiDim, ansiReset)
+	return w.Flush()
+}
+
+// formatMetrics summarizes the RTT and processing times recorded by metric.Metrics
+func formatMetrics(g prometheus.Gatherer) string {
+	families, err := g.Gather()
+	if err != nil {
+		return fmt.Sprintf("metrics unavailable: %v", err)
+	}
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+
+	parts := make([]string, 0)
+	if mf, ok := byName["rtt_times_ms"]; ok {
+		for _, m := range mf.GetMetric() {
+			parts = append(parts, fmt.Sprintf("rtt[%s]: %.2f ms", labelValue(m, "service"), m.GetGauge().GetValue()))
+		}
+	}
+	if mf, ok := byName["rtt_times_ms_histogram"]; ok {
+		for _, m := range mf.GetMetric() {
+			if hist := m.GetHistogram(); hist.GetSampleCount() > 0 {
+				parts = append(parts, fmt.Sprintf("avg rtt[%s]: %.2f ms",
+					labelValue(m, "service"), hist.GetSampleSum()/float64(hist.GetSampleCount())))
+			}
+		}
+	}
+	// processing times are recorded in seconds
+	if mf, ok := byName["processing_time_seconds"]; ok {
+		for _, m := range mf.GetMetric() {
+			if hist := m.GetHistogram(); hist.GetSampleCount() > 0 {
+				parts = append(parts, fmt.Sprintf("avg %s: %.2f ms (%d samples)", labelValue(m, "stage"),
+					hist.GetSampleSum()/float64(hist.GetSampleCount())*1000, hist.GetSampleCount()))
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return "no metrics recorded yet"
+	}
+	return strings.Join(parts, "  ")
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// sparkline renders the last width values scaled between their minimum and maximum
+func sparkline(values []float64, width int) string {
+	if len(values) == 0 {
+		return strings.Repeat(" ", width)
+	}
+	if len(values) > width {
+		values = values[len(values)-width:]
+	}
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		lo, hi = min(lo, v), max(hi, v)
+	}
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if hi > lo {
+			i = int((v - lo) * float64(len(sparkBlocks)-1) / (hi - lo))
+		}
+		b.WriteRune(sparkBlocks[i])
+	}
+	b.WriteString(strings.Repeat(" ", width-len(values)))
+	return b.String()
+}
+
+// aqiColor returns the 256-color code of the US EPA category of the given AQI
+func aqiColor(aqi int64) int {
+	switch {
+	case aqi <= 50:
+		return 40
+	case aqi <= 100:
+		return 220
+	case aqi <= 150:
+		return 208
+	case aqi <= 200:
+		return 196
+	case aqi <= 300:
+		return 92
+	default:
+		return 88
+	}
+}
+
+// colorize paints the background of s, using black text on the light colors
+func colorize(s string, color int) string {
+	fg := 15
+	switch color {
+	case 40, 208, 220:
+		fg = 16
+	}
+	return fmt.Sprintf("\033[1;38;5;%d;48;5;%dm%s%s", fg, color, s, ansiReset)
+}
+
+func formatInt(v *int64) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d", *v)
+}
+
+// formatMeasurement formats a value with its unit, sub-indices are shown without one
+func formatMeasurement(v *float64, u units.Unit) string {
+	if v == nil {
+		return "-"
+	}
+	if u == "" || u == units.Index {
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%.1f %s", *v, u)
+}
+
+func valueOf(v *int64) int64 {
+	if v == nil {
+		return -1
+	}
+	return *v
+}
+
+func formatAge(d time.Duration) string {
+	switch {
+	case d < 2*time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < 2*time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
@@ -0,0 +1,248 @@
+"use strict";
+
+// US EPA AQI categories
+const CATEGORIES = [
+  { max: 50, name: "Good", color: "#00e400" },
+  { max: 100, name: "Moderate", color: "#ffff00" },
+  { max: 150, name: "Unhealthy for sensitive groups", color: "#ff7e00" },
+  { max: 200, name: "Unhealthy", color: "#ff0000" },
+  { max: 300, name: "Very unhealthy", color: "#8f3f97" },
+  { max: Infinity, name: "Hazardous", color: "#7e0023" },
+];
+
+const REFRESH_MS = 30000;
+const SVG_NS = "http://www.w3.org/2000/svg";
+
+let stations = [];
+let selected = null;
+
+function category(aqi) {
+  if (aqi === undefined || aqi === null) {
+    return { name: "No data", color: "#d1d5db" };
+  }
+  return CATEGORIES.find((c) => aqi <= c.max);
+}
+
+function svgEl(name, attrs) {
+  const el = document.createElementNS(SVG_NS, name);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    el.setAttribute(k, v);
+  }
+  return el;
+}
+
+function fmt(v, unit) {
+  return v === undefined || v === null ? "-" : `${Math.round(v * 10) / 10}${unit || ""}`;
+}
+
+// unit returns the suffix of a measurement of p, sub-indices have none
+function unit(p, key) {
+  const u = (p.units || {})[key];
+  if (!u || u === "index") {
+    return "";
+  }
+  return u === "%" || u.startsWith("°") ? u : ` ${u}`;
+}
+
+function ago(ts) {
+  if (!ts) {
+    return "-";
+  }
+  const s = Math.round((Date.now() - new Date(ts).getTime()) / 1000);
+  if (s < 120) return `${s}s ago`;
+  if (s < 7200) return `${Math.round(s / 60)}m ago`;
+  if (s < 172800) return `${Math.round(s / 3600)}h ago`;
+  return `${Math.round(s / 86400)}d ago`;
+}
+
+async function getJSON(url) {
+  const res = await fetch(url);
+  if (!res.ok) {
+    throw new Error(`${url}: ${res.status}`);
+  }
+  return res.json();
+}
+
+function renderLegend() {
+  const legend = document.getElementById("legend");
+  legend.innerHTML = "";
+  for (const c of CATEGORIES) {
+    const span = document.createElement("span");
+    span.innerHTML = `<i style="background:${c.color}"></i>${c.name}`;
+    legend.appendChild(span);
+  }
+}
+
+function renderMap() {
+  const map = document.getElementById("map");
+  map.innerHTML = "";
+  if (stations.length === 0) {
+    return;
+  }
+  const W = 800, H = 450, PAD = 30;
+  const lngs = stations.map((f) => f.geometry.coordinates[0]);
+  const lats = stations.map((f) => f.geometry.coordinates[1]);
+  let minLng = Math.min(...lngs), maxLng = Math.max(...lngs);
+  let minLat = Math.min(...lats), maxLat = Math.max(...lats);
+  // Keep a minimal extent so a single station is centered
+  if (maxLng - minLng < 0.1) { minLng -= 0.05; maxLng += 0.05; }
+  if (maxLat - minLat < 0.1) { minLat -= 0.05; maxLat += 0.05; }
+  const scale = Math.min((W - 2 * PAD) / (maxLng - minLng), (H - 2 * PAD) / (maxLat - minLat));
+  const offX = (W - scale * (maxLng - minLng)) / 2;
+  const offY = (H - scale * (maxLat - minLat)) / 2;
+
+  for (const f of stations) {
+    const p = f.properties;
+    const x = offX + (f.geometry.coordinates[0] - minLng) * scale;
+    const y = H - (offY + (f.geometry.coordinates[1] - minLat) * scale);
+    const c = svgEl("circle", {
+      cx: x, cy: y, r: p.alert ? 9 : 7,
+      fill: category(p.aqi).color,
+      class: selected === p.idx ? "selected" : "",
+    });
+    const title = svgEl("title");
+    title.textContent = `${p.cityName || p.idx}\nAQI ${fmt(p.aqi)}${p.alert ? "\n" + p.alert.alertEvent : ""}`;
+    c.appendChild(title);
+    c.addEventListener("click", () => selectStation(p.idx));
+    map.appendChild(c);
+  }
+}
+
+function renderTable() {
+  const body = document.getElementById("stations");
+  body.innerHTML = "";
+  const sorted = [...stations].sort((a, b) => (b.properties.aqi || 0) - (a.properties.aqi || 0));
+  for (const f of sorted) {
+    const p = f.properties;
+    const tr = document.createElement("tr");
+    tr.innerHTML = `<td>${p.cityName || p.idx}</td>` +
+      `<td class="aqi" style="background:${category(p.aqi).color}">${fmt(p.aqi)}</td>` +
+      `<td>${fmt(p.pm25, unit(p, "pm25"))}</td><td>${fmt(p.temperature, unit(p, "temperature"))}</td>` +
+      `<td>${fmt(p.humidity, unit(p, "humidity"))}</td><td>${fmt(p.windSpeed, unit(p, "windSpeed"))}</td>` +
+      `<td>${ago(p.timestamp)}</td>`;
+    tr.addEventListener("click", () => selectStation(p.idx));
+    body.appendChild(tr);
+  }
+}
+
+function renderAlerts(alerts) {
+  const list = document.getElementById("alerts");
+  list.innerHTML = "";
+  if (alerts.length === 0) {
+    list.innerHTML = "<li>No active alerts</li>";
+    return;
+  }
+  const names = Object.fromEntries(stations.map((f) => [f.properties.idx, f.properties.cityName]));
+  for (const a of alerts) {
+    const li = document.createElement("li");
+    li.innerHTML = `<span class="severity"></span><span class="headline"></span>` +
+      `<span class="meta"></span>`;
+    li.querySelector(".severity").textContent = a.alertSeverity || "";
+    li.querySelector(".headline").textContent = a.alertHeadline || a.alertEvent || "";
+    li.querySelector(".meta").textContent =
+      `${names[a.idx] || a.idx} · expires ${new Date(a.alertExpires).toLocaleString()}`;
+    li.addEventListener("click", () => selectStation(a.idx));
+    list.appendChild(li);
+  }
+}
+
+function renderHealth(h) {
+  const el = document.getElementById("health");
+  const fresh = h.freshnessSec !== undefined ? ago(h.latestReading) : "-";
+  el.innerHTML = "";
+  const items = [
+    [h.connected && !h.lastError ? "ok" : "bad", h.connected ? "central storage connected" : "central storage unreachable"],
+    ["", `RTT ${h.rttMs.toFixed(1)} ms`],
+    ["", `${h.stations} stations`],
+    [h.activeAlerts > 0 ? "bad" : "", `${h.activeAlerts} alerts`],
+    ["", `latest reading ${fresh}`],
+  ];
+  for (const [cls, text] of items) {
+    const span = document.createElement("span");
+    span.className = cls;
+    span.textContent = text;
+    if (cls === "bad" && h.lastError) {
+      span.title = h.lastError;
+    }
+    el.appendChild(span);
+  }
+}
+
+function renderChart(readings) {
+  const chart = document.getElementById("chart");
+  chart.innerHTML = "";
+  const W = 800, H = 300, L = 40, R = 10, T = 10, B = 30;
+  if (readings.length === 0) {
+    const t = svgEl("text", { x: W / 2, y: H / 2, "text-anchor": "middle" });
+    t.textContent = "No readings in the last 24 hours";
+    chart.appendChild(t);
+    return;
+  }
+  const times = readings.map((r) => new Date(r.timestamp).getTime());
+  const minT = Math.min(...times), maxT = Math.max(...times, minT + 1);
+  // PM2.5 shares the axis of the AQI only when it is a sub-index
+  const plotted = (r, key) => r[key] !== undefined && (key !== "pm25" || (r.units || {}).pm25 === "index");
+  const maxV = Math.max(50, ...readings.map((r) => Math.max(r.aqi || 0, plotted(r, "pm25") ? r.pm25 : 0)));
+  const x = (t) => L + ((t - minT) / (maxT - minT)) * (W - L - R);
+  const y = (v) => H - B - (v / maxV) * (H - T - B);
+
+  for (let i = 0; i <= 4; i++) {
+    const v = (maxV / 4) * i;
+    chart.appendChild(svgEl("line", { x1: L, x2: W - R, y1: y(v), y2: y(v), class: "grid" }));
+    const label = svgEl("text", { x: L - 6, y: y(v) + 4, "text-anchor": "end" });
+    label.textContent = Math.round(v);
+    chart.appendChild(label);
+  }
+  chart.appendChild(svgEl("line", { x1: L, x2: W - R, y1: H - B, y2: H - B, class: "axis" }));
+  for (const t of [minT, (minT + maxT) / 2, maxT]) {
+    const label = svgEl("text", { x: x(t), y: H - 10, "text-anchor": "middle" });
+    label.textContent = new Date(t).toLocaleTimeString([], { hour: "2-digit", minute: "2-digit" });
+    chart.appendChild(label);
+  }
+
+  for (const key of ["aqi", "pm25"]) {
+    const points = readings
+      .filter((r) => plotted(r, key))
+      .map((r) => `${x(new Date(r.timestamp).getTime())},${y(r[key])}`);
+    chart.appendChild(svgEl("polyline", { points: points.join(" "), class: key }));
+  }
+}
+
+async function selectStation(idx) {
+  selected = idx;
+  renderMap();
+  const station = stations.find((f) => f.properties.idx === idx);
+  document.getElementById("chart-title").textContent =
+    `${station ? station.properties.cityName || idx : idx} · last 24 hours`;
+  try {
+    const page = await getJSON(`api/stations/${idx}/readings?hours=24`);
+    renderChart(page.items || []);
+  } catch (e) {
+    console.error(e);
+    renderChart([]);
+  }
+}
+
+async function refresh() {
+  try {
+    const [fc, alerts, health] = await Promise.all([
+      getJSON("api/stations"),
+      getJSON("api/alerts"),
+      getJSON("api/health"),
+    ]);
+    stations = fc.features || [];
+    renderMap();
+    renderTable();
+    renderAlerts(alerts);
+    renderHealth(health);
+    if (selected === null && stations.length > 0) {
+      selectStation(stations[0].properties.idx);
+    }
+  } catch (e) {
+    console.error(e);
+  }
+}
+
+renderLegend();
+refresh();
+setInterval(refresh, REFRESH_MS);
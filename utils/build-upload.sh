@@ -42,7 +42,7 @@ build_service() {
 
   cd $PARENT_DIR/../$sPath
   go mod tidy
-  docker build -t $sName:$v .
+  docker build -t $sName:$v -f Dockerfile ..
 }
 
 build_all() {
@@ -52,27 +52,27 @@ build_all() {
 
   cd $PARENT_DIR/../svc-1-data-collector
   go mod tidy
-  docker build -t svc-collector:$v .
+  docker build -t svc-collector:$v -f Dockerfile ..
 
   cd $PARENT_DIR/../svc-2-data-ingestor
   go mod tidy
-  docker build -t svc-ingestor:$v .
+  docker build -t svc-ingestor:$v -f Dockerfile ..
 
   cd $PARENT_DIR/../svc-3-local-storage
   go mod tidy
-  docker build -t svc-local-storage:$v .
+  docker build -t svc-local-storage:$v -f Dockerfile ..
 
   cd $PARENT_DIR/../svc-4-data-processor
   go mod tidy
-  docker build -t svc-processor:$v .
+  docker build -t svc-processor:$v -f Dockerfile ..
 
   cd $PARENT_DIR/../svc-5-central-storage
   go mod tidy
-  docker build -t svc-central-storage:$v .
+  docker build -t svc-central-storage:$v -f Dockerfile ..
 
   cd $PARENT_DIR/../svc-6-dashboard
   go mod tidy
-  docker build -t svc-dashboard:$v .
+  docker build -t svc-dashboard:$v -f Dockerfile ..
 }
 
 upload_all(){